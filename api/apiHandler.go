@@ -41,14 +41,36 @@ func (a *APIHandler) postHandler(c *gin.Context) {
 		a.ApiService.ChangePass(c)
 	case "save":
 		a.ApiService.Save(c, loginUser)
+	case "clientsBulk":
+		a.ApiService.BulkClients(c, loginUser)
+	case "acme":
+		a.ApiService.SaveAcme(c, loginUser)
+	case "tlsRotation":
+		a.ApiService.SaveTlsRotation(c, loginUser)
+	case "ca":
+		a.ApiService.SaveCa(c, loginUser)
+	case "revertChange":
+		a.ApiService.RevertChange(c, loginUser)
+	case "restoreSnapshot":
+		a.ApiService.RestoreSnapshot(c, loginUser)
 	case "restartApp":
 		a.ApiService.RestartApp(c)
 	case "restartSb":
 		a.ApiService.RestartSb(c)
+	case "backupNow":
+		a.ApiService.BackupNow(c)
+	case "restoreBackup":
+		a.ApiService.RestoreBackup(c)
+	case "testNotify":
+		a.ApiService.TestNotify(c)
+	case "updateRuleSets":
+		a.ApiService.UpdateRuleSets(c)
 	case "linkConvert":
 		a.ApiService.LinkConvert(c)
 	case "importdb":
 		a.ApiService.ImportDb(c)
+	case "import":
+		a.ApiService.ImportConfig(c, loginUser)
 	case "addToken":
 		a.ApiService.AddToken(c)
 		a.apiv2.ReloadTokens()
@@ -68,7 +90,7 @@ func (a *APIHandler) getHandler(c *gin.Context) {
 		a.ApiService.Logout(c)
 	case "load":
 		a.ApiService.LoadData(c)
-	case "inbounds", "outbounds", "endpoints", "tls", "clients", "config":
+	case "inbounds", "outbounds", "endpoints", "rules", "rulesets", "dnsservers", "dnsrules", "tls", "tlsRotations", "acme", "ca", "clients", "plans", "config":
 		err := a.ApiService.LoadPartialData(c, []string{action})
 		if err != nil {
 			jsonMsg(c, action, err)
@@ -88,10 +110,24 @@ func (a *APIHandler) getHandler(c *gin.Context) {
 		a.ApiService.GetLogs(c)
 	case "changes":
 		a.ApiService.CheckChanges(c)
+	case "changeDiff":
+		a.ApiService.GetChangeDiff(c)
+	case "snapshots":
+		a.ApiService.GetSnapshots(c)
+	case "backups":
+		a.ApiService.GetBackups(c)
+	case "certs":
+		a.ApiService.GetCerts(c)
+	case "dnsLookup":
+		a.ApiService.DnsLookup(c)
 	case "keypairs":
 		a.ApiService.GetKeypairs(c)
+	case "fingerprints":
+		a.ApiService.GetFingerprints(c)
 	case "getdb":
 		a.ApiService.GetDb(c)
+	case "export":
+		a.ApiService.ExportConfig(c)
 	case "tokens":
 		a.ApiService.GetTokens(c)
 	default:
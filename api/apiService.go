@@ -2,6 +2,7 @@ package api
 
 import (
 	"encoding/json"
+	"io"
 	"s-ui/database"
 	"s-ui/logger"
 	"s-ui/service"
@@ -22,9 +23,18 @@ type ApiService struct {
 	service.InboundService
 	service.OutboundService
 	service.EndpointService
+	service.RouteRuleService
+	service.RuleSetService
+	service.DnsService
+	service.PlanService
 	service.PanelService
 	service.StatsService
 	service.ServerService
+	service.BackupService
+	service.NotifyService
+	service.AcmeService
+	service.CertService
+	service.CaService
 }
 
 func (a *ApiService) LoadData(c *gin.Context) {
@@ -81,6 +91,26 @@ func (a *ApiService) getData(c *gin.Context) (interface{}, error) {
 		if err != nil {
 			return "", err
 		}
+		rules, err := a.RouteRuleService.GetAll()
+		if err != nil {
+			return "", err
+		}
+		ruleSets, err := a.RuleSetService.GetAll()
+		if err != nil {
+			return "", err
+		}
+		dnsServers, err := a.DnsService.GetAllServers()
+		if err != nil {
+			return "", err
+		}
+		dnsRules, err := a.DnsService.GetAllRules()
+		if err != nil {
+			return "", err
+		}
+		plans, err := a.PlanService.GetAll()
+		if err != nil {
+			return "", err
+		}
 		subURI, err := a.SettingService.GetFinalSubURI(strings.Split(c.Request.Host, ":")[0])
 		if err != nil {
 			return "", err
@@ -91,6 +121,11 @@ func (a *ApiService) getData(c *gin.Context) (interface{}, error) {
 		data["inbounds"] = inbounds
 		data["outbounds"] = outbounds
 		data["endpoints"] = endpoints
+		data["rules"] = rules
+		data["rulesets"] = ruleSets
+		data["dnsservers"] = dnsServers
+		data["dnsrules"] = dnsRules
+		data["plans"] = plans
 		data["subURI"] = subURI
 		data["onlines"] = onlines
 	} else {
@@ -124,13 +159,74 @@ func (a *ApiService) LoadPartialData(c *gin.Context, objs []string) error {
 				return err
 			}
 			data[obj] = endpoints
+		case "rules":
+			rules, err := a.RouteRuleService.GetAll()
+			if err != nil {
+				return err
+			}
+			data[obj] = rules
+		case "rulesets":
+			ruleSets, err := a.RuleSetService.GetAll()
+			if err != nil {
+				return err
+			}
+			data[obj] = ruleSets
+		case "dnsservers":
+			dnsServers, err := a.DnsService.GetAllServers()
+			if err != nil {
+				return err
+			}
+			data[obj] = dnsServers
+		case "dnsrules":
+			dnsRules, err := a.DnsService.GetAllRules()
+			if err != nil {
+				return err
+			}
+			data[obj] = dnsRules
+		case "plans":
+			plans, err := a.PlanService.GetAll()
+			if err != nil {
+				return err
+			}
+			data[obj] = plans
 		case "tls":
 			tlsConfigs, err := a.TlsService.GetAll()
 			if err != nil {
 				return err
 			}
 			data[obj] = tlsConfigs
+		case "tlsRotations":
+			rotations, err := a.ConfigService.GetTlsRotations()
+			if err != nil {
+				return err
+			}
+			data[obj] = rotations
+		case "acme":
+			certs, err := a.AcmeService.GetAll()
+			if err != nil {
+				return err
+			}
+			data[obj] = certs
+		case "ca":
+			certs, err := a.CaService.GetAll()
+			if err != nil {
+				return err
+			}
+			data[obj] = certs
 		case "clients":
+			query, err := clientQuery(c)
+			if err != nil {
+				return err
+			}
+			if query != nil {
+				page, err := a.ClientService.GetPage(query)
+				if err != nil {
+					return err
+				}
+				data[obj] = page.Clients
+				data["clientsTotal"] = page.Total
+				continue
+			}
 			clients, err := a.ClientService.Get(id)
 			if err != nil {
 				return err
@@ -151,10 +247,66 @@ func (a *ApiService) LoadPartialData(c *gin.Context, objs []string) error {
 		}
 	}
 
+	// Warnings of a save are sent with its data
+	if warnings, ok := c.Get("warnings"); ok {
+		data["warnings"] = warnings
+	}
+
 	jsonObj(c, data, nil)
 	return nil
 }
 
+// clientQuery reads paging, sorting and filters of clients from the url.
+// Without any of them, all clients are loaded.
+func clientQuery(c *gin.Context) (*service.ClientQuery, error) {
+	keys := []string{"page", "size", "search", "sort", "order", "group", "enable", "expired", "overQuota", "online", "inbound"}
+	found := false
+	for _, key := range keys {
+		if c.Query(key) != "" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	var err error
+	query := &service.ClientQuery{
+		Sort: c.Query("sort"),
+		Desc: c.Query("order") == "desc",
+	}
+	query.Group = c.Query("group")
+	query.Search = c.Query("search")
+	query.Expired = c.Query("expired") == "true"
+	query.OverQuota = c.Query("overQuota") == "true"
+	query.Online = c.Query("online") == "true"
+	if enable := c.Query("enable"); enable != "" {
+		value := enable == "true"
+		query.Enable = &value
+	}
+	if page := c.Query("page"); page != "" {
+		query.Page, err = strconv.Atoi(page)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if size := c.Query("size"); size != "" {
+		query.Size, err = strconv.Atoi(size)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if inbound := c.Query("inbound"); inbound != "" {
+		var id uint64
+		id, err = strconv.ParseUint(inbound, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		query.Inbound = uint(id)
+	}
+	return query, nil
+}
+
 func (a *ApiService) GetUsers(c *gin.Context) {
 	users, err := a.UserService.GetUsers()
 	if err != nil {
@@ -222,6 +374,75 @@ func (a *ApiService) CheckChanges(c *gin.Context) {
 	jsonObj(c, changes, nil)
 }
 
+func (a *ApiService) GetChangeDiff(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "", err)
+		return
+	}
+	diff, err := a.ConfigService.GetChangeDiff(id)
+	jsonObj(c, diff, err)
+}
+
+func (a *ApiService) GetSnapshots(c *gin.Context) {
+	snapshots, err := a.ConfigService.GetSnapshots()
+	jsonObj(c, snapshots, err)
+}
+
+func (a *ApiService) RestoreSnapshot(c *gin.Context, loginUser string) {
+	id, err := strconv.ParseUint(c.Request.FormValue("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "restoreSnapshot", err)
+		return
+	}
+	err = a.ConfigService.RestoreSnapshot(uint(id), loginUser, "restored by user")
+	if err != nil {
+		jsonMsg(c, "restoreSnapshot", err)
+		return
+	}
+	err = a.ConfigService.RestartCore()
+	jsonMsg(c, "restoreSnapshot", err)
+}
+
+func (a *ApiService) GetBackups(c *gin.Context) {
+	backups, err := a.BackupService.ListBackups()
+	jsonObj(c, backups, err)
+}
+
+func (a *ApiService) GetCerts(c *gin.Context) {
+	certs, err := a.CertService.GetInventory()
+	jsonObj(c, certs, err)
+}
+
+func (a *ApiService) BackupNow(c *gin.Context) {
+	name, err := a.BackupService.Backup()
+	jsonObj(c, name, err)
+}
+
+func (a *ApiService) TestNotify(c *gin.Context) {
+	err := a.NotifyService.TestChannels()
+	jsonMsg(c, "testNotify", err)
+}
+
+func (a *ApiService) RestoreBackup(c *gin.Context) {
+	destination, err := strconv.Atoi(c.Request.FormValue("destination"))
+	if err != nil {
+		jsonMsg(c, "restoreBackup", err)
+		return
+	}
+	err = a.BackupService.RestoreBackup(destination, c.Request.FormValue("name"))
+	jsonMsg(c, "restoreBackup", err)
+}
+
+func (a *ApiService) DnsLookup(c *gin.Context) {
+	result, err := a.DnsService.Lookup(c.Query("domain"), c.Query("server"), c.Query("inbound"), c.Query("user"), c.Query("strategy"))
+	jsonObj(c, result, err)
+}
+
+func (a *ApiService) GetFingerprints(c *gin.Context) {
+	jsonObj(c, service.UtlsFingerprints, nil)
+}
+
 func (a *ApiService) GetKeypairs(c *gin.Context) {
 	kType := c.Query("k")
 	options := c.Query("o")
@@ -245,6 +466,59 @@ func (a *ApiService) GetDb(c *gin.Context) {
 	c.Writer.Write(db)
 }
 
+func (a *ApiService) ExportConfig(c *gin.Context) {
+	format := c.Query("format")
+	if format == "" {
+		format = "json"
+	}
+	data, err := a.ConfigService.ExportConfig(format, c.Query("stats") == "true")
+	if err != nil {
+		jsonMsg(c, "export", err)
+		return
+	}
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Disposition", "attachment; filename=s-ui_config_"+time.Now().Format("20060102-150405")+"."+format)
+	c.Writer.Write(data)
+}
+
+func (a *ApiService) ImportConfig(c *gin.Context, loginUser string) {
+	var data []byte
+	file, _, err := c.Request.FormFile("config")
+	if err == nil {
+		defer file.Close()
+		data, err = io.ReadAll(file)
+		if err != nil {
+			jsonMsg(c, "import", err)
+			return
+		}
+	} else {
+		data = []byte(c.Request.FormValue("data"))
+	}
+	dryRun := c.Request.FormValue("dryRun") == "true"
+	mode := c.Request.FormValue("mode")
+	var report *service.ImportReport
+	// Databases of other panels are imported with the panel name in "from"
+	if from := c.Request.FormValue("from"); from != "" {
+		var xrayConfig []byte
+		xrayFile, _, errXray := c.Request.FormFile("xray")
+		if errXray == nil {
+			defer xrayFile.Close()
+			xrayConfig, err = io.ReadAll(xrayFile)
+			if err != nil {
+				jsonMsg(c, "import", err)
+				return
+			}
+		}
+		report, err = a.ConfigService.ImportPanel(from, data, xrayConfig, mode, dryRun, loginUser, getHostname(c))
+	} else {
+		report, err = a.ConfigService.ImportConfig(data, c.Request.FormValue("format"), mode, dryRun, loginUser, getHostname(c))
+	}
+	if err == nil && !dryRun {
+		err = a.ConfigService.RestartCore()
+	}
+	jsonObj(c, report, err)
+}
+
 func (a *ApiService) postActions(c *gin.Context) (string, json.RawMessage, error) {
 	var data map[string]json.RawMessage
 	err := c.ShouldBind(&data)
@@ -298,17 +572,98 @@ func (a *ApiService) Save(c *gin.Context, loginUser string) {
 	act := c.Request.FormValue("action")
 	data := c.Request.FormValue("data")
 	initUsers := c.Request.FormValue("initUsers")
-	objs, err := a.ConfigService.Save(obj, act, json.RawMessage(data), initUsers, loginUser, hostname)
+	dryRun := c.Request.FormValue("dryRun") == "true"
+	objs, check, err := a.ConfigService.Save(obj, act, json.RawMessage(data), initUsers, loginUser, hostname, dryRun)
+	if dryRun {
+		jsonObj(c, check, err)
+		return
+	}
 	if err != nil {
 		jsonMsg(c, "save", err)
 		return
 	}
+	if check != nil {
+		c.Set("warnings", check.Warnings)
+	}
 	err = a.LoadPartialData(c, objs)
 	if err != nil {
 		jsonMsg(c, obj, err)
 	}
 }
 
+func (a *ApiService) BulkClients(c *gin.Context, loginUser string) {
+	data := c.Request.FormValue("data")
+	_, err := a.ConfigService.BulkClients(json.RawMessage(data), loginUser, getHostname(c))
+	if err != nil {
+		jsonMsg(c, "clientsBulk", err)
+		return
+	}
+	err = a.LoadPartialData(c, []string{"clients", "inbounds"})
+	if err != nil {
+		jsonMsg(c, "clientsBulk", err)
+	}
+}
+
+func (a *ApiService) SaveTlsRotation(c *gin.Context, loginUser string) {
+	act := c.Request.FormValue("act")
+	data := c.Request.FormValue("data")
+	err := a.ConfigService.SaveTlsRotation(act, json.RawMessage(data), loginUser, getHostname(c))
+	if err != nil {
+		jsonMsg(c, "tlsRotation", err)
+		return
+	}
+	err = a.LoadPartialData(c, []string{"tlsRotations", "tls"})
+	if err != nil {
+		jsonMsg(c, "tlsRotation", err)
+	}
+}
+
+func (a *ApiService) SaveAcme(c *gin.Context, loginUser string) {
+	act := c.Request.FormValue("act")
+	data := c.Request.FormValue("data")
+	err := a.AcmeService.Save(act, json.RawMessage(data), loginUser)
+	if err != nil {
+		jsonMsg(c, "acme", err)
+		return
+	}
+	err = a.LoadPartialData(c, []string{"acme"})
+	if err != nil {
+		jsonMsg(c, "acme", err)
+	}
+}
+
+func (a *ApiService) SaveCa(c *gin.Context, loginUser string) {
+	act := c.Request.FormValue("act")
+	data := c.Request.FormValue("data")
+	err := a.CaService.Save(act, json.RawMessage(data), loginUser)
+	if err != nil {
+		jsonMsg(c, "ca", err)
+		return
+	}
+	err = a.LoadPartialData(c, []string{"ca"})
+	if err != nil {
+		jsonMsg(c, "ca", err)
+	}
+}
+
+func (a *ApiService) RevertChange(c *gin.Context, loginUser string) {
+	hostname := getHostname(c)
+	id, err := strconv.ParseUint(c.Request.FormValue("id"), 10, 64)
+	if err != nil {
+		jsonMsg(c, "revert", err)
+		return
+	}
+	objs, err := a.ConfigService.RevertChange(id, loginUser, hostname)
+	if err != nil {
+		jsonMsg(c, "revert", err)
+		return
+	}
+	err = a.LoadPartialData(c, objs)
+	if err != nil {
+		jsonMsg(c, "revert", err)
+	}
+}
+
 func (a *ApiService) RestartApp(c *gin.Context) {
 	err := a.PanelService.RestartPanel(3)
 	jsonMsg(c, "restartApp", err)
@@ -319,9 +674,26 @@ func (a *ApiService) RestartSb(c *gin.Context) {
 	jsonMsg(c, "restartSb", err)
 }
 
+func (a *ApiService) UpdateRuleSets(c *gin.Context) {
+	tag := c.Request.FormValue("tag")
+	err := a.ConfigService.UpdateRuleSets(tag, true)
+	if err != nil {
+		jsonMsg(c, "updateRuleSets", err)
+		return
+	}
+	err = a.LoadPartialData(c, []string{"rulesets"})
+	if err != nil {
+		jsonMsg(c, "updateRuleSets", err)
+	}
+}
+
 func (a *ApiService) LinkConvert(c *gin.Context) {
 	link := c.Request.FormValue("link")
-	result, _, err := util.GetOutbound(link, 0)
+	result, _, err := util.GetOutbounds(link, 0)
+	if err == nil && len(result) == 1 {
+		jsonObj(c, result[0], nil)
+		return
+	}
 	jsonObj(c, result, err)
 }
 
@@ -42,14 +42,36 @@ func (a *APIv2Handler) postHandler(c *gin.Context) {
 	switch action {
 	case "save":
 		a.ApiService.Save(c, username)
+	case "clientsBulk":
+		a.ApiService.BulkClients(c, username)
+	case "acme":
+		a.ApiService.SaveAcme(c, username)
+	case "tlsRotation":
+		a.ApiService.SaveTlsRotation(c, username)
+	case "ca":
+		a.ApiService.SaveCa(c, username)
+	case "revertChange":
+		a.ApiService.RevertChange(c, username)
+	case "restoreSnapshot":
+		a.ApiService.RestoreSnapshot(c, username)
 	case "restartApp":
 		a.ApiService.RestartApp(c)
 	case "restartSb":
 		a.ApiService.RestartSb(c)
+	case "backupNow":
+		a.ApiService.BackupNow(c)
+	case "restoreBackup":
+		a.ApiService.RestoreBackup(c)
+	case "testNotify":
+		a.ApiService.TestNotify(c)
+	case "updateRuleSets":
+		a.ApiService.UpdateRuleSets(c)
 	case "linkConvert":
 		a.ApiService.LinkConvert(c)
 	case "importdb":
 		a.ApiService.ImportDb(c)
+	case "import":
+		a.ApiService.ImportConfig(c, username)
 	default:
 		jsonMsg(c, "failed", common.NewError("unknown action: ", action))
 	}
@@ -61,7 +83,7 @@ func (a *APIv2Handler) getHandler(c *gin.Context) {
 	switch action {
 	case "load":
 		a.ApiService.LoadData(c)
-	case "inbounds", "outbounds", "endpoints", "tls", "clients", "config":
+	case "inbounds", "outbounds", "endpoints", "rules", "rulesets", "dnsservers", "dnsrules", "tls", "tlsRotations", "acme", "ca", "clients", "plans", "config":
 		err := a.ApiService.LoadPartialData(c, []string{action})
 		if err != nil {
 			jsonMsg(c, action, err)
@@ -81,10 +103,24 @@ func (a *APIv2Handler) getHandler(c *gin.Context) {
 		a.ApiService.GetLogs(c)
 	case "changes":
 		a.ApiService.CheckChanges(c)
+	case "changeDiff":
+		a.ApiService.GetChangeDiff(c)
+	case "snapshots":
+		a.ApiService.GetSnapshots(c)
+	case "backups":
+		a.ApiService.GetBackups(c)
+	case "certs":
+		a.ApiService.GetCerts(c)
+	case "dnsLookup":
+		a.ApiService.DnsLookup(c)
 	case "keypairs":
 		a.ApiService.GetKeypairs(c)
+	case "fingerprints":
+		a.ApiService.GetFingerprints(c)
 	case "getdb":
 		a.ApiService.GetDb(c)
+	case "export":
+		a.ApiService.ExportConfig(c)
 	default:
 		jsonMsg(c, "failed", common.NewError("unknown action: ", action))
 	}
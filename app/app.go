@@ -17,6 +17,7 @@ import (
 type APP struct {
 	service.SettingService
 	configService *service.ConfigService
+	acmeService   service.AcmeService
 	webServer     *web.Server
 	subServer     *sub.Server
 	cronJob       *cronjob.CronJob
@@ -63,7 +64,17 @@ func (a *APP) Start() error {
 		return err
 	}
 
-	err = a.cronJob.Start(loc, trafficAge)
+	changesAge, err := a.SettingService.GetChangesAge()
+	if err != nil {
+		return err
+	}
+
+	err = a.cronJob.Start(loc, trafficAge, changesAge)
+	if err != nil {
+		return err
+	}
+
+	err = a.acmeService.StartAcme()
 	if err != nil {
 		return err
 	}
@@ -100,6 +111,7 @@ func (a *APP) Stop() {
 	if err != nil {
 		logger.Warning("stop Core err:", err)
 	}
+	a.acmeService.StopAcme()
 }
 
 func (a *APP) initLog() {
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/service"
+	"time"
+)
+
+func listBackups() {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	backupService := service.BackupService{}
+	backups, err := backupService.ListBackups()
+	if err != nil {
+		fmt.Println("list backups failed:", err)
+		return
+	}
+	if len(backups) == 0 {
+		fmt.Println("No backups")
+		return
+	}
+	fmt.Println("Destination\tTime\t\t\tSize\tName")
+	for _, backup := range backups {
+		fmt.Printf("%d (%s)\t%s\t%d\t%s\n", backup.Destination, backup.Type, time.Unix(backup.Time, 0).Format(time.DateTime), backup.Size, backup.Name)
+	}
+}
+
+func backupNow() {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	backupService := service.BackupService{}
+	name, err := backupService.Backup()
+	if err != nil {
+		fmt.Println("backup failed:", err)
+		return
+	}
+	fmt.Println("backup", name, "stored")
+}
+
+func restoreBackup(destination int, name string) {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	backupService := service.BackupService{}
+	err = backupService.RestoreBackup(destination, name)
+	if err != nil {
+		fmt.Println("restore backup failed:", err)
+		return
+	}
+	fmt.Println("restore backup success, restart s-ui to apply it")
+}
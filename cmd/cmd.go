@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"os"
 	"runtime/debug"
-	"s-ui/cmd/migration"
 	"s-ui/config"
+	"s-ui/logger"
+
+	"github.com/op/go-logging"
 )
 
 func ParseCmd() {
@@ -15,6 +17,11 @@ func ParseCmd() {
 
 	adminCmd := flag.NewFlagSet("admin", flag.ExitOnError)
 	settingCmd := flag.NewFlagSet("setting", flag.ExitOnError)
+	snapshotCmd := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	migrateDbCmd := flag.NewFlagSet("migrate-db", flag.ExitOnError)
+	backupCmd := flag.NewFlagSet("backup", flag.ExitOnError)
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
 
 	var username string
 	var password string
@@ -31,6 +38,45 @@ func ParseCmd() {
 	settingCmd.IntVar(&subPort, "subPort", 0, "set sub port")
 	settingCmd.StringVar(&subPath, "subPath", "", "set sub path")
 
+	var list bool
+	var restore uint
+	snapshotCmd.BoolVar(&list, "list", false, "list known-good config snapshots")
+	snapshotCmd.UintVar(&restore, "restore", 0, "restore the snapshot with this id")
+
+	var backupList bool
+	var backupRestore string
+	var backupDestination int
+	backupCmd.BoolVar(&backupList, "list", false, "list stored backups")
+	backupCmd.StringVar(&backupRestore, "restore", "", "restore the backup with this name")
+	backupCmd.IntVar(&backupDestination, "destination", 0, "destination of the backup to restore")
+
+	var exportFormat string
+	var exportStats bool
+	var exportOutput string
+	exportCmd.StringVar(&exportFormat, "format", "json", "export format: json or yaml")
+	exportCmd.BoolVar(&exportStats, "stats", false, "include client traffic and stats")
+	exportCmd.StringVar(&exportOutput, "o", "", "write to this file instead of stdout")
+
+	var importFile string
+	var importFormat string
+	var importMode string
+	var importFrom string
+	var importXray string
+	var importDryRun bool
+	importCmd.StringVar(&importFile, "file", "", "exported config, or database of another panel to import")
+	importCmd.StringVar(&importFormat, "format", "", "import format: json or yaml, detected when empty")
+	importCmd.StringVar(&importFrom, "from", "", "import a database of another panel: 3x-ui, x-ui or marzban")
+	importCmd.StringVar(&importXray, "xray", "", "xray config of Marzban, for its inbounds")
+	importCmd.StringVar(&importMode, "mode", "merge", "merge: add new objects only, replace: replace exported sections")
+	importCmd.BoolVar(&importDryRun, "dry-run", false, "show the result without changing the database")
+
+	var dbFrom string
+	var dbType string
+	var dbDsn string
+	migrateDbCmd.StringVar(&dbFrom, "from", config.GetDBPath(), "path of the sqlite database to copy")
+	migrateDbCmd.StringVar(&dbType, "type", config.GetDBType(), "target database type: postgres or mysql")
+	migrateDbCmd.StringVar(&dbDsn, "dsn", config.GetDBDsn(), "target database dsn")
+
 	adminCmd.BoolVar(&show, "show", false, "show first admin credentials")
 	adminCmd.BoolVar(&reset, "reset", false, "reset first admin credentials")
 	adminCmd.StringVar(&username, "username", "", "set login username")
@@ -43,12 +89,27 @@ func ParseCmd() {
 		fmt.Println("Commands:")
 		fmt.Println("    admin          set/reset/show first admin credentials")
 		fmt.Println("    uri            Show panel URI")
-		fmt.Println("    migrate        migrate form older version")
+		fmt.Println("    migrate        apply pending database migrations, or 'migrate status' / 'migrate down'")
 		fmt.Println("    setting        set/reset/show settings")
+		fmt.Println("    snapshot       list/restore known-good config snapshots")
+		fmt.Println("    migrate-db     copy the sqlite database into a postgres or mysql database")
+		fmt.Println("    backup         back up the database now, or list/restore backups")
+		fmt.Println("    export         export the panel config as json or yaml")
+		fmt.Println("    import         import an exported panel config, or a 3x-ui, x-ui or Marzban database")
 		fmt.Println()
 		adminCmd.Usage()
 		fmt.Println()
 		settingCmd.Usage()
+		fmt.Println()
+		snapshotCmd.Usage()
+		fmt.Println()
+		migrateDbCmd.Usage()
+		fmt.Println()
+		backupCmd.Usage()
+		fmt.Println()
+		exportCmd.Usage()
+		fmt.Println()
+		importCmd.Usage()
 	}
 
 	flag.Parse()
@@ -66,6 +127,9 @@ func ParseCmd() {
 		return
 	}
 
+	// Commands open the database, whose migrations and services log
+	logger.InitLogger(logging.WARNING)
+
 	switch os.Args[1] {
 	case "admin":
 		err := adminCmd.Parse(os.Args[2:])
@@ -87,7 +151,11 @@ func ParseCmd() {
 		getPanelURI()
 
 	case "migrate":
-		migration.MigrateDb()
+		action := ""
+		if len(os.Args) > 2 {
+			action = os.Args[2]
+		}
+		migrateDb(action)
 
 	case "setting":
 		err := settingCmd.Parse(os.Args[2:])
@@ -104,6 +172,57 @@ func ParseCmd() {
 			updateSetting(port, path, subPort, subPath)
 			showSetting()
 		}
+	case "snapshot":
+		err := snapshotCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		switch {
+		case restore > 0:
+			restoreSnapshot(restore)
+		default:
+			listSnapshots()
+		}
+	case "migrate-db":
+		err := migrateDbCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		copyDbToBackend(dbFrom, dbType, dbDsn)
+	case "backup":
+		err := backupCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		switch {
+		case backupList:
+			listBackups()
+		case backupRestore != "":
+			restoreBackup(backupDestination, backupRestore)
+		default:
+			backupNow()
+		}
+	case "export":
+		err := exportCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		exportConfig(exportFormat, exportStats, exportOutput)
+	case "import":
+		err := importCmd.Parse(os.Args[2:])
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if importFile == "" {
+			importCmd.Usage()
+			return
+		}
+		importConfig(importFile, importFormat, importFrom, importXray, importMode, importDryRun)
 	default:
 		fmt.Println("Invalid subcommands")
 		flag.Usage()
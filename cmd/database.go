@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"s-ui/cmd/migration"
+	"s-ui/config"
+	"s-ui/database"
+	"time"
+)
+
+// migrateDb applies pending migrations, or shows or reverts them with action "status" or "down"
+func migrateDb(action string) {
+	// void running on first install
+	if config.GetDBType() == database.SQLite {
+		_, err := os.Stat(config.GetDBPath())
+		if err != nil {
+			fmt.Println("Database not found")
+			return
+		}
+	}
+
+	switch action {
+	case "", "up":
+		err := database.OpenDB(config.GetDBPath())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		pending, err := migration.Pending(database.GetDB())
+		if err != nil {
+			fmt.Println("get migration status failed:", err)
+			return
+		}
+		// InitDB backs up the database and applies pending migrations
+		err = database.InitDB(config.GetDBPath())
+		if err != nil {
+			fmt.Println("migrate database failed:", err)
+			return
+		}
+		for _, m := range pending {
+			fmt.Printf("Applied migration %d %s\n", m.Version, m.Name)
+		}
+		fmt.Println("Database is up to date")
+	case "status":
+		err := database.OpenDB(config.GetDBPath())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		status, err := migration.Status(database.GetDB())
+		if err != nil {
+			fmt.Println("get migration status failed:", err)
+			return
+		}
+		for _, m := range status {
+			applied := "pending"
+			if m.Applied {
+				applied = "applied " + time.Unix(m.AppliedAt, 0).Format(time.DateTime)
+			}
+			fmt.Printf("\t%d\t%-12s\t%s\n", m.Version, m.Name, applied)
+		}
+	case "down":
+		err := database.OpenDB(config.GetDBPath())
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		reverted, err := migration.Down(database.GetDB())
+		if err != nil {
+			fmt.Println("revert migration failed:", err)
+			return
+		}
+		fmt.Printf("Reverted migration %d %s\n", reverted.Version, reverted.Name)
+	default:
+		fmt.Println("Invalid migrate action:", action)
+	}
+}
+
+// copyDbToBackend copies a sqlite database into an empty postgres or mysql database
+func copyDbToBackend(from string, dbType string, dsn string) {
+	if dbType == database.SQLite {
+		fmt.Println("target must be postgres or mysql")
+		return
+	}
+	_, err := os.Stat(from)
+	if err != nil {
+		fmt.Println("Database not found:", from)
+		return
+	}
+	src, err := database.Open(database.SQLite, from)
+	if err != nil {
+		fmt.Println("open sqlite database failed:", err)
+		return
+	}
+	err = migration.Up(src)
+	if err != nil {
+		fmt.Println("migrate sqlite database failed:", err)
+		return
+	}
+	dst, err := database.Open(dbType, dsn)
+	if err != nil {
+		fmt.Println("open", dbType, "database failed:", err)
+		return
+	}
+	err = database.CopyDB(src, dst)
+	if err != nil {
+		fmt.Println("copy database failed:", err)
+		return
+	}
+	fmt.Println("copy database success, set SUI_DB_TYPE and SUI_DB_DSN and restart s-ui to use it")
+}
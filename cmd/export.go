@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/service"
+)
+
+func exportConfig(format string, withStats bool, output string) {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	configService := service.ConfigService{}
+	data, err := configService.ExportConfig(format, withStats)
+	if err != nil {
+		fmt.Println("export config failed:", err)
+		return
+	}
+	if output == "" {
+		os.Stdout.Write(data)
+		return
+	}
+	err = os.WriteFile(output, data, 0600)
+	if err != nil {
+		fmt.Println("export config failed:", err)
+		return
+	}
+	fmt.Println("config exported to", output)
+}
+
+func importConfig(file string, format string, from string, xrayFile string, mode string, dryRun bool) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var xrayConfig []byte
+	if xrayFile != "" {
+		xrayConfig, err = os.ReadFile(xrayFile)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+	err = database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Links are generated for the panel domain, like the subscription service does without a request
+	settingService := service.SettingService{}
+	hostname, _ := settingService.GetWebDomain()
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	configService := service.ConfigService{}
+	var report *service.ImportReport
+	if from != "" {
+		report, err = configService.ImportPanel(from, data, xrayConfig, mode, dryRun, "cli", hostname)
+	} else {
+		report, err = configService.ImportConfig(data, format, mode, dryRun, "cli", hostname)
+	}
+	if err != nil {
+		fmt.Println("import config failed:", err)
+		return
+	}
+	result, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(result))
+	if !dryRun {
+		fmt.Println("import config success, restart s-ui to apply it")
+	}
+}
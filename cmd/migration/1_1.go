@@ -29,7 +29,7 @@ func migrateClientSchema(db *gorm.DB) error {
 
 		rows.Scan(&cid, &cname, &ctype, &notnull, &dfltValue, &pk)
 		if cname == "config" || cname == "inbounds" || cname == "links" {
-			if ctype == "text" {
+			if strings.EqualFold(ctype, "text") {
 				fmt.Printf("Column %s has type TEXT\n", cname)
 				oldData := make([]struct {
 					Id   uint
@@ -63,14 +63,24 @@ func migrateClientSchema(db *gorm.DB) error {
 }
 
 func deleteOldWebSecret(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&model.Setting{}) {
+		return nil
+	}
 	return db.Exec("DELETE FROM settings WHERE key = ?", "webSecret").Error
 }
 
 func changesObj(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&model.Changes{}) {
+		return nil
+	}
 	return db.Exec("UPDATE changes SET obj = CAST('\"' || CAST(obj AS TEXT) || '\"' AS BLOB) WHERE actor = ? and obj not like ?", "DepleteJob", "\"%\"").Error
 }
 
 func to1_1(db *gorm.DB) error {
+	// Versions before 1.2 only used sqlite
+	if db.Dialector.Name() != "sqlite" {
+		return nil
+	}
 	err := migrateClientSchema(db)
 	if err != nil {
 		return err
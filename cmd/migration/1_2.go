@@ -60,7 +60,7 @@ func moveJsonToDb(db *gorm.DB) error {
 			} else {
 				tls_server, _ := json.MarshalIndent(tlsObj, "", "  ")
 				if len(tls_server) > 5 {
-					newTls := &model.Tls{
+					newTls := &baseTls{
 						Name:   tag,
 						Server: tls_server,
 						Client: json.RawMessage("{}"),
@@ -235,8 +235,8 @@ func migrateTls(db *gorm.DB) error {
 	if err != nil {
 		return err
 	}
-	var tlsConfig []model.Tls
-	err = db.Model(model.Tls{}).Scan(&tlsConfig).Error
+	var tlsConfig []baseTls
+	err = db.Model(baseTls{}).Scan(&tlsConfig).Error
 	if err != nil {
 		return err
 	}
@@ -258,6 +258,9 @@ func migrateTls(db *gorm.DB) error {
 		tlsConfig[index].Client, _ = json.MarshalIndent(tlsClient, "", "  ")
 	}
 
+	if len(tlsConfig) == 0 {
+		return nil
+	}
 	return db.Save(&tlsConfig).Error
 }
 
@@ -269,8 +272,8 @@ func dropInboundData(db *gorm.DB) error {
 }
 
 func migrateClients(db *gorm.DB) error {
-	var oldClients []model.Client
-	err := db.Model(model.Client{}).Scan(&oldClients).Error
+	var oldClients []baseClient
+	err := db.Model(baseClient{}).Scan(&oldClients).Error
 	if err != nil {
 		return err
 	}
@@ -288,6 +291,9 @@ func migrateClients(db *gorm.DB) error {
 		}
 		oldClients[index].Inbounds, _ = json.Marshal(inbound_ids)
 	}
+	if len(oldClients) == 0 {
+		return nil
+	}
 	return db.Save(oldClients).Error
 }
 
@@ -296,7 +302,15 @@ func migrateChanges(db *gorm.DB) error {
 }
 
 func to1_2(db *gorm.DB) error {
-	err := moveJsonToDb(db)
+	// inbound_data only exists in databases before 1.2
+	if db.Dialector.Name() != "sqlite" || !db.Migrator().HasTable(&InboundData{}) {
+		return nil
+	}
+	err := db.AutoMigrate(&baseTls{}, &baseClient{})
+	if err != nil {
+		return err
+	}
+	err = moveJsonToDb(db)
 	if err != nil {
 		return err
 	}
@@ -1,68 +1,157 @@
 package migration
 
 import (
-	"fmt"
-	"log"
-	"os"
-	"s-ui/config"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"time"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-func MigrateDb() {
-	// void running on first install
-	path := config.GetDBPath()
-	_, err := os.Stat(path)
+// Migration is one numbered step of the database schema. Up must be idempotent,
+// because databases before schema_migrations run every step once.
+// Down is nil when a step can not be reverted.
+type Migration struct {
+	Version uint
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration is a row of schema_migrations, recording an applied migration
+type SchemaMigration struct {
+	Version   uint   `json:"version" gorm:"primaryKey;autoIncrement:false"`
+	Name      string `json:"name"`
+	AppliedAt int64  `json:"appliedAt"`
+}
+
+type MigrationStatus struct {
+	Version   uint   `json:"version"`
+	Name      string `json:"name"`
+	Applied   bool   `json:"applied"`
+	AppliedAt int64  `json:"appliedAt,omitempty"`
+}
+
+// Migrations in the order of their versions. New steps are only appended.
+var migrations = []Migration{
+	{Version: 1, Name: "legacy_1_1", Up: to1_1},
+	{Version: 2, Name: "legacy_1_2", Up: to1_2},
+	{Version: 3, Name: "base_tables", Up: baseTables},
+	{Version: 4, Name: "route_rules", Up: routeRulesUp, Down: routeRulesDown},
+	{Version: 5, Name: "dns", Up: dnsUp, Down: dnsDown},
+	{Version: 6, Name: "snapshots", Up: snapshotsUp, Down: snapshotsDown},
+	{Version: 7, Name: "plans", Up: plansUp, Down: plansDown},
+	{Version: 8, Name: "client_notices", Up: clientNoticesUp, Down: clientNoticesDown},
+	{Version: 9, Name: "quota_policies", Up: quotaPoliciesUp, Down: quotaPoliciesDown},
+	{Version: 10, Name: "acme", Up: acmeUp, Down: acmeDown},
+	{Version: 11, Name: "cert_notices", Up: certNoticesUp, Down: certNoticesDown},
+	{Version: 12, Name: "tls_rotations", Up: tlsRotationsUp, Down: tlsRotationsDown},
+	{Version: 13, Name: "ca_certs", Up: caCertsUp, Down: caCertsDown},
+	{Version: 14, Name: "sub_tokens", Up: subTokensUp, Down: subTokensDown},
+}
+
+func applied(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	err := db.AutoMigrate(&SchemaMigration{})
+	if err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	err = db.Model(&SchemaMigration{}).Find(&rows).Error
 	if err != nil {
-		println("Database not found")
-		return
+		return nil, err
+	}
+	result := make(map[uint]SchemaMigration, len(rows))
+	for _, row := range rows {
+		result[row.Version] = row
 	}
+	return result, nil
+}
 
-	db, err := gorm.Open(sqlite.Open(path))
+// Pending returns migrations which are not applied to db
+func Pending(db *gorm.DB) ([]Migration, error) {
+	done, err := applied(db)
 	if err != nil {
-		log.Fatal(err)
-		return
+		return nil, err
 	}
-	tx := db.Begin()
-	defer func() {
-		if err == nil {
-			tx.Commit()
-		} else {
-			tx.Rollback()
+	var pending []Migration
+	for _, migration := range migrations {
+		if _, ok := done[migration.Version]; !ok {
+			pending = append(pending, migration)
 		}
-	}()
-	currentVersion := config.GetVersion()
-	dbVersion := ""
-	tx.Raw("SELECT value FROM settings WHERE key = ?", "version").Find(&dbVersion)
-	fmt.Println("Current version:", currentVersion, "\nDatabase version:", dbVersion)
-
-	if currentVersion == dbVersion {
-		fmt.Println("Database is up to date, no need to migrate")
-		return
 	}
+	return pending, nil
+}
 
-	fmt.Println("Start migrating database...")
+// Status lists all migrations and whether they are applied
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	done, err := applied(db)
+	if err != nil {
+		return nil, err
+	}
+	status := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		row, ok := done[migration.Version]
+		status = append(status, MigrationStatus{
+			Version:   migration.Version,
+			Name:      migration.Name,
+			Applied:   ok,
+			AppliedAt: row.AppliedAt,
+		})
+	}
+	return status, nil
+}
 
-	// Before 1.2
-	if dbVersion == "" {
-		err = to1_1(tx)
-		if err != nil {
-			log.Fatal("Migration to 1.1 failed: ", err)
-			return
-		}
-		err = to1_2(tx)
+// Up applies pending migrations in order, each one in its own transaction
+func Up(db *gorm.DB) error {
+	pending, err := Pending(db)
+	if err != nil {
+		return err
+	}
+	for _, migration := range pending {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := migration.Up(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   migration.Version,
+				Name:      migration.Name,
+				AppliedAt: time.Now().Unix(),
+			}).Error
+		})
 		if err != nil {
-			log.Fatal("Migration to 1.2 failed: ", err)
-			return
+			return common.NewErrorf("migration %d %s failed: %v", migration.Version, migration.Name, err)
 		}
+		logger.Infof("Applied migration %d %s", migration.Version, migration.Name)
 	}
+	return nil
+}
 
-	// Set version
-	err = tx.Raw("UPDATE settings SET value = ? WHERE key = ?", currentVersion, "version").Error
+// Down reverts the last applied migration, and returns it
+func Down(db *gorm.DB) (*Migration, error) {
+	done, err := applied(db)
 	if err != nil {
-		log.Fatal("Update version failed: ", err)
-		return
+		return nil, err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		migration := migrations[i]
+		if _, ok := done[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return nil, common.NewErrorf("migration %d %s can not be reverted", migration.Version, migration.Name)
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := migration.Down(tx)
+			if err != nil {
+				return err
+			}
+			return tx.Where("version = ?", migration.Version).Delete(&SchemaMigration{}).Error
+		})
+		if err != nil {
+			return nil, common.NewErrorf("reverting migration %d %s failed: %v", migration.Version, migration.Name, err)
+		}
+		return &migration, nil
 	}
-	fmt.Println("Migration done!")
+	return nil, common.NewError("no applied migration")
 }
@@ -0,0 +1,358 @@
+package migration
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"slices"
+	"testing"
+
+	"github.com/op/go-logging"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	gormLogger "gorm.io/gorm/logger"
+)
+
+// currentModels are the tables which the migrations must end up with
+var currentModels = []interface{}{
+	&model.Setting{},
+	&model.Tls{},
+	&model.Inbound{},
+	&model.Outbound{},
+	&model.Endpoint{},
+	&model.User{},
+	&model.Tokens{},
+	&model.Stats{},
+	&model.Client{},
+	&model.Changes{},
+	&model.RouteRule{},
+	&model.RuleSet{},
+	&model.DnsServer{},
+	&model.DnsRule{},
+	&model.Snapshot{},
+	&model.Plan{},
+	&model.ClientNotice{},
+	&model.AcmeCert{},
+	&model.AcmeFile{},
+	&model.CertNotice{},
+	&model.TlsRotation{},
+	&model.CaCert{},
+}
+
+// Tables which each reversible migration creates, and which its Down drops
+var migrationTables = map[uint][]string{
+	4:  {"route_rules", "rule_sets"},
+	5:  {"dns_servers", "dns_rules"},
+	6:  {"snapshots"},
+	7:  {"plans"},
+	8:  {"client_notices"},
+	10: {"acme_certs", "acme_files"},
+	11: {"cert_notices"},
+	12: {"tls_rotations"},
+	13: {"ca_certs"},
+}
+
+func TestMain(m *testing.M) {
+	logger.InitLogger(logging.ERROR)
+	os.Exit(m.Run())
+}
+
+func openTestDb(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "s-ui.db")), &gorm.Config{
+		Logger: gormLogger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// openFixtureDb opens a database of version 1.0, with the config.json which 1.2 moves into the database
+func openFixtureDb(t *testing.T) *gorm.DB {
+	t.Helper()
+	db := openTestDb(t)
+	fixture, err := os.ReadFile("testdata/v1_0.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(string(fixture)).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The config is read from the bin folder next to the executable
+	binFolder := t.TempDir()
+	config, err := os.ReadFile("testdata/config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(binFolder, "config.json"), config, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exeDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relBinFolder, err := filepath.Rel(exeDir, binFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SUI_BIN_FOLDER", relBinFolder)
+	return db
+}
+
+// columns lists the columns of every current table, and fails on missing tables or columns
+func columns(t *testing.T, db *gorm.DB) map[string][]string {
+	t.Helper()
+	result := map[string][]string{}
+	for _, m := range currentModels {
+		stmt := &gorm.Statement{DB: db}
+		err := stmt.Parse(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := stmt.Schema.Table
+		if !db.Migrator().HasTable(table) {
+			t.Errorf("table %s is missing", table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName != "" && !db.Migrator().HasColumn(m, field.DBName) {
+				t.Errorf("column %s.%s is missing", table, field.DBName)
+			}
+		}
+		columnTypes, err := db.Migrator().ColumnTypes(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range columnTypes {
+			result[table] = append(result[table], column.Name())
+		}
+		slices.Sort(result[table])
+	}
+	return result
+}
+
+func checkStatus(t *testing.T, db *gorm.DB, appliedUntil uint) {
+	t.Helper()
+	status, err := Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status) != len(migrations) {
+		t.Fatalf("status has %d migrations, want %d", len(status), len(migrations))
+	}
+	for _, s := range status {
+		if want := s.Version <= appliedUntil; s.Applied != want {
+			t.Errorf("migration %d %s applied = %v, want %v", s.Version, s.Name, s.Applied, want)
+		}
+		if s.Applied && s.AppliedAt == 0 {
+			t.Errorf("migration %d has no time of applying", s.Version)
+		}
+	}
+}
+
+func lastVersion() uint {
+	return migrations[len(migrations)-1].Version
+}
+
+func TestUpNewDatabase(t *testing.T) {
+	db := openTestDb(t)
+	checkStatus(t, db, 0)
+	err := Up(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, db, lastVersion())
+	columns(t, db)
+
+	var count int64
+	db.Model(model.Setting{}).Where("key = ?", "subByName").Count(&count)
+	if count != 0 {
+		t.Error("subByName is set on a new panel")
+	}
+
+	var outbounds []model.Outbound
+	db.Find(&outbounds)
+	if len(outbounds) != 1 || outbounds[0].Tag != "direct" {
+		t.Errorf("outbounds = %v, want a direct one", outbounds)
+	}
+
+	// Nothing is pending, so a second run changes nothing
+	err = Up(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Model(model.Outbound{}).Find(&outbounds)
+	if len(outbounds) != 1 {
+		t.Errorf("second run added outbounds: %v", outbounds)
+	}
+}
+
+func TestUpOldDatabase(t *testing.T) {
+	db := openFixtureDb(t)
+	err := Up(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, db, lastVersion())
+	upgraded := columns(t, db)
+
+	// An upgraded database has the same tables as a new one
+	fresh := openTestDb(t)
+	err = Up(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for table, want := range columns(t, fresh) {
+		if !slices.Equal(upgraded[table], want) {
+			t.Errorf("columns of %s = %v, want %v", table, upgraded[table], want)
+		}
+	}
+	for _, table := range []string{"inbound_data"} {
+		if db.Migrator().HasTable(table) {
+			t.Errorf("table %s is not dropped", table)
+		}
+	}
+
+	// 1.1 drops the old secret and keeps json in clients
+	var count int64
+	db.Model(model.Setting{}).Where("key = ?", "webSecret").Count(&count)
+	if count != 0 {
+		t.Error("webSecret is not deleted")
+	}
+	var client model.Client
+	err = db.Where("name = ?", "alice").First(&client).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.SubToken) < 20 || !client.SubByName || !db.Migrator().HasIndex(&model.Client{}, "SubToken") {
+		t.Errorf("sub token of client = %q, by name %v", client.SubToken, client.SubByName)
+	}
+	var subByName model.Setting
+	db.Where("key = ?", "subByName").First(&subByName)
+	if subByName.Value != "true" {
+		t.Errorf("subByName of a panel with clients = %q, want true", subByName.Value)
+	}
+
+	// 1.2 moves inbounds and outbounds into the database
+	var inbound model.Inbound
+	err = db.Where("tag = ?", "vless-in").First(&inbound).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inbound.TlsId != 1 {
+		t.Errorf("tls_id of inbound = %d, want 1", inbound.TlsId)
+	}
+	var addrs []map[string]interface{}
+	json.Unmarshal(inbound.Addrs, &addrs)
+	if len(addrs) != 1 {
+		t.Fatalf("addrs = %s", inbound.Addrs)
+	}
+	if tls, _ := addrs[0]["tls"].(map[string]interface{}); tls["enabled"] != true || tls["server_name"] != "example.com" || tls["insecure"] != true {
+		t.Errorf("tls of address = %v", addrs[0]["tls"])
+	}
+	var options map[string]interface{}
+	json.Unmarshal(inbound.Options, &options)
+	if _, ok := options["sniff"]; ok {
+		t.Errorf("deprecated sniff is kept: %s", inbound.Options)
+	}
+
+	var inboundIds []uint
+	json.Unmarshal(client.Inbounds, &inboundIds)
+	if !slices.Equal(inboundIds, []uint{inbound.Id}) {
+		t.Errorf("inbounds of client = %s, want [%d]", client.Inbounds, inbound.Id)
+	}
+
+	var tls model.Tls
+	db.First(&tls, 1)
+	var tlsClient map[string]interface{}
+	json.Unmarshal(tls.Client, &tlsClient)
+	if _, ok := tlsClient["server_name"]; ok || tlsClient["insecure"] != true {
+		t.Errorf("client of tls = %s", tls.Client)
+	}
+
+	var outboundTags []string
+	db.Model(model.Outbound{}).Order("id").Pluck("tag", &outboundTags)
+	if !slices.Equal(outboundTags, []string{"direct"}) {
+		t.Errorf("outbounds = %v, want block and dns outbounds to become rule actions", outboundTags)
+	}
+	var config model.Setting
+	err = db.Where("key = ?", "config").First(&config).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	var oldConfig struct {
+		Inbounds []interface{} `json:"inbounds"`
+		Route    struct {
+			Rules []map[string]interface{} `json:"rules"`
+		} `json:"route"`
+		Experimental map[string]interface{} `json:"experimental"`
+	}
+	json.Unmarshal([]byte(config.Value), &oldConfig)
+	var actions []string
+	for _, rule := range oldConfig.Route.Rules {
+		actions = append(actions, rule["action"].(string))
+	}
+	if !slices.Equal(actions, []string{"hijack-dns", "reject", "route", "sniff"}) {
+		t.Errorf("actions of rules = %v", actions)
+	}
+	if len(oldConfig.Inbounds) > 0 || oldConfig.Experimental["v2ray_api"] != nil {
+		t.Errorf("config keeps moved or removed parts: %s", config.Value)
+	}
+}
+
+func TestDown(t *testing.T) {
+	db := openFixtureDb(t)
+	err := Up(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var alice model.Client
+	db.Where("name = ?", "alice").First(&alice)
+
+	for version := lastVersion(); version > 3; version-- {
+		reverted, err := Down(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reverted.Version != version {
+			t.Fatalf("reverted migration %d, want %d", reverted.Version, version)
+		}
+		checkStatus(t, db, version-1)
+		for _, table := range migrationTables[version] {
+			if db.Migrator().HasTable(table) {
+				t.Errorf("down of %d keeps table %s", version, table)
+			}
+		}
+	}
+	for _, column := range []string{"dns", "plan_id", "grace_days", "quota_action", "throttle_kbps", "limited", "sub_token", "sub_by_name"} {
+		if db.Migrator().HasColumn(&baseClient{}, column) {
+			t.Errorf("column clients.%s is not dropped", column)
+		}
+	}
+
+	// The base and legacy steps can not be reverted
+	_, err = Down(db)
+	if err == nil {
+		t.Fatal("base tables are reverted")
+	}
+	checkStatus(t, db, 3)
+
+	// Data of the base is kept, and migrating up again restores the tables
+	var client model.Client
+	err = db.Model(baseClient{}).Where("name = ?", "alice").Scan(&client).Error
+	if err != nil || client.Id != alice.Id {
+		t.Errorf("client after down = %v, %v", client, err)
+	}
+	err = Up(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(t, db, lastVersion())
+	columns(t, db)
+}
@@ -0,0 +1,561 @@
+package migration
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+
+	"gorm.io/gorm"
+)
+
+// Tables of version 1.2, which later migrations change. They are frozen here,
+// so a new database gets the same base as an upgraded one.
+type baseSetting struct {
+	Id    uint `gorm:"primaryKey;autoIncrement"`
+	Key   string
+	Value string
+}
+
+type baseTls struct {
+	Id     uint `gorm:"primaryKey;autoIncrement"`
+	Name   string
+	Server json.RawMessage
+	Client json.RawMessage
+}
+
+type baseInbound struct {
+	Id      uint `gorm:"primaryKey;autoIncrement"`
+	Type    string
+	Tag     string `gorm:"unique"`
+	TlsId   uint
+	Tls     *baseTls `gorm:"foreignKey:TlsId;references:Id"`
+	Addrs   json.RawMessage
+	OutJson json.RawMessage
+	Options json.RawMessage
+}
+
+type baseOutbound struct {
+	Id      uint `gorm:"primaryKey;autoIncrement"`
+	Type    string
+	Tag     string `gorm:"unique"`
+	Options json.RawMessage
+}
+
+type baseEndpoint struct {
+	Id      uint `gorm:"primaryKey;autoIncrement"`
+	Type    string
+	Tag     string `gorm:"unique"`
+	Options json.RawMessage
+	Ext     json.RawMessage
+}
+
+type baseUser struct {
+	Id         uint `gorm:"primaryKey;autoIncrement"`
+	Username   string
+	Password   string
+	LastLogins string
+}
+
+type baseTokens struct {
+	Id     uint `gorm:"primaryKey;autoIncrement"`
+	Desc   string
+	Token  string
+	Expiry int64
+	UserId uint
+	User   *baseUser `gorm:"foreignKey:UserId;references:Id"`
+}
+
+type baseStats struct {
+	Id        uint64 `gorm:"primaryKey;autoIncrement"`
+	DateTime  int64
+	Resource  string
+	Tag       string
+	Direction bool
+	Traffic   int64
+}
+
+type baseClient struct {
+	Id       uint `gorm:"primaryKey;autoIncrement"`
+	Enable   bool
+	Name     string
+	Config   json.RawMessage
+	Inbounds json.RawMessage
+	Links    json.RawMessage
+	Volume   int64
+	Expiry   int64
+	Down     int64
+	Up       int64
+	Desc     string
+	Group    string
+}
+
+type baseChanges struct {
+	Id       uint64 `gorm:"primaryKey;autoIncrement"`
+	DateTime int64
+	Actor    string
+	Key      string
+	Action   string
+	Obj      json.RawMessage
+}
+
+func (baseSetting) TableName() string  { return "settings" }
+func (baseTls) TableName() string      { return "tls" }
+func (baseInbound) TableName() string  { return "inbounds" }
+func (baseOutbound) TableName() string { return "outbounds" }
+func (baseEndpoint) TableName() string { return "endpoints" }
+func (baseUser) TableName() string     { return "users" }
+func (baseTokens) TableName() string   { return "tokens" }
+func (baseStats) TableName() string    { return "stats" }
+func (baseClient) TableName() string   { return "clients" }
+func (baseChanges) TableName() string  { return "changes" }
+
+// baseTables creates tables of version 1.2, with a direct outbound in a new database
+func baseTables(db *gorm.DB) error {
+	newOutbounds := !db.Migrator().HasTable(&baseOutbound{})
+	err := db.AutoMigrate(
+		&baseSetting{},
+		&baseTls{},
+		&baseInbound{},
+		&baseOutbound{},
+		&baseEndpoint{},
+		&baseUser{},
+		&baseTokens{},
+		&baseStats{},
+		&baseClient{},
+		&baseChanges{},
+	)
+	if err != nil || !newOutbounds {
+		return err
+	}
+	return db.Create(&baseOutbound{Type: "direct", Tag: "direct", Options: json.RawMessage(`{}`)}).Error
+}
+
+// Tables and columns of the migrations after base_tables, frozen as each migration created them.
+// Later changes of the models are new migrations, which see these tables as they were.
+type routeRule struct {
+	Id       uint `gorm:"primaryKey;autoIncrement"`
+	Priority int
+	Enable   bool
+	Rule     json.RawMessage
+}
+
+type ruleSet struct {
+	Id      uint `gorm:"primaryKey;autoIncrement"`
+	Type    string
+	Tag     string `gorm:"unique"`
+	Options json.RawMessage
+}
+
+func (routeRule) TableName() string { return "route_rules" }
+func (ruleSet) TableName() string   { return "rule_sets" }
+
+func routeRulesUp(db *gorm.DB) error {
+	return db.AutoMigrate(&routeRule{}, &ruleSet{})
+}
+
+func routeRulesDown(db *gorm.DB) error {
+	return db.Migrator().DropTable(&routeRule{}, &ruleSet{})
+}
+
+type dnsServer struct {
+	Id      uint `gorm:"primaryKey;autoIncrement"`
+	Type    string
+	Tag     string `gorm:"unique"`
+	Options json.RawMessage
+}
+
+type dnsRule struct {
+	Id       uint `gorm:"primaryKey;autoIncrement"`
+	Priority int
+	Enable   bool
+	Rule     json.RawMessage
+}
+
+type dnsClient struct {
+	Id  uint `gorm:"primaryKey;autoIncrement"`
+	Dns string
+}
+
+func (dnsServer) TableName() string { return "dns_servers" }
+func (dnsRule) TableName() string   { return "dns_rules" }
+func (dnsClient) TableName() string { return "clients" }
+
+func dnsUp(db *gorm.DB) error {
+	err := db.AutoMigrate(&dnsServer{}, &dnsRule{})
+	if err != nil {
+		return err
+	}
+	if db.Migrator().HasColumn(&dnsClient{}, "dns") {
+		return nil
+	}
+	return db.Migrator().AddColumn(&dnsClient{}, "dns")
+}
+
+func dnsDown(db *gorm.DB) error {
+	err := db.Migrator().DropTable(&dnsServer{}, &dnsRule{})
+	if err != nil {
+		return err
+	}
+	if !db.Migrator().HasColumn(&dnsClient{}, "dns") {
+		return nil
+	}
+	return db.Migrator().DropColumn(&dnsClient{}, "dns")
+}
+
+type snapshot struct {
+	Id         uint `gorm:"primaryKey;autoIncrement"`
+	DateTime   int64
+	ConfigHash string
+	Config     json.RawMessage
+	State      json.RawMessage
+}
+
+// Changes keep the object before and after them, which snapshots revert to
+type diffChanges struct {
+	Id     uint64 `gorm:"primaryKey;autoIncrement"`
+	Before json.RawMessage
+	After  json.RawMessage
+}
+
+func (snapshot) TableName() string    { return "snapshots" }
+func (diffChanges) TableName() string { return "changes" }
+
+var changeDiffColumns = []string{"before", "after"}
+
+func snapshotsUp(db *gorm.DB) error {
+	err := db.AutoMigrate(&snapshot{})
+	if err != nil {
+		return err
+	}
+	for _, column := range changeDiffColumns {
+		if db.Migrator().HasColumn(&diffChanges{}, column) {
+			continue
+		}
+		err = db.Migrator().AddColumn(&diffChanges{}, column)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func snapshotsDown(db *gorm.DB) error {
+	err := db.Migrator().DropTable(&snapshot{})
+	if err != nil {
+		return err
+	}
+	for _, column := range changeDiffColumns {
+		if !db.Migrator().HasColumn(&diffChanges{}, column) {
+			continue
+		}
+		err = db.Migrator().DropColumn(&diffChanges{}, column)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type plan struct {
+	Id          uint   `gorm:"primaryKey;autoIncrement"`
+	Name        string `gorm:"unique"`
+	Volume      int64
+	Duration    int64
+	ResetPolicy string
+	Inbounds    json.RawMessage
+	SpeedLimit  int64
+	Group       string
+	Desc        string
+}
+
+type planClient struct {
+	Id     uint `gorm:"primaryKey;autoIncrement"`
+	PlanId uint
+}
+
+func (plan) TableName() string       { return "plans" }
+func (planClient) TableName() string { return "clients" }
+
+func plansUp(db *gorm.DB) error {
+	err := db.AutoMigrate(&plan{})
+	if err != nil {
+		return err
+	}
+	if db.Migrator().HasColumn(&planClient{}, "plan_id") {
+		return nil
+	}
+	return db.Migrator().AddColumn(&planClient{}, "plan_id")
+}
+
+func plansDown(db *gorm.DB) error {
+	err := db.Migrator().DropTable(&plan{})
+	if err != nil {
+		return err
+	}
+	if !db.Migrator().HasColumn(&planClient{}, "plan_id") {
+		return nil
+	}
+	return db.Migrator().DropColumn(&planClient{}, "plan_id")
+}
+
+type clientNotice struct {
+	Id        uint `gorm:"primaryKey;autoIncrement"`
+	ClientId  uint `gorm:"index"`
+	Kind      string
+	Threshold int
+	DateTime  int64
+}
+
+func (clientNotice) TableName() string { return "client_notices" }
+
+func clientNoticesUp(db *gorm.DB) error {
+	return db.AutoMigrate(&clientNotice{})
+}
+
+func clientNoticesDown(db *gorm.DB) error {
+	return db.Migrator().DropTable(&clientNotice{})
+}
+
+type quotaClient struct {
+	Id           uint `gorm:"primaryKey;autoIncrement"`
+	GraceDays    int64
+	QuotaAction  string
+	ThrottleKbps int64
+	Limited      string
+}
+
+type quotaPlan struct {
+	Id           uint `gorm:"primaryKey;autoIncrement"`
+	GraceDays    int64
+	QuotaAction  string
+	ThrottleKbps int64
+}
+
+func (quotaClient) TableName() string { return "clients" }
+func (quotaPlan) TableName() string   { return "plans" }
+
+var quotaPolicyColumns = map[interface{}][]string{
+	&quotaClient{}: {"grace_days", "quota_action", "throttle_kbps", "limited"},
+	&quotaPlan{}:   {"grace_days", "quota_action", "throttle_kbps"},
+}
+
+func quotaPoliciesUp(db *gorm.DB) error {
+	for table, columns := range quotaPolicyColumns {
+		for _, column := range columns {
+			if db.Migrator().HasColumn(table, column) {
+				continue
+			}
+			err := db.Migrator().AddColumn(table, column)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func quotaPoliciesDown(db *gorm.DB) error {
+	for table, columns := range quotaPolicyColumns {
+		for _, column := range columns {
+			if !db.Migrator().HasColumn(table, column) {
+				continue
+			}
+			err := db.Migrator().DropColumn(table, column)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type acmeCert struct {
+	Id          uint   `gorm:"primaryKey;autoIncrement"`
+	Domain      string `gorm:"unique"`
+	Challenge   string
+	DnsProvider string
+	DnsOptions  json.RawMessage
+	Issuer      string
+	NotAfter    int64
+	LastError   string
+	UpdatedAt   int64
+}
+
+type acmeFile struct {
+	Key      string `gorm:"primaryKey"`
+	Value    []byte
+	Modified int64
+}
+
+type acmeTls struct {
+	Id   uint `gorm:"primaryKey;autoIncrement"`
+	Acme string
+}
+
+func (acmeCert) TableName() string { return "acme_certs" }
+func (acmeFile) TableName() string { return "acme_files" }
+func (acmeTls) TableName() string  { return "tls" }
+
+func acmeUp(db *gorm.DB) error {
+	err := db.AutoMigrate(&acmeCert{}, &acmeFile{})
+	if err != nil {
+		return err
+	}
+	if db.Migrator().HasColumn(&acmeTls{}, "acme") {
+		return nil
+	}
+	return db.Migrator().AddColumn(&acmeTls{}, "acme")
+}
+
+func acmeDown(db *gorm.DB) error {
+	err := db.Migrator().DropTable(&acmeCert{}, &acmeFile{})
+	if err != nil {
+		return err
+	}
+	if !db.Migrator().HasColumn(&acmeTls{}, "acme") {
+		return nil
+	}
+	return db.Migrator().DropColumn(&acmeTls{}, "acme")
+}
+
+type certNotice struct {
+	Id        uint   `gorm:"primaryKey;autoIncrement"`
+	Cert      string `gorm:"index"`
+	NotAfter  int64
+	Threshold int
+	DateTime  int64
+}
+
+func (certNotice) TableName() string { return "cert_notices" }
+
+func certNoticesUp(db *gorm.DB) error {
+	return db.AutoMigrate(&certNotice{})
+}
+
+func certNoticesDown(db *gorm.DB) error {
+	return db.Migrator().DropTable(&certNotice{})
+}
+
+type tlsRotation struct {
+	Id                 uint `gorm:"primaryKey;autoIncrement"`
+	TlsId              uint `gorm:"uniqueIndex"`
+	RealityKey         int
+	RealityShortId     int
+	Ech                int
+	Overlap            int
+	LastRealityKey     int64
+	LastRealityShortId int64
+	LastEch            int64
+	OverlapUntil       int64
+}
+
+func (tlsRotation) TableName() string { return "tls_rotations" }
+
+func tlsRotationsUp(db *gorm.DB) error {
+	return db.AutoMigrate(&tlsRotation{})
+}
+
+func tlsRotationsDown(db *gorm.DB) error {
+	return db.Migrator().DropTable(&tlsRotation{})
+}
+
+type caCert struct {
+	Id        uint   `gorm:"primaryKey;autoIncrement"`
+	Name      string `gorm:"unique"`
+	Root      bool
+	Sans      json.RawMessage
+	Days      int
+	CertPem   string
+	KeyPem    string
+	NotAfter  int64
+	UpdatedAt int64
+}
+
+func (caCert) TableName() string { return "ca_certs" }
+
+func caCertsUp(db *gorm.DB) error {
+	return db.AutoMigrate(&caCert{})
+}
+
+func caCertsDown(db *gorm.DB) error {
+	return db.Migrator().DropTable(&caCert{})
+}
+
+// subTokenClient is the token of clients as migration 14 adds it
+type subTokenClient struct {
+	Id        uint   `gorm:"primaryKey;autoIncrement"`
+	SubToken  string `gorm:"uniqueIndex"`
+	SubByName bool
+}
+
+func (subTokenClient) TableName() string {
+	return "clients"
+}
+
+// subTokensUp gives every client a random token for its subscription links, which were on its name before.
+// Existing clients keep their links by name, until they rotate.
+func subTokensUp(db *gorm.DB) error {
+	for _, column := range []string{"SubToken", "SubByName"} {
+		if !db.Migrator().HasColumn(&subTokenClient{}, column) {
+			err := db.Migrator().AddColumn(&subTokenClient{}, column)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	var ids []uint
+	err := db.Model(&subTokenClient{}).Where("sub_token IS NULL OR sub_token = ?", "").Pluck("id", &ids).Error
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		token := make([]byte, 18)
+		_, err = rand.Read(token)
+		if err != nil {
+			return err
+		}
+		err = db.Model(&subTokenClient{}).Where("id = ?", id).UpdateColumns(map[string]interface{}{
+			"sub_token":   base64.RawURLEncoding.EncodeToString(token),
+			"sub_by_name": true,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	// Links by name stay on for panels which had clients, new panels have only tokens
+	if len(ids) > 0 {
+		var count int64
+		err = db.Model(&baseSetting{}).Where("key = ?", "subByName").Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			err = db.Create(&baseSetting{Key: "subByName", Value: "true"}).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if db.Migrator().HasIndex(&subTokenClient{}, "SubToken") {
+		return nil
+	}
+	return db.Migrator().CreateIndex(&subTokenClient{}, "SubToken")
+}
+
+func subTokensDown(db *gorm.DB) error {
+	if db.Migrator().HasIndex(&subTokenClient{}, "SubToken") {
+		err := db.Migrator().DropIndex(&subTokenClient{}, "SubToken")
+		if err != nil {
+			return err
+		}
+	}
+	for _, column := range []string{"sub_token", "sub_by_name"} {
+		if db.Migrator().HasColumn(&subTokenClient{}, column) {
+			err := db.Migrator().DropColumn(&subTokenClient{}, column)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return db.Where("key = ?", "subByName").Delete(&baseSetting{}).Error
+}
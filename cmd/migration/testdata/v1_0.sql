@@ -0,0 +1,22 @@
+CREATE TABLE `settings` (`id` integer PRIMARY KEY AUTOINCREMENT,`key` text,`value` text);
+INSERT INTO settings (key, value) VALUES ('webPort', '2095'), ('webSecret', 'old-secret');
+
+CREATE TABLE `tls` (`id` integer PRIMARY KEY AUTOINCREMENT,`name` text,`inbounds` blob,`server` blob,`client` blob);
+INSERT INTO tls (name, inbounds, server, client) VALUES ('main', CAST('["vless-in"]' AS BLOB), CAST('{"enabled":true,"server_name":"example.com"}' AS BLOB), CAST('{"insecure":true,"server_name":"example.com","utls":{"enabled":true,"fingerprint":"chrome"}}' AS BLOB));
+
+CREATE TABLE `inbound_data` (`id` integer PRIMARY KEY AUTOINCREMENT,`tag` text,`addrs` blob,`out_json` blob);
+INSERT INTO inbound_data (tag, addrs, out_json) VALUES ('vless-in', CAST('[{"server":"cdn.example.com","server_port":443,"tls":true,"insecure":true,"server_name":"example.com"}]' AS BLOB), CAST('{}' AS BLOB));
+
+CREATE TABLE `users` (`id` integer PRIMARY KEY AUTOINCREMENT,`username` text,`password` text,`last_logins` text);
+INSERT INTO users (username, password) VALUES ('admin', 'admin');
+
+CREATE TABLE `tokens` (`id` integer PRIMARY KEY AUTOINCREMENT,`desc` text,`token` text,`expiry` integer,`user_id` integer);
+
+CREATE TABLE `stats` (`id` integer PRIMARY KEY AUTOINCREMENT,`date_time` integer,`resource` text,`tag` text,`direction` numeric,`traffic` integer);
+INSERT INTO stats (date_time, resource, tag, direction, traffic) VALUES (1700000000, 'user', 'alice', 1, 1024);
+
+CREATE TABLE `clients` (`id` integer PRIMARY KEY AUTOINCREMENT,`enable` numeric,`name` text,`config` text,`inbounds` text,`links` text,`volume` integer,`expiry` integer,`down` integer,`up` integer,`desc` text,`group` text);
+INSERT INTO clients (enable, name, config, inbounds, links, volume, expiry, down, up, desc, `group`) VALUES (1, 'alice', '{"vless":{"name":"alice","uuid":"11111111-2222-3333-4444-555555555555"}}', 'vless-in', '[]', 0, 0, 0, 0, '', '');
+
+CREATE TABLE `changes` (`id` integer PRIMARY KEY AUTOINCREMENT,`date_time` integer,`actor` text,`key` text,`action` text,`index` integer,`obj` blob);
+INSERT INTO changes (date_time, actor, key, action, `index`, obj) VALUES (1700000000, 'DepleteJob', 'clients', 'disable', 0, CAST('["alice"]' AS BLOB));
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/service"
+	"time"
+)
+
+func listSnapshots() {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	configService := service.ConfigService{}
+	snapshots, err := configService.GetSnapshots()
+	if err != nil {
+		fmt.Println("list snapshots failed:", err)
+		return
+	}
+	if len(snapshots) == 0 {
+		fmt.Println("No snapshots")
+		return
+	}
+	fmt.Println("Known-good config snapshots:")
+	for _, snapshot := range snapshots {
+		fmt.Printf("\t%d\t%s\t%s\n", snapshot.Id, time.Unix(snapshot.DateTime, 0).Format(time.DateTime), snapshot.ConfigHash)
+	}
+}
+
+func restoreSnapshot(id uint) {
+	err := database.InitDB(config.GetDBPath())
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	configService := service.ConfigService{}
+	err = configService.RestoreSnapshot(id, "cli", "restored from command line")
+	if err != nil {
+		fmt.Println("restore snapshot failed:", err)
+		return
+	}
+	fmt.Println("restore snapshot success, restart s-ui to apply it")
+}
@@ -61,3 +61,17 @@ func GetDBFolderPath() string {
 func GetDBPath() string {
 	return fmt.Sprintf("%s/%s.db", GetDBFolderPath(), GetName())
 }
+
+// GetDBType returns the database backend: sqlite (default), postgres or mysql
+func GetDBType() string {
+	dbType := os.Getenv("SUI_DB_TYPE")
+	if dbType == "" {
+		return "sqlite"
+	}
+	return strings.ToLower(dbType)
+}
+
+// GetDBDsn returns the data source name of a postgres or mysql backend
+func GetDBDsn() string {
+	return os.Getenv("SUI_DB_DSN")
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"s-ui/util/common"
+	"sync"
 	"time"
 
 	"github.com/sagernet/sing-box/adapter"
@@ -39,10 +40,16 @@ type Box struct {
 	inbound     *inbound.Manager
 	outbound    *outbound.Manager
 	connection  *route.ConnectionManager
-	router      *route.Router
+	ctx         context.Context
+	router      *reloadableRouter
 	services    []adapter.LifecycleService
 	connTracker *ConnTracker
 	done        chan struct{}
+
+	// routerAccess guards the options of the running router, which a resolver of LookupDNS copies
+	routerAccess sync.Mutex
+	routeOptions option.RouteOptions
+	dnsOptions   option.DNSOptions
 }
 
 type Options struct {
@@ -118,7 +125,6 @@ func NewBox(options Options) (*Box, error) {
 	if err != nil {
 		return nil, common.NewError("create log factory", err)
 	}
-	factory = logFactory
 
 	routeOptions := sbCommon.PtrValueOrDefault(options.Route)
 	endpointManager := endpoint.NewManager(logFactory.NewLogger("endpoint"), endpointRegistry)
@@ -135,10 +141,13 @@ func NewBox(options Options) (*Box, error) {
 	service.MustRegister[adapter.NetworkManager](ctx, networkManager)
 	connectionManager := route.NewConnectionManager(logFactory.NewLogger("connection"))
 	service.MustRegister[adapter.ConnectionManager](ctx, connectionManager)
-	router, err := route.NewRouter(ctx, logFactory, routeOptions, sbCommon.PtrValueOrDefault(options.DNS))
+	dnsOptions := sbCommon.PtrValueOrDefault(options.DNS)
+	routeRouter, err := route.NewRouter(ctx, logFactory, routeOptions, dnsOptions)
 	if err != nil {
 		return nil, common.NewError("initialize router", err)
 	}
+	router := newReloadableRouter(routeRouter)
+	service.MustRegister[adapter.Router](ctx, router)
 	for i, endpointOptions := range options.Endpoints {
 		var tag string
 		if endpointOptions.Tag != "" {
@@ -246,6 +255,7 @@ func NewBox(options Options) (*Box, error) {
 		services = append(services, adapter.NewLifecycleService(timeService, "ntp service"))
 	}
 	return &Box{
+		ctx:         ctx,
 		network:     networkManager,
 		endpoint:    endpointManager,
 		inbound:     inboundManager,
@@ -258,6 +268,9 @@ func NewBox(options Options) (*Box, error) {
 		services:    services,
 		connTracker: connTracker,
 		done:        make(chan struct{}),
+
+		routeOptions: routeOptions,
+		dnsOptions:   dnsOptions,
 	}, nil
 }
 
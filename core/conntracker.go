@@ -24,6 +24,7 @@ type ConnTracker struct {
 	inbounds  map[string]Counter
 	outbounds map[string]Counter
 	users     map[string]Counter
+	limits    map[string]*userLimit
 }
 
 func NewConnTracker() *ConnTracker {
@@ -67,12 +68,20 @@ func (c *ConnTracker) loadOrCreateCounter(obj *map[string]Counter, name string)
 
 func (c *ConnTracker) RoutedConnection(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) net.Conn {
 	readCounter, writeCounter := c.getReadCounters(metadata.Inbound, matchOutbound.Tag(), metadata.User)
-	return bufio.NewInt64CounterConn(conn, readCounter, writeCounter)
+	conn = bufio.NewInt64CounterConn(conn, readCounter, writeCounter)
+	if limit := c.getLimit(metadata.User); limit != nil {
+		return &limitedConn{Conn: conn, limit: limit}
+	}
+	return conn
 }
 
 func (c *ConnTracker) RoutedPacketConnection(ctx context.Context, conn network.PacketConn, metadata adapter.InboundContext, matchedRule adapter.Rule, matchOutbound adapter.Outbound) network.PacketConn {
 	readCounter, writeCounter := c.getReadCounters(metadata.Inbound, matchOutbound.Tag(), metadata.User)
-	return bufio.NewInt64CounterPacketConn(conn, readCounter, writeCounter)
+	conn = bufio.NewInt64CounterPacketConn(conn, readCounter, writeCounter)
+	if limit := c.getLimit(metadata.User); limit != nil {
+		return &limitedPacketConn{PacketConn: conn, limit: limit}
+	}
+	return conn
 }
 
 func (c *ConnTracker) GetStats() *[]model.Stats {
@@ -0,0 +1,51 @@
+package core
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"time"
+
+	"github.com/sagernet/sing-box/adapter"
+	C "github.com/sagernet/sing-box/constant"
+	"github.com/sagernet/sing-dns"
+)
+
+// LookupDNS resolves a domain with the dns servers and rules of the running core. The query is matched
+// against dns rules as if it came from the given inbound and user, unless a server is forced.
+// A separate resolver without cache answers it, so the answer is fresh and the cache of real traffic is kept.
+func (c *Core) LookupDNS(domain string, server string, inbound string, user string, strategy string) ([]netip.Addr, time.Duration, error) {
+	if !c.isRunning {
+		return nil, 0, os.ErrInvalid
+	}
+	var domainStrategy dns.DomainStrategy
+	switch strategy {
+	case "", "as_is":
+		domainStrategy = dns.DomainStrategyAsIS
+	case "prefer_ipv4":
+		domainStrategy = dns.DomainStrategyPreferIPv4
+	case "prefer_ipv6":
+		domainStrategy = dns.DomainStrategyPreferIPv6
+	case "ipv4_only":
+		domainStrategy = dns.DomainStrategyUseIPv4
+	case "ipv6_only":
+		domainStrategy = dns.DomainStrategyUseIPv6
+	default:
+		return nil, 0, os.ErrInvalid
+	}
+	resolver, err := c.instance.newResolver()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resolver.Close()
+	ctx, cancel := context.WithTimeout(globalCtx, C.DNSTimeout)
+	defer cancel()
+	ctx = adapter.WithContext(ctx, &adapter.InboundContext{
+		Inbound:   inbound,
+		User:      user,
+		DNSServer: server,
+	})
+	start := time.Now()
+	addrs, err := resolver.Lookup(ctx, domain, domainStrategy)
+	return addrs, time.Since(start), err
+}
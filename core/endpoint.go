@@ -41,6 +41,15 @@ func (c *Core) RemoveInbound(tag string) error {
 	return inbound_manager.Remove(tag)
 }
 
+// HasInbound reports whether the running core holds the inbound of tag, with its listeners
+func (c *Core) HasInbound(tag string) bool {
+	if !c.isRunning {
+		return false
+	}
+	_, loaded := inbound_manager.Get(tag)
+	return loaded
+}
+
 func (c *Core) AddOutbound(config []byte) error {
 	if !c.isRunning {
 		return common.NewError("sing-box is not running")
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"net"
+
+	"github.com/sagernet/sing/common/buf"
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/common/network"
+	"golang.org/x/time/rate"
+)
+
+// minLimitBurst lets a whole packet or buffer pass a limiter at once
+const minLimitBurst = 64 * 1024
+
+// userLimit shapes all connections of a user, each direction to its own rate
+type userLimit struct {
+	bytesPerSecond int64
+	read           *rate.Limiter
+	write          *rate.Limiter
+}
+
+func newUserLimit(bytesPerSecond int64) *userLimit {
+	burst := int(bytesPerSecond)
+	if burst < minLimitBurst {
+		burst = minLimitBurst
+	}
+	return &userLimit{
+		bytesPerSecond: bytesPerSecond,
+		read:           rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+		write:          rate.NewLimiter(rate.Limit(bytesPerSecond), burst),
+	}
+}
+
+// SetUserLimits replaces the speed limits of users, in bytes per second.
+// Limits apply to connections routed afterwards.
+func (c *ConnTracker) SetUserLimits(limits map[string]int64) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	userLimits := make(map[string]*userLimit, len(limits))
+	for user, bytesPerSecond := range limits {
+		if bytesPerSecond <= 0 {
+			continue
+		}
+		// Keep limiters of unchanged users, with their current state
+		if limit, ok := c.limits[user]; ok && limit.bytesPerSecond == bytesPerSecond {
+			userLimits[user] = limit
+			continue
+		}
+		userLimits[user] = newUserLimit(bytesPerSecond)
+	}
+	c.limits = userLimits
+}
+
+func (c *ConnTracker) getLimit(user string) *userLimit {
+	if user == "" {
+		return nil
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.limits[user]
+}
+
+type limitedConn struct {
+	net.Conn
+	limit *userLimit
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(p) > c.limit.read.Burst() {
+		p = p[:c.limit.read.Burst()]
+	}
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.limit.read.WaitN(context.Background(), n)
+	}
+	return n, err
+}
+
+func (c *limitedConn) Write(p []byte) (int, error) {
+	var written int
+	burst := c.limit.write.Burst()
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+		c.limit.write.WaitN(context.Background(), len(chunk))
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+type limitedPacketConn struct {
+	network.PacketConn
+	limit *userLimit
+}
+
+func (c *limitedPacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	destination, err := c.PacketConn.ReadPacket(buffer)
+	if err == nil {
+		c.limit.read.WaitN(context.Background(), min(buffer.Len(), c.limit.read.Burst()))
+	}
+	return destination, err
+}
+
+func (c *limitedPacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	c.limit.write.WaitN(context.Background(), min(buffer.Len(), c.limit.write.Burst()))
+	return c.PacketConn.WritePacket(buffer, destination)
+}
@@ -62,6 +62,8 @@ func (c *Core) Start(sbConfig []byte) error {
 		return err
 	}
 
+	factory = c.instance.logFactory
+
 	err = c.instance.Start()
 	if err != nil {
 		return err
@@ -77,6 +79,27 @@ func (c *Core) Start(sbConfig []byte) error {
 	return nil
 }
 
+// Check parses the config and builds a box from it in an isolated context,
+// without starting any listener and without touching the running instance
+func (c *Core) Check(sbConfig []byte) error {
+	ctx := sb.Context(context.Background(), inboundRegistry(), outboundRegistry(), EndpointRegistry())
+	var opt option.Options
+	err := opt.UnmarshalJSONContext(ctx, sbConfig)
+	if err != nil {
+		return err
+	}
+	opt.Log = &option.LogOptions{Disabled: true}
+
+	instance, err := NewBox(Options{
+		Context: ctx,
+		Options: opt,
+	})
+	if err != nil {
+		return err
+	}
+	return instance.Close()
+}
+
 func (c *Core) Stop() error {
 	if c.isRunning {
 		c.isRunning = false
@@ -88,3 +111,11 @@ func (c *Core) Stop() error {
 func (c *Core) IsRunning() bool {
 	return c.isRunning
 }
+
+// SetUserLimits sets speed limits of users in bytes per second, which also survive restarts of the core
+func (c *Core) SetUserLimits(limits map[string]int64) {
+	if connTracker == nil {
+		connTracker = NewConnTracker()
+	}
+	connTracker.SetUserLimits(limits)
+}
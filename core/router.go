@@ -0,0 +1,174 @@
+package core
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+
+	"github.com/sagernet/sing-box/adapter"
+	"github.com/sagernet/sing-box/common/geoip"
+	"github.com/sagernet/sing-box/option"
+	"github.com/sagernet/sing-box/route"
+	"github.com/sagernet/sing-dns"
+	sbCommon "github.com/sagernet/sing/common"
+	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/service"
+
+	mdns "github.com/miekg/dns"
+)
+
+var _ adapter.Router = (*reloadableRouter)(nil)
+
+// reloadableRouter is handed to inbounds, outbounds and endpoints instead of the router itself,
+// so route rules, rule-sets and dns can be replaced without recreating them
+type reloadableRouter struct {
+	current atomic.Pointer[route.Router]
+}
+
+func newReloadableRouter(router *route.Router) *reloadableRouter {
+	r := &reloadableRouter{}
+	r.current.Store(router)
+	return r
+}
+
+func (r *reloadableRouter) router() *route.Router {
+	return r.current.Load()
+}
+
+func (r *reloadableRouter) Start(stage adapter.StartStage) error {
+	return r.router().Start(stage)
+}
+
+func (r *reloadableRouter) Close() error {
+	return r.router().Close()
+}
+
+func (r *reloadableRouter) FakeIPStore() adapter.FakeIPStore {
+	return r.router().FakeIPStore()
+}
+
+func (r *reloadableRouter) RouteConnection(ctx context.Context, conn net.Conn, metadata adapter.InboundContext) error {
+	return r.router().RouteConnection(ctx, conn, metadata)
+}
+
+func (r *reloadableRouter) RoutePacketConnection(ctx context.Context, conn N.PacketConn, metadata adapter.InboundContext) error {
+	return r.router().RoutePacketConnection(ctx, conn, metadata)
+}
+
+func (r *reloadableRouter) PreMatch(metadata adapter.InboundContext) error {
+	return r.router().PreMatch(metadata)
+}
+
+func (r *reloadableRouter) RouteConnectionEx(ctx context.Context, conn net.Conn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	r.router().RouteConnectionEx(ctx, conn, metadata, onClose)
+}
+
+func (r *reloadableRouter) RoutePacketConnectionEx(ctx context.Context, conn N.PacketConn, metadata adapter.InboundContext, onClose N.CloseHandlerFunc) {
+	r.router().RoutePacketConnectionEx(ctx, conn, metadata, onClose)
+}
+
+func (r *reloadableRouter) GeoIPReader() *geoip.Reader {
+	return r.router().GeoIPReader()
+}
+
+func (r *reloadableRouter) LoadGeosite(code string) (adapter.Rule, error) {
+	return r.router().LoadGeosite(code)
+}
+
+func (r *reloadableRouter) RuleSet(tag string) (adapter.RuleSet, bool) {
+	return r.router().RuleSet(tag)
+}
+
+func (r *reloadableRouter) NeedWIFIState() bool {
+	return r.router().NeedWIFIState()
+}
+
+func (r *reloadableRouter) Exchange(ctx context.Context, message *mdns.Msg) (*mdns.Msg, error) {
+	return r.router().Exchange(ctx, message)
+}
+
+func (r *reloadableRouter) Lookup(ctx context.Context, domain string, strategy dns.DomainStrategy) ([]netip.Addr, error) {
+	return r.router().Lookup(ctx, domain, strategy)
+}
+
+func (r *reloadableRouter) LookupDefault(ctx context.Context, domain string) ([]netip.Addr, error) {
+	return r.router().LookupDefault(ctx, domain)
+}
+
+func (r *reloadableRouter) ClearDNSCache() {
+	r.router().ClearDNSCache()
+}
+
+func (r *reloadableRouter) Rules() []adapter.Rule {
+	return r.router().Rules()
+}
+
+func (r *reloadableRouter) SetTracker(tracker adapter.ConnectionTracker) {
+	r.router().SetTracker(tracker)
+}
+
+func (r *reloadableRouter) ResetNetwork() {
+	r.router().ResetNetwork()
+}
+
+// ReloadRouter builds and starts a router with new route and dns options, then swaps it with the running one.
+// The running router is kept if the new one fails.
+func (s *Box) ReloadRouter(routeOptions option.RouteOptions, dnsOptions option.DNSOptions) error {
+	s.routerAccess.Lock()
+	defer s.routerAccess.Unlock()
+	newRouter, err := route.NewRouter(s.ctx, s.logFactory, routeOptions, dnsOptions)
+	// The new router registers itself, but others should keep using the reloadable one
+	service.MustRegister[adapter.Router](s.ctx, s.router)
+	if err != nil {
+		return err
+	}
+	newRouter.SetTracker(s.connTracker)
+	for _, stage := range adapter.ListStartStages {
+		err = newRouter.Start(stage)
+		if err != nil {
+			newRouter.Close()
+			return err
+		}
+	}
+	oldRouter := s.router.current.Swap(newRouter)
+	s.routeOptions = routeOptions
+	s.dnsOptions = dnsOptions
+	return oldRouter.Close()
+}
+
+// newResolver builds a router with the options of the running one, but without dns cache,
+// so its queries neither read nor fill the cache of real traffic. It only resolves, and is closed after use.
+func (s *Box) newResolver() (*route.Router, error) {
+	s.routerAccess.Lock()
+	defer s.routerAccess.Unlock()
+	dnsOptions := s.dnsOptions
+	dnsOptions.DNSClientOptions.DisableCache = true
+	resolver, err := route.NewRouter(s.ctx, s.logFactory, s.routeOptions, dnsOptions)
+	service.MustRegister[adapter.Router](s.ctx, s.router)
+	if err != nil {
+		return nil, err
+	}
+	// Dns transports, rules and rule-sets start until StartStateStart, route rules and updates of rule-sets after it
+	for _, stage := range []adapter.StartStage{adapter.StartStateInitialize, adapter.StartStateStart} {
+		err = resolver.Start(stage)
+		if err != nil {
+			resolver.Close()
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// ReloadRouter applies route and dns sections of a config to the running core
+func (c *Core) ReloadRouter(sbConfig []byte) error {
+	if !c.isRunning {
+		return nil
+	}
+	var opt option.Options
+	err := opt.UnmarshalJSONContext(globalCtx, sbConfig)
+	if err != nil {
+		return err
+	}
+	return c.instance.ReloadRouter(sbCommon.PtrValueOrDefault(opt.Route), sbCommon.PtrValueOrDefault(opt.DNS))
+}
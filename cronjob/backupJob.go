@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type BackupJob struct {
+	service.BackupService
+}
+
+func NewBackupJob() *BackupJob {
+	return &BackupJob{}
+}
+
+func (s *BackupJob) Run() {
+	err := s.BackupService.RunScheduled()
+	if err != nil {
+		logger.Warning("Scheduled backup failed: ", err)
+	}
+}
@@ -1,17 +0,0 @@
-package cronjob
-
-import (
-	"s-ui/service"
-)
-
-type CheckCoreJob struct {
-	service.ConfigService
-}
-
-func NewCheckCoreJob() *CheckCoreJob {
-	return &CheckCoreJob{}
-}
-
-func (s *CheckCoreJob) Run() {
-	s.ConfigService.StartCore("")
-}
@@ -14,7 +14,7 @@ func NewCronJob() *CronJob {
 	return &CronJob{}
 }
 
-func (c *CronJob) Start(loc *time.Location, trafficAge int) error {
+func (c *CronJob) Start(loc *time.Location, trafficAge int, changesAge int) error {
 	c.cron = cron.New(cron.WithLocation(loc), cron.WithSeconds())
 	c.cron.Start()
 
@@ -23,10 +23,27 @@ func (c *CronJob) Start(loc *time.Location, trafficAge int) error {
 		c.cron.AddJob("@every 10s", NewStatsJob())
 		// Start expiry job
 		c.cron.AddJob("@every 1m", NewDepleteJob())
+		// Warn about clients near their volume or expiry
+		c.cron.AddJob("@every 5m", NewNotifyJob())
+		// Reset traffic of clients at the start of the period of their plan
+		c.cron.AddJob("@daily", NewResetPlansJob())
 		// Start deleting old stats
 		c.cron.AddJob("@daily", NewDelStatsJob(trafficAge))
-		// Start core if it is not running
-		c.cron.AddJob("@every 5s", NewCheckCoreJob())
+		// Start deleting old changes
+		c.cron.AddJob("@daily", NewDelChangesJob(changesAge))
+		// Update local copies of remote rule sets
+		c.cron.AddJob("@every 1h", NewUpdateRuleSetsJob())
+		// Start core if it is down, and restart it if it is unhealthy
+		c.cron.AddJob("@every 5s", NewSuperviseCoreJob())
+		// Take changed certificate files, and warn about certificates near their expiry
+		c.cron.AddJob("@every 10s", NewReloadCertsJob())
+		c.cron.AddJob("@every 1h", NewNotifyCertsJob())
+		// Replace keys of tls profiles by their rotation policies
+		c.cron.AddJob("@every 10m", NewRotateTlsJob())
+		// Renew certificates of the internal CA
+		c.cron.AddJob("@every 1h", NewRenewCaJob())
+		// Back up the database when the backup interval has passed
+		c.cron.AddJob("@every 10m", NewBackupJob())
 	}()
 
 	return nil
@@ -0,0 +1,26 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type DelChangesJob struct {
+	service.ConfigService
+	changesAge int
+}
+
+func NewDelChangesJob(ca int) *DelChangesJob {
+	return &DelChangesJob{
+		changesAge: ca,
+	}
+}
+
+func (s *DelChangesJob) Run() {
+	err := s.ConfigService.DelOldChanges(s.changesAge)
+	if err != nil {
+		logger.Warning("Deleting old changes failed: ", err)
+		return
+	}
+	logger.Debug("Changes older than ", s.changesAge, " days were deleted")
+}
@@ -6,7 +6,7 @@ import (
 )
 
 type DepleteJob struct {
-	service.ClientService
+	service.ConfigService
 }
 
 func NewDepleteJob() *DepleteJob {
@@ -14,7 +14,7 @@ func NewDepleteJob() *DepleteJob {
 }
 
 func (s *DepleteJob) Run() {
-	err := s.ClientService.DepleteClients()
+	err := s.ConfigService.DepleteClients()
 	if err != nil {
 		logger.Warning("Disable depleted users failed: ", err)
 		return
@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type NotifyCertsJob struct {
+	service.CertService
+}
+
+func NewNotifyCertsJob() *NotifyCertsJob {
+	return new(NotifyCertsJob)
+}
+
+func (s *NotifyCertsJob) Run() {
+	err := s.CertService.NotifyCerts()
+	if err != nil {
+		logger.Warning("Notify certificates failed: ", err)
+	}
+}
@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type NotifyJob struct {
+	service.NotifyService
+}
+
+func NewNotifyJob() *NotifyJob {
+	return new(NotifyJob)
+}
+
+func (s *NotifyJob) Run() {
+	err := s.NotifyService.NotifyClients()
+	if err != nil {
+		logger.Warning("Notify clients failed: ", err)
+	}
+}
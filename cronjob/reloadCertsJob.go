@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type ReloadCertsJob struct {
+	service.CertService
+}
+
+func NewReloadCertsJob() *ReloadCertsJob {
+	return new(ReloadCertsJob)
+}
+
+func (s *ReloadCertsJob) Run() {
+	err := s.CertService.ReloadCerts()
+	if err != nil {
+		logger.Warning("Reload certificates failed: ", err)
+	}
+}
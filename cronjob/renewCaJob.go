@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type RenewCaJob struct {
+	service.CaService
+}
+
+func NewRenewCaJob() *RenewCaJob {
+	return new(RenewCaJob)
+}
+
+func (s *RenewCaJob) Run() {
+	err := s.CaService.RenewCaCerts()
+	if err != nil {
+		logger.Warning("Renew certificates of CA failed: ", err)
+	}
+}
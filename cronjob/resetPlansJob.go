@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type ResetPlansJob struct {
+	service.PlanService
+}
+
+func NewResetPlansJob() *ResetPlansJob {
+	return new(ResetPlansJob)
+}
+
+func (s *ResetPlansJob) Run() {
+	err := s.PlanService.ResetPlanTraffic()
+	if err != nil {
+		logger.Warning("Reset traffic of plans failed: ", err)
+	}
+}
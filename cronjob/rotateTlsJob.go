@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type RotateTlsJob struct {
+	service.ConfigService
+}
+
+func NewRotateTlsJob() *RotateTlsJob {
+	return new(RotateTlsJob)
+}
+
+func (s *RotateTlsJob) Run() {
+	err := s.ConfigService.RotateTlsKeys()
+	if err != nil {
+		logger.Warning("Rotate tls keys failed: ", err)
+	}
+}
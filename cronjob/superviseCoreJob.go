@@ -0,0 +1,17 @@
+package cronjob
+
+import (
+	"s-ui/service"
+)
+
+type SuperviseCoreJob struct {
+	service.ConfigService
+}
+
+func NewSuperviseCoreJob() *SuperviseCoreJob {
+	return &SuperviseCoreJob{}
+}
+
+func (s *SuperviseCoreJob) Run() {
+	s.ConfigService.SuperviseCore()
+}
@@ -0,0 +1,21 @@
+package cronjob
+
+import (
+	"s-ui/logger"
+	"s-ui/service"
+)
+
+type UpdateRuleSetsJob struct {
+	service.ConfigService
+}
+
+func NewUpdateRuleSetsJob() *UpdateRuleSetsJob {
+	return &UpdateRuleSetsJob{}
+}
+
+func (s *UpdateRuleSetsJob) Run() {
+	err := s.ConfigService.UpdateRuleSets("", false)
+	if err != nil {
+		logger.Warning("Updating rule sets failed: ", err)
+	}
+}
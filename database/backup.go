@@ -4,12 +4,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"os"
 	"path/filepath"
 	"s-ui/cmd/migration"
 	"s-ui/config"
-	"s-ui/database/model"
 	"s-ui/logger"
 	"s-ui/util/common"
 	"strings"
@@ -20,16 +18,8 @@ import (
 	"gorm.io/gorm"
 )
 
+// GetDb returns a sqlite copy of the database, without tables listed in exclude
 func GetDb(exclude string) ([]byte, error) {
-	exclude_changes, exclude_stats := false, false
-	for _, table := range strings.Split(exclude, ",") {
-		if table == "changes" {
-			exclude_changes = true
-		} else if table == "stats" {
-			exclude_stats = true
-		}
-	}
-
 	dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
 		return nil, err
@@ -42,101 +32,13 @@ func GetDb(exclude string) ([]byte, error) {
 	}
 	defer os.Remove(dbPath)
 
-	err = backupDb.AutoMigrate(
-		&model.Setting{},
-		&model.Tls{},
-		&model.Inbound{},
-		&model.Outbound{},
-		&model.Endpoint{},
-		&model.User{},
-		&model.Stats{},
-		&model.Client{},
-		&model.Changes{},
-	)
+	err = backupDb.AutoMigrate(models...)
 	if err != nil {
 		return nil, err
 	}
-
-	var settings []model.Setting
-	var tls []model.Tls
-	var inbound []model.Inbound
-	var outbound []model.Outbound
-	var endpoint []model.Endpoint
-	var users []model.User
-	var clients []model.Client
-	var stats []model.Stats
-	var changes []model.Changes
-
-	// Perform scans and handle errors
-	if err := db.Model(&model.Setting{}).Scan(&settings).Error; err != nil {
-		return nil, err
-	} else if len(settings) > 0 {
-		if err := backupDb.Save(settings).Error; err != nil {
-			return nil, err
-		}
-	}
-	if err := db.Model(&model.Tls{}).Scan(&tls).Error; err != nil {
-		return nil, err
-	} else if len(tls) > 0 {
-		if err := backupDb.Save(tls).Error; err != nil {
-			return nil, err
-		}
-	}
-	if err := db.Model(&model.Inbound{}).Scan(&inbound).Error; err != nil {
-		return nil, err
-	} else if len(inbound) > 0 {
-		if err := backupDb.Save(inbound).Error; err != nil {
-			return nil, err
-		}
-	}
-	if err := db.Model(&model.Outbound{}).Scan(&outbound).Error; err != nil {
-		return nil, err
-	} else if len(outbound) > 0 {
-		if err := backupDb.Save(outbound).Error; err != nil {
-			return nil, err
-		}
-	}
-	if err := db.Model(&model.Endpoint{}).Scan(&endpoint).Error; err != nil {
-		return nil, err
-	} else if len(endpoint) > 0 {
-		if err := backupDb.Save(endpoint).Error; err != nil {
-			return nil, err
-		}
-	}
-	if err := db.Model(&model.User{}).Scan(&users).Error; err != nil {
-		return nil, err
-	} else if len(users) > 0 {
-		if err := backupDb.Save(users).Error; err != nil {
-			return nil, err
-		}
-	}
-	if err := db.Model(&model.Client{}).Scan(&clients).Error; err != nil {
+	err = copyTables(db, backupDb, strings.Split(exclude, ",")...)
+	if err != nil {
 		return nil, err
-	} else if len(clients) > 0 {
-		if err := backupDb.Save(clients).Error; err != nil {
-			return nil, err
-		}
-	}
-
-	if !exclude_stats {
-		if err := db.Model(&model.Stats{}).Scan(&stats).Error; err != nil {
-			return nil, err
-		}
-		if len(stats) > 0 {
-			if err := backupDb.Save(stats).Error; err != nil {
-				return nil, err
-			}
-		}
-	}
-	if !exclude_changes {
-		if err := db.Model(&model.Changes{}).Scan(&changes).Error; err != nil {
-			return nil, err
-		}
-		if len(changes) > 0 {
-			if err := backupDb.Save(changes).Error; err != nil {
-				return nil, err
-			}
-		}
 	}
 
 	// Update WAL
@@ -164,7 +66,7 @@ func GetDb(exclude string) ([]byte, error) {
 	return fileContents, nil
 }
 
-func ImportDB(file multipart.File) error {
+func ImportDB(file io.ReadSeeker) error {
 	// Check if the file is a SQLite database
 	isValidDb, err := IsSQLiteDB(file)
 	if err != nil {
@@ -200,6 +102,23 @@ func ImportDB(file multipart.File) error {
 	// Remove temp file before returning
 	defer os.Remove(tempPath)
 
+	// External databases are replaced by the content of the uploaded file
+	if !IsSQLite() {
+		_, err = io.Copy(tempFile, file)
+		if err != nil {
+			return common.NewErrorf("Error saving db: %v", err)
+		}
+		err = importToBackend(tempPath)
+		if err != nil {
+			return err
+		}
+		err = SendSighup()
+		if err != nil {
+			return common.NewErrorf("Error restarting app: %v", err)
+		}
+		return nil
+	}
+
 	// Close old DB
 	old_db, _ := db.DB()
 	old_db.Close()
@@ -248,7 +167,6 @@ func ImportDB(file multipart.File) error {
 	}
 
 	// Migrate DB
-	migration.MigrateDb()
 	err = InitDB(config.GetDBPath())
 	if err != nil {
 		errRename := os.Rename(fallbackPath, config.GetDBPath())
@@ -267,6 +185,54 @@ func ImportDB(file multipart.File) error {
 	return nil
 }
 
+// importToBackend migrates an uploaded sqlite file, and copies it into the external database
+func importToBackend(sqlitePath string) error {
+	importDb, err := Open(SQLite, sqlitePath)
+	if err != nil {
+		return common.NewErrorf("Error checking db: %v", err)
+	}
+	defer func() {
+		importDb_db, _ := importDb.DB()
+		importDb_db.Close()
+	}()
+	err = migration.Up(importDb)
+	if err != nil {
+		return common.NewErrorf("Error migrating db: %v", err)
+	}
+	err = replaceDB(importDb, db)
+	if err != nil {
+		return common.NewErrorf("Error importing db: %v", err)
+	}
+	return nil
+}
+
+// backupBeforeMigration keeps a copy of the database in the backups folder before its schema changes
+func backupBeforeMigration(version uint) (string, error) {
+	dir := config.GetDBFolderPath() + "/backups"
+	err := os.MkdirAll(dir, 01740)
+	if err != nil {
+		return "", err
+	}
+	backupPath := fmt.Sprintf("%s/%s_before_migration_%d_%s.db", dir, config.GetName(), version, time.Now().Format("20060102-150405"))
+	if IsSQLite() {
+		return backupPath, db.Exec("VACUUM INTO ?", backupPath).Error
+	}
+
+	backupDb, err := Open(SQLite, backupPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		backupDb_db, _ := backupDb.DB()
+		backupDb_db.Close()
+	}()
+	err = backupDb.AutoMigrate(models...)
+	if err != nil {
+		return "", err
+	}
+	return backupPath, copyTables(db, backupDb)
+}
+
 func IsSQLiteDB(file io.Reader) (bool, error) {
 	signature := []byte("SQLite format 3\x00")
 	buf := make([]byte, len(signature))
@@ -0,0 +1,101 @@
+package database
+
+import (
+	"reflect"
+	"s-ui/util/common"
+	"slices"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+const copyBatchSize = 500
+
+// CopyDB copies all tables of src into the empty database dst, keeping ids
+func CopyDB(src *gorm.DB, dst *gorm.DB) error {
+	err := dst.AutoMigrate(models...)
+	if err != nil {
+		return err
+	}
+	for _, dbModel := range models {
+		var count int64
+		err = dst.Model(dbModel).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			stmt := &gorm.Statement{DB: dst}
+			stmt.Parse(dbModel)
+			return common.NewErrorf("target database is not empty, table %s has %d rows", stmt.Table, count)
+		}
+	}
+	return dst.Transaction(func(tx *gorm.DB) error {
+		return copyTables(src, tx)
+	})
+}
+
+// replaceDB replaces all tables of dst by tables of src
+func replaceDB(src *gorm.DB, dst *gorm.DB) error {
+	err := dst.AutoMigrate(models...)
+	if err != nil {
+		return err
+	}
+	return dst.Transaction(func(tx *gorm.DB) error {
+		for _, dbModel := range models {
+			err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(dbModel).Error
+			if err != nil {
+				return err
+			}
+		}
+		return copyTables(src, tx)
+	})
+}
+
+// copyTables copies rows of all tables of src into tx, except tables listed in exclude
+func copyTables(src *gorm.DB, tx *gorm.DB, exclude ...string) error {
+	for _, dbModel := range models {
+		stmt := &gorm.Statement{DB: src}
+		err := stmt.Parse(dbModel)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(exclude, stmt.Table) || !src.Migrator().HasTable(dbModel) {
+			continue
+		}
+		// Batches are ordered by the primary key, which is not id in every table
+		var orderBy []string
+		for _, field := range stmt.Schema.PrimaryFields {
+			orderBy = append(orderBy, stmt.Quote(field.DBName))
+		}
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(dbModel).Elem()))
+		result := src.Model(dbModel).Order(strings.Join(orderBy, ",")).FindInBatches(rows.Interface(), copyBatchSize, func(batch *gorm.DB, _ int) error {
+			return tx.Create(rows.Interface()).Error
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		err = resetSequence(tx, dbModel)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resetSequence moves the id sequence of a postgres table past the copied ids.
+// Other backends continue auto increments from the largest id by themselves.
+func resetSequence(tx *gorm.DB, dbModel interface{}) error {
+	if tx.Dialector.Name() != Postgres {
+		return nil
+	}
+	stmt := &gorm.Statement{DB: tx}
+	err := stmt.Parse(dbModel)
+	if err != nil {
+		return err
+	}
+	// Tables with other keys have no sequence
+	if field := stmt.Schema.LookUpField("id"); field == nil || !field.AutoIncrement {
+		return nil
+	}
+	return tx.Exec("SELECT setval(pg_get_serial_sequence(?, 'id'), COALESCE((SELECT MAX(id) FROM "+stmt.Quote(stmt.Table)+"), 0) + 1, false)", stmt.Table).Error
+}
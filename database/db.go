@@ -1,19 +1,46 @@
 package database
 
 import (
-	"encoding/json"
 	"os"
 	"path"
+	"s-ui/cmd/migration"
 	"s-ui/config"
 	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
 
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
+	gormLogger "gorm.io/gorm/logger"
 )
 
 var db *gorm.DB
 
+// Models of all tables, in the order they are created and copied
+var models = []interface{}{
+	&model.Setting{},
+	&model.Tls{},
+	&model.Inbound{},
+	&model.Outbound{},
+	&model.Endpoint{},
+	&model.User{},
+	&model.Tokens{},
+	&model.Stats{},
+	&model.Client{},
+	&model.Changes{},
+	&model.RouteRule{},
+	&model.RuleSet{},
+	&model.DnsServer{},
+	&model.DnsRule{},
+	&model.Snapshot{},
+	&model.Plan{},
+	&model.ClientNotice{},
+	&model.AcmeCert{},
+	&model.AcmeFile{},
+	&model.CertNotice{},
+	&model.TlsRotation{},
+	&model.CaCert{},
+}
+
 func initUser() error {
 	var count int64
 	err := db.Model(&model.User{}).Count(&count).Error
@@ -30,30 +57,50 @@ func initUser() error {
 	return nil
 }
 
+// OpenDB opens the backend selected by SUI_DB_TYPE. dbPath is only used by sqlite.
 func OpenDB(dbPath string) error {
-	dir := path.Dir(dbPath)
-	err := os.MkdirAll(dir, 01740)
+	var err error
+	dbType, dsn := config.GetDBType(), config.GetDBDsn()
+	if dbType == SQLite {
+		dsn = dbPath
+		err = os.MkdirAll(path.Dir(dbPath), 01740)
+		if err != nil {
+			return err
+		}
+	}
+	db, err = Open(dbType, dsn)
+	return err
+}
+
+// Open opens a database of the given backend
+func Open(dbType string, dsn string) (*gorm.DB, error) {
+	dialector, err := Dialector(dbType, dsn)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var gormLogger logger.Interface
+	var dbLogger gormLogger.Interface
 
 	if config.IsDebug() {
-		gormLogger = logger.Default
+		dbLogger = gormLogger.Default
 	} else {
-		gormLogger = logger.Discard
+		dbLogger = gormLogger.Discard
 	}
 
 	c := &gorm.Config{
-		Logger: gormLogger,
+		Logger: dbLogger,
+		// tls_id 0 of inbounds means no tls. sqlite does not enforce foreign keys, other backends would refuse it.
+		DisableForeignKeyConstraintWhenMigrating: dbType != SQLite,
+	}
+	gormDb, err := gorm.Open(dialector, c)
+	if err != nil {
+		return nil, err
 	}
-	db, err = gorm.Open(sqlite.Open(dbPath), c)
 
 	if config.IsDebug() {
-		db = db.Debug()
+		gormDb = gormDb.Debug()
 	}
-	return err
+	return gormDb, nil
 }
 
 func InitDB(dbPath string) error {
@@ -62,30 +109,25 @@ func InitDB(dbPath string) error {
 		return err
 	}
 
-	// Default Outbounds
-	if !db.Migrator().HasTable(&model.Outbound{}) {
-		db.Migrator().CreateTable(&model.Outbound{})
-		defaultOutbound := []model.Outbound{
-			{Type: "direct", Tag: "direct", Options: json.RawMessage(`{}`)},
-		}
-		db.Create(&defaultOutbound)
-	}
-
-	err = db.AutoMigrate(
-		&model.Setting{},
-		&model.Tls{},
-		&model.Inbound{},
-		&model.Outbound{},
-		&model.Endpoint{},
-		&model.User{},
-		&model.Tokens{},
-		&model.Stats{},
-		&model.Client{},
-		&model.Changes{},
-	)
+	pending, err := migration.Pending(db)
 	if err != nil {
 		return err
 	}
+	if len(pending) > 0 {
+		// A new database has nothing to back up
+		if db.Migrator().HasTable(&model.Setting{}) {
+			backupPath, err := backupBeforeMigration(pending[0].Version)
+			if err != nil {
+				return common.NewErrorf("backup before migration failed: %v", err)
+			}
+			logger.Infof("Database is backed up to %s before migration", backupPath)
+		}
+		err = migration.Up(db)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = initUser()
 	if err != nil {
 		return err
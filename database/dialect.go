@@ -0,0 +1,86 @@
+package database
+
+import (
+	"fmt"
+	"s-ui/util/common"
+	"strings"
+
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+	MySQL    = "mysql"
+)
+
+// Dialector returns the gorm dialector of a backend. For sqlite, dsn is the path of the database file.
+func Dialector(dbType string, dsn string) (gorm.Dialector, error) {
+	switch dbType {
+	case SQLite:
+		return sqlite.Open(dsn), nil
+	case Postgres:
+		if dsn == "" {
+			return nil, common.NewError("postgres needs a dsn")
+		}
+		return postgres.Open(dsn), nil
+	case MySQL:
+		if dsn == "" {
+			return nil, common.NewError("mysql needs a dsn")
+		}
+		return mysql.Open(dsn), nil
+	default:
+		return nil, common.NewErrorf("unknown database type: %s", dbType)
+	}
+}
+
+func dialect() string {
+	if db == nil {
+		return SQLite
+	}
+	return db.Dialector.Name()
+}
+
+// IsSQLite reports whether the database is a local sqlite file
+func IsSQLite() bool {
+	return dialect() == SQLite
+}
+
+// JsonExtract returns an sql expression of the value at key of a json column.
+// Strings are unquoted, objects and arrays are returned as json text.
+// key is a dot separated path, and must be a literal, not user input.
+func JsonExtract(column string, key string) string {
+	key = strings.ReplaceAll(key, "'", "")
+	switch dialect() {
+	case Postgres:
+		return fmt.Sprintf("(convert_from(%s, 'UTF8')::jsonb #>> '{%s}')", column, strings.ReplaceAll(key, ".", ","))
+	case MySQL:
+		return fmt.Sprintf("JSON_UNQUOTE(JSON_EXTRACT(CAST(%s AS CHAR), '$.%s'))", column, key)
+	default:
+		return fmt.Sprintf("json_extract(%s, '$.%s')", column, key)
+	}
+}
+
+// JsonArrayContains returns an sql condition, true when the json array in column contains
+// the integer given as its only argument
+func JsonArrayContains(column string) string {
+	switch dialect() {
+	case Postgres:
+		return fmt.Sprintf("convert_from(%s, 'UTF8')::jsonb @> jsonb_build_array(?::bigint)", column)
+	case MySQL:
+		return fmt.Sprintf("JSON_CONTAINS(CAST(%s AS CHAR), CAST(? AS CHAR))", column)
+	default:
+		return fmt.Sprintf("EXISTS (SELECT 1 FROM json_each(%s) WHERE json_each.value = ?)", column)
+	}
+}
+
+// QuoteColumn quotes a column name, for columns named like reserved words
+func QuoteColumn(column string) string {
+	if dialect() == MySQL {
+		return "`" + column + "`"
+	}
+	return "\"" + column + "\""
+}
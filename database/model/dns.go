@@ -0,0 +1,70 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type DnsServer struct {
+	Id      uint            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Type    string          `json:"type" form:"type"`
+	Tag     string          `json:"tag" form:"tag" gorm:"unique"`
+	Options json.RawMessage `json:"-" form:"-"`
+}
+
+type DnsRule struct {
+	Id       uint            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Priority int             `json:"priority" form:"priority"`
+	Enable   bool            `json:"enable" form:"enable"`
+	Rule     json.RawMessage `json:"rule" form:"rule"`
+}
+
+func (d *DnsServer) UnmarshalJSON(data []byte) error {
+	var err error
+	var raw map[string]interface{}
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to unmarshal dns server data: %w", err)
+	}
+
+	// Extract fixed fields and store the rest in Options
+	if val, exists := raw["id"].(float64); exists {
+		d.Id = uint(val)
+	}
+	delete(raw, "id")
+	d.Type, _ = raw["type"].(string)
+	delete(raw, "type")
+	d.Tag, _ = raw["tag"].(string)
+	delete(raw, "tag")
+
+	// Remaining fields
+	if len(raw) > 0 {
+		d.Options, err = json.MarshalIndent(raw, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal dns server options: %w", err)
+		}
+	} else {
+		d.Options = nil
+	}
+	return nil
+}
+
+// MarshalJSON customizes marshalling
+func (d DnsServer) MarshalJSON() ([]byte, error) {
+	// Combine fixed fields and dynamic fields into one map
+	combined := make(map[string]interface{})
+	combined["type"] = d.Type
+	combined["tag"] = d.Tag
+
+	if d.Options != nil {
+		var restFields map[string]json.RawMessage
+		if err := json.Unmarshal(d.Options, &restFields); err != nil {
+			return nil, err
+		}
+
+		for k, v := range restFields {
+			combined[k] = v
+		}
+	}
+
+	return json.Marshal(combined)
+}
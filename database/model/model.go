@@ -13,6 +13,60 @@ type Tls struct {
 	Name   string          `json:"name" form:"name"`
 	Server json.RawMessage `json:"server" form:"server"`
 	Client json.RawMessage `json:"client" form:"client"`
+	// Acme is the domain of a managed certificate, which replaces the certificate of Server
+	Acme string `json:"acme" form:"acme"`
+}
+
+// TlsRotation is a policy of a tls profile to replace its keys every some days, where zero days never replace them.
+// Old reality short ids and ECH keys are still accepted for Overlap hours, until OverlapUntil.
+// Reality has a single private key, so links with the old key stop working at once.
+type TlsRotation struct {
+	Id                 uint  `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	TlsId              uint  `json:"tlsId" form:"tlsId" gorm:"uniqueIndex"`
+	RealityKey         int   `json:"realityKey" form:"realityKey"`
+	RealityShortId     int   `json:"realityShortId" form:"realityShortId"`
+	Ech                int   `json:"ech" form:"ech"`
+	Overlap            int   `json:"overlap" form:"overlap"`
+	LastRealityKey     int64 `json:"lastRealityKey"`
+	LastRealityShortId int64 `json:"lastRealityShortId"`
+	LastEch            int64 `json:"lastEch"`
+	OverlapUntil       int64 `json:"overlapUntil"`
+}
+
+// CaCert is the root of the internal CA, or a leaf which it issues for Sans with a lifetime of Days.
+// Leaves are written to files for tls profiles and the panel, and renewed before they expire.
+type CaCert struct {
+	Id        uint            `json:"id" gorm:"primaryKey;autoIncrement"`
+	Name      string          `json:"name" gorm:"unique"`
+	Root      bool            `json:"root"`
+	Sans      json.RawMessage `json:"sans"`
+	Days      int             `json:"days"`
+	CertPem   string          `json:"certPem"`
+	KeyPem    string          `json:"-"`
+	NotAfter  int64           `json:"notAfter"`
+	UpdatedAt int64           `json:"updatedAt"`
+}
+
+// AcmeCert is a certificate of Domain which the panel obtains and renews from the ACME CA of settings.
+// Challenge is http, tls-alpn or dns, which uses DnsProvider with DnsOptions.
+// Issuer is the key of the CA which issued the current certificate.
+type AcmeCert struct {
+	Id          uint            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Domain      string          `json:"domain" form:"domain" gorm:"unique"`
+	Challenge   string          `json:"challenge" form:"challenge"`
+	DnsProvider string          `json:"dnsProvider" form:"dnsProvider"`
+	DnsOptions  json.RawMessage `json:"dnsOptions" form:"dnsOptions"`
+	Issuer      string          `json:"issuer" form:"issuer"`
+	NotAfter    int64           `json:"notAfter" form:"notAfter"`
+	LastError   string          `json:"lastError" form:"lastError"`
+	UpdatedAt   int64           `json:"updatedAt" form:"updatedAt"`
+}
+
+// AcmeFile is an entry of the ACME storage, like accounts, certificates and their keys
+type AcmeFile struct {
+	Key      string `gorm:"primaryKey"`
+	Value    []byte
+	Modified int64
 }
 
 type User struct {
@@ -35,6 +89,57 @@ type Client struct {
 	Up       int64           `json:"up" form:"up"`
 	Desc     string          `json:"desc" form:"desc"`
 	Group    string          `json:"group" form:"group"`
+	Dns      string          `json:"dns" form:"dns"`
+	PlanId   uint            `json:"planId" form:"planId"`
+	// Policy when the client runs out, which overrides the one of its plan
+	GraceDays    int64  `json:"graceDays" form:"graceDays"`
+	QuotaAction  string `json:"quotaAction" form:"quotaAction"`
+	ThrottleKbps int64  `json:"throttleKbps" form:"throttleKbps"`
+	// Limited is the quota action in effect, throttle or redirect
+	Limited string `json:"limited" form:"limited"`
+	// SubToken is the id of the client in links of subscriptions and the portal, replaced when the client rotates
+	SubToken string `json:"subToken" form:"subToken" gorm:"uniqueIndex"`
+	// SubByName lets the subscription be found by the name too, as before clients had tokens. A new token ends it.
+	SubByName bool `json:"-" form:"-"`
+}
+
+// ClientNotice records a warning sent to a client, so each threshold is notified once.
+// Kind is volume, with Threshold in percent, or expiry, with Threshold in days.
+type ClientNotice struct {
+	Id        uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	ClientId  uint   `json:"clientId" gorm:"index"`
+	Kind      string `json:"kind"`
+	Threshold int    `json:"threshold"`
+	DateTime  int64  `json:"dateTime"`
+}
+
+// CertNotice records a warning about a certificate, so each threshold in days is notified once.
+// Cert is the id of the certificate in the inventory, and a new NotAfter is notified again.
+type CertNotice struct {
+	Id        uint   `json:"id" gorm:"primaryKey;autoIncrement"`
+	Cert      string `json:"cert" gorm:"index"`
+	NotAfter  int64  `json:"notAfter"`
+	Threshold int    `json:"threshold"`
+	DateTime  int64  `json:"dateTime"`
+}
+
+// Plan is a template of clients. Duration is in days, and zero volume or duration is unlimited.
+// ResetPolicy is none, daily, weekly or monthly. SpeedLimit is in Mbps for each client of the plan.
+// Clients stay enabled GraceDays after expiry, and QuotaAction is disable, throttle or redirect
+// when their volume runs out.
+type Plan struct {
+	Id           uint            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Name         string          `json:"name" form:"name" gorm:"unique"`
+	Volume       int64           `json:"volume" form:"volume"`
+	Duration     int64           `json:"duration" form:"duration"`
+	ResetPolicy  string          `json:"resetPolicy" form:"resetPolicy"`
+	Inbounds     json.RawMessage `json:"inbounds" form:"inbounds"`
+	SpeedLimit   int64           `json:"speedLimit" form:"speedLimit"`
+	Group        string          `json:"group" form:"group"`
+	Desc         string          `json:"desc" form:"desc"`
+	GraceDays    int64           `json:"graceDays" form:"graceDays"`
+	QuotaAction  string          `json:"quotaAction" form:"quotaAction"`
+	ThrottleKbps int64           `json:"throttleKbps" form:"throttleKbps"`
 }
 
 type Stats struct {
@@ -53,6 +158,16 @@ type Changes struct {
 	Key      string          `json:"key"`
 	Action   string          `json:"action"`
 	Obj      json.RawMessage `json:"obj"`
+	Before   json.RawMessage `json:"before"`
+	After    json.RawMessage `json:"after"`
+}
+
+type Snapshot struct {
+	Id         uint            `json:"id" gorm:"primaryKey;autoIncrement"`
+	DateTime   int64           `json:"dateTime"`
+	ConfigHash string          `json:"configHash"`
+	Config     json.RawMessage `json:"config,omitempty"`
+	State      json.RawMessage `json:"state,omitempty"`
 }
 
 type Tokens struct {
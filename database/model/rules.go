@@ -0,0 +1,70 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+type RouteRule struct {
+	Id       uint            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Priority int             `json:"priority" form:"priority"`
+	Enable   bool            `json:"enable" form:"enable"`
+	Rule     json.RawMessage `json:"rule" form:"rule"`
+}
+
+type RuleSet struct {
+	Id      uint            `json:"id" form:"id" gorm:"primaryKey;autoIncrement"`
+	Type    string          `json:"type" form:"type"`
+	Tag     string          `json:"tag" form:"tag" gorm:"unique"`
+	Options json.RawMessage `json:"-" form:"-"`
+}
+
+func (r *RuleSet) UnmarshalJSON(data []byte) error {
+	var err error
+	var raw map[string]interface{}
+	if err = json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to unmarshal rule set data: %w", err)
+	}
+
+	// Extract fixed fields and store the rest in Options
+	if val, exists := raw["id"].(float64); exists {
+		r.Id = uint(val)
+	}
+	delete(raw, "id")
+	r.Type, _ = raw["type"].(string)
+	delete(raw, "type")
+	r.Tag, _ = raw["tag"].(string)
+	delete(raw, "tag")
+
+	// Remaining fields
+	if len(raw) > 0 {
+		r.Options, err = json.MarshalIndent(raw, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal rule set options: %w", err)
+		}
+	} else {
+		r.Options = nil
+	}
+	return nil
+}
+
+// MarshalJSON customizes marshalling
+func (r RuleSet) MarshalJSON() ([]byte, error) {
+	// Combine fixed fields and dynamic fields into one map
+	combined := make(map[string]interface{})
+	combined["type"] = r.Type
+	combined["tag"] = r.Tag
+
+	if r.Options != nil {
+		var restFields map[string]json.RawMessage
+		if err := json.Unmarshal(r.Options, &restFields); err != nil {
+			return nil, err
+		}
+
+		for k, v := range restFields {
+			combined[k] = v
+		}
+	}
+
+	return json.Marshal(combined)
+}
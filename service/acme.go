@@ -0,0 +1,517 @@
+package service
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/libdns/alidns"
+	"github.com/libdns/cloudflare"
+	"github.com/mholt/acmez"
+	sbtls "github.com/sagernet/sing-box/common/tls"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Challenges which prove control of a domain to the ACME CA
+const (
+	AcmeHttp    = "http"
+	AcmeTlsAlpn = "tls-alpn"
+	AcmeDns     = "dns"
+)
+
+// acmeDnsProviders build the provider of DNS-01 challenges from its options.
+// Another provider of libdns is supported by adding it here.
+var acmeDnsProviders = map[string]func(options json.RawMessage) (certmagic.ACMEDNSProvider, error){
+	"cloudflare": func(options json.RawMessage) (certmagic.ACMEDNSProvider, error) {
+		provider := &cloudflare.Provider{}
+		err := json.Unmarshal(options, provider)
+		if err != nil || provider.APIToken == "" {
+			return nil, common.NewError("cloudflare needs api_token")
+		}
+		return provider, nil
+	},
+	"alidns": func(options json.RawMessage) (certmagic.ACMEDNSProvider, error) {
+		provider := &alidns.Provider{}
+		err := json.Unmarshal(options, provider)
+		if err != nil || provider.AccKeyID == "" || provider.AccKeySecret == "" {
+			return nil, common.NewError("alidns needs access_key_id and access_key_secret")
+		}
+		return provider, nil
+	},
+}
+
+// acmeManager holds the certificates of the running panel. Each domain has its own config,
+// since challenges differ between domains.
+var acmeManager struct {
+	access  sync.Mutex
+	cache   *certmagic.Cache
+	configs sync.Map
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// acmePlaceholders are self-signed certificates which stand in until a domain gets its certificate
+var acmePlaceholders sync.Map
+
+type AcmeService struct {
+	InboundService
+}
+
+type acmeSettings struct {
+	email    string
+	ca       string
+	roots    *x509.CertPool
+	httpPort int
+	tlsPort  int
+}
+
+func (s *AcmeService) getSettings(db *gorm.DB) (*acmeSettings, error) {
+	settingService := SettingService{}
+	values := map[string]string{}
+	for _, key := range []string{"acmeEmail", "acmeCA", "acmeCARoot", "acmeHttpPort", "acmeTlsPort"} {
+		value, err := settingService.getString(db, key)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	settings := &acmeSettings{
+		email: values["acmeEmail"],
+		ca:    values["acmeCA"],
+	}
+	if settings.ca == "" {
+		settings.ca = certmagic.LetsEncryptProductionCA
+	}
+	if values["acmeCARoot"] != "" {
+		rootPem, err := os.ReadFile(values["acmeCARoot"])
+		if err != nil {
+			return nil, common.NewErrorf("failed to read root of ACME CA: %v", err)
+		}
+		settings.roots = x509.NewCertPool()
+		if !settings.roots.AppendCertsFromPEM(rootPem) {
+			return nil, common.NewError("no certificate in root of ACME CA")
+		}
+	}
+	settings.httpPort, _ = strconv.Atoi(values["acmeHttpPort"])
+	settings.tlsPort, _ = strconv.Atoi(values["acmeTlsPort"])
+	return settings, nil
+}
+
+func (s *AcmeService) GetAll() ([]model.AcmeCert, error) {
+	certs := []model.AcmeCert{}
+	err := database.GetDB().Model(model.AcmeCert{}).Order("id").Find(&certs).Error
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func (s *AcmeService) validate(cert *model.AcmeCert) error {
+	cert.Domain = strings.ToLower(strings.TrimSpace(cert.Domain))
+	if cert.Domain == "" {
+		return common.NewError("domain of certificate is empty")
+	}
+	switch cert.Challenge {
+	case "":
+		cert.Challenge = AcmeHttp
+	case AcmeHttp, AcmeTlsAlpn:
+	case AcmeDns:
+		newProvider, ok := acmeDnsProviders[cert.DnsProvider]
+		if !ok {
+			return common.NewErrorf("unknown dns provider: %s", cert.DnsProvider)
+		}
+		_, err := newProvider(cert.DnsOptions)
+		if err != nil {
+			return err
+		}
+	default:
+		return common.NewErrorf("unknown challenge: %s", cert.Challenge)
+	}
+	if strings.HasPrefix(cert.Domain, "*.") && cert.Challenge != AcmeDns {
+		return common.NewError("wildcard domains need the dns challenge")
+	}
+	return nil
+}
+
+// Save changes managed certificates. "renew" data is the domain, whose certificate is renewed now.
+// Certificates are obtained in the background, and inbounds using them restart when they are ready.
+func (s *AcmeService) Save(act string, data json.RawMessage, loginUser string) error {
+	var domain string
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		switch act {
+		case "new", "edit":
+			var cert model.AcmeCert
+			err := json.Unmarshal(data, &cert)
+			if err != nil {
+				return err
+			}
+			err = s.validate(&cert)
+			if err != nil {
+				return err
+			}
+			if act == "edit" {
+				var old model.AcmeCert
+				err = tx.Model(model.AcmeCert{}).Where("id = ?", cert.Id).First(&old).Error
+				if err != nil {
+					return err
+				}
+				if old.Domain != cert.Domain {
+					return common.NewError("domain of a certificate can not change")
+				}
+				cert.Issuer, cert.NotAfter = old.Issuer, old.NotAfter
+			}
+			cert.LastError = ""
+			err = tx.Save(&cert).Error
+			if err != nil {
+				return err
+			}
+			domain = cert.Domain
+		case "del", "renew":
+			err := json.Unmarshal(data, &domain)
+			if err != nil {
+				return err
+			}
+			if act == "del" {
+				err = s.checkUnused(tx, domain)
+				if err != nil {
+					return err
+				}
+				err = tx.Where("domain = ?", domain).Delete(model.AcmeCert{}).Error
+				if err != nil {
+					return err
+				}
+			}
+		default:
+			return common.NewErrorf("unknown action: %s", act)
+		}
+		return tx.Create(&model.Changes{
+			DateTime: time.Now().Unix(),
+			Actor:    loginUser,
+			Key:      "acme",
+			Action:   act,
+			Obj:      json.RawMessage(fmt.Sprintf("%q", domain)),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	switch act {
+	case "del":
+		s.unmanage(domain)
+	case "renew":
+		config, ok := acmeConfig(domain)
+		if !ok {
+			return common.NewErrorf("certificate of %s is not managed", domain)
+		}
+		go func() {
+			err := config.RenewCertSync(acmeManager.ctx, domain, true)
+			if err != nil {
+				logger.Warning("acme: failed to renew ", domain, ": ", err)
+			}
+		}()
+	default:
+		var cert model.AcmeCert
+		err = db.Model(model.AcmeCert{}).Where("domain = ?", domain).First(&cert).Error
+		if err != nil {
+			return err
+		}
+		s.unmanage(domain)
+		return s.manage(&cert)
+	}
+	return nil
+}
+
+// checkUnused fails if a tls profile or a panel server uses the certificate of domain
+func (s *AcmeService) checkUnused(tx *gorm.DB, domain string) error {
+	var count int64
+	err := tx.Model(model.Tls{}).Where("acme = ?", domain).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return common.NewErrorf("certificate of %s is used by tls", domain)
+	}
+	settingService := SettingService{}
+	for _, key := range []string{"webAcme", "subAcme"} {
+		value, err := settingService.getString(tx, key)
+		if err != nil {
+			return err
+		}
+		if value == domain {
+			return common.NewErrorf("certificate of %s is used by setting %s", domain, key)
+		}
+	}
+	return nil
+}
+
+// StartAcme manages all certificates, which are obtained and renewed in the background
+func (s *AcmeService) StartAcme() error {
+	acmeManager.access.Lock()
+	defer acmeManager.access.Unlock()
+	if acmeManager.cache != nil {
+		return nil
+	}
+	acmeManager.ctx, acmeManager.cancel = context.WithCancel(context.Background())
+	acmeManager.cache = certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(cert certmagic.Certificate) (*certmagic.Config, error) {
+			for _, name := range cert.Names {
+				if config, ok := acmeConfig(name); ok {
+					return config, nil
+				}
+			}
+			return nil, common.NewErrorf("certificate of %v is not managed", cert.Names)
+		},
+		Logger: zap.NewNop(),
+	})
+	certs, err := s.GetAll()
+	if err != nil {
+		return err
+	}
+	for i := range certs {
+		err = s.manageLocked(&certs[i])
+		if err != nil {
+			logger.Warning("acme: failed to manage ", certs[i].Domain, ": ", err)
+		}
+	}
+	return nil
+}
+
+func (s *AcmeService) StopAcme() {
+	acmeManager.access.Lock()
+	defer acmeManager.access.Unlock()
+	if acmeManager.cache == nil {
+		return
+	}
+	acmeManager.cancel()
+	acmeManager.cache.Stop()
+	acmeManager.cache = nil
+	acmeManager.configs.Range(func(key, _ any) bool {
+		acmeManager.configs.Delete(key)
+		return true
+	})
+}
+
+func acmeConfig(domain string) (*certmagic.Config, bool) {
+	config, ok := acmeManager.configs.Load(domain)
+	if !ok {
+		return nil, false
+	}
+	return config.(*certmagic.Config), true
+}
+
+func (s *AcmeService) manage(cert *model.AcmeCert) error {
+	acmeManager.access.Lock()
+	defer acmeManager.access.Unlock()
+	return s.manageLocked(cert)
+}
+
+func (s *AcmeService) manageLocked(cert *model.AcmeCert) error {
+	if acmeManager.cache == nil {
+		// Not running, like in the cli
+		return nil
+	}
+	settings, err := s.getSettings(database.GetDB())
+	if err != nil {
+		return err
+	}
+	config := certmagic.New(acmeManager.cache, certmagic.Config{
+		Storage: &acmeStorage{},
+		OnEvent: s.onEvent,
+		Logger:  zap.NewNop(),
+	})
+	issuer := certmagic.ACMEIssuer{
+		CA:                      settings.ca,
+		Email:                   settings.email,
+		Agreed:                  true,
+		DisableHTTPChallenge:    cert.Challenge != AcmeHttp,
+		DisableTLSALPNChallenge: cert.Challenge != AcmeTlsAlpn,
+		AltHTTPPort:             settings.httpPort,
+		AltTLSALPNPort:          settings.tlsPort,
+		TrustedRoots:            settings.roots,
+		Logger:                  zap.NewNop(),
+	}
+	if cert.Challenge == AcmeDns {
+		provider, err := acmeDnsProviders[cert.DnsProvider](cert.DnsOptions)
+		if err != nil {
+			return err
+		}
+		issuer.DNS01Solver = &certmagic.DNS01Solver{DNSProvider: provider}
+	}
+	config.Issuers = []certmagic.Issuer{certmagic.NewACMEIssuer(config, issuer)}
+	acmeManager.configs.Store(cert.Domain, config)
+	return config.ManageAsync(acmeManager.ctx, []string{cert.Domain})
+}
+
+func (s *AcmeService) unmanage(domain string) {
+	acmeManager.access.Lock()
+	defer acmeManager.access.Unlock()
+	acmeManager.configs.Delete(domain)
+	if acmeManager.cache != nil {
+		acmeManager.cache.RemoveManaged([]string{domain})
+	}
+}
+
+func (s *AcmeService) onEvent(ctx context.Context, event string, data map[string]any) error {
+	domain, _ := data["identifier"].(string)
+	switch event {
+	case "cert_obtained":
+		issuer, _ := data["issuer"].(string)
+		err := s.certObtained(domain, issuer)
+		if err != nil {
+			logger.Warning("acme: failed to apply certificate of ", domain, ": ", err)
+		}
+	case "cert_failed":
+		err, _ := data["error"].(error)
+		logger.Warning("acme: failed to obtain certificate of ", domain, ": ", err)
+		if err != nil {
+			database.GetDB().Model(model.AcmeCert{}).Where("domain = ?", domain).Update("last_error", err.Error())
+		}
+	}
+	return nil
+}
+
+// certObtained records a new certificate, and restarts inbounds which use it
+func (s *AcmeService) certObtained(domain string, issuer string) error {
+	db := database.GetDB()
+	certPem, _, err := loadAcmeCertificate(issuer, domain)
+	if err != nil {
+		return err
+	}
+	notAfter := int64(0)
+	if block, _ := pem.Decode(certPem); block != nil {
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			notAfter = leaf.NotAfter.Unix()
+		}
+	}
+	logger.Info("acme: obtained certificate of ", domain)
+	err = db.Model(model.AcmeCert{}).Where("domain = ?", domain).Updates(map[string]interface{}{
+		"issuer":     issuer,
+		"not_after":  notAfter,
+		"last_error": "",
+		"updated_at": time.Now().Unix(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	var inboundIds []uint
+	err = db.Model(model.Inbound{}).
+		Where("tls_id in (?)", db.Model(model.Tls{}).Select("id").Where("acme = ?", domain)).
+		Pluck("id", &inboundIds).Error
+	if err != nil {
+		return err
+	}
+	if len(inboundIds) == 0 {
+		return nil
+	}
+	LastUpdate = time.Now().Unix()
+	if !corePtr.IsRunning() {
+		return nil
+	}
+	return s.InboundService.RestartInbounds(db, inboundIds)
+}
+
+// loadAcmeCertificate reads the certificate chain and the private key of domain from the storage
+func loadAcmeCertificate(issuer string, domain string) ([]byte, []byte, error) {
+	storage := &acmeStorage{}
+	ctx := context.Background()
+	certPem, err := storage.Load(ctx, certmagic.StorageKeys.SiteCert(issuer, domain))
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPem, err := storage.Load(ctx, certmagic.StorageKeys.SitePrivateKey(issuer, domain))
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPem, keyPem, nil
+}
+
+// acmeServerTls is the server tls of a profile with the certificate of its managed domain.
+// Until the certificate is obtained, a self-signed one stands in, so that the core can start.
+func acmeServerTls(tx *gorm.DB, tlsProfile *model.Tls) (json.RawMessage, error) {
+	var cert model.AcmeCert
+	err := tx.Model(model.AcmeCert{}).Where("domain = ?", tlsProfile.Acme).First(&cert).Error
+	if err != nil {
+		return nil, common.NewErrorf("certificate of %s is not managed", tlsProfile.Acme)
+	}
+	var certPem, keyPem []byte
+	if cert.Issuer != "" {
+		certPem, keyPem, err = loadAcmeCertificate(cert.Issuer, cert.Domain)
+	}
+	if cert.Issuer == "" || err != nil {
+		certPem, keyPem, err = acmePlaceholder(cert.Domain)
+		if err != nil {
+			return nil, err
+		}
+	}
+	server := map[string]interface{}{}
+	if len(tlsProfile.Server) > 0 {
+		err = json.Unmarshal(tlsProfile.Server, &server)
+		if err != nil {
+			return nil, err
+		}
+	}
+	delete(server, "certificate_path")
+	delete(server, "key_path")
+	delete(server, "acme")
+	server["certificate"] = string(certPem)
+	server["key"] = string(keyPem)
+	return json.Marshal(server)
+}
+
+func acmePlaceholder(domain string) ([]byte, []byte, error) {
+	if pair, ok := acmePlaceholders.Load(domain); ok {
+		return pair.([2][]byte)[0], pair.([2][]byte)[1], nil
+	}
+	keyPem, certPem, err := sbtls.GenerateCertificate(nil, nil, time.Now, strings.TrimPrefix(domain, "*."), time.Now().AddDate(0, 0, 90))
+	if err != nil {
+		return nil, nil, err
+	}
+	acmePlaceholders.Store(domain, [2][]byte{certPem, keyPem})
+	return certPem, keyPem, nil
+}
+
+// AcmeTlsConfig serves the managed certificate of domain to a panel server, whatever name clients ask for.
+// It also answers TLS-ALPN challenges, in case the server listens on the port of them.
+func (s *AcmeService) AcmeTlsConfig(domain string) (*tls.Config, error) {
+	var count int64
+	err := database.GetDB().Model(model.AcmeCert{}).Where("domain = ?", domain).Count(&count).Error
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, common.NewErrorf("certificate of %s is not managed", domain)
+	}
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			config, ok := acmeConfig(domain)
+			if !ok {
+				return nil, common.NewErrorf("certificate of %s is not managed", domain)
+			}
+			isChallenge := len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == acmez.ACMETLS1Protocol
+			if !isChallenge && hello.ServerName != domain {
+				clientHello := *hello
+				clientHello.ServerName = strings.TrimPrefix(domain, "*.")
+				return config.GetCertificate(&clientHello)
+			}
+			return config.GetCertificate(hello)
+		},
+		NextProtos: []string{"http/1.1", acmez.ACMETLS1Protocol},
+	}, nil
+}
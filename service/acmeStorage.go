@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"io/fs"
+	"s-ui/database"
+	"s-ui/database/model"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"gorm.io/gorm/clause"
+)
+
+// acmeStorage keeps ACME accounts and certificates in the database.
+// Its locks are in memory, since only this process uses the storage.
+type acmeStorage struct{}
+
+var acmeLocks = struct {
+	access sync.Mutex
+	names  map[string]chan struct{}
+}{names: map[string]chan struct{}{}}
+
+func (s *acmeStorage) Lock(ctx context.Context, name string) error {
+	for {
+		acmeLocks.access.Lock()
+		held, locked := acmeLocks.names[name]
+		if !locked {
+			acmeLocks.names[name] = make(chan struct{})
+			acmeLocks.access.Unlock()
+			return nil
+		}
+		acmeLocks.access.Unlock()
+		select {
+		case <-held:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *acmeStorage) Unlock(ctx context.Context, name string) error {
+	acmeLocks.access.Lock()
+	defer acmeLocks.access.Unlock()
+	if held, locked := acmeLocks.names[name]; locked {
+		close(held)
+		delete(acmeLocks.names, name)
+	}
+	return nil
+}
+
+func (s *acmeStorage) Store(ctx context.Context, key string, value []byte) error {
+	return database.GetDB().Clauses(clause.OnConflict{UpdateAll: true}).Create(&model.AcmeFile{
+		Key:      key,
+		Value:    value,
+		Modified: time.Now().Unix(),
+	}).Error
+}
+
+func (s *acmeStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	var files []model.AcmeFile
+	err := database.GetDB().Where(&model.AcmeFile{Key: key}).Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return files[0].Value, nil
+}
+
+// keysUnder returns key and all keys under it like in a directory. Prefixes are matched here
+// rather than with LIKE, whose escaping differs between databases, as the storage stays small.
+func (s *acmeStorage) keysUnder(key string) ([]string, error) {
+	var keys []string
+	err := database.GetDB().Model(model.AcmeFile{}).Pluck("key", &keys).Error
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(key, "/") + "/"
+	result := []string{}
+	for _, k := range keys {
+		if k == key || strings.HasPrefix(k, prefix) {
+			result = append(result, k)
+		}
+	}
+	return result, nil
+}
+
+func (s *acmeStorage) Delete(ctx context.Context, key string) error {
+	keys, err := s.keysUnder(key)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fs.ErrNotExist
+	}
+	return database.GetDB().Where(map[string]interface{}{"key": keys}).Delete(&model.AcmeFile{}).Error
+}
+
+func (s *acmeStorage) Exists(ctx context.Context, key string) bool {
+	keys, err := s.keysUnder(key)
+	return err == nil && len(keys) > 0
+}
+
+func (s *acmeStorage) List(ctx context.Context, path string, recursive bool) ([]string, error) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	keys, err := s.keysUnder(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	// Direct children only, where deeper keys count as their directory
+	seen := map[string]bool{}
+	children := []string{}
+	for _, key := range keys {
+		if key == path {
+			continue
+		}
+		child := strings.TrimPrefix(key, prefix)
+		if !recursive {
+			child, _, _ = strings.Cut(child, "/")
+		}
+		if !seen[child] {
+			seen[child] = true
+			children = append(children, prefix+child)
+		}
+	}
+	return children, nil
+}
+
+func (s *acmeStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	var files []model.AcmeFile
+	err := database.GetDB().Where(&model.AcmeFile{Key: key}).Find(&files).Error
+	if err != nil {
+		return certmagic.KeyInfo{}, err
+	}
+	if len(files) > 0 {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   time.Unix(files[0].Modified, 0),
+			Size:       int64(len(files[0].Value)),
+			IsTerminal: true,
+		}, nil
+	}
+	if s.Exists(ctx, key) {
+		return certmagic.KeyInfo{Key: key}, nil
+	}
+	return certmagic.KeyInfo{}, fs.ErrNotExist
+}
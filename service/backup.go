@@ -0,0 +1,336 @@
+package service
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	backupTimeFormat = "20060102-150405"
+	// Encrypted backups start with this magic, then the scrypt salt and the gcm nonce
+	backupMagic     = "SUIBAK1\n"
+	backupSaltSize  = 16
+	backupEncSuffix = ".enc"
+)
+
+type BackupFile struct {
+	Destination int    `json:"destination"`
+	Type        string `json:"type"`
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	Time        int64  `json:"time"`
+	Encrypted   bool   `json:"encrypted"`
+}
+
+type BackupService struct {
+	SettingService
+}
+
+var (
+	backupMutex sync.Mutex
+	lastBackup  time.Time
+)
+
+func backupPrefix() string {
+	return config.GetName() + "_backup_"
+}
+
+// parseBackupName returns the time of a scheduled backup file, and false for other files
+func parseBackupName(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, backupPrefix()) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimPrefix(name, backupPrefix())
+	stamp = strings.TrimSuffix(stamp, backupEncSuffix)
+	if !strings.HasSuffix(stamp, ".db") {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(backupTimeFormat, strings.TrimSuffix(stamp, ".db"), time.Local)
+	return t, err == nil
+}
+
+func (s *BackupService) GetDestinations() ([]BackupDestination, error) {
+	value, err := s.SettingService.getString(database.GetDB(), "backupDestinations")
+	if err != nil {
+		return nil, err
+	}
+	return parseBackupDestinations(value)
+}
+
+func parseBackupDestinations(value string) ([]BackupDestination, error) {
+	var destinations []BackupDestination
+	err := json.Unmarshal([]byte(value), &destinations)
+	if err != nil {
+		return nil, common.NewErrorf("invalid backup destinations: %v", err)
+	}
+	for _, destination := range destinations {
+		err = destination.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return destinations, nil
+}
+
+// Backup stores a copy of the database in every destination, and removes backups beyond retention
+func (s *BackupService) Backup() (string, error) {
+	backupMutex.Lock()
+	defer backupMutex.Unlock()
+
+	destinations, err := s.GetDestinations()
+	if err != nil {
+		return "", err
+	}
+	if len(destinations) == 0 {
+		return "", common.NewError("no backup destination")
+	}
+	keep, err := s.SettingService.GetBackupKeep()
+	if err != nil {
+		return "", err
+	}
+	passphrase, err := s.SettingService.getString(database.GetDB(), "backupPassphrase")
+	if err != nil {
+		return "", err
+	}
+
+	data, err := database.GetDb("")
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	name := backupPrefix() + now.Format(backupTimeFormat) + ".db"
+	if passphrase != "" {
+		data, err = encryptBackup(data, passphrase)
+		if err != nil {
+			return "", err
+		}
+		name += backupEncSuffix
+	}
+
+	var errs []string
+	for index, destination := range destinations {
+		err = s.backupTo(&destination, name, data, keep)
+		if err != nil {
+			errs = append(errs, common.NewErrorf("destination %d (%s): %v", index, destination.Type, err).Error())
+		}
+	}
+	if len(errs) == len(destinations) {
+		return "", common.NewErrorf("backup failed: %s", strings.Join(errs, "; "))
+	}
+	lastBackup = now
+	if len(errs) > 0 {
+		return name, common.NewErrorf("backup %s is not stored everywhere: %s", name, strings.Join(errs, "; "))
+	}
+	logger.Info("database backup ", name, " stored")
+	return name, nil
+}
+
+func (s *BackupService) backupTo(destination *BackupDestination, name string, data []byte, keep int) error {
+	store, err := destination.open()
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	err = store.Put(name, data)
+	if err != nil {
+		return err
+	}
+	if keep <= 0 {
+		return nil
+	}
+	files, err := store.List()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, file := range files {
+		if _, ok := parseBackupName(file.Name); ok {
+			names = append(names, file.Name)
+		}
+	}
+	// Names sort by their time
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, oldName := range names[min(keep, len(names)):] {
+		err = store.Delete(oldName)
+		if err != nil {
+			logger.Warning("failed to delete old backup ", oldName, ": ", err)
+		}
+	}
+	return nil
+}
+
+// ListBackups lists scheduled backups of all destinations, newest first.
+// Destinations which can not be read are logged and skipped.
+func (s *BackupService) ListBackups() ([]BackupFile, error) {
+	destinations, err := s.GetDestinations()
+	if err != nil {
+		return nil, err
+	}
+	backups := []BackupFile{}
+	for index, destination := range destinations {
+		store, err := destination.open()
+		if err != nil {
+			logger.Warning("failed to open backup destination ", index, ": ", err)
+			continue
+		}
+		files, err := store.List()
+		store.Close()
+		if err != nil {
+			logger.Warning("failed to list backup destination ", index, ": ", err)
+			continue
+		}
+		for _, file := range files {
+			t, ok := parseBackupName(file.Name)
+			if !ok {
+				continue
+			}
+			backups = append(backups, BackupFile{
+				Destination: index,
+				Type:        destination.Type,
+				Name:        file.Name,
+				Size:        file.Size,
+				Time:        t.Unix(),
+				Encrypted:   strings.HasSuffix(file.Name, backupEncSuffix),
+			})
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].Time > backups[j].Time
+	})
+	return backups, nil
+}
+
+// RestoreBackup replaces the database by a backup, and restarts the app like an uploaded database
+func (s *BackupService) RestoreBackup(destinationIndex int, name string) error {
+	destinations, err := s.GetDestinations()
+	if err != nil {
+		return err
+	}
+	if destinationIndex < 0 || destinationIndex >= len(destinations) {
+		return common.NewErrorf("backup destination %d does not exist", destinationIndex)
+	}
+	if _, ok := parseBackupName(name); !ok {
+		return common.NewErrorf("invalid backup name: %s", name)
+	}
+	store, err := destinations[destinationIndex].open()
+	if err != nil {
+		return err
+	}
+	data, err := store.Get(name)
+	store.Close()
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, backupEncSuffix) {
+		passphrase, err := s.SettingService.getString(database.GetDB(), "backupPassphrase")
+		if err != nil {
+			return err
+		}
+		data, err = decryptBackup(data, passphrase)
+		if err != nil {
+			return err
+		}
+	}
+	return database.ImportDB(bytes.NewReader(data))
+}
+
+// RunScheduled makes a backup when the configured interval has passed since the last one
+func (s *BackupService) RunScheduled() error {
+	interval, err := s.SettingService.GetBackupInterval()
+	if err != nil || interval <= 0 {
+		return err
+	}
+	if lastBackup.IsZero() {
+		// After a restart, continue from the newest stored backup
+		backups, err := s.ListBackups()
+		if err != nil {
+			return err
+		}
+		if len(backups) > 0 {
+			lastBackup = time.Unix(backups[0].Time, 0)
+		}
+	}
+	if time.Since(lastBackup) < time.Duration(interval)*time.Hour {
+		return nil
+	}
+	_, err = s.Backup()
+	return err
+}
+
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+func encryptBackup(data []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(backupMagic), salt...), nonce...)
+	return gcm.Seal(header, nonce, data, []byte(backupMagic)), nil
+}
+
+func decryptBackup(data []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, common.NewError("backup is encrypted, but no backup passphrase is set")
+	}
+	if !bytes.HasPrefix(data, []byte(backupMagic)) {
+		return nil, common.NewError("not an encrypted backup")
+	}
+	data = data[len(backupMagic):]
+	if len(data) < backupSaltSize {
+		return nil, common.NewError("encrypted backup is truncated")
+	}
+	key, err := backupKey(passphrase, data[:backupSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	data = data[backupSaltSize:]
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, common.NewError("encrypted backup is truncated")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(backupMagic))
+	if err != nil {
+		return nil, common.NewError("wrong backup passphrase or corrupted backup")
+	}
+	return plain, nil
+}
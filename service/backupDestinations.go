@@ -0,0 +1,316 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"s-ui/config"
+	"s-ui/util/common"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+const backupTimeout = 5 * time.Minute
+
+// BackupDestination is where scheduled backups are stored. Fields are used by its type.
+type BackupDestination struct {
+	Type string `json:"type"`
+	// local and sftp
+	Path string `json:"path,omitempty"`
+	// s3
+	Endpoint  string `json:"endpoint,omitempty"`
+	Region    string `json:"region,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+	SSL       bool   `json:"ssl,omitempty"`
+	// sftp
+	Host       string `json:"host,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	User       string `json:"user,omitempty"`
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"privateKey,omitempty"`
+	HostKey    string `json:"hostKey,omitempty"`
+}
+
+type backupFileInfo struct {
+	Name string
+	Size int64
+}
+
+type backupStore interface {
+	Put(name string, data []byte) error
+	Get(name string) ([]byte, error)
+	List() ([]backupFileInfo, error)
+	Delete(name string) error
+	Close() error
+}
+
+func (d *BackupDestination) validate() error {
+	switch d.Type {
+	case "local":
+		return nil
+	case "s3":
+		if d.Endpoint == "" || d.Bucket == "" {
+			return common.NewError("s3 backup destination needs an endpoint and a bucket")
+		}
+	case "sftp":
+		if d.Host == "" || d.User == "" {
+			return common.NewError("sftp backup destination needs a host and a user")
+		}
+		if d.Password == "" && d.PrivateKey == "" {
+			return common.NewError("sftp backup destination needs a password or a private key")
+		}
+		if d.HostKey == "" {
+			return common.NewError("sftp backup destination needs the host key of the server")
+		}
+		_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.HostKey))
+		if err != nil {
+			return common.NewErrorf("invalid sftp host key: %v", err)
+		}
+	default:
+		return common.NewErrorf("unknown backup destination type: %s", d.Type)
+	}
+	return nil
+}
+
+// open connects to the destination. Callers close the returned store.
+func (d *BackupDestination) open() (backupStore, error) {
+	switch d.Type {
+	case "local":
+		dir := d.Path
+		if dir == "" {
+			dir = filepath.Join(config.GetDBFolderPath(), "backups")
+		}
+		err := os.MkdirAll(dir, 01740)
+		if err != nil {
+			return nil, err
+		}
+		return &localStore{dir: dir}, nil
+	case "s3":
+		client, err := minio.New(d.Endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(d.AccessKey, d.SecretKey, ""),
+			Secure: d.SSL,
+			Region: d.Region,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{client: client, bucket: d.Bucket, prefix: strings.Trim(d.Prefix, "/")}, nil
+	case "sftp":
+		return d.openSftp()
+	}
+	return nil, common.NewErrorf("unknown backup destination type: %s", d.Type)
+}
+
+type localStore struct {
+	dir string
+}
+
+func (l *localStore) Put(name string, data []byte) error {
+	tempPath := filepath.Join(l.dir, name+".tmp")
+	err := os.WriteFile(tempPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, filepath.Join(l.dir, name))
+}
+
+func (l *localStore) Get(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(l.dir, name))
+}
+
+func (l *localStore) List() ([]backupFileInfo, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []backupFileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		files = append(files, backupFileInfo{Name: entry.Name(), Size: info.Size()})
+	}
+	return files, nil
+}
+
+func (l *localStore) Delete(name string) error {
+	return os.Remove(filepath.Join(l.dir, name))
+}
+
+func (l *localStore) Close() error {
+	return nil
+}
+
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return s.prefix + "/" + name
+}
+
+func (s *s3Store) Put(name string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(name), bytes.NewReader(data), int64(len(data)), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (s *s3Store) Get(name string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	object, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	return io.ReadAll(object)
+}
+
+func (s *s3Store) List() ([]backupFileInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	prefix := ""
+	if s.prefix != "" {
+		prefix = s.prefix + "/"
+	}
+	var files []backupFileInfo
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		files = append(files, backupFileInfo{Name: strings.TrimPrefix(object.Key, prefix), Size: object.Size})
+	}
+	return files, nil
+}
+
+func (s *s3Store) Delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), backupTimeout)
+	defer cancel()
+	return s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{})
+}
+
+func (s *s3Store) Close() error {
+	return nil
+}
+
+type sftpStore struct {
+	conn   *ssh.Client
+	client *sftp.Client
+	dir    string
+}
+
+func (d *BackupDestination) openSftp() (backupStore, error) {
+	var auth []ssh.AuthMethod
+	if d.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(d.PrivateKey))
+		if err != nil {
+			return nil, common.NewErrorf("invalid sftp private key: %v", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if d.Password != "" {
+		auth = append(auth, ssh.Password(d.Password))
+	}
+	// The server is always verified, backups carry all secrets of the panel
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(d.HostKey))
+	if err != nil {
+		return nil, common.NewErrorf("invalid sftp host key: %v", err)
+	}
+	port := d.Port
+	if port == 0 {
+		port = 22
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(d.Host, strconv.Itoa(port)), &ssh.ClientConfig{
+		User:            d.User,
+		Auth:            auth,
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	dir := d.Path
+	if dir == "" {
+		dir = "."
+	}
+	err = client.MkdirAll(dir)
+	if err != nil {
+		client.Close()
+		conn.Close()
+		return nil, err
+	}
+	return &sftpStore{conn: conn, client: client, dir: dir}, nil
+}
+
+func (s *sftpStore) Put(name string, data []byte) error {
+	tempPath := path.Join(s.dir, name+".tmp")
+	file, err := s.client.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	return s.client.Rename(tempPath, path.Join(s.dir, name))
+}
+
+func (s *sftpStore) Get(name string) ([]byte, error) {
+	file, err := s.client.Open(path.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+func (s *sftpStore) List() ([]backupFileInfo, error) {
+	entries, err := s.client.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []backupFileInfo
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, backupFileInfo{Name: entry.Name(), Size: entry.Size()})
+		}
+	}
+	return files, nil
+}
+
+func (s *sftpStore) Delete(name string) error {
+	return s.client.Remove(path.Join(s.dir, name))
+}
+
+func (s *sftpStore) Close() error {
+	s.client.Close()
+	return s.conn.Close()
+}
@@ -0,0 +1,543 @@
+package service
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// caRootName is the name of the root in ca_certs, which leaves can not use
+const caRootName = "root"
+
+var caLeafName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// CaInfo is a certificate of the internal CA with the files of leaves
+type CaInfo struct {
+	model.CaCert
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+}
+
+type CaService struct{}
+
+// caFiles are where a leaf is written, for certificate paths of tls profiles and the panel
+func caFiles(name string) (string, string) {
+	dir := filepath.Join(config.GetDBFolderPath(), "ca")
+	return filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+}
+
+func (s *CaService) GetAll() ([]CaInfo, error) {
+	var certs []model.CaCert
+	err := database.GetDB().Model(model.CaCert{}).Order("root desc, id").Find(&certs).Error
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]CaInfo, len(certs))
+	for i, cert := range certs {
+		infos[i].CaCert = cert
+		if !cert.Root {
+			infos[i].CertFile, infos[i].KeyFile = caFiles(cert.Name)
+		}
+	}
+	return infos, nil
+}
+
+// GetRootPem returns the certificate of the root, or nothing without a root
+func (s *CaService) GetRootPem() (string, error) {
+	var roots []model.CaCert
+	err := database.GetDB().Model(model.CaCert{}).Where("root = ?", true).Find(&roots).Error
+	if err != nil || len(roots) == 0 {
+		return "", err
+	}
+	return roots[0].CertPem, nil
+}
+
+// Save changes the internal CA:
+//   - "create" makes a root like {"cn":"S-UI CA","days":3650}, and "import" takes one like {"cert":"...","key":"..."}.
+//     Leaves of an old root are issued again by the new one.
+//   - "issue" issues or issues again a leaf like {"name":"panel","sans":["example.com","1.2.3.4"],"days":90}.
+//   - "renew" issues a leaf again now, and "del" removes a leaf or the root without leaves. Their data is the name.
+func (s *CaService) Save(act string, data json.RawMessage, loginUser string) error {
+	var name string
+	db := database.GetDB()
+	var written []model.CaCert
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		switch act {
+		case "create", "import":
+			name = caRootName
+			written, err = s.saveRoot(tx, act, data)
+		case "issue":
+			var leaf struct {
+				Name string   `json:"name"`
+				Sans []string `json:"sans"`
+				Days int      `json:"days"`
+			}
+			err = json.Unmarshal(data, &leaf)
+			if err != nil {
+				return err
+			}
+			name = leaf.Name
+			var cert *model.CaCert
+			cert, err = s.issue(tx, leaf.Name, leaf.Sans, leaf.Days)
+			if err == nil {
+				written = append(written, *cert)
+			}
+		case "renew":
+			err = json.Unmarshal(data, &name)
+			if err != nil {
+				return err
+			}
+			var cert *model.CaCert
+			cert, err = s.renew(tx, name)
+			if err == nil {
+				written = append(written, *cert)
+			}
+		case "del":
+			err = json.Unmarshal(data, &name)
+			if err != nil {
+				return err
+			}
+			err = s.del(tx, name)
+		default:
+			return common.NewErrorf("unknown action: %s", act)
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Create(&model.Changes{
+			DateTime: time.Now().Unix(),
+			Actor:    loginUser,
+			Key:      "ca",
+			Action:   act,
+			Obj:      json.RawMessage(fmt.Sprintf("%q", name)),
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	if act == "del" && name != caRootName {
+		certFile, keyFile := caFiles(name)
+		os.Remove(certFile)
+		os.Remove(keyFile)
+	}
+	for _, cert := range written {
+		err = writeCaFiles(&cert)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *CaService) saveRoot(tx *gorm.DB, act string, data json.RawMessage) ([]model.CaCert, error) {
+	var root struct {
+		Cn   string `json:"cn"`
+		Days int    `json:"days"`
+		Cert string `json:"cert"`
+		Key  string `json:"key"`
+	}
+	err := json.Unmarshal(data, &root)
+	if err != nil {
+		return nil, err
+	}
+	certPem, keyPem := root.Cert, root.Key
+	if act == "create" {
+		if root.Cn == "" {
+			root.Cn = "S-UI CA"
+		}
+		if root.Days <= 0 {
+			return nil, common.NewError("days of root must be positive")
+		}
+		certPem, keyPem, err = createCaRoot(root.Cn, root.Days)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert, _, err := parseCaPair(certPem, keyPem)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA || cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, common.NewError("certificate is not a CA")
+	}
+	if cert.NotAfter.Before(time.Now()) {
+		return nil, common.NewError("certificate of CA has expired")
+	}
+
+	err = tx.Where("root = ?", true).Delete(model.CaCert{}).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Create(&model.CaCert{
+		Name:      caRootName,
+		Root:      true,
+		Sans:      json.RawMessage("[]"),
+		Days:      int(time.Until(cert.NotAfter).Hours() / 24),
+		CertPem:   certPem,
+		KeyPem:    keyPem,
+		NotAfter:  cert.NotAfter.Unix(),
+		UpdatedAt: time.Now().Unix(),
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var leaves []model.CaCert
+	err = tx.Model(model.CaCert{}).Where("root = ?", false).Find(&leaves).Error
+	if err != nil {
+		return nil, err
+	}
+	var written []model.CaCert
+	for _, leaf := range leaves {
+		cert, err := s.renew(tx, leaf.Name)
+		if err != nil {
+			return nil, err
+		}
+		written = append(written, *cert)
+	}
+	return written, nil
+}
+
+func (s *CaService) issue(tx *gorm.DB, name string, sans []string, days int) (*model.CaCert, error) {
+	if !caLeafName.MatchString(name) || name == caRootName {
+		return nil, common.NewErrorf("invalid name of certificate: %s", name)
+	}
+	if days <= 0 {
+		return nil, common.NewError("days of certificate must be positive")
+	}
+	if len(sans) == 0 {
+		return nil, common.NewError("certificate needs a domain or ip")
+	}
+	for i, san := range sans {
+		sans[i] = strings.TrimSpace(san)
+		if sans[i] == "" {
+			return nil, common.NewError("domain or ip of certificate is empty")
+		}
+	}
+	var cert model.CaCert
+	err := tx.Model(model.CaCert{}).Where("name = ?", name).Find(&cert).Error
+	if err != nil {
+		return nil, err
+	}
+	cert.Name = name
+	cert.Sans, _ = json.Marshal(sans)
+	cert.Days = days
+	err = signCaLeaf(tx, &cert)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, tx.Save(&cert).Error
+}
+
+func (s *CaService) renew(tx *gorm.DB, name string) (*model.CaCert, error) {
+	var cert model.CaCert
+	err := tx.Model(model.CaCert{}).Where("name = ? AND root = ?", name, false).First(&cert).Error
+	if err != nil {
+		return nil, common.NewErrorf("certificate %s not found", name)
+	}
+	err = signCaLeaf(tx, &cert)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, tx.Save(&cert).Error
+}
+
+// del removes a leaf which no certificate path refers to, or the root without leaves
+func (s *CaService) del(tx *gorm.DB, name string) error {
+	if name == caRootName {
+		var count int64
+		err := tx.Model(model.CaCert{}).Where("root = ?", false).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return common.NewError("delete certificates of the CA first")
+		}
+		return tx.Where("root = ?", true).Delete(model.CaCert{}).Error
+	}
+	certFile, _ := caFiles(name)
+	settingService := SettingService{}
+	for _, key := range []string{"webCertFile", "subCertFile"} {
+		value, err := settingService.getString(tx, key)
+		if err != nil {
+			return err
+		}
+		if value == certFile {
+			return common.NewErrorf("certificate %s is used by setting %s", name, key)
+		}
+	}
+	var tlsList []model.Tls
+	err := tx.Model(model.Tls{}).Find(&tlsList).Error
+	if err != nil {
+		return err
+	}
+	for _, tlsProfile := range tlsList {
+		if path, _ := tlsServerFiles(tlsProfile.Server); path == certFile {
+			return common.NewErrorf("certificate %s is used by tls %s", name, tlsProfile.Name)
+		}
+	}
+	result := tx.Where("name = ? AND root = ?", name, false).Delete(model.CaCert{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return common.NewErrorf("certificate %s not found", name)
+	}
+	return nil
+}
+
+// RenewCaCerts issues leaves again when a third of their lifetime is left, and writes missing files.
+// Inbounds and the panel take new files by ReloadCerts.
+func (s *CaService) RenewCaCerts() error {
+	db := database.GetDB()
+	var leaves []model.CaCert
+	err := db.Model(model.CaCert{}).Where("root = ?", false).Find(&leaves).Error
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, leaf := range leaves {
+		if now >= leaf.NotAfter-int64(leaf.Days)*86400/3 {
+			renewed, err := s.renew(db, leaf.Name)
+			if err != nil {
+				logger.Warning("renew certificate ", leaf.Name, " of CA failed: ", err)
+				continue
+			}
+			leaf = *renewed
+			logger.Info("renewed certificate ", leaf.Name, " of CA")
+		}
+		certFile, _ := caFiles(leaf.Name)
+		content, err := os.ReadFile(certFile)
+		if err != nil || string(content) != leaf.CertPem {
+			err = writeCaFiles(&leaf)
+			if err != nil {
+				logger.Warning("write certificate ", leaf.Name, " of CA failed: ", err)
+			}
+		}
+	}
+	return nil
+}
+
+// TrustedRoot returns the root in lines of sing-box options, if it issued the server certificate of a tls profile
+func (s *CaService) TrustedRoot(tlsProfile *model.Tls) []string {
+	if tlsProfile == nil {
+		return nil
+	}
+	rootPem, err := s.GetRootPem()
+	if err != nil || rootPem == "" {
+		return nil
+	}
+	certPem := tlsServerPem(tlsProfile.Server)
+	if certFile, _ := tlsServerFiles(tlsProfile.Server); certFile != "" {
+		certPem, err = os.ReadFile(certFile)
+		if err != nil {
+			return nil
+		}
+	}
+	root, err := parseCertPem(rootPem)
+	if err != nil {
+		return nil
+	}
+	leaf, err := parseCertPem(string(certPem))
+	if err != nil || leaf.CheckSignatureFrom(root) != nil {
+		return nil
+	}
+	return strings.Split(strings.TrimSpace(rootPem), "\n")
+}
+
+func createCaRoot(cn string, days int) (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := caSerial()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeCaPair(der, key)
+}
+
+// signCaLeaf issues a leaf for its sans by the root. It does not outlive the root.
+func signCaLeaf(tx *gorm.DB, cert *model.CaCert) error {
+	var root model.CaCert
+	err := tx.Model(model.CaCert{}).Where("root = ?", true).First(&root).Error
+	if err != nil {
+		return common.NewError("create or import a root of the CA first")
+	}
+	rootCert, rootKey, err := parseCaPair(root.CertPem, root.KeyPem)
+	if err != nil {
+		return err
+	}
+	var sans []string
+	json.Unmarshal(cert.Sans, &sans)
+	if len(sans) == 0 {
+		return common.NewErrorf("certificate %s has no domain or ip", cert.Name)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := caSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: sans[0]},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, cert.Days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(rootCert.NotAfter) {
+		template.NotAfter = rootCert.NotAfter
+	}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, rootCert, &key.PublicKey, rootKey)
+	if err != nil {
+		return err
+	}
+	cert.CertPem, cert.KeyPem, err = encodeCaPair(der, key)
+	if err != nil {
+		return err
+	}
+	cert.NotAfter = template.NotAfter.Unix()
+	cert.UpdatedAt = now.Unix()
+	return nil
+}
+
+func caSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCaPair(der []byte, key *ecdsa.PrivateKey) (string, string, error) {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+	return string(certPem), string(keyPem), nil
+}
+
+func parseCertPem(certPem string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPem))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, common.NewError("no certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// parseCaPair reads a certificate and its key in PKCS8, SEC1 or PKCS1
+func parseCaPair(certPem string, keyPem string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := parseCertPem(certPem)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode([]byte(keyPem))
+	if block == nil {
+		return nil, nil, common.NewError("no private key found")
+	}
+	var key interface{}
+	key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	}
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, common.NewError("unsupported private key")
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, common.NewError("unsupported private key")
+	}
+	switch public := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		ok = public.Equal(cert.PublicKey)
+	case *rsa.PublicKey:
+		ok = public.Equal(cert.PublicKey)
+	default:
+		ok = false
+	}
+	if !ok {
+		return nil, nil, common.NewError("private key does not match the certificate")
+	}
+	return cert, signer, nil
+}
+
+// writeCaFiles replaces files of a leaf, so that readers never see them half written
+func writeCaFiles(cert *model.CaCert) error {
+	if cert.Root {
+		return nil
+	}
+	certFile, keyFile := caFiles(cert.Name)
+	err := os.MkdirAll(filepath.Dir(certFile), 0700)
+	if err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		path    string
+		content string
+		mode    os.FileMode
+	}{
+		{keyFile, cert.KeyPem, 0600},
+		{certFile, cert.CertPem, 0644},
+	} {
+		temp := file.path + ".tmp"
+		err = os.WriteFile(temp, []byte(file.content), file.mode)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(temp, file.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,446 @@
+package service
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CertInfo is a certificate in use by the panel. Id is web, sub or tls:{id of the profile},
+// and Warning is set when it expires within the longest threshold of notifyCerts.
+type CertInfo struct {
+	Id        string   `json:"id"`
+	Name      string   `json:"name"`
+	Path      string   `json:"path,omitempty"`
+	Acme      string   `json:"acme,omitempty"`
+	Subject   string   `json:"subject,omitempty"`
+	SANs      []string `json:"sans,omitempty"`
+	Issuer    string   `json:"issuer,omitempty"`
+	NotBefore int64    `json:"notBefore,omitempty"`
+	NotAfter  int64    `json:"notAfter,omitempty"`
+	Warning   string   `json:"warning,omitempty"`
+	Error     string   `json:"error,omitempty"`
+}
+
+type CertService struct {
+	InboundService
+	NotifyService
+}
+
+// keyPair is a certificate file of a server of the panel, which is reloaded when the files change
+type keyPair struct {
+	certFile string
+	keyFile  string
+	stamp    string
+	cert     *tls.Certificate
+}
+
+var keyPairs = struct {
+	access sync.RWMutex
+	pairs  map[string]*keyPair
+}{pairs: map[string]*keyPair{}}
+
+// tlsFiles are the certificate files of tls profiles, by their id, when inbounds last used them
+var tlsFiles = struct {
+	access sync.Mutex
+	files  map[uint]tlsFileStamp
+}{files: map[uint]tlsFileStamp{}}
+
+type tlsFileStamp struct {
+	paths string
+	stamp string
+}
+
+// fileStamp changes when a file is written or replaced, also behind a symlink
+func fileStamp(paths ...string) string {
+	var stamp strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			stamp.WriteString("-;")
+			continue
+		}
+		fmt.Fprintf(&stamp, "%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp.String()
+}
+
+// tlsServerFiles returns certificate and key files of the server of a tls profile
+func tlsServerFiles(server json.RawMessage) (string, string) {
+	var files struct {
+		CertificatePath string `json:"certificate_path"`
+		KeyPath         string `json:"key_path"`
+	}
+	if len(server) > 0 {
+		json.Unmarshal(server, &files)
+	}
+	return files.CertificatePath, files.KeyPath
+}
+
+// tlsServerPem returns the inline certificate of the server of a tls profile, which is a string or lines
+func tlsServerPem(server json.RawMessage) []byte {
+	var inline struct {
+		Certificate json.RawMessage `json:"certificate"`
+	}
+	if len(server) == 0 || json.Unmarshal(server, &inline) != nil || len(inline.Certificate) == 0 {
+		return nil
+	}
+	var text string
+	if json.Unmarshal(inline.Certificate, &text) == nil {
+		return []byte(text)
+	}
+	var lines []string
+	if json.Unmarshal(inline.Certificate, &lines) == nil {
+		return []byte(strings.Join(lines, "\n"))
+	}
+	return nil
+}
+
+// acmeCertPem returns the current certificate of a managed domain
+func acmeCertPem(db *gorm.DB, domain string) ([]byte, error) {
+	var cert model.AcmeCert
+	err := db.Model(model.AcmeCert{}).Where("domain = ?", domain).First(&cert).Error
+	if err != nil {
+		return nil, common.NewErrorf("certificate of %s is not managed", domain)
+	}
+	if cert.Issuer == "" {
+		return nil, common.NewErrorf("certificate of %s is not obtained yet", domain)
+	}
+	certPem, _, err := loadAcmeCertificate(cert.Issuer, cert.Domain)
+	return certPem, err
+}
+
+// GetInventory lists certificates of the panel, the subscription server and tls profiles
+func (s *CertService) GetInventory() ([]CertInfo, error) {
+	db := database.GetDB()
+	thresholds, err := s.NotifyService.getThresholds("notifyCerts")
+	if err != nil {
+		return nil, err
+	}
+	settingService := SettingService{}
+	certs := []CertInfo{}
+	for _, server := range []struct{ id, name, acmeKey, certKey string }{
+		{"web", "panel", "webAcme", "webCertFile"},
+		{"sub", "subscription", "subAcme", "subCertFile"},
+	} {
+		acmeDomain, err := settingService.getString(db, server.acmeKey)
+		if err != nil {
+			return nil, err
+		}
+		certFile, err := settingService.getString(db, server.certKey)
+		if err != nil {
+			return nil, err
+		}
+		info := CertInfo{Id: server.id, Name: server.name}
+		switch {
+		case acmeDomain != "":
+			info.Acme = acmeDomain
+			certPem, err := acmeCertPem(db, acmeDomain)
+			info.parse(certPem, err)
+		case certFile != "":
+			info.Path = certFile
+			certPem, err := os.ReadFile(certFile)
+			info.parse(certPem, err)
+		default:
+			continue
+		}
+		certs = append(certs, info)
+	}
+
+	var tlsList []model.Tls
+	err = db.Model(model.Tls{}).Order("id").Find(&tlsList).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, tlsProfile := range tlsList {
+		info := CertInfo{Id: fmt.Sprintf("tls:%d", tlsProfile.Id), Name: tlsProfile.Name}
+		certFile, _ := tlsServerFiles(tlsProfile.Server)
+		inline := tlsServerPem(tlsProfile.Server)
+		switch {
+		case tlsProfile.Acme != "":
+			info.Acme = tlsProfile.Acme
+			certPem, err := acmeCertPem(db, tlsProfile.Acme)
+			info.parse(certPem, err)
+		case certFile != "":
+			info.Path = certFile
+			certPem, err := os.ReadFile(certFile)
+			info.parse(certPem, err)
+		case len(inline) > 0:
+			info.parse(inline, nil)
+		default:
+			// Like reality, or only a client
+			continue
+		}
+		certs = append(certs, info)
+	}
+
+	// The root of the internal CA is not renewed, since clients trust it
+	var roots []model.CaCert
+	err = db.Model(model.CaCert{}).Where("root = ?", true).Find(&roots).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		info := CertInfo{Id: "ca", Name: "internal CA"}
+		info.parse([]byte(root.CertPem), nil)
+		certs = append(certs, info)
+	}
+
+	now := time.Now().Unix()
+	for i := range certs {
+		certs[i].warn(thresholds, now)
+	}
+	return certs, nil
+}
+
+// parse reads the leaf certificate, which is the first of the chain
+func (c *CertInfo) parse(certPem []byte, err error) {
+	if err != nil {
+		c.Error = err.Error()
+		return
+	}
+	var block *pem.Block
+	rest := certPem
+	for {
+		block, rest = pem.Decode(rest)
+		if block == nil || block.Type == "CERTIFICATE" {
+			break
+		}
+	}
+	if block == nil {
+		c.Error = "no certificate found"
+		return
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		c.Error = err.Error()
+		return
+	}
+	c.Subject = leaf.Subject.CommonName
+	if c.Subject == "" {
+		c.Subject = leaf.Subject.String()
+	}
+	c.SANs = append([]string{}, leaf.DNSNames...)
+	for _, ip := range leaf.IPAddresses {
+		c.SANs = append(c.SANs, ip.String())
+	}
+	c.Issuer = leaf.Issuer.CommonName
+	if c.Issuer == "" {
+		c.Issuer = leaf.Issuer.String()
+	}
+	c.NotBefore = leaf.NotBefore.Unix()
+	c.NotAfter = leaf.NotAfter.Unix()
+}
+
+func (c *CertInfo) warn(thresholds []int, now int64) {
+	if c.NotAfter == 0 {
+		return
+	}
+	left := c.NotAfter - now
+	switch {
+	case left <= 0:
+		c.Warning = "expired"
+	case len(thresholds) > 0 && left <= int64(thresholds[len(thresholds)-1])*86400:
+		c.Warning = "expires in " + formatDuration(left)
+	}
+}
+
+// NotifyCerts warns about certificates which crossed a threshold of days before their expiry.
+// Each threshold is notified once per certificate, so a renewed one is notified again.
+func (s *CertService) NotifyCerts() error {
+	thresholds, err := s.NotifyService.getThresholds("notifyCerts")
+	if err != nil || len(thresholds) == 0 {
+		return err
+	}
+	channels, err := s.NotifyService.GetChannels()
+	if err != nil {
+		return err
+	}
+	certs, err := s.GetInventory()
+	if err != nil {
+		return err
+	}
+
+	db := database.GetDB()
+	var notices []model.CertNotice
+	err = db.Model(model.CertNotice{}).Find(&notices).Error
+	if err != nil {
+		return err
+	}
+	notified := make(map[string]uint, len(notices))
+	for _, notice := range notices {
+		notified[certNoticeKey(notice.Cert, notice.NotAfter, notice.Threshold)] = notice.Id
+	}
+
+	now := time.Now().Unix()
+	crossed := map[string]bool{}
+	for _, cert := range certs {
+		if cert.NotAfter == 0 {
+			continue
+		}
+		var records []model.CertNotice
+		for _, threshold := range thresholds {
+			if cert.NotAfter-now > int64(threshold)*86400 {
+				continue
+			}
+			key := certNoticeKey(cert.Id, cert.NotAfter, threshold)
+			crossed[key] = true
+			if _, ok := notified[key]; !ok {
+				records = append(records, model.CertNotice{Cert: cert.Id, NotAfter: cert.NotAfter, Threshold: threshold, DateTime: now})
+			}
+		}
+		if len(records) == 0 {
+			continue
+		}
+		// Crossing several thresholds at once sends only the most urgent one, which has the fewest days
+		notice := newCertNotice(&cert, records[0].Threshold, now)
+		logger.Warning(notice.Message)
+		if len(channels) > 0 {
+			err = s.NotifyService.send(channels, notice)
+			if err != nil {
+				// Not recorded, so it is sent again on the next run
+				logger.Warning("notify certificate ", cert.Name, " failed: ", err)
+				continue
+			}
+		}
+		err = db.Create(&records).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	// Replaced certificates are notified by their new expiry
+	var stale []uint
+	for key, id := range notified {
+		if !crossed[key] {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		return db.Where("id in ?", stale).Delete(model.CertNotice{}).Error
+	}
+	return nil
+}
+
+func certNoticeKey(cert string, notAfter int64, threshold int) string {
+	return fmt.Sprintf("%s:%d:%d", cert, notAfter, threshold)
+}
+
+func newCertNotice(cert *CertInfo, threshold int, now int64) *Notice {
+	name := cert.Name
+	if strings.HasPrefix(cert.Id, "tls:") {
+		name = "tls " + cert.Name
+	}
+	notice := &Notice{
+		Cert:      name,
+		Kind:      NoticeCert,
+		Threshold: threshold,
+		Expiry:    cert.NotAfter,
+	}
+	expiry := time.Unix(cert.NotAfter, 0).Format(time.RFC1123)
+	if cert.NotAfter <= now {
+		notice.Message = fmt.Sprintf("Certificate of %s (%s) has expired at %s", name, cert.Subject, expiry)
+	} else {
+		notice.Message = fmt.Sprintf("Certificate of %s (%s) expires in %s, at %s", name, cert.Subject, formatDuration(cert.NotAfter-now), expiry)
+	}
+	return notice
+}
+
+// KeyPairTlsConfig serves certificate files on a server of the panel, and takes new files without a restart
+func (s *CertService) KeyPairTlsConfig(server string, certFile string, keyFile string) (*tls.Config, error) {
+	stamp := fileStamp(certFile, keyFile)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pair := &keyPair{certFile: certFile, keyFile: keyFile, stamp: stamp, cert: &cert}
+	keyPairs.access.Lock()
+	keyPairs.pairs[server] = pair
+	keyPairs.access.Unlock()
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			keyPairs.access.RLock()
+			defer keyPairs.access.RUnlock()
+			return pair.cert, nil
+		},
+	}, nil
+}
+
+// ReleaseKeyPair stops reloading the files of a stopped server
+func (s *CertService) ReleaseKeyPair(server string) {
+	keyPairs.access.Lock()
+	defer keyPairs.access.Unlock()
+	delete(keyPairs.pairs, server)
+}
+
+// ReloadCerts loads changed certificate files of the panel servers, and restarts inbounds whose tls files changed
+func (s *CertService) ReloadCerts() error {
+	keyPairs.access.Lock()
+	for server, pair := range keyPairs.pairs {
+		stamp := fileStamp(pair.certFile, pair.keyFile)
+		if stamp == pair.stamp {
+			continue
+		}
+		// Files being written fail to load, and they change again when they are complete
+		pair.stamp = stamp
+		cert, err := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+		if err != nil {
+			logger.Warning("failed to reload certificate of ", server, " server: ", err)
+			continue
+		}
+		pair.cert = &cert
+		logger.Info("reloaded certificate of ", server, " server")
+	}
+	keyPairs.access.Unlock()
+
+	db := database.GetDB()
+	var tlsList []model.Tls
+	err := db.Model(model.Tls{}).Select("id", "server", "acme").Find(&tlsList).Error
+	if err != nil {
+		return err
+	}
+	tlsFiles.access.Lock()
+	defer tlsFiles.access.Unlock()
+	files := make(map[uint]tlsFileStamp, len(tlsList))
+	var changed []uint
+	for _, tlsProfile := range tlsList {
+		certFile, keyFile := tlsServerFiles(tlsProfile.Server)
+		if tlsProfile.Acme != "" || (certFile == "" && keyFile == "") {
+			continue
+		}
+		file := tlsFileStamp{paths: certFile + "\n" + keyFile, stamp: fileStamp(certFile, keyFile)}
+		files[tlsProfile.Id] = file
+		// New paths are applied by saving the profile
+		if old, ok := tlsFiles.files[tlsProfile.Id]; ok && old.paths == file.paths && old.stamp != file.stamp {
+			changed = append(changed, tlsProfile.Id)
+		}
+	}
+	tlsFiles.files = files
+	if len(changed) == 0 {
+		return nil
+	}
+
+	var inboundIds []uint
+	err = db.Model(model.Inbound{}).Where("tls_id in ?", changed).Pluck("id", &inboundIds).Error
+	if err != nil || len(inboundIds) == 0 {
+		return err
+	}
+	LastUpdate = time.Now().Unix()
+	if !corePtr.IsRunning() {
+		return nil
+	}
+	logger.Info("certificate files of tls ", changed, " changed, restarting inbounds ", inboundIds)
+	return s.InboundService.RestartInbounds(db, inboundIds)
+}
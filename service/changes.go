@@ -0,0 +1,458 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/util/common"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type FieldDiff struct {
+	Path   string      `json:"path"`
+	Action string      `json:"action"`
+	Old    interface{} `json:"old,omitempty"`
+	New    interface{} `json:"new,omitempty"`
+}
+
+// snapshot returns the stored state of objects addressed by a save request, in the format of save data
+func (s *ConfigService) snapshot(tx *gorm.DB, obj string, act string, data json.RawMessage) (json.RawMessage, error) {
+	switch obj {
+	case "config":
+		config, err := s.SettingService.getString(tx, "config")
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(config), nil
+	case "settings":
+		var settings map[string]string
+		err := json.Unmarshal(data, &settings)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[string]string, len(settings))
+		for key := range settings {
+			values[key], err = s.SettingService.getString(tx, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(values)
+	}
+
+	ids, names, err := snapshotKeys(obj, act, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 && len(names) == 0 {
+		return nil, nil
+	}
+	nameColumn := "tag"
+	if idKeyed(obj) {
+		nameColumn = "name"
+	}
+	query := tx.Where("id in ?", ids)
+	if len(ids) == 0 {
+		query = tx.Where(nameColumn+" in ?", names)
+	}
+
+	var records []interface{}
+	switch obj {
+	case "clients":
+		var clients []model.Client
+		err = query.Find(&clients).Error
+		for _, client := range clients {
+			records = append(records, client)
+		}
+	case "tls":
+		var tlsList []model.Tls
+		err = query.Find(&tlsList).Error
+		for _, tls := range tlsList {
+			records = append(records, tls)
+		}
+	case "inbounds":
+		var inbounds []model.Inbound
+		err = query.Find(&inbounds).Error
+		for _, inbound := range inbounds {
+			var record *map[string]interface{}
+			record, err = inbound.MarshalFull()
+			if err != nil {
+				return nil, err
+			}
+			// Keep clients of the inbound, to restore them with the inbound
+			var clientIds []uint
+			err = tx.Model(model.Client{}).
+				Where(database.JsonArrayContains("clients.inbounds"), inbound.Id).
+				Pluck("id", &clientIds).Error
+			if err != nil {
+				return nil, err
+			}
+			(*record)["users"] = clientIds
+			records = append(records, *record)
+		}
+	case "outbounds":
+		var outbounds []model.Outbound
+		err = query.Find(&outbounds).Error
+		for _, outbound := range outbounds {
+			var record map[string]interface{}
+			record, err = withId(outbound, outbound.Id)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	case "endpoints":
+		var endpoints []model.Endpoint
+		err = query.Find(&endpoints).Error
+		for _, endpoint := range endpoints {
+			var record map[string]interface{}
+			record, err = withId(endpoint, endpoint.Id)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	case "rules":
+		var rules []model.RouteRule
+		err = query.Find(&rules).Error
+		for _, rule := range rules {
+			records = append(records, rule)
+		}
+	case "dnsservers":
+		var servers []model.DnsServer
+		err = query.Find(&servers).Error
+		for _, server := range servers {
+			var record map[string]interface{}
+			record, err = withId(server, server.Id)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	case "dnsrules":
+		var dnsRules []model.DnsRule
+		err = query.Find(&dnsRules).Error
+		for _, rule := range dnsRules {
+			records = append(records, rule)
+		}
+	case "plans":
+		var plans []model.Plan
+		err = query.Find(&plans).Error
+		for _, plan := range plans {
+			records = append(records, plan)
+		}
+	case "rulesets":
+		var ruleSets []model.RuleSet
+		err = query.Find(&ruleSets).Error
+		for _, ruleSet := range ruleSets {
+			var record map[string]interface{}
+			record, err = withId(ruleSet, ruleSet.Id)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+	default:
+		return nil, common.NewErrorf("unknown object type: %s", obj)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(records)
+}
+
+// snapshotKeys extracts ids or unique names of objects from save data
+func snapshotKeys(obj string, act string, data json.RawMessage) ([]uint, []string, error) {
+	switch act {
+	case "del":
+		if idKeyed(obj) {
+			var id uint
+			err := json.Unmarshal(data, &id)
+			return []uint{id}, nil, err
+		}
+		var tag string
+		err := json.Unmarshal(data, &tag)
+		return nil, []string{tag}, err
+	case "addbulk":
+		var clients []model.Client
+		err := json.Unmarshal(data, &clients)
+		if err != nil {
+			return nil, nil, err
+		}
+		names := make([]string, len(clients))
+		for i, client := range clients {
+			names[i] = client.Name
+		}
+		return nil, names, nil
+	case "addplan":
+		var req PlanClients
+		err := json.Unmarshal(data, &req)
+		if err != nil {
+			return nil, nil, err
+		}
+		names, err := req.names()
+		return nil, names, err
+	case "order":
+		var ids []uint
+		err := json.Unmarshal(data, &ids)
+		return ids, nil, err
+	}
+	var keys struct {
+		Id   uint   `json:"id"`
+		Tag  string `json:"tag"`
+		Name string `json:"name"`
+	}
+	err := json.Unmarshal(data, &keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	if keys.Id > 0 {
+		return []uint{keys.Id}, nil, nil
+	}
+	name := keys.Tag
+	if idKeyed(obj) {
+		name = keys.Name
+	}
+	if len(name) == 0 {
+		return nil, nil, nil
+	}
+	return nil, []string{name}, nil
+}
+
+// idKeyed reports whether objects are deleted by id, and identified by name instead of tag
+func idKeyed(obj string) bool {
+	return obj == "clients" || obj == "tls" || obj == "rules" || obj == "dnsrules" || obj == "plans"
+}
+
+func withId(obj json.Marshaler, id uint) (map[string]interface{}, error) {
+	data, err := obj.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	err = json.Unmarshal(data, &record)
+	if err != nil {
+		return nil, err
+	}
+	record["id"] = id
+	return record, nil
+}
+
+func (s *ConfigService) GetChange(id uint64) (*model.Changes, error) {
+	db := database.GetDB()
+	change := &model.Changes{}
+	err := db.Model(model.Changes{}).Where("id = ?", id).First(change).Error
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// GetChangeDiff returns field level differences between before and after snapshots of a change
+func (s *ConfigService) GetChangeDiff(id uint64) ([]FieldDiff, error) {
+	change, err := s.GetChange(id)
+	if err != nil {
+		return nil, err
+	}
+	var before, after interface{}
+	if len(change.Before) > 0 {
+		json.Unmarshal(change.Before, &before)
+	}
+	if len(change.After) > 0 {
+		json.Unmarshal(change.After, &after)
+	}
+	// Records are compared by id instead of position
+	if beforeList, ok := before.([]interface{}); ok {
+		before = recordsById(beforeList)
+	}
+	if afterList, ok := after.([]interface{}); ok {
+		after = recordsById(afterList)
+	}
+	// Missing snapshots mean that all records are added or removed
+	if before == nil {
+		before = map[string]interface{}{}
+	}
+	if after == nil {
+		after = map[string]interface{}{}
+	}
+	diffs := []FieldDiff{}
+	diffValues("", before, after, &diffs)
+	return diffs, nil
+}
+
+func recordsById(records []interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(records))
+	for i, record := range records {
+		key := strconv.Itoa(i)
+		if recordMap, ok := record.(map[string]interface{}); ok {
+			if id, ok := recordMap["id"].(float64); ok {
+				key = strconv.FormatUint(uint64(id), 10)
+			}
+		}
+		result[key] = record
+	}
+	return result
+}
+
+func diffValues(path string, oldValue interface{}, newValue interface{}, diffs *[]FieldDiff) {
+	oldMap, oldIsMap := oldValue.(map[string]interface{})
+	newMap, newIsMap := newValue.(map[string]interface{})
+	if oldIsMap && newIsMap {
+		keys := make([]string, 0, len(oldMap)+len(newMap))
+		for key := range oldMap {
+			keys = append(keys, key)
+		}
+		for key := range newMap {
+			if _, ok := oldMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			diffValues(joinPath(path, key), oldMap[key], newMap[key], diffs)
+		}
+		return
+	}
+	oldJson, _ := json.Marshal(oldValue)
+	newJson, _ := json.Marshal(newValue)
+	if string(oldJson) == string(newJson) {
+		return
+	}
+	switch {
+	case oldValue == nil:
+		*diffs = append(*diffs, FieldDiff{Path: path, Action: "new", New: newValue})
+	case newValue == nil:
+		*diffs = append(*diffs, FieldDiff{Path: path, Action: "del", Old: oldValue})
+	default:
+		*diffs = append(*diffs, FieldDiff{Path: path, Action: "edit", Old: oldValue, New: newValue})
+	}
+}
+
+func joinPath(path string, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+// RevertChange re-applies the state before a change through the normal save path, in one transaction
+func (s *ConfigService) RevertChange(id uint64, loginUser string, hostname string) ([]string, error) {
+	change, err := s.GetChange(id)
+	if err != nil {
+		return nil, err
+	}
+	var before, after []map[string]interface{}
+	switch change.Key {
+	case "config", "settings":
+		if len(change.Before) == 0 {
+			return nil, common.NewError("change has no snapshot to revert to")
+		}
+		objs, _, err := s.Save(change.Key, "set", change.Before, "", loginUser, hostname, false)
+		return objs, err
+	}
+	if len(change.Before) > 0 {
+		err = json.Unmarshal(change.Before, &before)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(change.After) > 0 {
+		err = json.Unmarshal(change.After, &after)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(before) == 0 && len(after) == 0 {
+		return nil, common.NewError("change has no snapshot to revert to")
+	}
+
+	var ops []saveOp
+	// Objects which did not exist before are deleted
+	for _, record := range after {
+		if containsRecord(before, record) {
+			continue
+		}
+		var data json.RawMessage
+		if idKeyed(change.Key) {
+			data, _ = json.Marshal(record["id"])
+		} else {
+			data, _ = json.Marshal(record["tag"])
+		}
+		ops = append(ops, saveOp{obj: change.Key, act: "del", data: data})
+	}
+	// Objects which existed before are restored
+	for _, record := range before {
+		act := "edit"
+		if !containsRecord(after, record) {
+			act = "new"
+		}
+		initUsers := ""
+		if change.Key == "inbounds" {
+			if users, ok := record["users"].([]interface{}); ok && act == "new" {
+				userIds := make([]string, len(users))
+				for i, user := range users {
+					userIds[i] = fmt.Sprint(user)
+				}
+				initUsers = strings.Join(userIds, ",")
+			}
+			delete(record, "users")
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, saveOp{obj: change.Key, act: act, data: data, initUsers: initUsers, revert: true})
+	}
+	objs, _, err := s.saveAll(ops, loginUser, hostname, false)
+	return objs, err
+}
+
+// Usage, the subscription token and the quota state of clients move on by themselves,
+// so they are not taken back by a revert
+var clientStateColumns = []string{"up", "down", "sub_token", "limited"}
+
+// keepClientState replaces the state of a client in a reverted record by its current state
+func keepClientState(tx *gorm.DB, data json.RawMessage) (json.RawMessage, error) {
+	var client model.Client
+	err := json.Unmarshal(data, &client)
+	if err != nil {
+		return nil, err
+	}
+	var current model.Client
+	err = tx.Model(model.Client{}).Select(clientStateColumns).Where("id = ?", client.Id).First(&current).Error
+	if err != nil {
+		return nil, err
+	}
+	client.Up = current.Up
+	client.Down = current.Down
+	client.SubToken = current.SubToken
+	client.Limited = current.Limited
+	return json.Marshal(client)
+}
+
+func containsRecord(records []map[string]interface{}, record map[string]interface{}) bool {
+	for _, r := range records {
+		if r["id"] == record["id"] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ConfigService) DelOldChanges(days int) error {
+	if days <= 0 {
+		return nil
+	}
+	oldTime := time.Now().AddDate(0, 0, -(days)).Unix()
+	db := database.GetDB()
+	return db.Where("date_time < ?", oldTime).Delete(model.Changes{}).Error
+}
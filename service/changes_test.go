@@ -0,0 +1,114 @@
+package service
+
+import (
+	"encoding/json"
+	"s-ui/database/model"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+func saveClient(t *testing.T, s *ConfigService, act string, data string) {
+	t.Helper()
+	_, _, err := s.Save("clients", act, json.RawMessage(data), "", "admin", "example.com", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lastChangeId(t *testing.T, db *gorm.DB) uint64 {
+	t.Helper()
+	var change model.Changes
+	err := db.Model(model.Changes{}).Order("id desc").First(&change).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return change.Id
+}
+
+func TestRevertEditKeepsClientState(t *testing.T) {
+	db := openTestDb(t)
+	s := &ConfigService{}
+	saveClient(t, s, "new", `{"enable":true,"name":"alice","desc":"old","volume":1000,"config":{},"inbounds":[],"links":[]}`)
+	client := loadClient(t, db, "alice")
+	data, _ := json.Marshal(map[string]interface{}{
+		"id": client.Id, "enable": true, "name": "alice", "desc": "new", "volume": 2000,
+		"subToken": client.SubToken, "config": map[string]interface{}{}, "inbounds": []uint{}, "links": []interface{}{},
+	})
+	saveClient(t, s, "edit", string(data))
+	changeId := lastChangeId(t, db)
+
+	// Usage, a rotated token and the quota state move on after the change
+	err := db.Model(model.Client{}).Where("id = ?", client.Id).Updates(map[string]interface{}{
+		"up": 500, "down": 700, "sub_token": "rotated", "limited": QuotaThrottle,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.RevertChange(changeId, "admin", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reverted := loadClient(t, db, "alice")
+	if reverted.Desc != "old" || reverted.Volume != 1000 {
+		t.Errorf("desc = %q, volume = %d, want the values before the change", reverted.Desc, reverted.Volume)
+	}
+	if reverted.Up != 500 || reverted.Down != 700 || reverted.SubToken != "rotated" || reverted.Limited != QuotaThrottle {
+		t.Errorf("up = %d, down = %d, token = %q, limited = %q, want the current state", reverted.Up, reverted.Down, reverted.SubToken, reverted.Limited)
+	}
+}
+
+func TestRevertNewAndDel(t *testing.T) {
+	db := openTestDb(t)
+	s := &ConfigService{}
+	saveClient(t, s, "new", `{"enable":true,"name":"alice","config":{},"inbounds":[],"links":[]}`)
+	created := lastChangeId(t, db)
+	client := loadClient(t, db, "alice")
+
+	saveClient(t, s, "del", `1`)
+	deleted := lastChangeId(t, db)
+	_, err := s.RevertChange(deleted, "admin", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := loadClient(t, db, "alice")
+	if restored.Id != client.Id || restored.SubToken != client.SubToken {
+		t.Errorf("restored client = %d %q, want %d %q", restored.Id, restored.SubToken, client.Id, client.SubToken)
+	}
+
+	_, err = s.RevertChange(created, "admin", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int64
+	db.Model(model.Client{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d clients after reverting their creation", count)
+	}
+}
+
+func TestRevertIsOneTransaction(t *testing.T) {
+	db := openTestDb(t)
+	s := &ConfigService{}
+	saveClient(t, s, "new", `{"enable":true,"name":"alice","desc":"current","config":{},"inbounds":[],"links":[]}`)
+	client := loadClient(t, db, "alice")
+
+	// The second record of the change is gone, so its part of the revert fails
+	before, _ := json.Marshal([]map[string]interface{}{
+		{"id": client.Id, "enable": true, "name": "alice", "desc": "old", "config": map[string]interface{}{}, "inbounds": []uint{}},
+		{"id": 99, "enable": true, "name": "gone", "config": map[string]interface{}{}, "inbounds": []uint{}},
+	})
+	change := model.Changes{Key: "clients", Action: "edit", Actor: "admin", Before: before, After: before}
+	err := db.Create(&change).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RevertChange(change.Id, "admin", "example.com")
+	if err == nil {
+		t.Fatal("revert of a missing client succeeds")
+	}
+	if got := loadClient(t, db, "alice"); got.Desc != "current" {
+		t.Errorf("desc = %q, a failed revert is partly committed", got.Desc)
+	}
+}
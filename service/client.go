@@ -1,20 +1,23 @@
 package service
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"s-ui/database"
 	"s-ui/database/model"
-	"s-ui/logger"
 	"s-ui/util"
 	"s-ui/util/common"
 	"strings"
 	"time"
 
+	"github.com/gofrs/uuid/v5"
 	"gorm.io/gorm"
 )
 
 type ClientService struct {
 	InboundService
+	DnsService
 }
 
 func (s *ClientService) Get(id string) (*[]model.Client, error) {
@@ -38,13 +41,134 @@ func (s *ClientService) getById(id string) (*[]model.Client, error) {
 func (s *ClientService) GetAll() (*[]model.Client, error) {
 	db := database.GetDB()
 	var clients []model.Client
-	err := db.Model(model.Client{}).Select("`id`, `enable`, `name`, `desc`, `group`, `inbounds`, `up`, `down`, `volume`, `expiry`").Find(&clients).Error
+	err := db.Model(model.Client{}).Select("id", "enable", "name", "desc", "group", "inbounds", "up", "down", "volume", "expiry").Find(&clients).Error
 	if err != nil {
 		return nil, err
 	}
 	return &clients, nil
 }
 
+// ClientFilter selects clients by their attributes. Empty fields do not filter.
+type ClientFilter struct {
+	Group     string `json:"group,omitempty"`
+	Enable    *bool  `json:"enable,omitempty"`
+	Expired   bool   `json:"expired,omitempty"`
+	OverQuota bool   `json:"overQuota,omitempty"`
+	Online    bool   `json:"online,omitempty"`
+	Inbound   uint   `json:"inbound,omitempty"`
+	Search    string `json:"search,omitempty"`
+}
+
+func (f *ClientFilter) empty() bool {
+	return f == nil || (f.Group == "" && f.Enable == nil && !f.Expired && !f.OverQuota && !f.Online && f.Inbound == 0 && f.Search == "")
+}
+
+func (f *ClientFilter) apply(query *gorm.DB) *gorm.DB {
+	if f == nil {
+		return query
+	}
+	if f.Group != "" {
+		query = query.Where(map[string]interface{}{"group": f.Group})
+	}
+	if f.Enable != nil {
+		query = query.Where("enable = ?", *f.Enable)
+	}
+	if f.Expired {
+		query = query.Where("expiry > 0 AND expiry < ?", time.Now().Unix())
+	}
+	if f.OverQuota {
+		query = query.Where("volume > 0 AND up + down >= volume")
+	}
+	if f.Online {
+		query = query.Where("name in ?", append([]string{}, onlineResources.User...))
+	}
+	if f.Inbound > 0 {
+		query = query.Where(database.JsonArrayContains("clients.inbounds"), f.Inbound)
+	}
+	if f.Search != "" {
+		pattern := "%" + strings.ToLower(f.Search) + "%"
+		query = query.Where("LOWER(name) LIKE ? OR LOWER("+database.QuoteColumn("desc")+") LIKE ?", pattern, pattern)
+	}
+	return query
+}
+
+// ClientQuery is a page of clients matching a filter, in the given order
+type ClientQuery struct {
+	ClientFilter
+	Page int    `json:"page"`
+	Size int    `json:"size"`
+	Sort string `json:"sort"`
+	Desc bool   `json:"desc"`
+}
+
+type ClientPage struct {
+	Clients []model.Client `json:"clients"`
+	Total   int64          `json:"total"`
+	Page    int            `json:"page"`
+	Size    int            `json:"size"`
+}
+
+const (
+	defaultClientPageSize = 50
+	maxClientPageSize     = 1000
+)
+
+// clientOrder returns the order clause of a sort of clients, ties are in order of id
+func clientOrder(sort string, desc bool) (string, error) {
+	var columns []string
+	switch sort {
+	case "", "id":
+	case "name", "volume":
+		columns = []string{sort}
+	case "group":
+		columns = []string{database.QuoteColumn("group")}
+	case "usage":
+		columns = []string{"up + down"}
+	case "expiry":
+		// Unlimited clients come after the ones with an expiry
+		columns = []string{"CASE WHEN expiry = 0 THEN 1 ELSE 0 END", "expiry"}
+	default:
+		return "", common.NewErrorf("unknown sort of clients: %s", sort)
+	}
+	columns = append(columns, "id")
+	if desc {
+		for i := range columns {
+			columns[i] += " DESC"
+		}
+	}
+	return strings.Join(columns, ", "), nil
+}
+
+func (s *ClientService) GetPage(q *ClientQuery) (*ClientPage, error) {
+	if q.Page < 1 {
+		q.Page = 1
+	}
+	if q.Size < 1 {
+		q.Size = defaultClientPageSize
+	} else if q.Size > maxClientPageSize {
+		q.Size = maxClientPageSize
+	}
+	order, err := clientOrder(q.Sort, q.Desc)
+	if err != nil {
+		return nil, err
+	}
+
+	db := database.GetDB()
+	page := &ClientPage{Clients: []model.Client{}, Page: q.Page, Size: q.Size}
+	err = q.apply(db.Model(model.Client{})).Count(&page.Total).Error
+	if err != nil {
+		return nil, err
+	}
+	err = q.apply(db.Model(model.Client{})).
+		Select("id", "enable", "name", "desc", "group", "inbounds", "up", "down", "volume", "expiry").
+		Order(order).Limit(q.Size).Offset((q.Page - 1) * q.Size).
+		Find(&page.Clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
 func (s *ClientService) Save(tx *gorm.DB, act string, data json.RawMessage, hostname string) ([]uint, error) {
 	var err error
 	var inboundIds []uint
@@ -54,11 +178,23 @@ func (s *ClientService) Save(tx *gorm.DB, act string, data json.RawMessage, host
 		var client model.Client
 		err = json.Unmarshal(data, &client)
 		if err != nil {
-			return nil, common.NewErrorf("failed to unmarshal client data: %w", err)
+			return nil, common.NewErrorf("failed to unmarshal client data: %v", err)
 		}
 		err = json.Unmarshal(client.Inbounds, &inboundIds)
 		if err != nil {
-			return nil, common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d: %w", client.Id, err)
+			return nil, common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d: %v", client.Id, err)
+		}
+		err = s.DnsService.ValidateClientDns(tx, client.Dns)
+		if err != nil {
+			return nil, err
+		}
+		err = validateQuotaPolicy(client.GraceDays, client.QuotaAction, client.ThrottleKbps)
+		if err != nil {
+			return nil, err
+		}
+		err = setSubTokens(tx, []*model.Client{&client})
+		if err != nil {
+			return nil, err
 		}
 		err = s.updateLinksWithFixedInbounds(tx, []*model.Client{&client}, inboundIds, hostname)
 		if err != nil {
@@ -66,13 +202,13 @@ func (s *ClientService) Save(tx *gorm.DB, act string, data json.RawMessage, host
 		}
 		err = tx.Save(&client).Error
 		if err != nil {
-			return nil, common.NewErrorf("failed to save client ID %d: %w", client.Id, err)
+			return nil, common.NewErrorf("failed to save client ID %d: %v", client.Id, err)
 		}
 	case "addbulk":
 		var clients []*model.Client
 		err = json.Unmarshal(data, &clients)
 		if err != nil {
-			return nil, common.NewErrorf("failed to unmarshal bulk client data: %w", err)
+			return nil, common.NewErrorf("failed to unmarshal bulk client data: %v", err)
 		}
 		if len(clients) == 0 {
 			// No clients to add. Return successfully with no inbound IDs affected.
@@ -84,39 +220,58 @@ func (s *ClientService) Save(tx *gorm.DB, act string, data json.RawMessage, host
 		if clients[0].Inbounds != nil {
 			err = json.Unmarshal(clients[0].Inbounds, &inboundIds)
 			if err != nil {
-				return nil, common.NewErrorf("failed to unmarshal inbounds for the first client in bulk add: %w", err)
+				return nil, common.NewErrorf("failed to unmarshal inbounds for the first client in bulk add: %v", err)
 			}
 		} else {
 			// If Inbounds is nil, initialize inboundIds as an empty slice.
 			// This means no specific inbounds are linked, or they will be handled by updateLinksWithFixedInbounds if logic allows.
 			inboundIds = []uint{}
 		}
+		for _, client := range clients {
+			err = s.DnsService.ValidateClientDns(tx, client.Dns)
+			if err != nil {
+				return nil, err
+			}
+			err = validateQuotaPolicy(client.GraceDays, client.QuotaAction, client.ThrottleKbps)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = setSubTokens(tx, clients)
+		if err != nil {
+			return nil, err
+		}
 		err = s.updateLinksWithFixedInbounds(tx, clients, inboundIds, hostname)
 		if err != nil {
-			return nil, common.NewErrorf("failed to update links for bulk clients: %w", err)
+			return nil, common.NewErrorf("failed to update links for bulk clients: %v", err)
 		}
 		err = tx.Save(clients).Error
 		if err != nil {
-			return nil, common.NewErrorf("failed to save bulk clients: %w", err)
+			return nil, common.NewErrorf("failed to save bulk clients: %v", err)
+		}
+	case "addplan":
+		inboundIds, err = s.addPlanClients(tx, data, hostname)
+		if err != nil {
+			return nil, err
 		}
 	case "del":
 		var id uint
 		err = json.Unmarshal(data, &id)
 		if err != nil {
-			return nil, common.NewErrorf("failed to unmarshal client ID for deletion: %w", err)
+			return nil, common.NewErrorf("failed to unmarshal client ID for deletion: %v", err)
 		}
 		var client model.Client
 		err = tx.Where("id = ?", id).First(&client).Error
 		if err != nil {
-			return nil, common.NewErrorf("failed to find client ID %d for deletion: %w", id, err)
+			return nil, common.NewErrorf("failed to find client ID %d for deletion: %v", id, err)
 		}
 		err = json.Unmarshal(client.Inbounds, &inboundIds)
 		if err != nil {
-			return nil, common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d being deleted: %w", id, err)
+			return nil, common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d being deleted: %v", id, err)
 		}
 		err = tx.Where("id = ?", id).Delete(model.Client{}).Error
 		if err != nil {
-			return nil, common.NewErrorf("failed to delete client ID %d: %w", id, err)
+			return nil, common.NewErrorf("failed to delete client ID %d: %v", id, err)
 		}
 	default:
 		return nil, common.NewErrorf("unknown action: %s", act)
@@ -125,6 +280,95 @@ func (s *ClientService) Save(tx *gorm.DB, act string, data json.RawMessage, host
 	return inboundIds, nil
 }
 
+// clientCredentials are the secrets of a client, shared by its users in inbounds of all protocols
+type clientCredentials struct {
+	uuid         string
+	password     string
+	ssPassword   string
+	ss16Password string
+	flow         string
+}
+
+// config returns the users of a client for each protocol, with random secrets where they are empty
+func (c *clientCredentials) config(name string) json.RawMessage {
+	if c.uuid == "" {
+		id, _ := uuid.NewV4()
+		c.uuid = id.String()
+	}
+	if c.password == "" {
+		c.password = common.Random(16)
+	}
+	if c.ssPassword == "" {
+		c.ssPassword = randomKey(32)
+	}
+	if c.ss16Password == "" {
+		c.ss16Password = randomKey(16)
+	}
+	userPass := map[string]interface{}{"username": name, "password": c.password}
+	config := map[string]interface{}{
+		"mixed":         userPass,
+		"socks":         userPass,
+		"http":          userPass,
+		"naive":         userPass,
+		"shadowsocks":   map[string]interface{}{"name": name, "password": c.ssPassword},
+		"shadowsocks16": map[string]interface{}{"name": name, "password": c.ss16Password},
+		"shadowtls":     map[string]interface{}{"name": name, "password": c.password},
+		"vmess":         map[string]interface{}{"name": name, "uuid": c.uuid, "alterId": 0},
+		"vless":         map[string]interface{}{"name": name, "uuid": c.uuid, "flow": c.flow},
+		"trojan":        map[string]interface{}{"name": name, "password": c.password},
+		"hysteria":      map[string]interface{}{"name": name, "auth_str": c.password},
+		"tuic":          map[string]interface{}{"name": name, "uuid": c.uuid, "password": c.password},
+		"hysteria2":     map[string]interface{}{"name": name, "password": c.password},
+	}
+	data, _ := json.Marshal(config)
+	return data
+}
+
+func randomKey(size int) string {
+	key := make([]byte, size)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// newSubToken is a random id of a client in links of subscriptions and the portal
+func newSubToken() string {
+	token := make([]byte, 18)
+	rand.Read(token)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// setSubTokens keeps the saved subscription token of clients which come without one, and gives new clients a new one.
+// A token of another client is refused, since it opens the subscription of that client.
+// Links by name are kept only with the saved token, so a new token stops them too.
+func setSubTokens(tx *gorm.DB, clients []*model.Client) error {
+	for _, client := range clients {
+		var saved model.Client
+		if client.Id > 0 {
+			err := tx.Model(model.Client{}).Select("sub_token", "sub_by_name").Where("id = ?", client.Id).Find(&saved).Error
+			if err != nil {
+				return err
+			}
+		}
+		if client.SubToken == "" {
+			client.SubToken = saved.SubToken
+		}
+		client.SubByName = saved.SubByName && client.SubToken == saved.SubToken
+		if client.SubToken == "" {
+			client.SubToken = newSubToken()
+			continue
+		}
+		var count int64
+		err := tx.Model(model.Client{}).Where("sub_token = ? AND id <> ?", client.SubToken, client.Id).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return common.NewErrorf("subscription token of client %s is used by another client", client.Name)
+		}
+	}
+	return nil
+}
+
 func (s *ClientService) updateLinksWithFixedInbounds(tx *gorm.DB, clients []*model.Client, inbounIds []uint, hostname string) error {
 	var err error
 	var inbounds []model.Inbound
@@ -133,7 +377,7 @@ func (s *ClientService) updateLinksWithFixedInbounds(tx *gorm.DB, clients []*mod
 	if len(inbounIds) > 0 {
 		err = tx.Model(model.Inbound{}).Preload("Tls").Where("id in ? and type in ?", inbounIds, util.InboundTypeWithLink).Find(&inbounds).Error
 		if err != nil {
-			return common.NewErrorf("failed to find inbounds for link update: %w", err)
+			return common.NewErrorf("failed to find inbounds for link update: %v", err)
 		}
 	}
 	for index, client := range clients {
@@ -142,13 +386,13 @@ func (s *ClientService) updateLinksWithFixedInbounds(tx *gorm.DB, clients []*mod
 		if client.Links != nil {
 			err = json.Unmarshal(client.Links, &clientLinks)
 			if err != nil {
-				return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %w", client.Id, err)
+				return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %v", client.Id, err)
 			}
 		}
 
 		newClientLinks := []map[string]string{}
 		for _, inbound := range inbounds {
-			newLinks := util.LinkGenerator(client.Config, &inbound, hostname)
+			newLinks := s.linkGenerator(tx, client.Config, &inbound, hostname)
 			for _, newLink := range newLinks {
 				newClientLinks = append(newClientLinks, map[string]string{
 					"remark": inbound.Tag,
@@ -167,7 +411,7 @@ func (s *ClientService) updateLinksWithFixedInbounds(tx *gorm.DB, clients []*mod
 
 		clients[index].Links, err = json.MarshalIndent(newClientLinks, "", "  ")
 		if err != nil {
-			return common.NewErrorf("failed to marshal new client links for client ID %d: %w", client.Id, err)
+			return common.NewErrorf("failed to marshal new client links for client ID %d: %v", client.Id, err)
 		}
 	}
 	return nil
@@ -181,12 +425,12 @@ func (s *ClientService) UpdateClientsOnInboundAdd(tx *gorm.DB, initIds string, i
 	var clients []model.Client
 	err := tx.Model(model.Client{}).Where("id in ?", clientIds).Find(&clients).Error
 	if err != nil {
-		return common.NewErrorf("failed to find clients for inbound add: %w", err)
+		return common.NewErrorf("failed to find clients for inbound add: %v", err)
 	}
 	var inbound model.Inbound
 	err = tx.Model(model.Inbound{}).Preload("Tls").Where("id = ?", inboundId).Find(&inbound).Error
 	if err != nil {
-		return common.NewErrorf("failed to find inbound ID %d: %w", inboundId, err)
+		return common.NewErrorf("failed to find inbound ID %d: %v", inboundId, err)
 	}
 	for _, client := range clients {
 		// Add inbounds
@@ -194,23 +438,23 @@ func (s *ClientService) UpdateClientsOnInboundAdd(tx *gorm.DB, initIds string, i
 		if client.Inbounds != nil { // Check if Inbounds is nil before unmarshalling
 			err = json.Unmarshal(client.Inbounds, &clientInbounds)
 			if err != nil {
-				return common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d: %w", client.Id, err)
+				return common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d: %v", client.Id, err)
 			}
 		}
 		clientInbounds = append(clientInbounds, inboundId)
 		client.Inbounds, err = json.MarshalIndent(clientInbounds, "", "  ")
 		if err != nil {
-			return common.NewErrorf("failed to marshal client.Inbounds for client ID %d: %w", client.Id, err)
+			return common.NewErrorf("failed to marshal client.Inbounds for client ID %d: %v", client.Id, err)
 		}
 		// Add links
 		var clientLinks, newClientLinks []map[string]string
 		if client.Links != nil { // Check if Links is nil before unmarshalling
 			err = json.Unmarshal(client.Links, &clientLinks)
 			if err != nil {
-				return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %w", client.Id, err)
+				return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %v", client.Id, err)
 			}
 		}
-		newLinks := util.LinkGenerator(client.Config, &inbound, hostname)
+		newLinks := s.linkGenerator(tx, client.Config, &inbound, hostname)
 		for _, newLink := range newLinks {
 			newClientLinks = append(newClientLinks, map[string]string{
 				"remark": inbound.Tag,
@@ -226,11 +470,11 @@ func (s *ClientService) UpdateClientsOnInboundAdd(tx *gorm.DB, initIds string, i
 
 		client.Links, err = json.MarshalIndent(newClientLinks, "", "  ")
 		if err != nil {
-			return common.NewErrorf("failed to marshal client.Links for client ID %d: %w", client.Id, err)
+			return common.NewErrorf("failed to marshal client.Links for client ID %d: %v", client.Id, err)
 		}
 		err = tx.Save(&client).Error
 		if err != nil {
-			return common.NewErrorf("failed to save client ID %d after inbound add: %w", client.Id, err)
+			return common.NewErrorf("failed to save client ID %d after inbound add: %v", client.Id, err)
 		}
 	}
 	return nil
@@ -239,10 +483,10 @@ func (s *ClientService) UpdateClientsOnInboundAdd(tx *gorm.DB, initIds string, i
 func (s *ClientService) UpdateClientsOnInboundDelete(tx *gorm.DB, id uint, tag string) error {
 	var clients []model.Client
 	err := tx.Table("clients").
-		Where("EXISTS (SELECT 1 FROM json_each(clients.inbounds) WHERE json_each.value = ?)", id).
+		Where(database.JsonArrayContains("clients.inbounds"), id).
 		Find(&clients).Error
 	if err != nil {
-		return common.NewErrorf("failed to find clients for inbound delete (inbound ID %d): %w", id, err)
+		return common.NewErrorf("failed to find clients for inbound delete (inbound ID %d): %v", id, err)
 	}
 	for _, client := range clients {
 		// Delete inbounds
@@ -250,7 +494,7 @@ func (s *ClientService) UpdateClientsOnInboundDelete(tx *gorm.DB, id uint, tag s
 		if client.Inbounds != nil {
 			err = json.Unmarshal(client.Inbounds, &clientInbounds)
 			if err != nil {
-				return common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d: %w", client.Id, err)
+				return common.NewErrorf("failed to unmarshal client.Inbounds for client ID %d: %v", client.Id, err)
 			}
 		}
 		for _, clientInbound := range clientInbounds {
@@ -260,14 +504,14 @@ func (s *ClientService) UpdateClientsOnInboundDelete(tx *gorm.DB, id uint, tag s
 		}
 		client.Inbounds, err = json.MarshalIndent(newClientInbounds, "", "  ")
 		if err != nil {
-			return common.NewErrorf("failed to marshal client.Inbounds for client ID %d: %w", client.Id, err)
+			return common.NewErrorf("failed to marshal client.Inbounds for client ID %d: %v", client.Id, err)
 		}
 		// Delete links
 		var clientLinks, newClientLinks []map[string]string
 		if client.Links != nil {
 			err = json.Unmarshal(client.Links, &clientLinks)
 			if err != nil {
-				return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %w", client.Id, err)
+				return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %v", client.Id, err)
 			}
 		}
 		for _, clientLink := range clientLinks {
@@ -277,11 +521,11 @@ func (s *ClientService) UpdateClientsOnInboundDelete(tx *gorm.DB, id uint, tag s
 		}
 		client.Links, err = json.MarshalIndent(newClientLinks, "", "  ")
 		if err != nil {
-			return common.NewErrorf("failed to marshal client.Links for client ID %d: %w", client.Id, err)
+			return common.NewErrorf("failed to marshal client.Links for client ID %d: %v", client.Id, err)
 		}
 		err = tx.Save(&client).Error
 		if err != nil {
-			return common.NewErrorf("failed to save client ID %d after inbound delete: %w", client.Id, err)
+			return common.NewErrorf("failed to save client ID %d after inbound delete: %v", client.Id, err)
 		}
 	}
 	return nil
@@ -294,25 +538,25 @@ func (s *ClientService) UpdateLinksByInboundChange(tx *gorm.DB, inbounIds []uint
 		if database.IsNotFound(err) {
 			return nil // No matching inbounds found, not an error, just nothing to do.
 		}
-		return common.NewErrorf("failed to find inbounds for link change: %w", err)
+		return common.NewErrorf("failed to find inbounds for link change: %v", err)
 	}
 	for _, inbound := range inbounds {
 		var clients []model.Client
 		err = tx.Table("clients").
-			Where("EXISTS (SELECT 1 FROM json_each(clients.inbounds) WHERE json_each.value = ?)", inbound.Id).
+			Where(database.JsonArrayContains("clients.inbounds"), inbound.Id).
 			Find(&clients).Error
 		if err != nil {
-			return common.NewErrorf("failed to find clients for inbound ID %d link change: %w", inbound.Id, err)
+			return common.NewErrorf("failed to find clients for inbound ID %d link change: %v", inbound.Id, err)
 		}
 		for _, client := range clients {
 			var clientLinks, newClientLinks []map[string]string
 			if client.Links != nil {
 				err = json.Unmarshal(client.Links, &clientLinks)
 				if err != nil {
-					return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %w", client.Id, err)
+					return common.NewErrorf("failed to unmarshal client.Links for client ID %d: %v", client.Id, err)
 				}
 			}
-			newLinks := util.LinkGenerator(client.Config, &inbound, hostname)
+			newLinks := s.linkGenerator(tx, client.Config, &inbound, hostname)
 			for _, newLink := range newLinks {
 				newClientLinks = append(newClientLinks, map[string]string{
 					"remark": inbound.Tag,
@@ -328,88 +572,41 @@ func (s *ClientService) UpdateLinksByInboundChange(tx *gorm.DB, inbounIds []uint
 
 			client.Links, err = json.MarshalIndent(newClientLinks, "", "  ")
 			if err != nil {
-				return common.NewErrorf("failed to marshal client.Links for client ID %d: %w", client.Id, err)
+				return common.NewErrorf("failed to marshal client.Links for client ID %d: %v", client.Id, err)
 			}
 			err = tx.Save(&client).Error
 			if err != nil {
-				return common.NewErrorf("failed to save client ID %d after link change: %w", client.Id, err)
+				return common.NewErrorf("failed to save client ID %d after link change: %v", client.Id, err)
 			}
 		}
 	}
 	return nil
 }
 
-func (s *ClientService) DepleteClients() error {
-	var err error
-	var clients []model.Client
-	var changes []model.Changes
-	var inboundIds []uint
-
-	now := time.Now().Unix()
-	db := database.GetDB()
-
-	tx := db.Begin()
-	defer func() {
-		if err == nil {
-			tx.Commit()
-			if len(inboundIds) > 0 && corePtr.IsRunning() {
-				// Pass tx to RestartInbounds to ensure atomicity
-				err1 := s.InboundService.RestartInbounds(tx, inboundIds) // Changed db to tx
-				if err1 != nil {
-					logger.Error("unable to restart inbounds: ", err1)
-				}
-			}
-		} else {
-			tx.Rollback()
-		}
-	}()
-
-	err = tx.Model(model.Client{}).Where("enable = true AND ((volume >0 AND up+down > volume) OR (expiry > 0 AND expiry < ?))", now).Find(&clients).Error
-	if err != nil {
-		// Wrap GORM errors for better context if this function returns the error directly
-		return common.NewErrorf("failed to find clients for depletion: %w", err)
+// linkGenerator resolves inbound dependencies which are needed for link generation
+func (s *ClientService) linkGenerator(tx *gorm.DB, clientConfig json.RawMessage, inbound *model.Inbound, hostname string) []string {
+	if inbound.Type != "shadowtls" {
+		return util.LinkGenerator(clientConfig, inbound, hostname)
 	}
 
-	dt := time.Now().Unix()
-	for _, client := range clients {
-		logger.Debug("Client ", client.Name, " is going to be disabled")
-		var userInbounds []uint
-		if client.Inbounds != nil {
-			err = json.Unmarshal(client.Inbounds, &userInbounds)
-			if err != nil {
-				// Log the error and continue to disable other clients, or return the error.
-				// For a batch job, logging and continuing might be preferable.
-				logger.Errorf("failed to unmarshal client.Inbounds for client %s (ID %d) during depletion: %v", client.Name, client.Id, err)
-				// Decide if this error should halt the entire depletion or just skip this client's inbounds for restart.
-				// For now, we'll let it proceed to collect other inboundIds, but this client's inbounds might be missed for restart.
-				// Clear the error so the transaction can continue for other clients
-				err = nil
-			}
-		}
-		inboundIds = s.uniqueAppendInboundIds(inboundIds, userInbounds)
-		changes = append(changes, model.Changes{
-			DateTime: dt,
-			Actor:    "DepleteJob",
-			Key:      "clients",
-			Action:   "disable",
-			Obj:      json.RawMessage("\"" + client.Name + "\""),
-		})
+	var detourTag string
+	err := tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Pluck(database.JsonExtract("options", "detour"), &detourTag).Error
+	if err != nil || len(detourTag) == 0 {
+		return []string{}
 	}
-
-	// Save changes
-	if len(changes) > 0 {
-		err = tx.Model(model.Client{}).Where("enable = true AND ((volume >0 AND up+down > volume) OR (expiry > 0 AND expiry < ?))", now).Update("enable", false).Error
-		if err != nil {
-			return common.NewErrorf("failed to update clients to disabled state during depletion: %w", err)
-		}
-		err = tx.Model(model.Changes{}).Create(&changes).Error
-		if err != nil {
-			return common.NewErrorf("failed to create change log during client depletion: %w", err)
-		}
-		LastUpdate = dt
+	var detour model.Inbound
+	err = tx.Model(model.Inbound{}).Where("tag = ?", detourTag).First(&detour).Error
+	if err != nil {
+		return []string{}
 	}
-
-	return nil
+	var detourUsers int64
+	err = tx.Model(model.Client{}).
+		Where(database.JsonArrayContains("clients.inbounds"), detour.Id).
+		Count(&detourUsers).Error
+	if err != nil {
+		return []string{}
+	}
+	return util.ShadowTlsLinkGenerator(clientConfig, inbound, &detour, detourUsers > 0, hostname)
 }
 
 // avoid duplicate inboundIds
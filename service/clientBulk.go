@@ -0,0 +1,343 @@
+package service
+
+import (
+	"encoding/json"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strings"
+	"time"
+)
+
+// ClientBulkEdit holds the fields set by a bulk edit. Nil fields are kept.
+type ClientBulkEdit struct {
+	Enable *bool   `json:"enable,omitempty"`
+	Volume *int64  `json:"volume,omitempty"`
+	Expiry *int64  `json:"expiry,omitempty"`
+	Desc   *string `json:"desc,omitempty"`
+	Group  *string `json:"group,omitempty"`
+	Dns    *string `json:"dns,omitempty"`
+}
+
+// ClientBulkRequest is an operation over clients selected by ids, or by a filter
+type ClientBulkRequest struct {
+	Action string        `json:"action"`
+	Ids    []uint        `json:"ids,omitempty"`
+	Filter *ClientFilter `json:"filter,omitempty"`
+	// edit
+	Edit *ClientBulkEdit `json:"edit,omitempty"`
+	// extendExpiry, in days
+	Days int64 `json:"days,omitempty"`
+	// addVolume, in bytes
+	Volume int64 `json:"volume,omitempty"`
+	// moveInbounds, the inbound ids to set, add or remove
+	Inbounds []uint `json:"inbounds,omitempty"`
+	Mode     string `json:"mode,omitempty"`
+}
+
+type ClientBulkResult struct {
+	Action string `json:"action"`
+	Ids    []uint `json:"ids"`
+}
+
+var clientBulkActions = map[string]bool{
+	"edit":         true,
+	"del":          true,
+	"enable":       true,
+	"disable":      true,
+	"resetTraffic": true,
+	"extendExpiry": true,
+	"addVolume":    true,
+	"moveInbounds": true,
+}
+
+func (r *ClientBulkRequest) validate() error {
+	if !clientBulkActions[r.Action] {
+		return common.NewErrorf("unknown bulk action: %s", r.Action)
+	}
+	if len(r.Ids) == 0 && r.Filter.empty() {
+		return common.NewError("no clients are selected")
+	}
+	switch r.Action {
+	case "edit":
+		if r.Edit == nil {
+			return common.NewError("edit needs the fields to set")
+		}
+	case "extendExpiry":
+		if r.Days == 0 {
+			return common.NewError("extendExpiry needs days")
+		}
+	case "addVolume":
+		if r.Volume == 0 {
+			return common.NewError("addVolume needs a volume")
+		}
+	case "moveInbounds":
+		switch r.Mode {
+		case "":
+			r.Mode = "set"
+		case "set", "add", "remove":
+		default:
+			return common.NewErrorf("unknown mode of moveInbounds: %s", r.Mode)
+		}
+	}
+	return nil
+}
+
+// BulkClients applies one operation to all selected clients in a single transaction.
+// Inbounds of the affected users are restarted once, and each client gets its own change entry.
+func (s *ConfigService) BulkClients(data json.RawMessage, loginUser string, hostname string) (result *ClientBulkResult, err error) {
+	var req ClientBulkRequest
+	err = json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, common.NewErrorf("failed to unmarshal bulk request: %v", err)
+	}
+	err = req.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var inboundIds []uint
+	var reloadRouter bool
+	wasRunning := corePtr.IsRunning()
+	db := database.GetDB()
+	tx := db.Begin()
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			if wasRunning && !corePtr.IsRunning() {
+				errStart := s.StartCore("")
+				if errStart != nil {
+					logger.Errorf("failed to start core after a failed bulk change: %v", errStart)
+				}
+			}
+			return
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			return
+		}
+		if corePtr.IsRunning() {
+			errApply := s.applyCoreChanges(&coreChanges{reloadRouter: reloadRouter, userLimits: true}, inboundIds)
+			if errApply != nil {
+				logger.Errorf("unable to apply bulk change to core: %v", errApply)
+			}
+		}
+		LastUpdate = time.Now().Unix()
+	}()
+
+	query := tx.Model(model.Client{})
+	if len(req.Ids) > 0 {
+		query = query.Where("id in ?", req.Ids)
+	}
+	var clients []model.Client
+	err = req.Filter.apply(query).Order("id").Find(&clients).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to find clients: %v", err)
+	}
+	if len(clients) == 0 {
+		return nil, common.NewError("no clients match the selection")
+	}
+
+	if req.Action == "edit" && req.Edit.Dns != nil {
+		err = s.DnsService.ValidateClientDns(tx, *req.Edit.Dns)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if req.Action == "moveInbounds" && len(req.Inbounds) > 0 {
+		var count int64
+		err = tx.Model(model.Inbound{}).Where("id in ?", req.Inbounds).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if int(count) != len(uniqueIds(req.Inbounds)) {
+			return nil, common.NewError("some inbounds do not exist")
+		}
+	}
+
+	oldClientDns, err := s.DnsService.clientRules(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	restartIds := map[uint]bool{}
+	result = &ClientBulkResult{Action: req.Action, Ids: make([]uint, 0, len(clients))}
+	dt := time.Now().Unix()
+	for i := range clients {
+		client := &clients[i]
+		var before, after json.RawMessage
+		before, err = json.Marshal([]model.Client{*client})
+		if err != nil {
+			return nil, err
+		}
+		var userInbounds []uint
+		if client.Inbounds != nil {
+			err = json.Unmarshal(client.Inbounds, &userInbounds)
+			if err != nil {
+				return nil, common.NewErrorf("failed to unmarshal inbounds of client %s: %v", client.Name, err)
+			}
+		}
+		wasEnabled := client.Enable
+		newInbounds := userInbounds
+
+		switch req.Action {
+		case "edit":
+			if req.Edit.Enable != nil {
+				client.Enable = *req.Edit.Enable
+			}
+			if req.Edit.Volume != nil {
+				client.Volume = *req.Edit.Volume
+			}
+			if req.Edit.Expiry != nil {
+				client.Expiry = *req.Edit.Expiry
+			}
+			if req.Edit.Desc != nil {
+				client.Desc = *req.Edit.Desc
+			}
+			if req.Edit.Group != nil {
+				client.Group = *req.Edit.Group
+			}
+			if req.Edit.Dns != nil {
+				client.Dns = *req.Edit.Dns
+			}
+		case "enable":
+			client.Enable = true
+		case "disable":
+			client.Enable = false
+		case "resetTraffic":
+			client.Up = 0
+			client.Down = 0
+		case "extendExpiry":
+			// Unlimited clients stay unlimited, and expired ones are extended from now
+			if client.Expiry > 0 {
+				if client.Expiry < dt {
+					client.Expiry = dt
+				}
+				client.Expiry += req.Days * 86400
+			}
+		case "addVolume":
+			// Unlimited clients stay unlimited
+			if client.Volume > 0 {
+				client.Volume += req.Volume
+				if client.Volume <= 0 {
+					return nil, common.NewErrorf("volume of client %s would be exhausted", client.Name)
+				}
+			}
+		case "moveInbounds":
+			newInbounds = moveInbounds(userInbounds, req.Inbounds, req.Mode)
+			client.Inbounds, err = json.Marshal(newInbounds)
+			if err != nil {
+				return nil, err
+			}
+			err = s.ClientService.updateLinksWithFixedInbounds(tx, []*model.Client{client}, newInbounds, hostname)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if req.Action == "del" {
+			err = tx.Where("id = ?", client.Id).Delete(model.Client{}).Error
+			if err != nil {
+				return nil, common.NewErrorf("failed to delete client %s: %v", client.Name, err)
+			}
+		} else {
+			err = tx.Save(client).Error
+			if err != nil {
+				return nil, common.NewErrorf("failed to save client %s: %v", client.Name, err)
+			}
+			after, err = json.Marshal([]model.Client{*client})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		// Users of inbounds change only with deletion, enabling or moving
+		if req.Action == "del" || wasEnabled != client.Enable || req.Action == "moveInbounds" {
+			for _, id := range userInbounds {
+				restartIds[id] = true
+			}
+			for _, id := range newInbounds {
+				restartIds[id] = true
+			}
+		}
+
+		err = tx.Create(&model.Changes{
+			DateTime: dt,
+			Actor:    loginUser,
+			Key:      "clients",
+			Action:   "bulk-" + req.Action,
+			Obj:      data,
+			Before:   before,
+			After:    after,
+		}).Error
+		if err != nil {
+			return nil, common.NewErrorf("failed to create change log: %v", err)
+		}
+		result.Ids = append(result.Ids, client.Id)
+	}
+
+	if len(restartIds) > 0 {
+		var detourIds []uint
+		ids := make([]uint, 0, len(restartIds))
+		for id := range restartIds {
+			ids = append(ids, id)
+		}
+		detourIds, err = s.InboundService.DetourInboundIds(tx, ids)
+		if err != nil {
+			return nil, err
+		}
+		inboundIds = uniqueIds(append(ids, detourIds...))
+	}
+
+	pendingConfig, err := s.getConfig(tx, "")
+	if err != nil {
+		return nil, err
+	}
+	err = s.CheckConfig(pendingConfig)
+	if err != nil {
+		return nil, common.NewErrorf("invalid config: %s", strings.TrimSpace(err.Error()))
+	}
+
+	newClientDns, err := s.DnsService.clientRules(tx)
+	if err != nil {
+		return nil, err
+	}
+	oldDnsJson, _ := json.Marshal(oldClientDns)
+	newDnsJson, _ := json.Marshal(newClientDns)
+	reloadRouter = string(oldDnsJson) != string(newDnsJson)
+	return result, nil
+}
+
+func moveInbounds(current []uint, inbounds []uint, mode string) []uint {
+	switch mode {
+	case "add":
+		return uniqueIds(append(append([]uint{}, current...), inbounds...))
+	case "remove":
+		removed := make(map[uint]bool, len(inbounds))
+		for _, id := range inbounds {
+			removed[id] = true
+		}
+		result := []uint{}
+		for _, id := range current {
+			if !removed[id] {
+				result = append(result, id)
+			}
+		}
+		return result
+	default:
+		return uniqueIds(inbounds)
+	}
+}
+
+func uniqueIds(ids []uint) []uint {
+	seen := make(map[uint]bool, len(ids))
+	result := make([]uint, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	return result
+}
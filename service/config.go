@@ -2,13 +2,18 @@ package service
 
 import (
 	"encoding/json"
+	"os"
 	"s-ui/core"
 	"s-ui/database"
 	"s-ui/database/model"
 	"s-ui/logger"
 	"s-ui/util/common"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 var (
@@ -23,6 +28,10 @@ type ConfigService struct {
 	InboundService
 	OutboundService
 	EndpointService
+	RouteRuleService
+	RuleSetService
+	DnsService
+	PlanService
 }
 
 type SingBoxConfig struct {
@@ -42,52 +51,39 @@ func NewConfigService(core *core.Core) *ConfigService {
 }
 
 func (s *ConfigService) GetConfig(data string) (*SingBoxConfig, error) {
-	var err error
-	if len(data) == 0 {
-		data, err = s.SettingService.GetConfig()
-		if err != nil {
-			return nil, common.NewErrorf("failed to get base config from settings: %w", err)
-		}
-	}
-	singboxConfig := SingBoxConfig{}
-	err = json.Unmarshal([]byte(data), &singboxConfig)
-	if err != nil {
-		return nil, common.NewErrorf("failed to unmarshal base config: %w", err)
-	}
-
-	singboxConfig.Inbounds, err = s.InboundService.GetAllConfig(database.GetDB())
-	if err != nil {
-		return nil, common.NewErrorf("failed to get all inbound configs: %w", err)
-	}
-	singboxConfig.Outbounds, err = s.OutboundService.GetAllConfig(database.GetDB())
-	if err != nil {
-		return nil, common.NewErrorf("failed to get all outbound configs: %w", err)
-	}
-	singboxConfig.Endpoints, err = s.EndpointService.GetAllConfig(database.GetDB())
-	if err != nil {
-		return nil, common.NewErrorf("failed to get all endpoint configs: %w", err)
-	}
-	return &singboxConfig, nil
+	return s.getConfig(database.GetDB(), data)
 }
 
 func (s *ConfigService) StartCore(defaultConfig string) error {
 	if corePtr.IsRunning() {
 		return nil
 	}
+	err := s.applyUserLimits(database.GetDB())
+	if err != nil {
+		logger.Warning("unable to apply speed limits of clients: ", err)
+	}
 	singboxConfig, err := s.GetConfig(defaultConfig)
 	if err != nil {
-		return common.NewErrorf("failed to get full config for core start: %w", err)
+		supervisor.failed("", err)
+		return common.NewErrorf("failed to get full config for core start: %v", err)
 	}
 	rawConfig, err := json.MarshalIndent(singboxConfig, "", "  ")
 	if err != nil {
-		return common.NewErrorf("failed to marshal full config for core start: %w", err)
+		supervisor.failed("", err)
+		return common.NewErrorf("failed to marshal full config for core start: %v", err)
 	}
-	err = corePtr.Start(rawConfig)
+	return s.startCore(rawConfig, false)
+}
+
+func (s *ConfigService) startCore(rawConfig []byte, fallback bool) error {
+	err := corePtr.Start(rawConfig)
 	if err != nil {
 		// Log the original error before wrapping
 		logger.Errorf("start sing-box err: %v", err)
-		return common.NewErrorf("failed to start sing-box core: %w", err)
+		supervisor.failed(configHash(rawConfig), err)
+		return common.NewErrorf("failed to start sing-box core: %v", err)
 	}
+	supervisor.started(rawConfig, fallback)
 	logger.Info("sing-box started")
 	return nil
 }
@@ -95,7 +91,7 @@ func (s *ConfigService) StartCore(defaultConfig string) error {
 func (s *ConfigService) RestartCore() error {
 	err := s.StopCore()
 	if err != nil {
-		return common.NewErrorf("failed to stop core during restart: %w", err)
+		return common.NewErrorf("failed to stop core during restart: %v", err)
 	}
 	return s.StartCore("")
 }
@@ -103,27 +99,154 @@ func (s *ConfigService) RestartCore() error {
 func (s *ConfigService) restartCoreWithConfig(config json.RawMessage) error {
 	err := s.StopCore()
 	if err != nil {
-		return common.NewErrorf("failed to stop core before restarting with new config: %w", err)
+		return common.NewErrorf("failed to stop core before restarting with new config: %v", err)
 	}
 	return s.StartCore(string(config))
 }
 
+// Route and dns options which are owned by the router, and can be reloaded without a restart
+var reloadableRouteKeys = map[string]bool{
+	"rules":        true,
+	"rule_set":     true,
+	"geoip":        true,
+	"geosite":      true,
+	"find_process": true,
+}
+
+// applyBaseConfig applies a changed base config to the running core. Route rules, rule-sets and dns
+// are reloaded in place, other changes need a restart which drops all connections.
+func (s *ConfigService) applyBaseConfig(oldConfig json.RawMessage, newConfig json.RawMessage) error {
+	if !corePtr.IsRunning() {
+		return s.StartCore(string(newConfig))
+	}
+	restart, reloadRouter, err := baseConfigChanges(oldConfig, newConfig)
+	if err != nil {
+		return err
+	}
+	switch {
+	case restart:
+		return s.restartCoreWithConfig(newConfig)
+	case reloadRouter:
+		err = corePtr.ReloadRouter(newConfig)
+		if err != nil {
+			return err
+		}
+		logger.Info("sing-box route and dns reloaded")
+	}
+	return nil
+}
+
+func baseConfigChanges(oldConfig json.RawMessage, newConfig json.RawMessage) (restart bool, reloadRouter bool, err error) {
+	var oldSections, newSections map[string]json.RawMessage
+	err = json.Unmarshal(oldConfig, &oldSections)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(newConfig, &newSections)
+	if err != nil {
+		return
+	}
+	for key, changed := range changedKeys(oldSections, newSections) {
+		if !changed {
+			continue
+		}
+		switch key {
+		case "dns":
+			reloadRouter = true
+		case "route":
+			var oldRoute, newRoute map[string]json.RawMessage
+			json.Unmarshal(oldSections[key], &oldRoute)
+			json.Unmarshal(newSections[key], &newRoute)
+			for routeKey, routeChanged := range changedKeys(oldRoute, newRoute) {
+				if !routeChanged {
+					continue
+				}
+				if reloadableRouteKeys[routeKey] {
+					reloadRouter = true
+				} else {
+					restart = true
+				}
+			}
+		default:
+			restart = true
+		}
+	}
+	return
+}
+
+func changedKeys(oldObj map[string]json.RawMessage, newObj map[string]json.RawMessage) map[string]bool {
+	changed := make(map[string]bool, len(oldObj)+len(newObj))
+	for key, value := range oldObj {
+		changed[key] = string(normalizeJson(value)) != string(normalizeJson(newObj[key]))
+	}
+	for key, value := range newObj {
+		if _, ok := changed[key]; !ok {
+			changed[key] = normalizeJson(value) != nil
+		}
+	}
+	return changed
+}
+
 func (s *ConfigService) StopCore() error {
+	if !corePtr.IsRunning() {
+		return nil
+	}
 	err := corePtr.Stop()
+	supervisor.stopped("stop", "")
 	if err != nil {
-		return common.NewErrorf("failed to stop sing-box core: %w", err)
+		return common.NewErrorf("failed to stop sing-box core: %v", err)
 	}
 	logger.Info("sing-box stopped")
 	return nil
 }
 
-func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initUsers string, loginUser string, hostname string) (objs []string, err error) { // Added named return for err
+// saveOp is the save of one object. A revert applies several of them in one transaction.
+type saveOp struct {
+	obj       string
+	act       string
+	data      json.RawMessage
+	initUsers string
+	// revert marks records of a change snapshot, which keep the current usage and state of clients
+	revert bool
+}
+
+// Save applies a change in a transaction and commits it only if the resulting config is valid.
+// With dryRun the transaction is always rolled back, and the diff and validation errors are returned.
+func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initUsers string, loginUser string, hostname string, dryRun bool) (objs []string, check *ConfigCheck, err error) {
+	return s.saveAll([]saveOp{{obj: obj, act: act, data: data, initUsers: initUsers}}, loginUser, hostname, dryRun)
+}
+
+// saveAll applies saves in order in one transaction, so either all or none of them are committed
+func (s *ConfigService) saveAll(ops []saveOp, loginUser string, hostname string, dryRun bool) (objs []string, check *ConfigCheck, err error) {
 	var inboundIdsToRestart []uint // Renamed to avoid confusion with inboundId
-	var singleInboundId uint       // Stores ID from inbound save operation
-	objs = []string{obj}
+	var warnings []string
+	var changes *coreChanges
+	var oldConfig *SingBoxConfig
+	wasRunning := corePtr.IsRunning()
+
+	if dryRun {
+		oldConfig, err = s.GetConfig("")
+		if err != nil {
+			return
+		}
+	}
+
+	// The network is not dialed while the transaction holds the database
+	for _, op := range ops {
+		if op.obj == "tls" && (op.act == "new" || op.act == "edit") {
+			warnings = append(warnings, s.TlsService.realityTargetWarnings(op.data)...)
+		}
+	}
 
 	db := database.GetDB()
 	tx := db.Begin()
+	// Changes of a dry run are collected too, and never applied
+	changes = &coreChanges{}
+	tx = tx.Set(coreChangesKey, changes)
+	if dryRun {
+		tx = tx.Set(dryRunKey, true)
+	}
+	tx = tx.Session(&gorm.Session{})
 
 	defer func() {
 		if p := recover(); p != nil {
@@ -131,18 +254,31 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 			// Re-panic to propagate the panic upwards after rolling back
 			// It's generally better to avoid panics and handle errors explicitly
 			panic(p)
-		} else if err != nil {
+		} else if err != nil || dryRun {
 			tx.Rollback()
+			// A failed restart leaves the core down, bring it back with the unchanged config
+			if !dryRun && wasRunning && !corePtr.IsRunning() {
+				errStart := s.StartCore("")
+				if errStart != nil {
+					logger.Errorf("failed to start core after a failed save: %v", errStart)
+					err = common.NewErrorf("%v; %v", err, s.rollbackToSnapshot(loginUser, errStart))
+				}
+			}
 		} else {
 			err = tx.Commit().Error // Capture commit error
 			if err == nil {
-				if len(inboundIdsToRestart) > 0 && corePtr.IsRunning() {
-					// Use db for RestartInbounds as the transaction is committed.
-					// If RestartInbounds needs to be part of the main transaction, this logic needs adjustment.
-					errRestart := s.InboundService.RestartInbounds(db, inboundIdsToRestart)
-					if errRestart != nil {
-						logger.Errorf("unable to restart inbounds: %v", errRestart)
-						// Decide if this error should be propagated. For now, logging it.
+				for _, path := range changes.staleFiles {
+					os.Remove(path)
+				}
+				if corePtr.IsRunning() {
+					errApply := s.applyCoreChanges(changes, inboundIdsToRestart)
+					if errApply != nil {
+						// The core is out of step with the database, restart it with the saved config
+						logger.Errorf("unable to apply changes to core: %v", errApply)
+						errRestart := s.RestartCore()
+						if errRestart != nil {
+							logger.Errorf("failed to restart core after a save: %v", errRestart)
+						}
 					}
 				}
 				// Try to start core if it is not running
@@ -151,7 +287,10 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 					errStart := s.StartCore("")
 					if errStart != nil {
 						logger.Errorf("failed to auto-start core after save: %v", errStart)
-						// Decide if this error should be propagated.
+						// The change broke a working core, go back to the last known-good state
+						if wasRunning {
+							err = s.rollbackToSnapshot(loginUser, errStart)
+						}
 					}
 				}
 				LastUpdate = time.Now().Unix()
@@ -159,47 +298,113 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 		}
 	}()
 
+	for _, op := range ops {
+		var opObjs []string
+		var opInboundIds []uint
+		var opWarnings []string
+		opObjs, opInboundIds, opWarnings, err = s.saveOne(tx, op, loginUser, hostname)
+		if err != nil {
+			return
+		}
+		for _, o := range opObjs {
+			if !slices.Contains(objs, o) {
+				objs = append(objs, o)
+			}
+		}
+		inboundIdsToRestart = uniqueIds(append(inboundIdsToRestart, opInboundIds...))
+		warnings = append(warnings, opWarnings...)
+	}
+
+	// Validate the pending config before it gets committed
+	var pendingConfig *SingBoxConfig
+	pendingConfig, err = s.getConfig(tx, "")
+	if err != nil {
+		return
+	}
+	checkErr := s.CheckConfig(pendingConfig)
+	if dryRun {
+		check = &ConfigCheck{
+			Diff:     DiffConfigs(oldConfig, pendingConfig),
+			Errors:   []string{},
+			Warnings: warnings,
+		}
+		if checkErr != nil {
+			check.Errors = append(check.Errors, strings.TrimSpace(checkErr.Error()))
+		}
+		return
+	}
+	if checkErr != nil {
+		err = common.NewErrorf("invalid config: %s", strings.TrimSpace(checkErr.Error()))
+		return
+	}
+	if len(warnings) > 0 {
+		check = &ConfigCheck{Warnings: warnings}
+	}
+	// err is nil here, so defer will commit.
+	return
+}
+
+// saveOne applies one save in tx with its change log. The core takes it after commit, see applyCoreChanges.
+func (s *ConfigService) saveOne(tx *gorm.DB, op saveOp, loginUser string, hostname string) (objs []string, inboundIdsToRestart []uint, warnings []string, err error) {
+	obj, act, data, initUsers := op.obj, op.act, op.data, op.initUsers
+	objs = []string{obj}
+
+	if op.revert && obj == "clients" && act == "edit" {
+		data, err = keepClientState(tx, data)
+		if err != nil {
+			return
+		}
+	}
+
+	// New objects without a name are found by their new id for the after snapshot
+	snapshotData := data
+
+	var before json.RawMessage
+	before, err = s.snapshot(tx, obj, act, data)
+	if err != nil {
+		err = common.NewErrorf("failed to take snapshot before change: %v", err)
+		return
+	}
+
+	// Clients may carry a dns override, which lives in dns rules of the router
+	var oldClientDns []json.RawMessage
+	if obj == "clients" {
+		oldClientDns, err = s.DnsService.clientRules(tx)
+		if err != nil {
+			return
+		}
+	}
+
 	switch obj {
 	case "clients":
 		inboundIdsToRestart, err = s.ClientService.Save(tx, act, data, hostname)
 		if err != nil {
-			err = common.NewErrorf("failed to save clients: %w", err)
+			err = common.NewErrorf("failed to save clients: %v", err)
 			return
 		}
 		objs = append(objs, "inbounds")
 	case "tls":
-		inboundIdsToRestart, err = s.TlsService.Save(tx, act, data)
+		var tlsWarnings []string
+		inboundIdsToRestart, tlsWarnings, err = s.TlsService.Save(tx, act, data)
 		if err != nil {
-			err = common.NewErrorf("failed to save tls: %w", err)
+			err = common.NewErrorf("failed to save tls: %v", err)
 			return
 		}
+		warnings = append(warnings, tlsWarnings...)
 	case "inbounds":
 		var actualInboundIdToRestart uint // To be populated by InboundService.Save
 		var tagForClientUpdate string
 
 		if act == "del" {
-			var idToDelete uint
-			// For deletion, 'data' is expected to be the ID of the inbound (as a JSON number).
-			if errUnmarshal := json.Unmarshal(data, &idToDelete); errUnmarshal != nil {
-				err = common.NewErrorf("failed to unmarshal inbound ID for deletion from 'data': %w", errUnmarshal)
+			// For deletion, 'data' is the tag of the inbound, as InboundService.Save expects it.
+			if errUnmarshal := json.Unmarshal(data, &tagForClientUpdate); errUnmarshal != nil {
+				err = common.NewErrorf("failed to unmarshal inbound tag for deletion from 'data': %v", errUnmarshal)
 				return // Triggers rollback in defer
 			}
-			if idToDelete == 0 {
-				err = common.NewError("inbound ID for deletion cannot be zero")
-				return // Triggers rollback
-			}
-			var tempInbound model.Inbound
-			// Fetch the tag using the ID from 'data' before it's conceptually deleted by InboundService.Save
-			if errDb := tx.Model(&model.Inbound{}).Where("id = ?", idToDelete).Select("tag").First(&tempInbound).Error; errDb != nil {
-				err = common.NewErrorf("failed to retrieve tag for inbound ID %d prior to deletion: %w", idToDelete, errDb)
-				return // Triggers rollback
-			}
-			tagForClientUpdate = tempInbound.Tag
-			// 'data' (containing the ID) is passed as is to InboundService.Save
 		}
 
 		// Call InboundService.Save. For "del", it uses the ID in 'data' and returns it.
-		actualInboundIdToRestart, err = s.InboundService.Save(tx, act, data, initUsers, hostname)
+		actualInboundIdToRestart, err = s.InboundService.Save(tx, act, data, hostname)
 		if err != nil {
 			// This error will be wrapped by the main error handling for "inbounds" case below
 			return
@@ -224,6 +429,12 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 			err = s.ClientService.UpdateClientsOnInboundAdd(tx, initUsers, actualInboundIdToRestart, hostname)
 		case "edit":
 			if len(idsForClientLinkUpdate) > 0 {
+				var detourIds []uint
+				detourIds, err = s.InboundService.DetourInboundIds(tx, idsForClientLinkUpdate)
+				if err != nil {
+					return
+				}
+				idsForClientLinkUpdate = append(idsForClientLinkUpdate, detourIds...)
 				err = s.ClientService.UpdateLinksByInboundChange(tx, idsForClientLinkUpdate, hostname)
 			}
 		case "del":
@@ -239,44 +450,79 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 			return
 		}
 		objs = append(objs, "clients")
+	case "plans":
+		inboundIdsToRestart, err = s.PlanService.Save(tx, act, data, hostname)
+		if err != nil {
+			err = common.NewErrorf("failed to save plans: %v", err)
+			return
+		}
+		if len(inboundIdsToRestart) > 0 {
+			objs = append(objs, "clients", "inbounds")
+		}
 	case "outbounds":
 		err = s.OutboundService.Save(tx, act, data)
 		if err != nil {
-			err = common.NewErrorf("failed to save outbounds: %w", err)
+			err = common.NewErrorf("failed to save outbounds: %v", err)
 			return
 		}
 	case "endpoints":
 		err = s.EndpointService.Save(tx, act, data)
 		if err != nil {
-			err = common.NewErrorf("failed to save endpoints: %w", err)
+			err = common.NewErrorf("failed to save endpoints: %v", err)
+			return
+		}
+	case "rules":
+		var ruleId uint
+		ruleId, err = s.RouteRuleService.Save(tx, act, data)
+		if err != nil {
+			err = common.NewErrorf("failed to save rules: %v", err)
 			return
 		}
+		if act == "new" {
+			snapshotData, _ = json.Marshal(map[string]uint{"id": ruleId})
+		}
+	case "rulesets":
+		err = s.RuleSetService.Save(tx, act, data)
+		if err != nil {
+			err = common.NewErrorf("failed to save rule sets: %v", err)
+			return
+		}
+	case "dnsservers":
+		err = s.DnsService.SaveServer(tx, act, data)
+		if err != nil {
+			err = common.NewErrorf("failed to save dns servers: %v", err)
+			return
+		}
+	case "dnsrules":
+		var ruleId uint
+		ruleId, err = s.DnsService.SaveRule(tx, act, data)
+		if err != nil {
+			err = common.NewErrorf("failed to save dns rules: %v", err)
+			return
+		}
+		if act == "new" {
+			snapshotData, _ = json.Marshal(map[string]uint{"id": ruleId})
+		}
 	case "config":
 		// The 'data' here is the JSON string for the core config.
 		// The SettingService.Update method handles saving this to the "config" key.
 		err = s.SettingService.Update(tx, "config", string(data))
 		if err != nil {
-			err = common.NewErrorf("failed to save config using SettingService.Update: %w", err)
+			err = common.NewErrorf("failed to save config using SettingService.Update: %v", err)
 			return
 		}
-		// Restart core with the new config.
-		err = s.restartCoreWithConfig(data)
-		if err != nil {
-			err = common.NewErrorf("failed to restart core with new config: %w", err)
-			return // This will trigger rollback in defer
-		}
 
 	case "settings":
 		// 'data' for "settings" is expected to be a JSON object like {"key1":"value1", "key2":"value2"}
 		var settingsToUpdate map[string]string
 		if errUnmarshal := json.Unmarshal(data, &settingsToUpdate); errUnmarshal != nil {
-			err = common.NewErrorf("failed to unmarshal settings data: %w", errUnmarshal)
+			err = common.NewErrorf("failed to unmarshal settings data: %v", errUnmarshal)
 			return
 		}
 		for key, value := range settingsToUpdate {
 			err = s.SettingService.Update(tx, key, value)
 			if err != nil {
-				err = common.NewErrorf("failed to save setting '%s': %w", key, err)
+				err = common.NewErrorf("failed to save setting '%s': %v", key, err)
 				return // Rollback on first error
 			}
 		}
@@ -286,25 +532,11 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 	}
 	// If any of the above cases returned an error, 'err' is set and defer will rollback.
 
-	dt := time.Now().Unix()
-	changeLog := model.Changes{
-		DateTime: dt,
-		Actor:    loginUser,
-		Key:      obj,
-		Action:   act,
-		Obj:      data, // Consider if storing raw data is always appropriate or if a summary/ID is better
-	}
-	err = tx.Create(&changeLog).Error
-	if err != nil {
-		err = common.NewErrorf("failed to create change log: %w", err)
-		return
-	}
-
 	// Update side changes (still within the same transaction)
 	if obj == "tls" && len(inboundIdsToRestart) > 0 { // use inboundIdsToRestart
 		err = s.ClientService.UpdateLinksByInboundChange(tx, inboundIdsToRestart, hostname)
 		if err != nil {
-			err = common.NewErrorf("failed to update client links after tls change: %w", err)
+			err = common.NewErrorf("failed to update client links after tls change: %v", err)
 			return
 		}
 		objs = append(objs, "clients")
@@ -312,48 +544,137 @@ func (s *ConfigService) Save(obj string, act string, data json.RawMessage, initU
 		err = s.InboundService.UpdateOutJsons(tx, inboundIdsToRestart, hostname)
 		if err != nil {
 			// Consistent error wrapping
-			err = common.NewErrorf("unable to update out_json of inbounds after tls change: %w", err)
+			err = common.NewErrorf("unable to update out_json of inbounds after tls change: %v", err)
 			return
 		}
 		objs = append(objs, "inbounds")
 	}
 
-	if obj == "inbounds" {
-		// singleInboundId holds the ID of the inbound that was new/edited/deleted
-		idsForClientUpdate := []uint{}
-		if singleInboundId != 0 { // Ensure singleInboundId is valid
-			idsForClientUpdate = append(idsForClientUpdate, singleInboundId)
-		}
+	var after json.RawMessage
+	after, err = s.snapshot(tx, obj, act, snapshotData)
+	if err != nil {
+		err = common.NewErrorf("failed to take snapshot after change: %v", err)
+		return
+	}
 
-		switch act {
-		case "new":
-			// initUsers might be a comma-separated string of client IDs
-			err = s.ClientService.UpdateClientsOnInboundAdd(tx, initUsers, singleInboundId, hostname)
-		case "edit":
-			if len(idsForClientUpdate) > 0 {
-				err = s.ClientService.UpdateLinksByInboundChange(tx, idsForClientUpdate, hostname)
+	dt := time.Now().Unix()
+	changeLog := model.Changes{
+		DateTime: dt,
+		Actor:    loginUser,
+		Key:      obj,
+		Action:   act,
+		Obj:      data, // Consider if storing raw data is always appropriate or if a summary/ID is better
+		Before:   before,
+		After:    after,
+	}
+	err = tx.Create(&changeLog).Error
+	if err != nil {
+		err = common.NewErrorf("failed to create change log: %v", err)
+		return
+	}
+
+	// The core takes the change after commit, see applyCoreChanges
+	if pending := pendingCore(tx); pending != nil {
+		switch obj {
+		case "config":
+			if pending.oldBase == nil {
+				pending.oldBase = before
 			}
-		case "del":
-			var tag string
-			// The 'data' for 'del' inbound is just the tag string, not a full JSON object.
-			// It's better to pass the tag directly if possible, or unmarshal carefully.
-			// Assuming 'data' is a JSON string like "\"the-tag\""
-			if unmarshalErr := json.Unmarshal(data, &tag); unmarshalErr != nil {
-				err = common.NewErrorf("failed to unmarshal tag for inbound deletion: %w", unmarshalErr)
+			pending.newBase = data
+		case "clients":
+			var newClientDns []json.RawMessage
+			newClientDns, err = s.DnsService.clientRules(tx)
+			if err != nil {
 				return
 			}
-			// singleInboundId here is the ID of the inbound that was deleted.
-			err = s.ClientService.UpdateClientsOnInboundDelete(tx, singleInboundId, tag)
+			oldDnsJson, _ := json.Marshal(oldClientDns)
+			newDnsJson, _ := json.Marshal(newClientDns)
+			pending.reloadRouter = pending.reloadRouter || string(oldDnsJson) != string(newDnsJson)
+			pending.userLimits = true
+		case "plans":
+			pending.userLimits = true
+		case "rules", "rulesets", "dnsservers", "dnsrules":
+			pending.reloadRouter = true
 		}
+	}
+	return
+}
+
+// applyCoreChanges brings a committed save to the running core. Inbounds are restarted by their ids,
+// which takes new, edited and renamed inbounds, and the router is reloaded with the saved config.
+func (s *ConfigService) applyCoreChanges(changes *coreChanges, inboundIds []uint) error {
+	if changes == nil {
+		return nil
+	}
+	if changes.newBase != nil {
+		err := s.applyBaseConfig(changes.oldBase, changes.newBase)
 		if err != nil {
-			// Wrap specific errors from client service updates
-			err = common.NewErrorf("failed to update clients after inbound %s: %w", act, err)
-			return
+			return common.NewErrorf("failed to apply new config to core: %v", err)
 		}
-		objs = append(objs, "clients")
 	}
-	// err is nil here, so defer will commit.
-	return
+	for _, tag := range changes.removeInbounds {
+		err := corePtr.RemoveInbound(tag)
+		if err != nil && err != os.ErrInvalid {
+			return err
+		}
+	}
+	for _, tag := range changes.removeEndpoints {
+		err := corePtr.RemoveEndpoint(tag)
+		if err != nil && err != os.ErrInvalid {
+			return err
+		}
+	}
+	for _, tag := range changes.removeOutbounds {
+		err := corePtr.RemoveOutbound(tag)
+		if err != nil && err != os.ErrInvalid {
+			return err
+		}
+	}
+	for _, outbound := range changes.outbounds {
+		err := corePtr.AddOutbound(outbound)
+		if err != nil {
+			return err
+		}
+	}
+	for _, endpoint := range changes.endpoints {
+		err := corePtr.AddEndpoint(endpoint)
+		if err != nil {
+			return err
+		}
+	}
+	db := database.GetDB()
+	if changes.userLimits {
+		err := s.applyUserLimits(db)
+		if err != nil {
+			return err
+		}
+	}
+	if len(inboundIds) > 0 {
+		err := s.InboundService.RestartInbounds(db, inboundIds)
+		if err != nil {
+			return common.NewErrorf("unable to restart inbounds: %v", err)
+		}
+	}
+	if changes.reloadRouter {
+		singboxConfig, err := s.getConfig(db, "")
+		if err != nil {
+			return err
+		}
+		return s.reloadRouter(singboxConfig)
+	}
+	return nil
+}
+
+func (s *ConfigService) reloadRouter(singboxConfig *SingBoxConfig) error {
+	rawConfig, err := json.Marshal(singboxConfig)
+	if err != nil {
+		return err
+	}
+	err = corePtr.ReloadRouter(rawConfig)
+	if err != nil {
+		return common.NewErrorf("failed to reload route of core: %v", err)
+	}
+	return nil
 }
 
 func (s *ConfigService) CheckChanges(lu string) (bool, error) {
@@ -363,7 +684,7 @@ func (s *ConfigService) CheckChanges(lu string) (bool, error) {
 
 	lastUpdateUnix, err := strconv.ParseInt(lu, 10, 64)
 	if err != nil {
-		return false, common.NewErrorf("invalid last update timestamp format '%s': %w", lu, err)
+		return false, common.NewErrorf("invalid last update timestamp format '%s': %v", lu, err)
 	}
 
 	// If LastUpdate (in-memory cache) is more recent, then there are changes.
@@ -378,7 +699,7 @@ func (s *ConfigService) CheckChanges(lu string) (bool, error) {
 	// Use parameterized query to prevent SQL injection
 	queryErr := db.Model(&model.Changes{}).Where("date_time > ?", lastUpdateUnix).Count(&count).Error
 	if queryErr != nil {
-		return false, common.NewErrorf("failed to query changes from database: %w", queryErr)
+		return false, common.NewErrorf("failed to query changes from database: %v", queryErr)
 	}
 
 	if count > 0 {
@@ -396,7 +717,7 @@ func (s *ConfigService) CheckChanges(lu string) (bool, error) {
 func (s *ConfigService) GetChanges(actor string, chngKey string, countStr string) ([]model.Changes, error) {
 	c, err := strconv.Atoi(countStr)
 	if err != nil {
-		return nil, common.NewErrorf("invalid count parameter '%s': %w", countStr, err)
+		return nil, common.NewErrorf("invalid count parameter '%s': %v", countStr, err)
 	}
 	if c <= 0 {
 		// Or handle as "no limit" if that's desired, but typically a positive count is expected.
@@ -410,7 +731,7 @@ func (s *ConfigService) GetChanges(actor string, chngKey string, countStr string
 		query = query.Where("actor = ?", actor)
 	}
 	if len(chngKey) > 0 {
-		query = query.Where("`key` = ?", chngKey) // Ensure 'key' is quoted if it's a reserved keyword
+		query = query.Where(&model.Changes{Key: chngKey})
 	}
 
 	var chngs []model.Changes
@@ -419,7 +740,7 @@ func (s *ConfigService) GetChanges(actor string, chngKey string, countStr string
 	if dbErr != nil {
 		// Log the error, but also return it so the caller can handle it.
 		logger.Warningf("failed to get changes: %v", dbErr)
-		return nil, common.NewErrorf("failed to retrieve changes: %w", dbErr)
+		return nil, common.NewErrorf("failed to retrieve changes: %v", dbErr)
 	}
 	return chngs, nil
 }
@@ -0,0 +1,258 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"s-ui/util/common"
+	"slices"
+
+	"gorm.io/gorm"
+)
+
+// dryRunKey marks a transaction whose changes must not reach the running core
+const dryRunKey = "sui:dryRun"
+
+// coreChangesKey keeps the coreChanges of a save in its transaction
+const coreChangesKey = "sui:coreChanges"
+
+// coreChanges are what a save changes in the running core. They are applied only after
+// the save is checked and committed, so the core never runs what the database does not have.
+type coreChanges struct {
+	removeInbounds  []string
+	removeOutbounds []string
+	removeEndpoints []string
+	outbounds       []json.RawMessage
+	endpoints       []json.RawMessage
+	reloadRouter    bool
+	// userLimits is set when speed limits of clients may change
+	userLimits bool
+	// oldBase and newBase are set when the base config changes
+	oldBase json.RawMessage
+	newBase json.RawMessage
+	// staleFiles belong to the state before the save, and are removed after commit
+	staleFiles []string
+}
+
+type ConfigDiff struct {
+	Object string          `json:"object"`
+	Tag    string          `json:"tag,omitempty"`
+	Action string          `json:"action"`
+	Old    json.RawMessage `json:"old,omitempty"`
+	New    json.RawMessage `json:"new,omitempty"`
+}
+
+type ConfigCheck struct {
+	Diff   []ConfigDiff `json:"diff"`
+	Errors []string     `json:"errors"`
+	// Warnings are found by checks of the saved object, like checkTls, and do not stop the save
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (s *ConfigService) getConfig(db *gorm.DB, data string) (*SingBoxConfig, error) {
+	var err error
+	if len(data) == 0 {
+		data, err = s.SettingService.getString(db, "config")
+		if err != nil {
+			return nil, common.NewErrorf("failed to get base config from settings: %v", err)
+		}
+	}
+	singboxConfig := SingBoxConfig{}
+	err = json.Unmarshal([]byte(data), &singboxConfig)
+	if err != nil {
+		return nil, common.NewErrorf("failed to unmarshal base config: %v", err)
+	}
+
+	singboxConfig.Inbounds, err = s.InboundService.GetAllConfig(db)
+	if err != nil {
+		return nil, common.NewErrorf("failed to get all inbound configs: %v", err)
+	}
+	singboxConfig.Outbounds, err = s.OutboundService.GetAllConfig(db)
+	if err != nil {
+		return nil, common.NewErrorf("failed to get all outbound configs: %v", err)
+	}
+	singboxConfig.Endpoints, err = s.EndpointService.GetAllConfig(db)
+	if err != nil {
+		return nil, common.NewErrorf("failed to get all endpoint configs: %v", err)
+	}
+	singboxConfig.Route, err = s.addRouteRules(db, singboxConfig.Route)
+	if err != nil {
+		return nil, err
+	}
+	singboxConfig.Dns, err = s.DnsService.GetAllConfig(db, singboxConfig.Dns)
+	if err != nil {
+		return nil, err
+	}
+	return &singboxConfig, nil
+}
+
+// addRouteRules appends managed rules and rule-sets after the ones written in the base config.
+// Rules of redirected clients go first, so that they apply whatever the other rules match.
+func (s *ConfigService) addRouteRules(db *gorm.DB, route json.RawMessage) (json.RawMessage, error) {
+	rules, err := s.RouteRuleService.GetAllConfig(db)
+	if err != nil {
+		return nil, err
+	}
+	ruleSets, err := s.RuleSetService.GetAllConfig(db)
+	if err != nil {
+		return nil, err
+	}
+	redirectRules, err := s.ClientService.redirectRules(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 && len(ruleSets) == 0 && len(redirectRules) == 0 {
+		return route, nil
+	}
+	routeMap := map[string]json.RawMessage{}
+	if len(route) > 0 {
+		err = json.Unmarshal(route, &routeMap)
+		if err != nil {
+			return nil, common.NewErrorf("failed to unmarshal route of base config: %v", err)
+		}
+		if routeMap == nil {
+			routeMap = map[string]json.RawMessage{}
+		}
+	}
+	for key, items := range map[string][]json.RawMessage{"rules": rules, "rule_set": ruleSets} {
+		var first []json.RawMessage
+		if key == "rules" {
+			first = redirectRules
+		}
+		if len(items) == 0 && len(first) == 0 {
+			continue
+		}
+		var baseItems []json.RawMessage
+		if len(routeMap[key]) > 0 {
+			err = json.Unmarshal(routeMap[key], &baseItems)
+			if err != nil {
+				return nil, common.NewErrorf("failed to unmarshal route %s of base config: %v", key, err)
+			}
+		}
+		routeMap[key], err = json.Marshal(append(append(first, baseItems...), items...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(routeMap)
+}
+
+// CheckConfig validates a full config the same way sing-box does on start, without starting it
+func (s *ConfigService) CheckConfig(singboxConfig *SingBoxConfig) error {
+	rawConfig, err := json.Marshal(singboxConfig)
+	if err != nil {
+		return err
+	}
+	return corePtr.Check(rawConfig)
+}
+
+func DiffConfigs(oldConfig *SingBoxConfig, newConfig *SingBoxConfig) []ConfigDiff {
+	diffs := []ConfigDiff{}
+	sections := []struct {
+		name     string
+		old, new json.RawMessage
+	}{
+		{"log", oldConfig.Log, newConfig.Log},
+		{"dns", oldConfig.Dns, newConfig.Dns},
+		{"ntp", oldConfig.Ntp, newConfig.Ntp},
+		{"route", oldConfig.Route, newConfig.Route},
+		{"experimental", oldConfig.Experimental, newConfig.Experimental},
+	}
+	for _, section := range sections {
+		if diff := diffObject(section.name, "", section.old, section.new); diff != nil {
+			diffs = append(diffs, *diff)
+		}
+	}
+	diffs = append(diffs, diffTagged("inbounds", oldConfig.Inbounds, newConfig.Inbounds)...)
+	diffs = append(diffs, diffTagged("outbounds", oldConfig.Outbounds, newConfig.Outbounds)...)
+	diffs = append(diffs, diffTagged("endpoints", oldConfig.Endpoints, newConfig.Endpoints)...)
+	return diffs
+}
+
+func diffTagged(object string, oldList []json.RawMessage, newList []json.RawMessage) []ConfigDiff {
+	diffs := []ConfigDiff{}
+	oldByTag := make(map[string]json.RawMessage, len(oldList))
+	for _, item := range oldList {
+		oldByTag[objectTag(item)] = item
+	}
+	newTags := make(map[string]bool, len(newList))
+	for _, item := range newList {
+		tag := objectTag(item)
+		newTags[tag] = true
+		if diff := diffObject(object, tag, oldByTag[tag], item); diff != nil {
+			diffs = append(diffs, *diff)
+		}
+	}
+	for _, item := range oldList {
+		tag := objectTag(item)
+		if !newTags[tag] {
+			diffs = append(diffs, ConfigDiff{Object: object, Tag: tag, Action: "del", Old: item})
+		}
+	}
+	return diffs
+}
+
+func diffObject(object string, tag string, oldObj json.RawMessage, newObj json.RawMessage) *ConfigDiff {
+	oldNorm := normalizeJson(oldObj)
+	newNorm := normalizeJson(newObj)
+	switch {
+	case bytes.Equal(oldNorm, newNorm):
+		return nil
+	case oldNorm == nil:
+		return &ConfigDiff{Object: object, Tag: tag, Action: "new", New: newObj}
+	case newNorm == nil:
+		return &ConfigDiff{Object: object, Tag: tag, Action: "del", Old: oldObj}
+	}
+	return &ConfigDiff{Object: object, Tag: tag, Action: "edit", Old: oldObj, New: newObj}
+}
+
+// normalizeJson returns json with sorted keys, or nil for empty values
+func normalizeJson(data json.RawMessage) []byte {
+	var obj interface{}
+	if len(data) == 0 || json.Unmarshal(data, &obj) != nil || obj == nil {
+		return nil
+	}
+	normalized, _ := json.Marshal(obj)
+	return normalized
+}
+
+func objectTag(data json.RawMessage) string {
+	var obj struct {
+		Tag string `json:"tag"`
+	}
+	json.Unmarshal(data, &obj)
+	return obj.Tag
+}
+
+// applyToCore reports whether changes made in tx should be applied to the running core too
+func applyToCore(tx *gorm.DB) bool {
+	if _, dryRun := tx.Get(dryRunKey); dryRun {
+		return false
+	}
+	return corePtr.IsRunning()
+}
+
+// removeAfterCommit removes a file once the save in tx is committed, whether the core runs or not.
+// Dry runs and failed saves keep it.
+func removeAfterCommit(tx *gorm.DB, path string) {
+	changes, _ := tx.Get(coreChangesKey)
+	if pending, ok := changes.(*coreChanges); ok {
+		pending.staleFiles = append(pending.staleFiles, path)
+	}
+}
+
+// removedAfterCommit reports whether the save in tx removes a file, so the pending config must not use it
+func removedAfterCommit(tx *gorm.DB, path string) bool {
+	changes, _ := tx.Get(coreChangesKey)
+	pending, ok := changes.(*coreChanges)
+	return ok && slices.Contains(pending.staleFiles, path)
+}
+
+// pendingCore returns the core changes collected in tx, or nil when its changes stay away from the core
+func pendingCore(tx *gorm.DB) *coreChanges {
+	if !applyToCore(tx) {
+		return nil
+	}
+	changes, _ := tx.Get(coreChangesKey)
+	pending, _ := changes.(*coreChanges)
+	return pending
+}
@@ -0,0 +1,503 @@
+package service
+
+import (
+	"encoding/json"
+	"net"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/util/common"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type DnsService struct{}
+
+// Default ports and paths of dns server types, and whether they need a server address
+var dnsServerTypes = map[string]struct {
+	port       int
+	path       string
+	needServer bool
+}{
+	"udp":    {53, "", true},
+	"tcp":    {53, "", true},
+	"tls":    {853, "", true},
+	"https":  {443, "/dns-query", true},
+	"h3":     {443, "/dns-query", true},
+	"quic":   {853, "", true},
+	"fakeip": {0, "", false},
+	"local":  {0, "", false},
+}
+
+// Options of managed dns servers, which are rendered into the address of sing-box dns servers
+type dnsServerOptions struct {
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Path       string `json:"path"`
+	Inet4Range string `json:"inet4_range"`
+	Inet6Range string `json:"inet6_range"`
+}
+
+var dnsServerAddressKeys = []string{"server", "server_port", "path", "inet4_range", "inet6_range"}
+
+func (s *DnsService) GetAllServers() ([]map[string]interface{}, error) {
+	db := database.GetDB()
+	servers := []model.DnsServer{}
+	err := db.Model(model.DnsServer{}).Find(&servers).Error
+	if err != nil {
+		return nil, err
+	}
+	data := make([]map[string]interface{}, 0, len(servers))
+	for _, server := range servers {
+		serverData, err := withId(server, server.Id)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, serverData)
+	}
+	return data, nil
+}
+
+func (s *DnsService) GetAllRules() ([]model.DnsRule, error) {
+	db := database.GetDB()
+	rules := []model.DnsRule{}
+	err := db.Model(model.DnsRule{}).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// GetAllConfig merges managed dns servers, per client overrides and dns rules into the dns section of the base config.
+// Rules of the base config come first, then client overrides, then managed rules in their order.
+func (s *DnsService) GetAllConfig(db *gorm.DB, dnsConfig json.RawMessage) (json.RawMessage, error) {
+	var servers []model.DnsServer
+	err := db.Model(model.DnsServer{}).Find(&servers).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to get dns servers: %v", err)
+	}
+	clientRules, err := s.clientRules(db)
+	if err != nil {
+		return nil, err
+	}
+	var rules []model.DnsRule
+	err = db.Model(model.DnsRule{}).Where("enable = ?", true).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to get dns rules: %v", err)
+	}
+	if len(servers) == 0 && len(clientRules) == 0 && len(rules) == 0 {
+		return dnsConfig, nil
+	}
+
+	dnsMap := map[string]json.RawMessage{}
+	if len(dnsConfig) > 0 {
+		err = json.Unmarshal(dnsConfig, &dnsMap)
+		if err != nil {
+			return nil, common.NewErrorf("failed to unmarshal dns of base config: %v", err)
+		}
+		if dnsMap == nil {
+			dnsMap = map[string]json.RawMessage{}
+		}
+	}
+
+	var serversJson []json.RawMessage
+	for _, server := range servers {
+		serverJson, err := renderDnsServer(server)
+		if err != nil {
+			return nil, err
+		}
+		serversJson = append(serversJson, serverJson)
+		if server.Type == "fakeip" && len(dnsMap["fakeip"]) == 0 {
+			var options dnsServerOptions
+			json.Unmarshal(server.Options, &options)
+			if options.Inet4Range == "" && options.Inet6Range == "" {
+				options.Inet4Range = "198.18.0.0/15"
+				options.Inet6Range = "fc00::/18"
+			}
+			fakeip := map[string]interface{}{"enabled": true}
+			if options.Inet4Range != "" {
+				fakeip["inet4_range"] = options.Inet4Range
+			}
+			if options.Inet6Range != "" {
+				fakeip["inet6_range"] = options.Inet6Range
+			}
+			dnsMap["fakeip"], _ = json.Marshal(fakeip)
+		}
+	}
+	rulesJson := clientRules
+	for _, rule := range rules {
+		rulesJson = append(rulesJson, rule.Rule)
+	}
+
+	for key, items := range map[string][]json.RawMessage{"servers": serversJson, "rules": rulesJson} {
+		if len(items) == 0 {
+			continue
+		}
+		var baseItems []json.RawMessage
+		if len(dnsMap[key]) > 0 {
+			err = json.Unmarshal(dnsMap[key], &baseItems)
+			if err != nil {
+				return nil, common.NewErrorf("failed to unmarshal dns %s of base config: %v", key, err)
+			}
+		}
+		dnsMap[key], err = json.Marshal(append(baseItems, items...))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(dnsMap)
+}
+
+// renderDnsServer converts a managed dns server to a sing-box dns server with an address
+func renderDnsServer(server model.DnsServer) (json.RawMessage, error) {
+	var options dnsServerOptions
+	rendered := map[string]interface{}{}
+	if len(server.Options) > 0 {
+		err := json.Unmarshal(server.Options, &options)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(server.Options, &rendered)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, key := range dnsServerAddressKeys {
+		delete(rendered, key)
+	}
+	rendered["tag"] = server.Tag
+
+	serverType, ok := dnsServerTypes[server.Type]
+	if !ok {
+		return nil, common.NewErrorf("unknown dns server type: %s", server.Type)
+	}
+	if !serverType.needServer {
+		rendered["address"] = server.Type
+		return json.Marshal(rendered)
+	}
+	port := options.ServerPort
+	if port == 0 {
+		port = serverType.port
+	}
+	address := server.Type + "://" + net.JoinHostPort(options.Server, strconv.Itoa(port))
+	if serverType.path != "" {
+		path := options.Path
+		if path == "" {
+			path = serverType.path
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		address += path
+	}
+	rendered["address"] = address
+	return json.Marshal(rendered)
+}
+
+// clientRules returns dns rules which send queries of clients with a dns override to their server
+func (s *DnsService) clientRules(db *gorm.DB) ([]json.RawMessage, error) {
+	var clients []model.Client
+	err := db.Model(model.Client{}).Select("name", "dns").
+		Where("enable = ? AND dns IS NOT NULL AND dns != ''", true).Order("id").Find(&clients).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to get dns of clients: %v", err)
+	}
+	var servers []string
+	usersByServer := map[string][]string{}
+	for _, client := range clients {
+		if _, ok := usersByServer[client.Dns]; !ok {
+			servers = append(servers, client.Dns)
+		}
+		usersByServer[client.Dns] = append(usersByServer[client.Dns], client.Name)
+	}
+	rules := make([]json.RawMessage, 0, len(servers))
+	for _, server := range servers {
+		rule, err := json.Marshal(map[string]interface{}{
+			"auth_user": usersByServer[server],
+			"server":    server,
+		})
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (s *DnsService) SaveServer(tx *gorm.DB, act string, data json.RawMessage) error {
+	var err error
+
+	switch act {
+	case "new", "edit":
+		var server model.DnsServer
+		err = server.UnmarshalJSON(data)
+		if err != nil {
+			return err
+		}
+		if server.Tag == "" {
+			return common.NewError("dns server tag cannot be empty")
+		}
+		serverType, ok := dnsServerTypes[server.Type]
+		if !ok {
+			return common.NewErrorf("unknown dns server type: %s", server.Type)
+		}
+		var options map[string]interface{}
+		json.Unmarshal(server.Options, &options)
+		if serverType.needServer {
+			if host, _ := options["server"].(string); host == "" {
+				return common.NewErrorf("server of dns server '%s' cannot be empty", server.Tag)
+			}
+		}
+		refs, err := ruleRefs(tx)
+		if err != nil {
+			return err
+		}
+		if detour, _ := options["detour"].(string); detour != "" && !refs["outbound"][detour] {
+			return common.NewErrorf("detour '%s' of dns server does not exist", detour)
+		}
+		serverTags, err := allDnsServerTags(tx)
+		if err != nil {
+			return err
+		}
+		if resolver, _ := options["address_resolver"].(string); resolver != "" && (resolver == server.Tag || !tagSet(serverTags)[resolver]) {
+			return common.NewErrorf("address resolver '%s' of dns server does not exist", resolver)
+		}
+
+		var count int64
+		query := tx.Model(model.DnsServer{}).Where("tag = ?", server.Tag)
+		if act == "edit" {
+			query = query.Where("id != ?", server.Id)
+		}
+		err = query.Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return common.NewErrorf("dns server tag '%s' already exists", server.Tag)
+		}
+		if act == "edit" {
+			var oldTag string
+			err = tx.Model(model.DnsServer{}).Where("id = ?", server.Id).Pluck("tag", &oldTag).Error
+			if err != nil {
+				return err
+			}
+			if oldTag != server.Tag {
+				err = s.checkServerNotInUse(tx, oldTag)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = tx.Save(&server).Error
+		if err != nil {
+			return err
+		}
+	case "del":
+		var tag string
+		err = json.Unmarshal(data, &tag)
+		if err != nil {
+			return err
+		}
+		err = s.checkServerNotInUse(tx, tag)
+		if err != nil {
+			return err
+		}
+		err = tx.Where("tag = ?", tag).Delete(model.DnsServer{}).Error
+		if err != nil {
+			return err
+		}
+	default:
+		return common.NewErrorf("unknown action: %s", act)
+	}
+	return nil
+}
+
+func (s *DnsService) checkServerNotInUse(tx *gorm.DB, tag string) error {
+	var rules []model.DnsRule
+	err := tx.Model(model.DnsRule{}).Find(&rules).Error
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if ruleUsesTag(rule.Rule, "server", tag) {
+			return common.NewErrorf("dns server '%s' is used by dns rule %d", tag, rule.Id)
+		}
+	}
+	var clientName string
+	err = tx.Model(model.Client{}).Where("dns = ?", tag).Limit(1).Pluck("name", &clientName).Error
+	if err != nil {
+		return err
+	}
+	if clientName != "" {
+		return common.NewErrorf("dns server '%s' is used by client %s", tag, clientName)
+	}
+	var servers []model.DnsServer
+	err = tx.Model(model.DnsServer{}).Where("tag != ?", tag).Find(&servers).Error
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		var options struct {
+			AddressResolver string `json:"address_resolver"`
+		}
+		json.Unmarshal(server.Options, &options)
+		if options.AddressResolver == tag {
+			return common.NewErrorf("dns server '%s' is the address resolver of %s", tag, server.Tag)
+		}
+	}
+	return nil
+}
+
+// SaveRule applies a dns rule change and returns id of the changed rule.
+// "del" data is the rule id, and "order" data is the list of rule ids in their new order.
+func (s *DnsService) SaveRule(tx *gorm.DB, act string, data json.RawMessage) (uint, error) {
+	var err error
+
+	switch act {
+	case "new", "edit":
+		var rule model.DnsRule
+		err = json.Unmarshal(data, &rule)
+		if err != nil {
+			return 0, err
+		}
+		err = s.validateRule(tx, rule.Rule)
+		if err != nil {
+			return 0, err
+		}
+		if act == "new" {
+			// New rules are added to the end
+			var maxPriority *int
+			err = tx.Model(model.DnsRule{}).Select("MAX(priority)").Scan(&maxPriority).Error
+			if err != nil {
+				return 0, err
+			}
+			if maxPriority != nil {
+				rule.Priority = *maxPriority + 1
+			}
+			err = tx.Create(&rule).Error
+		} else {
+			err = tx.Save(&rule).Error
+		}
+		if err != nil {
+			return 0, err
+		}
+		return rule.Id, nil
+	case "del":
+		var id uint
+		err = json.Unmarshal(data, &id)
+		if err != nil {
+			return 0, err
+		}
+		err = tx.Where("id = ?", id).Delete(model.DnsRule{}).Error
+		if err != nil {
+			return 0, err
+		}
+		return id, nil
+	case "order":
+		var ids []uint
+		err = json.Unmarshal(data, &ids)
+		if err != nil {
+			return 0, err
+		}
+		for priority, id := range ids {
+			err = tx.Model(model.DnsRule{}).Where("id = ?", id).Update("priority", priority).Error
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	default:
+		return 0, common.NewErrorf("unknown action: %s", act)
+	}
+}
+
+// validateRule checks that dns servers, inbounds, outbounds and rule-sets referenced by a dns rule exist
+func (s *DnsService) validateRule(tx *gorm.DB, ruleJson json.RawMessage) error {
+	var rule map[string]interface{}
+	err := json.Unmarshal(ruleJson, &rule)
+	if err != nil || rule == nil {
+		return common.NewError("invalid dns rule")
+	}
+	refs, err := ruleRefs(tx)
+	if err != nil {
+		return err
+	}
+	// dns rules match queries of any outbound with "any"
+	refs["outbound"]["any"] = true
+	serverTags, err := allDnsServerTags(tx)
+	if err != nil {
+		return err
+	}
+	refs["server"] = tagSet(serverTags)
+	return validateRuleRefs(rule, refs)
+}
+
+// ValidateClientDns checks the dns override of a client
+func (s *DnsService) ValidateClientDns(tx *gorm.DB, server string) error {
+	if server == "" {
+		return nil
+	}
+	serverTags, err := allDnsServerTags(tx)
+	if err != nil {
+		return err
+	}
+	if !tagSet(serverTags)[server] {
+		return common.NewErrorf("dns server '%s' does not exist", server)
+	}
+	return nil
+}
+
+// allDnsServerTags returns tags of dns servers in the base config and in the database
+func allDnsServerTags(tx *gorm.DB) ([]string, error) {
+	var tags []string
+	err := tx.Model(model.DnsServer{}).Pluck("tag", &tags).Error
+	if err != nil {
+		return nil, err
+	}
+	var baseConfig struct {
+		Dns struct {
+			Servers []struct {
+				Tag string `json:"tag"`
+			} `json:"servers"`
+		} `json:"dns"`
+	}
+	settingService := SettingService{}
+	baseConfigJson, err := settingService.getString(tx, "config")
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(baseConfigJson), &baseConfig)
+	for _, server := range baseConfig.Dns.Servers {
+		tags = append(tags, server.Tag)
+	}
+	return tags, nil
+}
+
+// LookupResult is the answer of a test query through the running core
+type LookupResult struct {
+	Addresses []string `json:"addresses"`
+	Duration  int64    `json:"duration"`
+}
+
+// Lookup resolves a domain through the running core, to see which answers clients get
+func (s *DnsService) Lookup(domain string, server string, inbound string, user string, strategy string) (*LookupResult, error) {
+	if domain == "" {
+		return nil, common.NewError("domain cannot be empty")
+	}
+	if !corePtr.IsRunning() {
+		return nil, common.NewError("core is not running")
+	}
+	addrs, duration, err := corePtr.LookupDNS(domain, server, inbound, user, strategy)
+	if err != nil {
+		return nil, err
+	}
+	result := &LookupResult{
+		Addresses: make([]string, len(addrs)),
+		Duration:  duration.Milliseconds(),
+	}
+	for i, addr := range addrs {
+		result.Addresses[i] = addr.String()
+	}
+	return result, nil
+}
@@ -3,11 +3,12 @@ package service
 import (
 	"encoding/json"
 	"log" // Added for logging
-	"os"
 	"s-ui/database"
 	"s-ui/database/model"
+	"s-ui/util"
 	"s-ui/util/common"
 
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 	"gorm.io/gorm"
 )
 
@@ -61,7 +62,7 @@ func (o *EndpointService) GetAllConfig(db *gorm.DB) ([]json.RawMessage, error) {
 		return nil, err
 	}
 	for _, endpoint := range endpoints {
-		endpointJson, err := endpoint.MarshalJSON()
+		endpointJson, err := coreEndpoint(endpoint)
 		if err != nil {
 			return nil, err // Return error if marshal fails
 		}
@@ -70,6 +71,13 @@ func (o *EndpointService) GetAllConfig(db *gorm.DB) ([]json.RawMessage, error) {
 	return endpointsJson, nil
 }
 
+// coreEndpoint is the config of an endpoint for sing-box, which has no ext
+func coreEndpoint(endpoint *model.Endpoint) ([]byte, error) {
+	config := *endpoint
+	config.Ext = nil
+	return config.MarshalJSON()
+}
+
 func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) error {
 	var err error
 
@@ -98,8 +106,22 @@ func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 			}
 		}
 
+		// Peers of clients get their keys before they are validated
+		if endpoint.Type == "wireguard" {
+			err = s.wireguardClientPeers(tx, &endpoint)
+			if err != nil {
+				return err
+			}
+			json.Unmarshal(endpoint.Options, &endpointOpts)
+		}
+
 		// WireGuard-specific validation
 		if endpoint.Type == "wireguard" || endpoint.Type == "warp" {
+			// A listening endpoint waits for its peers, which need no address
+			listening := false
+			if port, ok := endpointOpts["listen_port"].(float64); ok && port > 0 {
+				listening = true
+			}
 			// Use endpointOpts directly here
 			peers, ok := endpointOpts["peers"].([]interface{})
 			if !ok || len(peers) == 0 {
@@ -114,17 +136,20 @@ func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 				if pk, ok := peer["public_key"].(string); !ok || pk == "" {
 					return common.NewErrorf("Peer %d missing public_key.", i)
 				}
+				if allowed, ok := peer["allowed_ips"].([]interface{}); !ok || len(allowed) == 0 {
+					return common.NewErrorf("Peer %d missing allowed_ips.", i)
+				}
+				if listening {
+					continue
+				}
 				if addr, ok := peer["address"].(string); !ok || addr == "" {
 					return common.NewErrorf("Peer %d missing address.", i)
 				}
 				if port, ok := peer["port"].(float64); !ok || port <= 0 {
 					return common.NewErrorf("Peer %d missing or invalid port.", i)
 				}
-				if allowed, ok := peer["allowed_ips"].([]interface{}); !ok || len(allowed) == 0 {
-					return common.NewErrorf("Peer %d missing allowed_ips.", i)
-				}
-				if _, ok := peer["persistent_keepalive"].(float64); !ok {
-					return common.NewErrorf("Peer %d does not have persistent_keepalive set. This may cause NAT issues.", i)
+				if _, ok := peer["persistent_keepalive_interval"].(float64); !ok {
+					return common.NewErrorf("Peer %d does not have persistent_keepalive_interval set. This may cause NAT issues.", i)
 				}
 			}
 		}
@@ -209,7 +234,7 @@ func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 			} else { // "edit"
 				var oldLicense string
 				// Use Pluck for single column, ensure it's from the correct endpoint
-				err = tx.Model(&model.Endpoint{}).Where("id = ?", endpoint.Id).Pluck("json_extract(ext, '$.license_key')", &oldLicense).Error
+				err = tx.Model(&model.Endpoint{}).Where("id = ?", endpoint.Id).Pluck(database.JsonExtract("ext", "license_key"), &oldLicense).Error
 				if err != nil {
 					if err == gorm.ErrRecordNotFound {
 						oldLicense = ""
@@ -224,48 +249,23 @@ func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 			}
 		}
 
-		if corePtr.IsRunning() {
-			configData, err := endpoint.MarshalJSON()
+		if changes := pendingCore(tx); changes != nil {
+			configData, err := coreEndpoint(&endpoint)
 			if err != nil {
 				return err
 			}
 			if act == "edit" {
-				var oldTag string
-				var oldType string // Added to fetch the old type
-
-				// Fetch oldTag
-				err = tx.Model(&model.Endpoint{}).Where("id = ?", endpoint.Id).Pluck("tag", &oldTag).Error
+				var old model.Endpoint
+				err = tx.Model(&model.Endpoint{}).Where("id = ?", endpoint.Id).First(&old).Error
 				if err != nil {
-					if err == gorm.ErrRecordNotFound {
-						oldTag = "" // If not found, assume it wasn't in core or tag was cleared
-					} else {
-						return common.NewErrorf("Failed to retrieve old tag for endpoint ID %d: %v", endpoint.Id, err)
-					}
+					return common.NewErrorf("Failed to retrieve old endpoint ID %d: %v", endpoint.Id, err)
 				}
-
-				// Fetch oldType
-				err = tx.Model(&model.Endpoint{}).Where("id = ?", endpoint.Id).Pluck("type", &oldType).Error
-				if err != nil {
-					if err == gorm.ErrRecordNotFound {
-						// This is less likely if oldTag was found, but handle defensively
-						oldType = ""
-					} else {
-						return common.NewErrorf("Failed to retrieve old type for endpoint ID %d: %v", endpoint.Id, err)
-					}
-				}
-
-				// Remove from core if oldTag exists AND (tag has changed OR type has changed)
-				if oldTag != "" && (oldTag != endpoint.Tag || oldType != endpoint.Type) {
-					err = corePtr.RemoveEndpoint(oldTag)    // Remove using the OLD tag
-					if err != nil && err != os.ErrInvalid { // os.ErrInvalid might mean tag not found, which is fine
-						return common.NewErrorf("Failed to remove old endpoint '%s' (type: '%s') from core: %v", oldTag, oldType, err)
-					}
+				// Remove from core if tag or type has changed
+				if old.Tag != endpoint.Tag || old.Type != endpoint.Type {
+					changes.removeEndpoints = append(changes.removeEndpoints, old.Tag)
 				}
 			}
-			err = corePtr.AddEndpoint(configData) // Add/update with new config
-			if err != nil {
-				return common.NewErrorf("Failed to add/update endpoint '%s' (type: '%s') in core: %v", endpoint.Tag, endpoint.Type, err)
-			}
+			changes.endpoints = append(changes.endpoints, configData)
 		}
 
 		err = tx.Save(&endpoint).Error
@@ -278,11 +278,8 @@ func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 		if err != nil {
 			return err
 		}
-		if corePtr.IsRunning() {
-			err = corePtr.RemoveEndpoint(tag)
-			if err != nil && err != os.ErrInvalid {
-				return err
-			}
+		if changes := pendingCore(tx); changes != nil {
+			changes.removeEndpoints = append(changes.removeEndpoints, tag)
 		}
 		err = tx.Where("tag = ?", tag).Delete(&model.Endpoint{}).Error // Pass pointer to Delete
 		if err != nil {
@@ -294,6 +291,92 @@ func (s *EndpointService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 	return nil
 }
 
+// wireguardClientPeers keeps peers of clients in ext of a listening wireguard endpoint, for their links.
+// A peer of a client without keys gets a new key pair, and a peer in options with its allowed_ips.
+// Keys of other peers must match each other, and peers which are gone from options are dropped.
+func (s *EndpointService) wireguardClientPeers(tx *gorm.DB, endpoint *model.Endpoint) error {
+	var options map[string]interface{}
+	err := json.Unmarshal(endpoint.Options, &options)
+	if err != nil {
+		return common.NewError("Invalid endpoint options JSON.")
+	}
+	var ext map[string]interface{}
+	json.Unmarshal(endpoint.Ext, &ext)
+	if ext == nil || ext["peers"] == nil {
+		return nil
+	}
+	if port, _ := options["listen_port"].(float64); port <= 0 {
+		return common.NewError("Peers of clients need a listening endpoint.")
+	}
+	extPeersJson, _ := json.Marshal(ext["peers"])
+	var extPeers []util.WireguardPeerExt
+	err = json.Unmarshal(extPeersJson, &extPeers)
+	if err != nil {
+		return common.NewErrorf("Invalid peers of clients: %v", err)
+	}
+
+	peers, _ := options["peers"].([]interface{})
+	publicKeys := make(map[string]bool, len(peers))
+	for _, peerRaw := range peers {
+		if peer, ok := peerRaw.(map[string]interface{}); ok {
+			publicKey, _ := peer["public_key"].(string)
+			publicKeys[publicKey] = true
+		}
+	}
+	clientPeers := []util.WireguardPeerExt{}
+	for _, peer := range extPeers {
+		if peer.Client == "" {
+			return common.NewError("Peer of a client has no client.")
+		}
+		var count int64
+		err = tx.Model(model.Client{}).Where("name = ?", peer.Client).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return common.NewErrorf("Client %s of a peer not found.", peer.Client)
+		}
+		if peer.PrivateKey == "" {
+			if len(peer.AllowedIPs) == 0 {
+				return common.NewErrorf("Peer of client %s missing allowed_ips.", peer.Client)
+			}
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return err
+			}
+			peer.PrivateKey = key.String()
+			peer.PublicKey = key.PublicKey().String()
+			peers = append(peers, map[string]interface{}{
+				"public_key":  peer.PublicKey,
+				"allowed_ips": peer.AllowedIPs,
+			})
+		} else {
+			key, err := wgtypes.ParseKey(peer.PrivateKey)
+			if err != nil {
+				return common.NewErrorf("Invalid private key of peer of client %s.", peer.Client)
+			}
+			if peer.PublicKey == "" {
+				peer.PublicKey = key.PublicKey().String()
+			} else if peer.PublicKey != key.PublicKey().String() {
+				return common.NewErrorf("Public key of peer of client %s does not match its private key.", peer.Client)
+			}
+			if !publicKeys[peer.PublicKey] {
+				continue
+			}
+		}
+		peer.AllowedIPs = nil
+		clientPeers = append(clientPeers, peer)
+	}
+	options["peers"] = peers
+	ext["peers"] = clientPeers
+	endpoint.Options, err = json.MarshalIndent(options, "", "  ")
+	if err != nil {
+		return err
+	}
+	endpoint.Ext, err = json.MarshalIndent(ext, "", "  ")
+	return err
+}
+
 // Helper function to extract all allowed_ips from an endpoint's options
 func extractAllowedIPsFromOptions(options json.RawMessage) ([]string, error) {
 	if options == nil {
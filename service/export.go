@@ -0,0 +1,1176 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"gorm.io/gorm"
+)
+
+// exportVersion is increased when the export format changes incompatibly
+const exportVersion = 1
+
+// Settings which are secrets or belong to this installation are not exported
+var exportSkipSettings = map[string]bool{
+	"secret":             true,
+	"version":            true,
+	"backupPassphrase":   true,
+	"backupDestinations": true,
+	"notifyChannels":     true,
+}
+
+// PanelExport is the portable form of the panel configuration. Objects refer to each other
+// by tag or name instead of database ids. A missing section is left untouched on import.
+type PanelExport struct {
+	Version    int               `json:"version"`
+	AppVersion string            `json:"appVersion,omitempty"`
+	ExportedAt int64             `json:"exportedAt,omitempty"`
+	Settings   map[string]string `json:"settings"`
+	Tls        []ExportTls       `json:"tls"`
+	Inbounds   []ExportInbound   `json:"inbounds"`
+	Outbounds  []ExportTagged    `json:"outbounds"`
+	Endpoints  []ExportEndpoint  `json:"endpoints"`
+	RuleSets   []ExportTagged    `json:"rulesets"`
+	Rules      []ExportRule      `json:"rules"`
+	DnsServers []ExportTagged    `json:"dnsservers"`
+	DnsRules   []ExportRule      `json:"dnsrules"`
+	Plans      []ExportPlan      `json:"plans"`
+	Clients    []ExportClient    `json:"clients"`
+	Stats      []ExportStats     `json:"stats,omitempty"`
+}
+
+type ExportTls struct {
+	Name   string          `json:"name"`
+	Server json.RawMessage `json:"server,omitempty"`
+	Client json.RawMessage `json:"client,omitempty"`
+}
+
+type ExportInbound struct {
+	Type    string          `json:"type"`
+	Tag     string          `json:"tag"`
+	Tls     string          `json:"tls,omitempty"`
+	Addrs   json.RawMessage `json:"addrs,omitempty"`
+	OutJson json.RawMessage `json:"out_json,omitempty"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+type ExportTagged struct {
+	Type    string          `json:"type"`
+	Tag     string          `json:"tag"`
+	Options json.RawMessage `json:"options,omitempty"`
+}
+
+type ExportEndpoint struct {
+	Type    string          `json:"type"`
+	Tag     string          `json:"tag"`
+	Options json.RawMessage `json:"options,omitempty"`
+	Ext     json.RawMessage `json:"ext,omitempty"`
+}
+
+type ExportRule struct {
+	Priority int             `json:"priority"`
+	Enable   bool            `json:"enable"`
+	Rule     json.RawMessage `json:"rule"`
+}
+
+type ExportClient struct {
+	Name     string          `json:"name"`
+	Enable   bool            `json:"enable"`
+	Config   json.RawMessage `json:"config,omitempty"`
+	Inbounds []string        `json:"inbounds"`
+	Links    json.RawMessage `json:"links,omitempty"`
+	Volume   int64           `json:"volume"`
+	Expiry   int64           `json:"expiry"`
+	Up       int64           `json:"up,omitempty"`
+	Down     int64           `json:"down,omitempty"`
+	Desc     string          `json:"desc,omitempty"`
+	Group    string          `json:"group,omitempty"`
+	Dns      string          `json:"dns,omitempty"`
+	Plan     string          `json:"plan,omitempty"`
+	// Policy when the client runs out
+	GraceDays    int64  `json:"graceDays,omitempty"`
+	QuotaAction  string `json:"quotaAction,omitempty"`
+	ThrottleKbps int64  `json:"throttleKbps,omitempty"`
+	// SubToken keeps subscription links of the client working on the importing panel
+	SubToken  string `json:"subToken,omitempty"`
+	SubByName bool   `json:"subByName,omitempty"`
+}
+
+type ExportPlan struct {
+	Name         string   `json:"name"`
+	Volume       int64    `json:"volume"`
+	Duration     int64    `json:"duration"`
+	ResetPolicy  string   `json:"resetPolicy,omitempty"`
+	Inbounds     []string `json:"inbounds"`
+	SpeedLimit   int64    `json:"speedLimit,omitempty"`
+	Group        string   `json:"group,omitempty"`
+	Desc         string   `json:"desc,omitempty"`
+	GraceDays    int64    `json:"graceDays,omitempty"`
+	QuotaAction  string   `json:"quotaAction,omitempty"`
+	ThrottleKbps int64    `json:"throttleKbps,omitempty"`
+}
+
+type ExportStats struct {
+	DateTime  int64  `json:"dateTime"`
+	Resource  string `json:"resource"`
+	Tag       string `json:"tag"`
+	Direction bool   `json:"direction"`
+	Traffic   int64  `json:"traffic"`
+}
+
+type ImportConflict struct {
+	Object string `json:"object"`
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+type ImportReport struct {
+	Mode      string           `json:"mode"`
+	DryRun    bool             `json:"dryRun"`
+	Created   map[string]int   `json:"created"`
+	Conflicts []ImportConflict `json:"conflicts"`
+	Errors    []string         `json:"errors"`
+	// Settings of another panel which could not be converted
+	Unsupported []string `json:"unsupported,omitempty"`
+}
+
+// ExportConfig renders the panel configuration as json or yaml. Traffic is only exported with withStats.
+func (s *ConfigService) ExportConfig(format string, withStats bool) ([]byte, error) {
+	db := database.GetDB()
+	export := PanelExport{
+		Version:    exportVersion,
+		AppVersion: config.GetVersion(),
+		ExportedAt: time.Now().Unix(),
+		Settings:   map[string]string{},
+	}
+
+	var settings []model.Setting
+	err := db.Model(model.Setting{}).Order("id").Find(&settings).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range settings {
+		if !exportSkipSettings[setting.Key] {
+			export.Settings[setting.Key] = setting.Value
+		}
+	}
+
+	var tlsList []model.Tls
+	err = db.Model(model.Tls{}).Order("id").Find(&tlsList).Error
+	if err != nil {
+		return nil, err
+	}
+	tlsNames := make(map[uint]string, len(tlsList))
+	export.Tls = []ExportTls{}
+	for _, tls := range tlsList {
+		tlsNames[tls.Id] = tls.Name
+		export.Tls = append(export.Tls, ExportTls{Name: tls.Name, Server: tls.Server, Client: tls.Client})
+	}
+
+	var inbounds []model.Inbound
+	err = db.Model(model.Inbound{}).Order("id").Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	inboundTags := make(map[uint]string, len(inbounds))
+	export.Inbounds = []ExportInbound{}
+	for _, inbound := range inbounds {
+		inboundTags[inbound.Id] = inbound.Tag
+		export.Inbounds = append(export.Inbounds, ExportInbound{
+			Type:    inbound.Type,
+			Tag:     inbound.Tag,
+			Tls:     tlsNames[inbound.TlsId],
+			Addrs:   inbound.Addrs,
+			OutJson: inbound.OutJson,
+			Options: inbound.Options,
+		})
+	}
+
+	var outbounds []model.Outbound
+	err = db.Model(model.Outbound{}).Order("id").Find(&outbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	export.Outbounds = []ExportTagged{}
+	for _, outbound := range outbounds {
+		export.Outbounds = append(export.Outbounds, ExportTagged{Type: outbound.Type, Tag: outbound.Tag, Options: outbound.Options})
+	}
+
+	var endpoints []model.Endpoint
+	err = db.Model(model.Endpoint{}).Order("id").Find(&endpoints).Error
+	if err != nil {
+		return nil, err
+	}
+	export.Endpoints = []ExportEndpoint{}
+	for _, endpoint := range endpoints {
+		export.Endpoints = append(export.Endpoints, ExportEndpoint{Type: endpoint.Type, Tag: endpoint.Tag, Options: endpoint.Options, Ext: endpoint.Ext})
+	}
+
+	var ruleSets []model.RuleSet
+	err = db.Model(model.RuleSet{}).Order("id").Find(&ruleSets).Error
+	if err != nil {
+		return nil, err
+	}
+	export.RuleSets = []ExportTagged{}
+	for _, ruleSet := range ruleSets {
+		export.RuleSets = append(export.RuleSets, ExportTagged{Type: ruleSet.Type, Tag: ruleSet.Tag, Options: ruleSet.Options})
+	}
+
+	var rules []model.RouteRule
+	err = db.Model(model.RouteRule{}).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	export.Rules = []ExportRule{}
+	for _, rule := range rules {
+		export.Rules = append(export.Rules, ExportRule{Priority: rule.Priority, Enable: rule.Enable, Rule: rule.Rule})
+	}
+
+	var dnsServers []model.DnsServer
+	err = db.Model(model.DnsServer{}).Order("id").Find(&dnsServers).Error
+	if err != nil {
+		return nil, err
+	}
+	export.DnsServers = []ExportTagged{}
+	for _, server := range dnsServers {
+		export.DnsServers = append(export.DnsServers, ExportTagged{Type: server.Type, Tag: server.Tag, Options: server.Options})
+	}
+
+	var dnsRules []model.DnsRule
+	err = db.Model(model.DnsRule{}).Order("priority, id").Find(&dnsRules).Error
+	if err != nil {
+		return nil, err
+	}
+	export.DnsRules = []ExportRule{}
+	for _, rule := range dnsRules {
+		export.DnsRules = append(export.DnsRules, ExportRule{Priority: rule.Priority, Enable: rule.Enable, Rule: rule.Rule})
+	}
+
+	var plans []model.Plan
+	err = db.Model(model.Plan{}).Order("id").Find(&plans).Error
+	if err != nil {
+		return nil, err
+	}
+	planNames := make(map[uint]string, len(plans))
+	export.Plans = []ExportPlan{}
+	for _, plan := range plans {
+		planNames[plan.Id] = plan.Name
+		exportPlan := ExportPlan{
+			Name:         plan.Name,
+			Volume:       plan.Volume,
+			Duration:     plan.Duration,
+			ResetPolicy:  plan.ResetPolicy,
+			Inbounds:     []string{},
+			SpeedLimit:   plan.SpeedLimit,
+			Group:        plan.Group,
+			Desc:         plan.Desc,
+			GraceDays:    plan.GraceDays,
+			QuotaAction:  plan.QuotaAction,
+			ThrottleKbps: plan.ThrottleKbps,
+		}
+		var inboundIds []uint
+		if len(plan.Inbounds) > 0 {
+			err = json.Unmarshal(plan.Inbounds, &inboundIds)
+			if err != nil {
+				return nil, common.NewErrorf("invalid inbounds of plan %s: %v", plan.Name, err)
+			}
+		}
+		for _, id := range inboundIds {
+			if tag, ok := inboundTags[id]; ok {
+				exportPlan.Inbounds = append(exportPlan.Inbounds, tag)
+			}
+		}
+		export.Plans = append(export.Plans, exportPlan)
+	}
+
+	var clients []model.Client
+	err = db.Model(model.Client{}).Order("id").Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	export.Clients = []ExportClient{}
+	for _, client := range clients {
+		exportClient := ExportClient{
+			Name:         client.Name,
+			Enable:       client.Enable,
+			Config:       client.Config,
+			Inbounds:     []string{},
+			Volume:       client.Volume,
+			Expiry:       client.Expiry,
+			Desc:         client.Desc,
+			Group:        client.Group,
+			Dns:          client.Dns,
+			Plan:         planNames[client.PlanId],
+			GraceDays:    client.GraceDays,
+			QuotaAction:  client.QuotaAction,
+			ThrottleKbps: client.ThrottleKbps,
+			SubToken:     client.SubToken,
+			SubByName:    client.SubByName,
+		}
+		var inboundIds []uint
+		if len(client.Inbounds) > 0 {
+			err = json.Unmarshal(client.Inbounds, &inboundIds)
+			if err != nil {
+				return nil, common.NewErrorf("invalid inbounds of client %s: %v", client.Name, err)
+			}
+		}
+		for _, id := range inboundIds {
+			if tag, ok := inboundTags[id]; ok {
+				exportClient.Inbounds = append(exportClient.Inbounds, tag)
+			}
+		}
+		// Local links are generated from inbounds on import
+		exportClient.Links, err = nonLocalLinks(client.Links)
+		if err != nil {
+			return nil, common.NewErrorf("invalid links of client %s: %v", client.Name, err)
+		}
+		if withStats {
+			exportClient.Up = client.Up
+			exportClient.Down = client.Down
+		}
+		export.Clients = append(export.Clients, exportClient)
+	}
+
+	if withStats {
+		var stats []model.Stats
+		err = db.Model(model.Stats{}).Order("id").Find(&stats).Error
+		if err != nil {
+			return nil, err
+		}
+		export.Stats = []ExportStats{}
+		for _, stat := range stats {
+			export.Stats = append(export.Stats, ExportStats{
+				DateTime:  stat.DateTime,
+				Resource:  stat.Resource,
+				Tag:       stat.Tag,
+				Direction: stat.Direction,
+				Traffic:   stat.Traffic,
+			})
+		}
+	}
+
+	return encodeExport(&export, format)
+}
+
+func nonLocalLinks(links json.RawMessage) (json.RawMessage, error) {
+	if len(links) == 0 {
+		return nil, nil
+	}
+	var clientLinks []map[string]string
+	err := json.Unmarshal(links, &clientLinks)
+	if err != nil {
+		return nil, err
+	}
+	kept := []map[string]string{}
+	for _, link := range clientLinks {
+		if link["type"] != "local" {
+			kept = append(kept, link)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(kept)
+}
+
+func encodeExport(export *PanelExport, format string) ([]byte, error) {
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "", "json":
+		return data, nil
+	case "yaml", "yml":
+		// Numbers are kept as json numbers, so that yaml does not write large integers as floats
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var value interface{}
+		err = decoder.Decode(&value)
+		if err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		encoder := yaml.NewEncoder(&out)
+		encoder.SetIndent(2)
+		err = encoder.Encode(yamlNumbers(value))
+		if err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	}
+	return nil, common.NewErrorf("unknown export format: %s", format)
+}
+
+func yamlNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = yamlNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = yamlNumbers(item)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	}
+	return value
+}
+
+// decodeExport reads an export in json or yaml. The format is detected when it is empty.
+func decodeExport(data []byte, format string) (*PanelExport, error) {
+	trimmed := bytes.TrimSpace(data)
+	if format == "" {
+		format = "yaml"
+		if bytes.HasPrefix(trimmed, []byte("{")) {
+			format = "json"
+		}
+	}
+	switch format {
+	case "json":
+	case "yaml", "yml":
+		var value interface{}
+		err := yaml.Unmarshal(trimmed, &value)
+		if err != nil {
+			return nil, common.NewErrorf("invalid yaml: %v", err)
+		}
+		trimmed, err = json.Marshal(value)
+		if err != nil {
+			return nil, common.NewErrorf("invalid yaml: %v", err)
+		}
+	default:
+		return nil, common.NewErrorf("unknown import format: %s", format)
+	}
+	export := &PanelExport{}
+	err := json.Unmarshal(trimmed, export)
+	if err != nil {
+		return nil, common.NewErrorf("invalid export: %v", err)
+	}
+	if export.Version < 1 || export.Version > exportVersion {
+		return nil, common.NewErrorf("unsupported export version %d", export.Version)
+	}
+	return export, nil
+}
+
+// validate checks the export on its own, before it is compared with the database
+func (e *PanelExport) validate() error {
+	var errs []string
+	unique := func(object string, names []string) map[string]bool {
+		seen := make(map[string]bool, len(names))
+		for _, name := range names {
+			if name == "" {
+				errs = append(errs, object+": missing name or tag")
+			} else if seen[name] {
+				errs = append(errs, object+": duplicate "+name)
+			}
+			seen[name] = true
+		}
+		return seen
+	}
+	var names []string
+	for _, tls := range e.Tls {
+		names = append(names, tls.Name)
+	}
+	unique("tls", names)
+	names = nil
+	for _, inbound := range e.Inbounds {
+		names = append(names, inbound.Tag)
+		if inbound.Type == "" {
+			errs = append(errs, "inbounds: missing type of "+inbound.Tag)
+		}
+	}
+	unique("inbounds", names)
+	// Outbounds and endpoints share tags in sing-box
+	names = nil
+	for _, outbound := range e.Outbounds {
+		names = append(names, outbound.Tag)
+		if outbound.Type == "" {
+			errs = append(errs, "outbounds: missing type of "+outbound.Tag)
+		}
+	}
+	for _, endpoint := range e.Endpoints {
+		names = append(names, endpoint.Tag)
+		if endpoint.Type == "" {
+			errs = append(errs, "endpoints: missing type of "+endpoint.Tag)
+		}
+	}
+	unique("outbounds and endpoints", names)
+	names = nil
+	for _, ruleSet := range e.RuleSets {
+		names = append(names, ruleSet.Tag)
+	}
+	unique("rulesets", names)
+	names = nil
+	for _, server := range e.DnsServers {
+		names = append(names, server.Tag)
+	}
+	unique("dnsservers", names)
+	names = nil
+	for _, plan := range e.Plans {
+		names = append(names, plan.Name)
+	}
+	unique("plans", names)
+	names = nil
+	for _, client := range e.Clients {
+		names = append(names, client.Name)
+	}
+	unique("clients", names)
+	for _, rule := range append(append([]ExportRule{}, e.Rules...), e.DnsRules...) {
+		if len(rule.Rule) == 0 || !json.Valid(rule.Rule) {
+			errs = append(errs, "rules: a rule is missing or invalid")
+		}
+	}
+	if len(errs) > 0 {
+		return common.NewErrorf("invalid export: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// ImportConfig applies an export with mode "replace", which swaps every section found in the export,
+// or "merge", which only adds objects whose tag or name is new and reports the others as conflicts.
+// With dryRun nothing is stored, and the report shows what would happen.
+func (s *ConfigService) ImportConfig(data []byte, format string, mode string, dryRun bool, loginUser string, hostname string) (*ImportReport, error) {
+	export, err := decodeExport(data, format)
+	if err != nil {
+		return nil, err
+	}
+	return s.importExport(export, mode, dryRun, loginUser, hostname)
+}
+
+func (s *ConfigService) importExport(export *PanelExport, mode string, dryRun bool, loginUser string, hostname string) (*ImportReport, error) {
+	if mode == "" {
+		mode = "merge"
+	}
+	if mode != "merge" && mode != "replace" {
+		return nil, common.NewErrorf("unknown import mode: %s", mode)
+	}
+	err := export.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{
+		Mode:      mode,
+		DryRun:    dryRun,
+		Created:   map[string]int{},
+		Conflicts: []ImportConflict{},
+		Errors:    []string{},
+	}
+	importer := &configImporter{
+		ConfigService: s,
+		export:        export,
+		replace:       mode == "replace",
+		hostname:      hostname,
+		report:        report,
+	}
+
+	db := database.GetDB()
+	tx := db.Begin()
+	if dryRun {
+		tx = tx.Set(dryRunKey, true).Session(&gorm.Session{})
+	}
+	err = importer.run(tx)
+	if err == nil {
+		var pendingConfig *SingBoxConfig
+		pendingConfig, err = s.getConfig(tx, "")
+		if err == nil {
+			checkErr := s.CheckConfig(pendingConfig)
+			if checkErr != nil {
+				if dryRun {
+					report.Errors = append(report.Errors, strings.TrimSpace(checkErr.Error()))
+				} else {
+					err = common.NewErrorf("invalid config: %s", strings.TrimSpace(checkErr.Error()))
+				}
+			}
+		}
+	}
+	if err == nil && !dryRun {
+		obj, _ := json.Marshal(report)
+		err = tx.Create(&model.Changes{
+			DateTime: time.Now().Unix(),
+			Actor:    loginUser,
+			Key:      "import",
+			Action:   mode,
+			Obj:      obj,
+		}).Error
+	}
+	if err != nil || dryRun {
+		tx.Rollback()
+		if err != nil {
+			return nil, err
+		}
+		return report, nil
+	}
+	err = tx.Commit().Error
+	if err != nil {
+		return nil, err
+	}
+	LastUpdate = time.Now().Unix()
+	logger.Info("configuration imported with mode ", mode, " by ", loginUser)
+
+	// An import may touch any part of the config, so the core restarts with all of it
+	wasRunning := corePtr.IsRunning()
+	if wasRunning {
+		err = s.RestartCore()
+	} else {
+		err = s.StartCore("")
+	}
+	if err != nil {
+		logger.Errorf("failed to start core after import: %v", err)
+		// The import broke a working core, go back to the last known-good state
+		if wasRunning {
+			return nil, s.rollbackToSnapshot(loginUser, err)
+		}
+	}
+	return report, nil
+}
+
+// configImporter carries the mapping from tags and names to new ids while an export is applied
+type configImporter struct {
+	*ConfigService
+	export   *PanelExport
+	replace  bool
+	hostname string
+	report   *ImportReport
+
+	tlsIds     map[string]uint
+	inboundIds map[string]uint
+	planIds    map[string]uint
+}
+
+func (i *configImporter) conflict(object string, name string) {
+	i.report.Conflicts = append(i.report.Conflicts, ImportConflict{
+		Object: object,
+		Name:   name,
+		Reason: "already exists, kept the current one",
+	})
+}
+
+func (i *configImporter) run(tx *gorm.DB) error {
+	for key, value := range i.export.Settings {
+		if exportSkipSettings[key] {
+			continue
+		}
+		err := i.SettingService.Update(tx, key, value)
+		if err != nil {
+			return common.NewErrorf("failed to import setting %s: %v", key, err)
+		}
+		i.report.Created["settings"]++
+	}
+	err := i.importTls(tx)
+	if err != nil {
+		return err
+	}
+	err = i.importInbounds(tx)
+	if err != nil {
+		return err
+	}
+	err = i.importTagged(tx, "outbounds", &model.Outbound{}, i.export.Outbounds, func(item ExportTagged) interface{} {
+		return &model.Outbound{Type: item.Type, Tag: item.Tag, Options: item.Options}
+	})
+	if err != nil {
+		return err
+	}
+	err = i.importEndpoints(tx)
+	if err != nil {
+		return err
+	}
+	err = i.importTagged(tx, "rulesets", &model.RuleSet{}, i.export.RuleSets, func(item ExportTagged) interface{} {
+		return &model.RuleSet{Type: item.Type, Tag: item.Tag, Options: item.Options}
+	})
+	if err != nil {
+		return err
+	}
+	err = i.importTagged(tx, "dnsservers", &model.DnsServer{}, i.export.DnsServers, func(item ExportTagged) interface{} {
+		return &model.DnsServer{Type: item.Type, Tag: item.Tag, Options: item.Options}
+	})
+	if err != nil {
+		return err
+	}
+	err = i.importRules(tx, "rules", &model.RouteRule{}, i.export.Rules, func(item ExportRule) interface{} {
+		return &model.RouteRule{Priority: item.Priority, Enable: item.Enable, Rule: item.Rule}
+	})
+	if err != nil {
+		return err
+	}
+	err = i.importRules(tx, "dnsrules", &model.DnsRule{}, i.export.DnsRules, func(item ExportRule) interface{} {
+		return &model.DnsRule{Priority: item.Priority, Enable: item.Enable, Rule: item.Rule}
+	})
+	if err != nil {
+		return err
+	}
+	err = i.importPlans(tx)
+	if err != nil {
+		return err
+	}
+	err = i.importClients(tx)
+	if err != nil {
+		return err
+	}
+	return i.importStats(tx)
+}
+
+func (i *configImporter) importTls(tx *gorm.DB) error {
+	var existing []model.Tls
+	err := tx.Model(model.Tls{}).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	i.tlsIds = make(map[string]uint, len(existing))
+	if i.export.Tls == nil {
+		for _, tls := range existing {
+			i.tlsIds[tls.Name] = tls.Id
+		}
+		return nil
+	}
+	oldNames := make(map[uint]string, len(existing))
+	var inbounds []model.Inbound
+	if i.replace {
+		for _, tls := range existing {
+			oldNames[tls.Id] = tls.Name
+		}
+		err = tx.Model(model.Inbound{}).Select("id", "tls_id").Where("tls_id > 0").Find(&inbounds).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&model.Tls{}).Error
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, tls := range existing {
+			i.tlsIds[tls.Name] = tls.Id
+		}
+	}
+	for _, item := range i.export.Tls {
+		if _, ok := i.tlsIds[item.Name]; ok {
+			i.conflict("tls", item.Name)
+			continue
+		}
+		tls := &model.Tls{Name: item.Name, Server: item.Server, Client: item.Client}
+		err = tx.Create(tls).Error
+		if err != nil {
+			return err
+		}
+		i.tlsIds[item.Name] = tls.Id
+		i.report.Created["tls"]++
+	}
+	if !i.replace || i.export.Inbounds != nil {
+		return nil
+	}
+	// Kept inbounds follow their tls by name
+	for _, inbound := range inbounds {
+		err = tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Update("tls_id", i.tlsIds[oldNames[inbound.TlsId]]).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *configImporter) importInbounds(tx *gorm.DB) error {
+	var existing []model.Inbound
+	err := tx.Model(model.Inbound{}).Select("id", "tag").Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	i.inboundIds = make(map[string]uint, len(existing))
+	if i.export.Inbounds == nil {
+		for _, inbound := range existing {
+			i.inboundIds[inbound.Tag] = inbound.Id
+		}
+		return nil
+	}
+	oldTags := make(map[uint]string, len(existing))
+	if i.replace {
+		for _, inbound := range existing {
+			oldTags[inbound.Id] = inbound.Tag
+		}
+		err = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&model.Inbound{}).Error
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, inbound := range existing {
+			i.inboundIds[inbound.Tag] = inbound.Id
+		}
+	}
+	var newIds []uint
+	for _, item := range i.export.Inbounds {
+		if _, ok := i.inboundIds[item.Tag]; ok {
+			i.conflict("inbounds", item.Tag)
+			continue
+		}
+		inbound := &model.Inbound{Type: item.Type, Tag: item.Tag, Addrs: item.Addrs, OutJson: item.OutJson, Options: item.Options}
+		if item.Tls != "" {
+			tlsId, ok := i.tlsIds[item.Tls]
+			if !ok {
+				return common.NewErrorf("inbound %s uses unknown tls %s", item.Tag, item.Tls)
+			}
+			inbound.TlsId = tlsId
+		}
+		if len(inbound.Addrs) == 0 {
+			inbound.Addrs = json.RawMessage("[]")
+		}
+		if len(inbound.OutJson) == 0 {
+			inbound.OutJson = json.RawMessage("{}")
+		}
+		err = tx.Create(inbound).Error
+		if err != nil {
+			return err
+		}
+		i.inboundIds[item.Tag] = inbound.Id
+		newIds = append(newIds, inbound.Id)
+		i.report.Created["inbounds"]++
+	}
+	if len(newIds) > 0 {
+		err = i.InboundService.UpdateOutJsons(tx, newIds, i.hostname)
+		if err != nil {
+			return err
+		}
+	}
+	if !i.replace {
+		return nil
+	}
+	// Kept plans and clients follow their inbounds by tag
+	if i.export.Plans == nil {
+		var plans []model.Plan
+		err = tx.Model(model.Plan{}).Find(&plans).Error
+		if err != nil {
+			return err
+		}
+		for _, plan := range plans {
+			var mapped []uint
+			mapped, err = i.mapInbounds(plan.Inbounds, oldTags)
+			if err != nil {
+				return err
+			}
+			plan.Inbounds, _ = json.Marshal(mapped)
+			err = tx.Model(model.Plan{}).Where("id = ?", plan.Id).Update("inbounds", plan.Inbounds).Error
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if i.export.Clients != nil {
+		return nil
+	}
+	var clients []*model.Client
+	err = tx.Model(model.Client{}).Find(&clients).Error
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		var mapped []uint
+		mapped, err = i.mapInbounds(client.Inbounds, oldTags)
+		if err != nil {
+			return err
+		}
+		client.Inbounds, _ = json.Marshal(mapped)
+		err = i.ClientService.updateLinksWithFixedInbounds(tx, []*model.Client{client}, mapped, i.hostname)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(model.Client{}).Where("id = ?", client.Id).
+			Updates(map[string]interface{}{"inbounds": client.Inbounds, "links": client.Links}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapInbounds maps a json list of replaced inbound ids to the new inbounds with the same tags
+func (i *configImporter) mapInbounds(inbounds json.RawMessage, oldTags map[uint]string) ([]uint, error) {
+	var inboundIds []uint
+	if len(inbounds) > 0 {
+		err := json.Unmarshal(inbounds, &inboundIds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	mapped := []uint{}
+	for _, id := range inboundIds {
+		if newId, ok := i.inboundIds[oldTags[id]]; ok {
+			mapped = append(mapped, newId)
+		}
+	}
+	return mapped, nil
+}
+
+func (i *configImporter) importEndpoints(tx *gorm.DB) error {
+	items := make([]ExportTagged, 0, len(i.export.Endpoints))
+	exts := make(map[string]json.RawMessage, len(i.export.Endpoints))
+	for _, endpoint := range i.export.Endpoints {
+		items = append(items, ExportTagged{Type: endpoint.Type, Tag: endpoint.Tag, Options: endpoint.Options})
+		exts[endpoint.Tag] = endpoint.Ext
+	}
+	if i.export.Endpoints == nil {
+		items = nil
+	}
+	return i.importTagged(tx, "endpoints", &model.Endpoint{}, items, func(item ExportTagged) interface{} {
+		return &model.Endpoint{Type: item.Type, Tag: item.Tag, Options: item.Options, Ext: exts[item.Tag]}
+	})
+}
+
+// importTagged imports a section whose objects are only referred to by their tags
+func (i *configImporter) importTagged(tx *gorm.DB, object string, dbModel interface{}, items []ExportTagged, record func(ExportTagged) interface{}) error {
+	if items == nil {
+		return nil
+	}
+	existing := map[string]bool{}
+	if i.replace {
+		err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(dbModel).Error
+		if err != nil {
+			return err
+		}
+	} else {
+		var tags []string
+		err := tx.Model(dbModel).Pluck("tag", &tags).Error
+		if err != nil {
+			return err
+		}
+		for _, tag := range tags {
+			existing[tag] = true
+		}
+	}
+	for _, item := range items {
+		if existing[item.Tag] {
+			i.conflict(object, item.Tag)
+			continue
+		}
+		err := tx.Create(record(item)).Error
+		if err != nil {
+			return common.NewErrorf("failed to import %s %s: %v", object, item.Tag, err)
+		}
+		i.report.Created[object]++
+	}
+	return nil
+}
+
+// importRules replaces rules, or appends them on merge as rules have no name to match
+func (i *configImporter) importRules(tx *gorm.DB, object string, dbModel interface{}, items []ExportRule, record func(ExportRule) interface{}) error {
+	if items == nil {
+		return nil
+	}
+	if i.replace {
+		err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(dbModel).Error
+		if err != nil {
+			return err
+		}
+	}
+	for _, item := range items {
+		err := tx.Create(record(item)).Error
+		if err != nil {
+			return err
+		}
+		i.report.Created[object]++
+	}
+	return nil
+}
+
+func (i *configImporter) importPlans(tx *gorm.DB) error {
+	var existing []model.Plan
+	err := tx.Model(model.Plan{}).Select("id", "name").Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	i.planIds = make(map[string]uint, len(existing))
+	if i.export.Plans == nil {
+		for _, plan := range existing {
+			i.planIds[plan.Name] = plan.Id
+		}
+		return nil
+	}
+	oldNames := make(map[uint]string, len(existing))
+	if i.replace {
+		for _, plan := range existing {
+			oldNames[plan.Id] = plan.Name
+		}
+		err = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&model.Plan{}).Error
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, plan := range existing {
+			i.planIds[plan.Name] = plan.Id
+		}
+	}
+	for _, item := range i.export.Plans {
+		if _, ok := i.planIds[item.Name]; ok {
+			i.conflict("plans", item.Name)
+			continue
+		}
+		inboundIds := []uint{}
+		for _, tag := range item.Inbounds {
+			id, ok := i.inboundIds[tag]
+			if !ok {
+				return common.NewErrorf("plan %s uses unknown inbound %s", item.Name, tag)
+			}
+			inboundIds = append(inboundIds, id)
+		}
+		plan := &model.Plan{
+			Name:         item.Name,
+			Volume:       item.Volume,
+			Duration:     item.Duration,
+			ResetPolicy:  item.ResetPolicy,
+			SpeedLimit:   item.SpeedLimit,
+			Group:        item.Group,
+			Desc:         item.Desc,
+			GraceDays:    item.GraceDays,
+			QuotaAction:  item.QuotaAction,
+			ThrottleKbps: item.ThrottleKbps,
+		}
+		plan.Inbounds, _ = json.Marshal(inboundIds)
+		_, err = i.PlanService.validate(tx, plan)
+		if err != nil {
+			return common.NewErrorf("failed to import plan %s: %v", item.Name, err)
+		}
+		err = tx.Create(plan).Error
+		if err != nil {
+			return err
+		}
+		i.planIds[item.Name] = plan.Id
+		i.report.Created["plans"]++
+	}
+	if !i.replace || i.export.Clients != nil {
+		return nil
+	}
+	// Kept clients follow their plan by name
+	var clients []model.Client
+	err = tx.Model(model.Client{}).Select("id", "plan_id").Where("plan_id > 0").Find(&clients).Error
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		err = tx.Model(model.Client{}).Where("id = ?", client.Id).Update("plan_id", i.planIds[oldNames[client.PlanId]]).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *configImporter) importClients(tx *gorm.DB) error {
+	if i.export.Clients == nil {
+		return nil
+	}
+	existing := map[string]bool{}
+	if i.replace {
+		err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&model.Client{}).Error
+		if err != nil {
+			return err
+		}
+	} else {
+		var names []string
+		err := tx.Model(model.Client{}).Pluck("name", &names).Error
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			existing[name] = true
+		}
+	}
+	for _, item := range i.export.Clients {
+		if existing[item.Name] {
+			i.conflict("clients", item.Name)
+			continue
+		}
+		inboundIds := []uint{}
+		for _, tag := range item.Inbounds {
+			id, ok := i.inboundIds[tag]
+			if !ok {
+				return common.NewErrorf("client %s uses unknown inbound %s", item.Name, tag)
+			}
+			inboundIds = append(inboundIds, id)
+		}
+		err := validateQuotaPolicy(item.GraceDays, item.QuotaAction, item.ThrottleKbps)
+		if err != nil {
+			return common.NewErrorf("failed to import client %s: %v", item.Name, err)
+		}
+		client := &model.Client{
+			Enable:       item.Enable,
+			Name:         item.Name,
+			Config:       item.Config,
+			Links:        item.Links,
+			Volume:       item.Volume,
+			Expiry:       item.Expiry,
+			Up:           item.Up,
+			Down:         item.Down,
+			Desc:         item.Desc,
+			Group:        item.Group,
+			Dns:          item.Dns,
+			GraceDays:    item.GraceDays,
+			QuotaAction:  item.QuotaAction,
+			ThrottleKbps: item.ThrottleKbps,
+			SubToken:     item.SubToken,
+		}
+		err = setSubTokens(tx, []*model.Client{client})
+		if err != nil {
+			return common.NewErrorf("failed to import client %s: %v", item.Name, err)
+		}
+		client.SubByName = item.SubByName && client.SubToken == item.SubToken
+		if item.Plan != "" {
+			planId, ok := i.planIds[item.Plan]
+			if !ok {
+				return common.NewErrorf("client %s uses unknown plan %s", item.Name, item.Plan)
+			}
+			client.PlanId = planId
+		}
+		client.Inbounds, _ = json.Marshal(inboundIds)
+		err = i.ClientService.updateLinksWithFixedInbounds(tx, []*model.Client{client}, inboundIds, i.hostname)
+		if err != nil {
+			return err
+		}
+		err = tx.Create(client).Error
+		if err != nil {
+			return common.NewErrorf("failed to import client %s: %v", item.Name, err)
+		}
+		i.report.Created["clients"]++
+	}
+	return nil
+}
+
+func (i *configImporter) importStats(tx *gorm.DB) error {
+	if i.export.Stats == nil {
+		return nil
+	}
+	if i.replace {
+		err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(&model.Stats{}).Error
+		if err != nil {
+			return err
+		}
+	}
+	stats := make([]model.Stats, 0, len(i.export.Stats))
+	for _, stat := range i.export.Stats {
+		stats = append(stats, model.Stats{
+			DateTime:  stat.DateTime,
+			Resource:  stat.Resource,
+			Tag:       stat.Tag,
+			Direction: stat.Direction,
+			Traffic:   stat.Traffic,
+		})
+	}
+	if len(stats) == 0 {
+		return nil
+	}
+	err := tx.CreateInBatches(stats, 500).Error
+	if err != nil {
+		return err
+	}
+	i.report.Created["stats"] = len(stats)
+	return nil
+}
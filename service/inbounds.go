@@ -89,7 +89,7 @@ func (s *InboundService) GetAll() (*[]map[string]interface{}, error) {
 				// For now, let's assume we still add the inbound but without users if this condition is met.
 			} else {
 				users := []string{}
-				err = db.Raw("SELECT clients.name FROM clients, json_each(clients.inbounds) as je WHERE je.value = ?", inbound.Id).Scan(&users).Error
+				err = db.Model(model.Client{}).Where(database.JsonArrayContains("clients.inbounds"), inbound.Id).Pluck("name", &users).Error
 				if err != nil {
 					// Decide on error handling: return error, or log and continue without users for this inbound
 					log.Printf("Warning: Failed to fetch users for inbound ID %d (Tag: %s): %v", inbound.Id, inbound.Tag, err)
@@ -116,7 +116,7 @@ func (s *InboundService) FromIds(ids []uint) ([]*model.Inbound, error) {
 	return inbounds, nil
 }
 
-func (s *InboundService) Save(tx *gorm.DB, act string, data json.RawMessage, initUserIds string, hostname string) (uint, error) {
+func (s *InboundService) Save(tx *gorm.DB, act string, data json.RawMessage, hostname string) (uint, error) {
 	var err error
 	var id uint
 
@@ -139,62 +139,31 @@ func (s *InboundService) Save(tx *gorm.DB, act string, data json.RawMessage, ini
 			return 0, err
 		}
 
-		err = tx.Save(&inbound).Error
-		if err != nil {
-			return 0, err
-		}
-		id = inbound.Id
-
-		if corePtr.IsRunning() {
-			if act == "edit" {
-				var oldTag string
-				err = tx.Model(&model.Inbound{}).Where("id = ?", inbound.Id).Pluck("tag", &oldTag).Error
-				if err != nil {
-					if err == gorm.ErrRecordNotFound {
-						log.Printf("Warning: Inbound ID %d not found when trying to retrieve old tag for edit. Proceeding as if it's a new entry for core operations.", inbound.Id)
-						oldTag = "" // Treat as if no old tag existed
-					} else {
-						return 0, fmt.Errorf("failed to retrieve old tag for inbound ID %d: %w", inbound.Id, err)
-					}
-				}
-				if oldTag != "" { // Only attempt removal if oldTag was found and is not empty
-					err = corePtr.RemoveInbound(oldTag)
-					if err != nil && err != os.ErrInvalid { // os.ErrInvalid might mean tag not found in core, which is fine
-						return 0, fmt.Errorf("failed to remove old inbound '%s' from core: %w", oldTag, err)
-					}
-				}
-			}
-
-			inboundConfig, err := inbound.MarshalJSON()
+		// A renamed inbound leaves the core by its old tag, the new one is added by RestartInbounds after commit
+		if changes := pendingCore(tx); changes != nil && act == "edit" {
+			var oldTag string
+			err = tx.Model(model.Inbound{}).Where("id = ?", inbound.Id).Pluck("tag", &oldTag).Error
 			if err != nil {
-				return 0, err
+				return 0, fmt.Errorf("failed to retrieve old tag for inbound ID %d: %v", inbound.Id, err)
 			}
-
-			if act == "edit" {
-				inboundConfig, err = s.addUsers(tx, inboundConfig, inbound.Id, inbound.Type)
-			} else {
-				inboundConfig, err = s.initUsers(tx, inboundConfig, initUserIds, inbound.Type)
-			}
-			if err != nil {
-				return 0, err
+			if oldTag != "" && oldTag != inbound.Tag {
+				changes.removeInbounds = append(changes.removeInbounds, oldTag)
 			}
+		}
 
-			err = corePtr.AddInbound(inboundConfig)
-			if err != nil {
-				return 0, err
-			}
+		err = tx.Save(&inbound).Error
+		if err != nil {
+			return 0, err
 		}
+		id = inbound.Id
 	case "del":
 		var tag string
 		err = json.Unmarshal(data, &tag)
 		if err != nil {
 			return 0, err
 		}
-		if corePtr.IsRunning() {
-			err = corePtr.RemoveInbound(tag)
-			if err != nil && err != os.ErrInvalid {
-				return 0, err
-			}
+		if changes := pendingCore(tx); changes != nil {
+			changes.removeInbounds = append(changes.removeInbounds, tag)
 		}
 		err = tx.Model(model.Inbound{}).Select("id").Where("tag = ?", tag).Scan(&id).Error
 		if err != nil {
@@ -210,6 +179,24 @@ func (s *InboundService) Save(tx *gorm.DB, act string, data json.RawMessage, ini
 	return id, nil
 }
 
+// DetourInboundIds returns ids of inbounds which forward to one of the given inbounds, like shadowtls
+func (s *InboundService) DetourInboundIds(tx *gorm.DB, inboundIds []uint) ([]uint, error) {
+	var tags []string
+	err := tx.Model(model.Inbound{}).Where("id in ?", inboundIds).Pluck("tag", &tags).Error
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint
+	if len(tags) == 0 {
+		return ids, nil
+	}
+	err = tx.Model(model.Inbound{}).Where(database.JsonExtract("options", "detour")+" IN ?", tags).Pluck("id", &ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
 func (s *InboundService) UpdateOutJsons(tx *gorm.DB, inboundIds []uint, hostname string) error {
 	var inbounds []model.Inbound
 	err := tx.Model(model.Inbound{}).Preload("Tls").Where("id in ?", inboundIds).Find(&inbounds).Error
@@ -238,7 +225,7 @@ func (s *InboundService) GetAllConfig(db *gorm.DB) ([]json.RawMessage, error) {
 		return nil, err
 	}
 	for _, inbound := range inbounds {
-		inboundJson, err := inbound.MarshalJSON()
+		inboundJson, err := marshalInbound(db, inbound)
 		if err != nil {
 			return nil, err
 		}
@@ -259,40 +246,26 @@ func (s *InboundService) hasUser(inboundType string) bool {
 	return false
 }
 
-func (s *InboundService) fetchUsers(db *gorm.DB, inboundType string, condition string, inbound map[string]interface{}) ([]json.RawMessage, error) {
+func (s *InboundService) fetchUsers(db *gorm.DB, inboundType string, condition string, conditionArgs []interface{}, inbound map[string]interface{}) ([]json.RawMessage, error) {
 	if inboundType == "shadowtls" {
-		if versionRaw, ok := inbound["version"]; ok {
-			var versionFloat float64
-			if err := json.Unmarshal(versionRaw.(json.RawMessage), &versionFloat); err != nil {
-				log.Printf("Warning: could not unmarshal shadowtls version from inbound options: %v. Assuming version 0.", err)
-				versionFloat = 0
-			}
-			if int(versionFloat) < 3 {
-				return nil, nil
-			}
-		} else {
-			log.Printf("Warning: shadowtls version not found in inbound options. Assuming version 0 for user fetching logic.")
-			return nil, nil // Or handle as version 0, which means no users for < 3
+		// Users are only supported since version 3
+		version, _ := inbound["version"].(float64)
+		if int(version) < 3 {
+			return nil, nil
 		}
 	}
 	if inboundType == "shadowsocks" {
-		if methodRaw, ok := inbound["method"]; ok {
-			var method string
-			if err := json.Unmarshal(methodRaw.(json.RawMessage), &method); err != nil {
-				log.Printf("Warning: could not unmarshal shadowsocks method from inbound options: %v", err)
-			} else {
-				if method == "2022-blake3-aes-128-gcm" {
-					inboundType = "shadowsocks16"
-				}
-			}
-		} else {
-			log.Printf("Warning: shadowsocks method not found in inbound options.")
+		if method, _ := inbound["method"].(string); method == "2022-blake3-aes-128-gcm" {
+			inboundType = "shadowsocks16"
 		}
 	}
 
 	var users []string
-	err := db.Raw(`SELECT json_extract(clients.config, ?) FROM clients WHERE enable = true AND ?`,
-		"$."+inboundType, condition).Scan(&users).Error
+	// Clients without config of this protocol are skipped
+	userConfig := database.JsonExtract("clients.config", inboundType)
+	args := append([]interface{}{true}, conditionArgs...)
+	err := db.Raw(`SELECT `+userConfig+` FROM clients WHERE enable = ? AND `+userConfig+` IS NOT NULL AND `+condition,
+		args...).Scan(&users).Error
 	if err != nil {
 		return nil, err
 	}
@@ -317,8 +290,8 @@ func (s *InboundService) addUsers(db *gorm.DB, inboundJson []byte, inboundId uin
 		return nil, err
 	}
 
-	condition := fmt.Sprintf("%d IN (SELECT json_each.value FROM json_each(clients.inbounds))", inboundId)
-	inbound["users"], err = s.fetchUsers(db, inboundType, condition, inbound)
+	condition := database.JsonArrayContains("clients.inbounds")
+	inbound["users"], err = s.fetchUsers(db, inboundType, condition, []interface{}{inboundId}, inbound)
 	if err != nil {
 		return nil, err
 	}
@@ -326,29 +299,20 @@ func (s *InboundService) addUsers(db *gorm.DB, inboundJson []byte, inboundId uin
 	return json.Marshal(inbound)
 }
 
-func (s *InboundService) initUsers(db *gorm.DB, inboundJson []byte, clientIds string, inboundType string) ([]byte, error) {
-	ClientIds := strings.Split(clientIds, ",")
-	if len(ClientIds) == 0 {
-		return inboundJson, nil
-	}
-
-	if !s.hasUser(inboundType) {
-		return inboundJson, nil
-	}
-
-	var inbound map[string]interface{}
-	err := json.Unmarshal(inboundJson, &inbound)
-	if err != nil {
-		return nil, err
+// marshalInbound is the config of an inbound for the core, where a managed certificate replaces the one of its tls
+func marshalInbound(tx *gorm.DB, inbound *model.Inbound) ([]byte, error) {
+	if inbound.Tls == nil || inbound.Tls.Acme == "" {
+		return inbound.MarshalJSON()
 	}
-
-	condition := fmt.Sprintf("id IN (%s)", strings.Join(ClientIds, ","))
-	inbound["users"], err = s.fetchUsers(db, inboundType, condition, inbound)
+	server, err := acmeServerTls(tx, inbound.Tls)
 	if err != nil {
 		return nil, err
 	}
-
-	return json.Marshal(inbound)
+	tls := *inbound.Tls
+	tls.Server = server
+	withAcme := *inbound
+	withAcme.Tls = &tls
+	return withAcme.MarshalJSON()
 }
 
 func (s *InboundService) RestartInbounds(tx *gorm.DB, ids []uint) error {
@@ -362,7 +326,7 @@ func (s *InboundService) RestartInbounds(tx *gorm.DB, ids []uint) error {
 		if err != nil && err != os.ErrInvalid {
 			return err
 		}
-		inboundConfig, err := inbound.MarshalJSON()
+		inboundConfig, err := marshalInbound(tx, inbound)
 		if err != nil {
 			return err
 		}
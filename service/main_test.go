@@ -0,0 +1,30 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"s-ui/core"
+	"s-ui/database"
+	"s-ui/logger"
+	"testing"
+
+	"github.com/op/go-logging"
+	"gorm.io/gorm"
+)
+
+func TestMain(m *testing.M) {
+	logger.InitLogger(logging.ERROR)
+	// The core is not started, so saves only change the database
+	NewConfigService(core.NewCore())
+	os.Exit(m.Run())
+}
+
+// openTestDb makes a new sqlite database in a temporary folder the database of services
+func openTestDb(t *testing.T) *gorm.DB {
+	t.Helper()
+	err := database.InitDB(filepath.Join(t.TempDir(), "s-ui.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return database.GetDB()
+}
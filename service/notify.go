@@ -0,0 +1,450 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const notifyTimeout = 30 * time.Second
+
+// Kinds of client notices
+const (
+	NoticeVolume = "volume"
+	NoticeExpiry = "expiry"
+	NoticeCert   = "cert"
+)
+
+// NotifyChannel is where warnings about clients are sent. Fields are used by its type.
+type NotifyChannel struct {
+	Type string `json:"type"`
+	// smtp, Security is none, starttls or tls
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	Security string   `json:"security,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+	// webhook
+	Url     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Notice is a warning about a client, or a certificate of the cert kind, posted as json to webhooks
+type Notice struct {
+	Client    string `json:"client,omitempty"`
+	Cert      string `json:"cert,omitempty"`
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind"`
+	Threshold int    `json:"threshold"`
+	Used      int64  `json:"used"`
+	Volume    int64  `json:"volume"`
+	Expiry    int64  `json:"expiry"`
+	Message   string `json:"message"`
+}
+
+type NotifyService struct {
+	SettingService
+}
+
+func (c *NotifyChannel) validate() error {
+	switch c.Type {
+	case "smtp":
+		if c.Host == "" || c.From == "" || len(c.To) == 0 {
+			return common.NewError("smtp notify channel needs a host, a sender and recipients")
+		}
+		switch c.Security {
+		case "", "none", "starttls", "tls":
+		default:
+			return common.NewErrorf("unknown smtp security: %s", c.Security)
+		}
+	case "webhook":
+		if !strings.HasPrefix(c.Url, "http://") && !strings.HasPrefix(c.Url, "https://") {
+			return common.NewError("webhook notify channel needs an http or https url")
+		}
+	default:
+		return common.NewErrorf("unknown notify channel type: %s", c.Type)
+	}
+	return nil
+}
+
+func parseNotifyChannels(value string) ([]NotifyChannel, error) {
+	var channels []NotifyChannel
+	err := json.Unmarshal([]byte(value), &channels)
+	if err != nil {
+		return nil, common.NewErrorf("invalid notify channels: %v", err)
+	}
+	for _, channel := range channels {
+		err = channel.validate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return channels, nil
+}
+
+// parseThresholds reads a comma separated list of positive numbers
+func parseThresholds(key string, value string) ([]int, error) {
+	var thresholds []int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		threshold, err := strconv.Atoi(part)
+		if err != nil || threshold <= 0 {
+			return nil, common.NewErrorf("%s must be a list of positive numbers", key)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Ints(thresholds)
+	return thresholds, nil
+}
+
+func (s *NotifyService) getThresholds(key string) ([]int, error) {
+	value, err := s.SettingService.getString(database.GetDB(), key)
+	if err != nil {
+		return nil, err
+	}
+	return parseThresholds(key, value)
+}
+
+func (s *NotifyService) GetChannels() ([]NotifyChannel, error) {
+	value, err := s.SettingService.getString(database.GetDB(), "notifyChannels")
+	if err != nil {
+		return nil, err
+	}
+	return parseNotifyChannels(value)
+}
+
+// NotifyClients warns about enabled clients which crossed a threshold of volume or expiry.
+// Each threshold is notified once, until the client is below it again, like after a traffic reset.
+func (s *NotifyService) NotifyClients() error {
+	channels, err := s.GetChannels()
+	if err != nil || len(channels) == 0 {
+		return err
+	}
+	volumeThresholds, err := s.getThresholds("notifyVolume")
+	if err != nil {
+		return err
+	}
+	expiryThresholds, err := s.getThresholds("notifyExpiry")
+	if err != nil {
+		return err
+	}
+
+	db := database.GetDB()
+	now := time.Now().Unix()
+	var clients []model.Client
+	err = db.Model(model.Client{}).
+		Select("id", "name", "group", "volume", "expiry", "up", "down").
+		Where("enable = ? AND (volume > 0 OR expiry > ?)", true, now).
+		Find(&clients).Error
+	if err != nil {
+		return err
+	}
+	var notices []model.ClientNotice
+	err = db.Model(model.ClientNotice{}).Find(&notices).Error
+	if err != nil {
+		return err
+	}
+	notified := make(map[string]uint, len(notices))
+	for _, notice := range notices {
+		notified[noticeKey(notice.ClientId, notice.Kind, notice.Threshold)] = notice.Id
+	}
+
+	// A notice to send, with the thresholds it records. Without a notice, they are only recorded.
+	type pendingNotice struct {
+		notice  *Notice
+		records []model.ClientNotice
+	}
+	crossed := map[string]bool{}
+	var pending []pendingNotice
+	for _, client := range clients {
+		used := client.Up + client.Down
+		var volumeCrossed, expiryCrossed []int
+		if client.Volume > 0 {
+			percent := used * 100 / client.Volume
+			for _, threshold := range volumeThresholds {
+				if percent >= int64(threshold) {
+					volumeCrossed = append(volumeCrossed, threshold)
+				}
+			}
+		}
+		if client.Expiry > now {
+			for _, threshold := range expiryThresholds {
+				if client.Expiry-now <= int64(threshold)*86400 {
+					expiryCrossed = append(expiryCrossed, threshold)
+				}
+			}
+		}
+		for _, check := range []struct {
+			kind       string
+			thresholds []int
+			// The most urgent threshold is the highest percent, or the fewest days
+			urgent int
+		}{
+			{NoticeVolume, volumeCrossed, len(volumeCrossed) - 1},
+			{NoticeExpiry, expiryCrossed, 0},
+		} {
+			if len(check.thresholds) == 0 {
+				continue
+			}
+			item := pendingNotice{}
+			for _, threshold := range check.thresholds {
+				key := noticeKey(client.Id, check.kind, threshold)
+				crossed[key] = true
+				if _, ok := notified[key]; !ok {
+					item.records = append(item.records, model.ClientNotice{ClientId: client.Id, Kind: check.kind, Threshold: threshold, DateTime: now})
+				}
+			}
+			if len(item.records) == 0 {
+				continue
+			}
+			// Crossing several thresholds at once sends only the most urgent one
+			urgent := check.thresholds[check.urgent]
+			if _, ok := notified[noticeKey(client.Id, check.kind, urgent)]; !ok {
+				item.notice = newNotice(&client, check.kind, urgent, now)
+			}
+			pending = append(pending, item)
+		}
+	}
+
+	// Clients below a threshold again are notified the next time they cross it
+	var stale []uint
+	for key, id := range notified {
+		if !crossed[key] {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		err = db.Where("id in ?", stale).Delete(model.ClientNotice{}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, item := range pending {
+		if item.notice != nil {
+			err = s.send(channels, item.notice)
+			if err != nil {
+				// Not recorded, so it is sent again on the next run
+				logger.Warning("notify client ", item.notice.Client, " failed: ", err)
+				continue
+			}
+		}
+		err = db.Create(&item.records).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func noticeKey(clientId uint, kind string, threshold int) string {
+	return fmt.Sprintf("%d:%s:%d", clientId, kind, threshold)
+}
+
+func newNotice(client *model.Client, kind string, threshold int, now int64) *Notice {
+	notice := &Notice{
+		Client:    client.Name,
+		Group:     client.Group,
+		Kind:      kind,
+		Threshold: threshold,
+		Used:      client.Up + client.Down,
+		Volume:    client.Volume,
+		Expiry:    client.Expiry,
+	}
+	if kind == NoticeVolume {
+		notice.Message = fmt.Sprintf("Client %s has used %d%% of its volume (%s of %s)",
+			client.Name, notice.Used*100/client.Volume, formatBytes(notice.Used), formatBytes(client.Volume))
+	} else {
+		notice.Message = fmt.Sprintf("Client %s expires in %s, at %s",
+			client.Name, formatDuration(client.Expiry-now), time.Unix(client.Expiry, 0).Format(time.RFC1123))
+	}
+	return notice
+}
+
+func formatBytes(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return strconv.FormatFloat(value, 'f', 2, 64) + " " + units[unit]
+}
+
+func formatDuration(seconds int64) string {
+	days := seconds / 86400
+	if days > 0 {
+		return fmt.Sprintf("%d days %d hours", days, seconds%86400/3600)
+	}
+	return fmt.Sprintf("%d hours %d minutes", seconds/3600, seconds%3600/60)
+}
+
+// TestChannels sends a sample notice to every channel
+func (s *NotifyService) TestChannels() error {
+	channels, err := s.GetChannels()
+	if err != nil {
+		return err
+	}
+	if len(channels) == 0 {
+		return common.NewError("no notify channels")
+	}
+	notice := &Notice{
+		Client:  "test",
+		Kind:    "test",
+		Message: "This is a test notification of s-ui",
+	}
+	return s.send(channels, notice)
+}
+
+// send delivers a notice to all channels. It fails only if no channel got it.
+func (s *NotifyService) send(channels []NotifyChannel, notice *Notice) error {
+	var errs []string
+	for _, channel := range channels {
+		var err error
+		switch channel.Type {
+		case "smtp":
+			err = channel.sendMail(notice)
+		case "webhook":
+			err = channel.postWebhook(notice)
+		}
+		if err != nil {
+			errs = append(errs, channel.Type+": "+err.Error())
+		}
+	}
+	if len(errs) == len(channels) {
+		return common.NewError(strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		logger.Warning("notify channel failed: ", err)
+	}
+	return nil
+}
+
+func (c *NotifyChannel) sendMail(notice *Notice) error {
+	port := c.Port
+	if port == 0 {
+		switch c.Security {
+		case "tls":
+			port = 465
+		case "starttls":
+			port = 587
+		default:
+			port = 25
+		}
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.Host}
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: notifyTimeout}
+	if c.Security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifyTimeout))
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if c.Security == "starttls" {
+		err = client.StartTLS(tlsConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		err = client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host))
+		if err != nil {
+			return err
+		}
+	}
+	err = client.Mail(c.From)
+	if err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		err = client.Rcpt(to)
+		if err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	subject := "s-ui: " + notice.Message
+	if notice.Kind != "test" {
+		target := notice.Client
+		if notice.Kind == NoticeCert {
+			target = notice.Cert
+		}
+		subject = fmt.Sprintf("s-ui: %s warning for %s", notice.Kind, target)
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", c.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n")
+	message.WriteString(notice.Message + "\r\n")
+	_, err = writer.Write(message.Bytes())
+	if err != nil {
+		return err
+	}
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (c *NotifyChannel) postWebhook(notice *Notice) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range c.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return common.NewErrorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
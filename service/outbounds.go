@@ -2,7 +2,6 @@ package service
 
 import (
 	"encoding/json"
-	"os"
 	"s-ui/database"
 	"s-ui/database/model"
 	"s-ui/logger"
@@ -18,7 +17,7 @@ func (o *OutboundService) GetAll() (*[]map[string]interface{}, error) {
 	outbounds := []*model.Outbound{}
 	err := db.Model(&model.Outbound{}).Find(&outbounds).Error // Corrected: Use Find and pass pointer to slice
 	if err != nil {
-		return nil, common.NewErrorf("failed to get all outbounds: %w", err)
+		return nil, common.NewErrorf("failed to get all outbounds: %v", err)
 	}
 	var data []map[string]interface{}
 	for _, outbound := range outbounds {
@@ -48,7 +47,7 @@ func (o *OutboundService) GetAllConfig(db *gorm.DB) ([]json.RawMessage, error) {
 	var outbounds []*model.Outbound
 	err := db.Model(&model.Outbound{}).Find(&outbounds).Error // Corrected: Use Find and pass pointer to slice
 	if err != nil {
-		return nil, common.NewErrorf("failed to get all outbound configs: %w", err)
+		return nil, common.NewErrorf("failed to get all outbound configs: %v", err)
 	}
 	for _, outbound := range outbounds {
 		outboundJson, err := outbound.MarshalJSON()
@@ -70,7 +69,7 @@ func (s *OutboundService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 		var outbound model.Outbound
 		err = outbound.UnmarshalJSON(data)
 		if err != nil {
-			return common.NewErrorf("failed to unmarshal outbound data for save: %w", err)
+			return common.NewErrorf("failed to unmarshal outbound data for save: %v", err)
 		}
 
 		// Basic validation
@@ -91,67 +90,50 @@ func (s *OutboundService) Save(tx *gorm.DB, act string, data json.RawMessage) er
 		}
 		err = query.Count(&count).Error
 		if err != nil {
-			return common.NewErrorf("failed to check for duplicate outbound tag '%s': %w", outbound.Tag, err)
+			return common.NewErrorf("failed to check for duplicate outbound tag '%s': %v", outbound.Tag, err)
 		}
 		if count > 0 {
 			return common.NewErrorf("outbound tag '%s' already exists", outbound.Tag)
 		}
 
-		if corePtr.IsRunning() {
+		if changes := pendingCore(tx); changes != nil {
 			configData, err := outbound.MarshalJSON()
 			if err != nil {
-				return common.NewErrorf("failed to marshal outbound for core operation: %w", err)
+				return common.NewErrorf("failed to marshal outbound for core operation: %v", err)
 			}
 			if act == "edit" {
 				var oldTag string
-				// Use Pluck for single field, and handle potential ErrRecordNotFound
 				err = tx.Model(&model.Outbound{}).Where("id = ?", outbound.Id).Pluck("tag", &oldTag).Error
 				if err != nil {
-					if database.IsNotFound(err) {
-						logger.Warningf("Outbound with ID %d not found when attempting to get old tag for edit. Proceeding as if it's a new core entry.", outbound.Id)
-						// oldTag will be empty, so RemoveOutbound won't be called or will be a no-op if it handles empty string
-					} else {
-						return common.NewErrorf("failed to get old tag for outbound ID %d: %w", outbound.Id, err)
-					}
+					return common.NewErrorf("failed to get old tag for outbound ID %d: %v", outbound.Id, err)
 				}
-				if oldTag != "" { // Only remove if oldTag was found
-					err = corePtr.RemoveOutbound(oldTag)
-					if err != nil && err != os.ErrInvalid { // os.ErrInvalid might mean it wasn't found in core, which is fine
-						// Log this error but attempt to add the new one anyway, as removing the old one is best-effort
-						logger.Errorf("Failed to remove old outbound '%s' from core: %v. Attempting to add new/updated outbound '%s'.", oldTag, err, outbound.Tag)
-					}
+				if oldTag != "" && oldTag != outbound.Tag {
+					changes.removeOutbounds = append(changes.removeOutbounds, oldTag)
 				}
 			}
-			err = corePtr.AddOutbound(configData)
-			if err != nil {
-				return common.NewErrorf("failed to add outbound '%s' to core: %w", outbound.Tag, err)
-			}
+			changes.outbounds = append(changes.outbounds, configData)
 		}
 
 		err = tx.Save(&outbound).Error
 		if err != nil {
-			return common.NewErrorf("failed to save outbound '%s' to database: %w", outbound.Tag, err)
+			return common.NewErrorf("failed to save outbound '%s' to database: %v", outbound.Tag, err)
 		}
 	case "del":
 		var tag string
 		err = json.Unmarshal(data, &tag)
 		if err != nil {
-			return common.NewErrorf("failed to unmarshal tag for delete: %w", err)
+			return common.NewErrorf("failed to unmarshal tag for delete: %v", err)
 		}
 		if tag == "" {
 			return common.NewError("tag for delete cannot be empty")
 		}
-		if corePtr.IsRunning() {
-			err = corePtr.RemoveOutbound(tag)
-			if err != nil && err != os.ErrInvalid { // os.ErrInvalid might mean it wasn't found in core, which is fine
-				// Log this error but proceed with DB deletion
-				logger.Errorf("Failed to remove outbound '%s' from core during delete: %v. Proceeding with database deletion.", tag, err)
-			}
+		if changes := pendingCore(tx); changes != nil {
+			changes.removeOutbounds = append(changes.removeOutbounds, tag)
 		}
 		// Ensure we pass a pointer to Delete for proper GORM behavior with struct conditions
 		err = tx.Where("tag = ?", tag).Delete(&model.Outbound{}).Error
 		if err != nil {
-			return common.NewErrorf("failed to delete outbound '%s' from database: %w", tag, err)
+			return common.NewErrorf("failed to delete outbound '%s' from database: %v", tag, err)
 		}
 	default:
 		return common.NewErrorf("unknown action: %s", act)
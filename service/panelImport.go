@@ -0,0 +1,898 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"s-ui/database"
+	"s-ui/util/common"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+// Panels which can be imported with ImportPanel
+const (
+	Panel3xUi    = "3x-ui"
+	PanelXUi     = "x-ui"
+	PanelMarzban = "marzban"
+)
+
+// xrayInbound is an inbound of an xray config, as stored by x-ui panels and in the xray config of Marzban
+type xrayInbound struct {
+	Tag            string          `json:"tag"`
+	Listen         string          `json:"listen"`
+	Port           json.RawMessage `json:"port"`
+	Protocol       string          `json:"protocol"`
+	Settings       json.RawMessage `json:"settings"`
+	StreamSettings json.RawMessage `json:"streamSettings"`
+	Sniffing       json.RawMessage `json:"sniffing"`
+}
+
+type xrayCertificate struct {
+	CertificateFile string   `json:"certificateFile"`
+	KeyFile         string   `json:"keyFile"`
+	Certificate     []string `json:"certificate"`
+	Key             []string `json:"key"`
+}
+
+type xrayStream struct {
+	Network     string `json:"network"`
+	Security    string `json:"security"`
+	TlsSettings *struct {
+		ServerName   string            `json:"serverName"`
+		Alpn         []string          `json:"alpn"`
+		MinVersion   string            `json:"minVersion"`
+		MaxVersion   string            `json:"maxVersion"`
+		Certificates []xrayCertificate `json:"certificates"`
+		Settings     struct {
+			Fingerprint   string `json:"fingerprint"`
+			AllowInsecure bool   `json:"allowInsecure"`
+		} `json:"settings"`
+	} `json:"tlsSettings"`
+	RealitySettings *struct {
+		Dest        string   `json:"dest"`
+		Target      string   `json:"target"`
+		Xver        int      `json:"xver"`
+		ServerNames []string `json:"serverNames"`
+		PrivateKey  string   `json:"privateKey"`
+		ShortIds    []string `json:"shortIds"`
+		Settings    struct {
+			PublicKey   string `json:"publicKey"`
+			Fingerprint string `json:"fingerprint"`
+		} `json:"settings"`
+	} `json:"realitySettings"`
+	TcpSettings *struct {
+		AcceptProxyProtocol bool `json:"acceptProxyProtocol"`
+		Header              struct {
+			Type string `json:"type"`
+		} `json:"header"`
+	} `json:"tcpSettings"`
+	WsSettings *struct {
+		AcceptProxyProtocol bool              `json:"acceptProxyProtocol"`
+		Path                string            `json:"path"`
+		Host                string            `json:"host"`
+		Headers             map[string]string `json:"headers"`
+	} `json:"wsSettings"`
+	GrpcSettings *struct {
+		ServiceName string `json:"serviceName"`
+	} `json:"grpcSettings"`
+	HttpSettings *struct {
+		Path string   `json:"path"`
+		Host []string `json:"host"`
+	} `json:"httpSettings"`
+	HttpupgradeSettings *struct {
+		AcceptProxyProtocol bool   `json:"acceptProxyProtocol"`
+		Path                string `json:"path"`
+		Host                string `json:"host"`
+	} `json:"httpupgradeSettings"`
+}
+
+type xrayClient struct {
+	Id         string `json:"id"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+	Email      string `json:"email"`
+	Flow       string `json:"flow"`
+	Enable     *bool  `json:"enable"`
+	TotalGB    int64  `json:"totalGB"`
+	ExpiryTime int64  `json:"expiryTime"`
+	LimitIp    int    `json:"limitIp"`
+	Reset      int    `json:"reset"`
+}
+
+type xrayAccount struct {
+	User string `json:"user"`
+	Pass string `json:"pass"`
+}
+
+type xraySettings struct {
+	Clients        []xrayClient      `json:"clients"`
+	Accounts       []xrayAccount     `json:"accounts"`
+	Fallbacks      []json.RawMessage `json:"fallbacks"`
+	Decryption     string            `json:"decryption"`
+	Method         string            `json:"method"`
+	Password       string            `json:"password"`
+	Network        string            `json:"network"`
+	Auth           string            `json:"auth"`
+	Address        string            `json:"address"`
+	Port           int               `json:"port"`
+	FollowRedirect bool              `json:"followRedirect"`
+}
+
+// importedClient collects the credentials of a client, which may be spread over several inbounds
+type importedClient struct {
+	ExportClient
+	clientCredentials
+}
+
+// panelConverter turns inbounds and clients of another panel into an export of this panel
+type panelConverter struct {
+	export  *PanelExport
+	notes   []string
+	tags    map[string]bool
+	clients map[string]*importedClient
+	order   []string
+}
+
+func newPanelConverter() *panelConverter {
+	return &panelConverter{
+		export: &PanelExport{
+			Version:  exportVersion,
+			Tls:      []ExportTls{},
+			Inbounds: []ExportInbound{},
+			Clients:  []ExportClient{},
+		},
+		tags:    map[string]bool{},
+		clients: map[string]*importedClient{},
+	}
+}
+
+func (c *panelConverter) note(format string, args ...interface{}) {
+	c.notes = append(c.notes, fmt.Sprintf(format, args...))
+}
+
+// ImportPanel imports inbounds and clients from a 3x-ui or x-ui database, or from a Marzban database
+// with the xray config of Marzban for its inbounds. Settings which have no counterpart are reported.
+func (s *ConfigService) ImportPanel(from string, data []byte, xrayConfig []byte, mode string, dryRun bool, loginUser string, hostname string) (*ImportReport, error) {
+	db, closeDb, err := openPanelDb(data)
+	if err != nil {
+		return nil, err
+	}
+	defer closeDb()
+
+	converter := newPanelConverter()
+	switch from {
+	case Panel3xUi, PanelXUi:
+		err = converter.readXui(db)
+	case PanelMarzban:
+		err = converter.readMarzban(db, xrayConfig)
+	default:
+		err = common.NewErrorf("unknown panel: %s", from)
+	}
+	if err != nil {
+		return nil, err
+	}
+	export := converter.finish()
+	if len(export.Inbounds) == 0 && len(export.Clients) == 0 {
+		return nil, common.NewErrorf("nothing to import from %s: %s", from, strings.Join(converter.notes, "; "))
+	}
+	// Sections which were not read are left untouched
+	if len(export.Tls) == 0 {
+		export.Tls = nil
+	}
+	report, err := s.importExport(export, mode, dryRun, loginUser, hostname)
+	if err != nil {
+		return nil, err
+	}
+	report.Unsupported = converter.notes
+	return report, nil
+}
+
+func openPanelDb(data []byte) (*gorm.DB, func(), error) {
+	file, err := os.CreateTemp("", "s-ui-import-*.db")
+	if err != nil {
+		return nil, nil, err
+	}
+	path := file.Name()
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, err
+	}
+	db, err := database.Open(database.SQLite, path)
+	if err != nil {
+		os.Remove(path)
+		return nil, nil, common.NewErrorf("invalid sqlite database: %v", err)
+	}
+	closeDb := func() {
+		if sqlDb, err := db.DB(); err == nil {
+			sqlDb.Close()
+		}
+		os.Remove(path)
+	}
+	return db, closeDb, nil
+}
+
+type xuiInbound struct {
+	Id             uint
+	Up             int64
+	Down           int64
+	Total          int64
+	Remark         string
+	Enable         bool
+	ExpiryTime     int64
+	Listen         string
+	Port           int
+	Protocol       string
+	Settings       string
+	StreamSettings string
+	Tag            string
+	Sniffing       string
+}
+
+type xuiClientTraffic struct {
+	Email      string
+	Up         int64
+	Down       int64
+	Total      int64
+	ExpiryTime int64
+	Enable     bool
+}
+
+// readXui reads a database of x-ui or 3x-ui. 3x-ui keeps traffic and limits per client,
+// while x-ui keeps them per inbound.
+func (c *panelConverter) readXui(db *gorm.DB) error {
+	if !db.Migrator().HasTable("inbounds") {
+		return common.NewError("not an x-ui database: no inbounds table")
+	}
+	var rows []xuiInbound
+	err := db.Table("inbounds").Order("id").Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	traffics := map[string]xuiClientTraffic{}
+	perClient := db.Migrator().HasTable("client_traffics")
+	if perClient {
+		var trafficRows []xuiClientTraffic
+		err = db.Table("client_traffics").Find(&trafficRows).Error
+		if err != nil {
+			return err
+		}
+		for _, traffic := range trafficRows {
+			traffics[traffic.Email] = traffic
+		}
+	}
+
+	for _, row := range rows {
+		name := strings.TrimSpace(row.Remark)
+		if name == "" {
+			name = row.Tag
+		}
+		if !row.Enable {
+			c.note("inbound %s is disabled, skipped", name)
+			continue
+		}
+		port, _ := json.Marshal(row.Port)
+		in := xrayInbound{
+			Tag:            name,
+			Listen:         row.Listen,
+			Port:           port,
+			Protocol:       row.Protocol,
+			Settings:       json.RawMessage(row.Settings),
+			StreamSettings: json.RawMessage(row.StreamSettings),
+			Sniffing:       json.RawMessage(row.Sniffing),
+		}
+		tag, settings, ok := c.addInbound(in)
+		if !ok {
+			continue
+		}
+		clients := c.inboundClients(tag, in.Protocol, settings)
+		if perClient {
+			if row.Total > 0 || row.ExpiryTime > 0 {
+				c.note("inbound %s: traffic and expiry limits of an inbound are not supported, only limits of clients", tag)
+			}
+			for _, client := range clients {
+				traffic, ok := traffics[client.Name]
+				if !ok {
+					continue
+				}
+				client.Up, client.Down = traffic.Up, traffic.Down
+				if !traffic.Enable {
+					client.Enable = false
+				}
+			}
+			continue
+		}
+		// x-ui limits the whole inbound, which is applied to each of its clients
+		for _, client := range clients {
+			client.Volume = row.Total
+			client.Expiry = xuiExpiry(row.ExpiryTime)
+		}
+		if len(clients) == 1 {
+			clients[0].Up, clients[0].Down = row.Up, row.Down
+		} else if row.Up+row.Down > 0 {
+			c.note("inbound %s: traffic of the inbound can not be split between %d clients, not imported", tag, len(clients))
+		}
+	}
+	return nil
+}
+
+// xuiExpiry converts an expiry in milliseconds, where negative values start counting on first use
+func xuiExpiry(expiryTime int64) int64 {
+	if expiryTime <= 0 {
+		return 0
+	}
+	return expiryTime / 1000
+}
+
+type marzbanUser struct {
+	Id          uint
+	Username    string
+	Status      string
+	UsedTraffic int64
+	DataLimit   *int64
+	Expire      *int64
+	Note        string
+}
+
+type marzbanProxy struct {
+	Id       uint
+	UserId   uint
+	Type     string
+	Settings string
+}
+
+type marzbanExclude struct {
+	ProxyId    uint
+	InboundTag string
+}
+
+// readMarzban reads users of a Marzban database. Inbounds of Marzban are in its xray config,
+// without it users are imported without inbounds.
+func (c *panelConverter) readMarzban(db *gorm.DB, xrayConfig []byte) error {
+	if !db.Migrator().HasTable("users") || !db.Migrator().HasTable("proxies") {
+		return common.NewError("not a Marzban database: no users or proxies table")
+	}
+	// Inbound tags of each protocol, in the way Marzban names protocols
+	protocolTags := map[string][]string{}
+	if len(xrayConfig) > 0 {
+		var xray struct {
+			Inbounds []xrayInbound `json:"inbounds"`
+		}
+		err := json.Unmarshal(xrayConfig, &xray)
+		if err != nil {
+			return common.NewErrorf("invalid xray config: %v", err)
+		}
+		for _, in := range xray.Inbounds {
+			originalTag := in.Tag
+			tag, _, ok := c.addInbound(in)
+			if ok {
+				protocol := strings.ToLower(in.Protocol)
+				protocolTags[protocol] = append(protocolTags[protocol], originalTag+"\x00"+tag)
+			}
+		}
+	} else {
+		c.note("no xray config of Marzban, users are imported without inbounds")
+	}
+
+	var users []marzbanUser
+	err := db.Table("users").Order("id").Find(&users).Error
+	if err != nil {
+		return err
+	}
+	var proxies []marzbanProxy
+	err = db.Table("proxies").Order("id").Find(&proxies).Error
+	if err != nil {
+		return err
+	}
+	excluded := map[uint]map[string]bool{}
+	if db.Migrator().HasTable("exclude_inbounds_association") {
+		var excludes []marzbanExclude
+		err = db.Table("exclude_inbounds_association").Find(&excludes).Error
+		if err != nil {
+			return err
+		}
+		for _, exclude := range excludes {
+			if excluded[exclude.ProxyId] == nil {
+				excluded[exclude.ProxyId] = map[string]bool{}
+			}
+			excluded[exclude.ProxyId][exclude.InboundTag] = true
+		}
+	}
+	userProxies := map[uint][]marzbanProxy{}
+	for _, proxy := range proxies {
+		userProxies[proxy.UserId] = append(userProxies[proxy.UserId], proxy)
+	}
+
+	usedTraffic := false
+	for _, user := range users {
+		client := c.client(user.Username)
+		client.Enable = user.Status == "active" || user.Status == "on_hold"
+		client.Desc = user.Note
+		client.Down = user.UsedTraffic
+		usedTraffic = usedTraffic || user.UsedTraffic > 0
+		if user.DataLimit != nil {
+			client.Volume = *user.DataLimit
+		}
+		if user.Expire != nil {
+			client.Expiry = *user.Expire
+		}
+		if user.Status == "on_hold" {
+			c.note("user %s: on hold expiry is not supported", user.Username)
+		}
+		for _, proxy := range userProxies[user.Id] {
+			protocol := strings.ToLower(proxy.Type)
+			var settings xrayClient
+			err = json.Unmarshal([]byte(proxy.Settings), &settings)
+			if err != nil {
+				c.note("user %s: invalid %s settings, skipped", user.Username, proxy.Type)
+				continue
+			}
+			switch protocol {
+			case "vmess", "vless":
+				c.setCredential(client, "uuid", settings.Id, "")
+				if protocol == "vless" {
+					c.setCredential(client, "flow", settings.Flow, "")
+				}
+			case "trojan":
+				c.setCredential(client, "password", settings.Password, "")
+			case "shadowsocks":
+				c.setCredential(client, "ssPassword", settings.Password, "")
+			default:
+				c.note("user %s: protocol %s is not supported", user.Username, proxy.Type)
+				continue
+			}
+			for _, entry := range protocolTags[protocol] {
+				originalTag, tag, _ := strings.Cut(entry, "\x00")
+				if !excluded[proxy.Id][originalTag] {
+					client.addInbound(tag)
+				}
+			}
+		}
+	}
+	if usedTraffic {
+		c.note("used traffic of Marzban users is not split by direction, it is imported as download")
+	}
+	return nil
+}
+
+func (c *importedClient) addInbound(tag string) {
+	for _, inbound := range c.Inbounds {
+		if inbound == tag {
+			return
+		}
+	}
+	c.Inbounds = append(c.Inbounds, tag)
+}
+
+func (c *panelConverter) client(name string) *importedClient {
+	client, ok := c.clients[name]
+	if !ok {
+		client = &importedClient{ExportClient: ExportClient{Name: name, Enable: true, Inbounds: []string{}}}
+		c.clients[name] = client
+		c.order = append(c.order, name)
+	}
+	return client
+}
+
+// setCredential keeps the first credential of a client, and reports a different one from another inbound
+func (c *panelConverter) setCredential(client *importedClient, field string, value string, inbound string) {
+	if value == "" {
+		return
+	}
+	var current *string
+	switch field {
+	case "uuid":
+		current = &client.uuid
+	case "password":
+		current = &client.password
+	case "ssPassword":
+		current = &client.ssPassword
+	case "ss16Password":
+		current = &client.ss16Password
+	case "flow":
+		current = &client.flow
+	}
+	if *current == "" {
+		*current = value
+	} else if *current != value && field != "flow" {
+		c.note("client %s has a different %s in inbound %s, kept the first one", client.Name, field, inbound)
+	}
+}
+
+// inboundClients converts users of an inbound to clients, and returns them
+func (c *panelConverter) inboundClients(tag string, protocol string, settings *xraySettings) []*importedClient {
+	var clients []*importedClient
+	switch protocol {
+	case "socks", "http":
+		for _, account := range settings.Accounts {
+			client := c.client(account.User)
+			c.setCredential(client, "password", account.Pass, tag)
+			client.addInbound(tag)
+			clients = append(clients, client)
+		}
+		return clients
+	case "shadowsocks":
+		if len(settings.Clients) == 0 && settings.Password != "" {
+			// A single user inbound becomes a client named by the inbound
+			settings.Clients = []xrayClient{{Email: tag, Password: settings.Password, Method: settings.Method}}
+			settings.Password = ""
+		}
+	}
+	for index, xc := range settings.Clients {
+		name := xc.Email
+		if name == "" {
+			name = fmt.Sprintf("%s-%d", tag, index+1)
+		}
+		client := c.client(name)
+		switch protocol {
+		case "vmess", "vless":
+			c.setCredential(client, "uuid", xc.Id, tag)
+			c.setCredential(client, "flow", xc.Flow, tag)
+		case "trojan":
+			c.setCredential(client, "password", xc.Password, tag)
+		case "shadowsocks":
+			if xc.Method != "" && settings.Method != "" && xc.Method != settings.Method {
+				c.note("client %s of inbound %s: method %s differs from the inbound, the inbound method is used", name, tag, xc.Method)
+			}
+			if settings.Method == "2022-blake3-aes-128-gcm" {
+				c.setCredential(client, "ss16Password", xc.Password, tag)
+			} else {
+				c.setCredential(client, "ssPassword", xc.Password, tag)
+			}
+		}
+		if xc.Enable != nil && !*xc.Enable {
+			client.Enable = false
+		}
+		if xc.TotalGB > 0 {
+			client.Volume = xc.TotalGB
+		}
+		if xc.ExpiryTime < 0 {
+			c.note("client %s: expiry counted from first use is not supported", name)
+		} else if xc.ExpiryTime > 0 {
+			client.Expiry = xuiExpiry(xc.ExpiryTime)
+		}
+		if xc.LimitIp > 0 {
+			c.note("client %s: ip limit is not supported", name)
+		}
+		if xc.Reset > 0 {
+			c.note("client %s: periodic traffic reset is not supported", name)
+		}
+		client.addInbound(tag)
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// addInbound converts an xray inbound, and returns its tag and settings. Unsupported inbounds are reported and skipped.
+func (c *panelConverter) addInbound(in xrayInbound) (string, *xraySettings, bool) {
+	tag := in.Tag
+	port := xrayPort(in.Port)
+	if tag == "" {
+		tag = fmt.Sprintf("inbound-%d", port)
+	}
+	if c.tags[tag] {
+		tag = fmt.Sprintf("%s-%d", tag, port)
+	}
+	if port == 0 {
+		c.note("inbound %s has no single port, skipped", tag)
+		return "", nil, false
+	}
+
+	settings := &xraySettings{}
+	if len(in.Settings) > 0 {
+		err := json.Unmarshal(in.Settings, settings)
+		if err != nil {
+			c.note("inbound %s: invalid settings, skipped", tag)
+			return "", nil, false
+		}
+	}
+	stream := &xrayStream{}
+	if len(in.StreamSettings) > 0 {
+		err := json.Unmarshal(in.StreamSettings, stream)
+		if err != nil {
+			c.note("inbound %s: invalid stream settings, skipped", tag)
+			return "", nil, false
+		}
+	}
+
+	listen := in.Listen
+	if listen == "" || listen == "0.0.0.0" {
+		listen = "::"
+	}
+	options := map[string]interface{}{
+		"listen":      listen,
+		"listen_port": port,
+	}
+	inboundType := in.Protocol
+	withTransport := false
+	withTls := false
+	switch in.Protocol {
+	case "vless":
+		if settings.Decryption != "" && settings.Decryption != "none" {
+			c.note("inbound %s: vless decryption %s is not supported", tag, settings.Decryption)
+		}
+		withTransport, withTls = true, true
+	case "vmess":
+		withTransport, withTls = true, true
+	case "trojan":
+		withTransport, withTls = true, true
+	case "shadowsocks":
+		if settings.Method == "" {
+			c.note("inbound %s: shadowsocks without a method, skipped", tag)
+			return "", nil, false
+		}
+		options["method"] = settings.Method
+		if strings.HasPrefix(settings.Method, "2022-") && settings.Password != "" {
+			options["password"] = settings.Password
+		}
+		if network := xrayNetwork(settings.Network); network != "" {
+			options["network"] = network
+		}
+	case "socks", "http":
+		if in.Protocol == "http" {
+			withTls = true
+		}
+		if settings.Auth == "noauth" || (in.Protocol == "socks" && settings.Auth == "" && len(settings.Accounts) == 0) {
+			c.note("inbound %s: %s without authentication is imported as open", tag, in.Protocol)
+		}
+	case "dokodemo-door":
+		inboundType = "direct"
+		if settings.Address != "" {
+			options["override_address"] = settings.Address
+		}
+		if settings.Port > 0 {
+			options["override_port"] = settings.Port
+		}
+		if network := xrayNetwork(settings.Network); network != "" {
+			options["network"] = network
+		}
+		if settings.FollowRedirect {
+			c.note("inbound %s: followRedirect is not supported, use a redirect or tproxy inbound", tag)
+		}
+	default:
+		c.note("inbound %s: protocol %s is not supported, skipped", tag, in.Protocol)
+		return "", nil, false
+	}
+	if len(settings.Fallbacks) > 0 {
+		c.note("inbound %s: fallbacks are not supported", tag)
+	}
+
+	if withTransport {
+		transport, ok := c.xrayTransport(tag, stream)
+		if !ok {
+			return "", nil, false
+		}
+		if transport != nil {
+			options["transport"] = transport
+		}
+	} else if stream.Network != "" && stream.Network != "tcp" {
+		c.note("inbound %s: transport %s is not supported by %s, skipped", tag, stream.Network, in.Protocol)
+		return "", nil, false
+	}
+
+	tlsName := ""
+	switch stream.Security {
+	case "", "none":
+	case "tls", "reality":
+		if !withTls {
+			c.note("inbound %s: %s with %s is not supported, imported without it", tag, in.Protocol, stream.Security)
+			break
+		}
+		tls, ok := c.xrayTls(tag, stream)
+		if !ok {
+			return "", nil, false
+		}
+		c.export.Tls = append(c.export.Tls, *tls)
+		tlsName = tls.Name
+	default:
+		c.note("inbound %s: security %s is not supported, skipped", tag, stream.Security)
+		return "", nil, false
+	}
+
+	if len(in.Sniffing) > 0 {
+		var sniffing struct {
+			Enabled bool `json:"enabled"`
+		}
+		json.Unmarshal(in.Sniffing, &sniffing)
+		if sniffing.Enabled {
+			c.note("inbound %s: sniffing is set by route rules in sing-box, not imported", tag)
+		}
+	}
+
+	rawOptions, _ := json.Marshal(options)
+	c.tags[tag] = true
+	c.export.Inbounds = append(c.export.Inbounds, ExportInbound{
+		Type:    inboundType,
+		Tag:     tag,
+		Tls:     tlsName,
+		Options: rawOptions,
+	})
+	return tag, settings, true
+}
+
+func (c *panelConverter) xrayTransport(tag string, stream *xrayStream) (map[string]interface{}, bool) {
+	switch stream.Network {
+	case "", "tcp", "raw":
+		if stream.TcpSettings != nil {
+			if stream.TcpSettings.Header.Type != "" && stream.TcpSettings.Header.Type != "none" {
+				c.note("inbound %s: tcp header %s is not supported", tag, stream.TcpSettings.Header.Type)
+			}
+			if stream.TcpSettings.AcceptProxyProtocol {
+				c.note("inbound %s: proxy protocol is not supported", tag)
+			}
+		}
+		return nil, true
+	case "ws":
+		transport := map[string]interface{}{"type": "ws"}
+		if ws := stream.WsSettings; ws != nil {
+			if ws.Path != "" {
+				transport["path"] = ws.Path
+			}
+			host := ws.Host
+			if host == "" {
+				host = ws.Headers["Host"]
+			}
+			if host != "" {
+				transport["headers"] = map[string]string{"Host": host}
+			}
+			if ws.AcceptProxyProtocol {
+				c.note("inbound %s: proxy protocol is not supported", tag)
+			}
+		}
+		return transport, true
+	case "grpc":
+		transport := map[string]interface{}{"type": "grpc"}
+		if stream.GrpcSettings != nil && stream.GrpcSettings.ServiceName != "" {
+			transport["service_name"] = stream.GrpcSettings.ServiceName
+		}
+		return transport, true
+	case "http", "h2":
+		transport := map[string]interface{}{"type": "http"}
+		if h := stream.HttpSettings; h != nil {
+			if h.Path != "" {
+				transport["path"] = h.Path
+			}
+			if len(h.Host) > 0 {
+				transport["host"] = h.Host
+			}
+		}
+		return transport, true
+	case "httpupgrade":
+		transport := map[string]interface{}{"type": "httpupgrade"}
+		if h := stream.HttpupgradeSettings; h != nil {
+			if h.Path != "" {
+				transport["path"] = h.Path
+			}
+			if h.Host != "" {
+				transport["host"] = h.Host
+			}
+			if h.AcceptProxyProtocol {
+				c.note("inbound %s: proxy protocol is not supported", tag)
+			}
+		}
+		return transport, true
+	}
+	c.note("inbound %s: transport %s is not supported, skipped", tag, stream.Network)
+	return nil, false
+}
+
+func (c *panelConverter) xrayTls(tag string, stream *xrayStream) (*ExportTls, bool) {
+	server := map[string]interface{}{"enabled": true}
+	client := map[string]interface{}{}
+	if stream.Security == "reality" {
+		reality := stream.RealitySettings
+		if reality == nil || reality.PrivateKey == "" {
+			c.note("inbound %s: reality without a private key, skipped", tag)
+			return nil, false
+		}
+		dest := reality.Target
+		if dest == "" {
+			dest = reality.Dest
+		}
+		host, portText, err := net.SplitHostPort(dest)
+		if err != nil {
+			host, portText = dest, "443"
+		}
+		handshakePort, _ := strconv.Atoi(portText)
+		if len(reality.ServerNames) > 0 {
+			server["server_name"] = reality.ServerNames[0]
+			if len(reality.ServerNames) > 1 {
+				c.note("inbound %s: only the first reality server name %s is used", tag, reality.ServerNames[0])
+			}
+		}
+		shortIds := reality.ShortIds
+		if shortIds == nil {
+			shortIds = []string{}
+		}
+		server["reality"] = map[string]interface{}{
+			"enabled":     true,
+			"handshake":   map[string]interface{}{"server": host, "server_port": handshakePort},
+			"private_key": reality.PrivateKey,
+			"short_id":    shortIds,
+		}
+		if reality.Xver > 0 {
+			c.note("inbound %s: reality proxy protocol (xver) is not supported", tag)
+		}
+		if reality.Settings.PublicKey == "" {
+			c.note("inbound %s: reality public key is missing, set it in the tls of the inbound for links", tag)
+		}
+		client["reality"] = map[string]interface{}{"public_key": reality.Settings.PublicKey}
+		if fingerprint := reality.Settings.Fingerprint; fingerprint != "" {
+			client["utls"] = map[string]interface{}{"enabled": true, "fingerprint": fingerprint}
+		}
+	} else {
+		tlsSettings := stream.TlsSettings
+		if tlsSettings == nil || len(tlsSettings.Certificates) == 0 {
+			c.note("inbound %s: tls without a certificate, skipped", tag)
+			return nil, false
+		}
+		if tlsSettings.ServerName != "" {
+			server["server_name"] = tlsSettings.ServerName
+		}
+		if len(tlsSettings.Alpn) > 0 {
+			server["alpn"] = tlsSettings.Alpn
+		}
+		if tlsSettings.MinVersion != "" {
+			server["min_version"] = tlsSettings.MinVersion
+		}
+		if tlsSettings.MaxVersion != "" {
+			server["max_version"] = tlsSettings.MaxVersion
+		}
+		certificate := tlsSettings.Certificates[0]
+		if certificate.CertificateFile != "" {
+			server["certificate_path"] = certificate.CertificateFile
+			server["key_path"] = certificate.KeyFile
+		} else {
+			server["certificate"] = certificate.Certificate
+			server["key"] = certificate.Key
+		}
+		if len(tlsSettings.Certificates) > 1 {
+			c.note("inbound %s: only the first tls certificate is used", tag)
+		}
+		if tlsSettings.Settings.AllowInsecure {
+			client["insecure"] = true
+		}
+		if fingerprint := tlsSettings.Settings.Fingerprint; fingerprint != "" {
+			client["utls"] = map[string]interface{}{"enabled": true, "fingerprint": fingerprint}
+		}
+	}
+	rawServer, _ := json.Marshal(server)
+	rawClient, _ := json.Marshal(client)
+	return &ExportTls{Name: tag, Server: rawServer, Client: rawClient}, true
+}
+
+// xrayPort returns the port of an inbound, or 0 for ranges and environment ports
+func xrayPort(raw json.RawMessage) int {
+	var port int
+	if json.Unmarshal(raw, &port) == nil {
+		return port
+	}
+	var text string
+	if json.Unmarshal(raw, &text) == nil {
+		port, _ = strconv.Atoi(text)
+	}
+	return port
+}
+
+func xrayNetwork(network string) string {
+	switch network {
+	case "tcp", "udp":
+		return network
+	}
+	return ""
+}
+
+// finish builds the export with a config of every protocol for each client, like the panel creates new clients
+func (c *panelConverter) finish() *PanelExport {
+	for _, name := range c.order {
+		client := c.clients[name]
+		client.Config = client.config(name)
+		c.export.Clients = append(c.export.Clients, client.ExportClient)
+	}
+	return c.export
+}
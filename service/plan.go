@@ -0,0 +1,351 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Reset policies of plans, the traffic of their clients is reset at the start of each period
+const (
+	PlanResetNone    = "none"
+	PlanResetDaily   = "daily"
+	PlanResetWeekly  = "weekly"
+	PlanResetMonthly = "monthly"
+)
+
+const maxPlanClients = 1000
+
+var planNamePattern = regexp.MustCompile(`\{n(?::(\d+))?\}`)
+
+type PlanService struct {
+	ClientService
+}
+
+// planRequest is a plan to save. With Propagate, an edit is also applied to clients of the plan.
+type planRequest struct {
+	model.Plan
+	Propagate bool `json:"propagate"`
+}
+
+// PlanClients creates Count clients of a plan. In Pattern, {n} is the number of a client
+// counted from Start, and {n:3} is the number padded with zeros to 3 digits.
+type PlanClients struct {
+	PlanId  uint   `json:"planId"`
+	Count   int    `json:"count"`
+	Pattern string `json:"pattern"`
+	Start   int    `json:"start"`
+}
+
+func (p *PlanClients) names() ([]string, error) {
+	if p.Count < 1 || p.Count > maxPlanClients {
+		return nil, common.NewErrorf("count of clients must be between 1 and %d", maxPlanClients)
+	}
+	pattern := strings.TrimSpace(p.Pattern)
+	if pattern == "" {
+		return nil, common.NewError("pattern of client names is empty")
+	}
+	if !planNamePattern.MatchString(pattern) {
+		if p.Count == 1 {
+			return []string{pattern}, nil
+		}
+		pattern += "{n}"
+	}
+	start := p.Start
+	if start == 0 {
+		start = 1
+	}
+	names := make([]string, 0, p.Count)
+	for i := 0; i < p.Count; i++ {
+		number := start + i
+		names = append(names, planNamePattern.ReplaceAllStringFunc(pattern, func(match string) string {
+			width, _ := strconv.Atoi(planNamePattern.FindStringSubmatch(match)[1])
+			return fmt.Sprintf("%0*d", width, number)
+		}))
+	}
+	return names, nil
+}
+
+func (s *PlanService) GetAll() ([]model.Plan, error) {
+	db := database.GetDB()
+	plans := []model.Plan{}
+	err := db.Model(model.Plan{}).Order("id").Find(&plans).Error
+	if err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// Save applies a plan change, and returns inbounds whose users are changed by propagation.
+// "del" data is the plan id, and clients of a deleted plan are kept without a plan.
+func (s *PlanService) Save(tx *gorm.DB, act string, data json.RawMessage, hostname string) ([]uint, error) {
+	var err error
+
+	switch act {
+	case "new", "edit":
+		var req planRequest
+		err = json.Unmarshal(data, &req)
+		if err != nil {
+			return nil, err
+		}
+		plan := &req.Plan
+		var inboundIds []uint
+		inboundIds, err = s.validate(tx, plan)
+		if err != nil {
+			return nil, err
+		}
+		if act == "new" {
+			err = tx.Create(plan).Error
+		} else {
+			err = tx.Save(plan).Error
+		}
+		if err != nil {
+			return nil, err
+		}
+		if act == "edit" && req.Propagate {
+			return s.propagate(tx, plan, inboundIds, hostname)
+		}
+		return nil, nil
+	case "del":
+		var id uint
+		err = json.Unmarshal(data, &id)
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Model(model.Client{}).Where("plan_id = ?", id).Update("plan_id", 0).Error
+		if err != nil {
+			return nil, err
+		}
+		err = tx.Where("id = ?", id).Delete(model.Plan{}).Error
+		if err != nil {
+			return nil, err
+		}
+		return nil, nil
+	default:
+		return nil, common.NewErrorf("unknown action: %s", act)
+	}
+}
+
+// validate checks fields of a plan and that its inbounds exist, and returns ids of its inbounds
+func (s *PlanService) validate(tx *gorm.DB, plan *model.Plan) ([]uint, error) {
+	plan.Name = strings.TrimSpace(plan.Name)
+	if plan.Name == "" {
+		return nil, common.NewError("name of plan is empty")
+	}
+	if plan.Volume < 0 || plan.Duration < 0 || plan.SpeedLimit < 0 {
+		return nil, common.NewError("volume, duration and speed limit of plan can not be negative")
+	}
+	err := validateQuotaPolicy(plan.GraceDays, plan.QuotaAction, plan.ThrottleKbps)
+	if err != nil {
+		return nil, err
+	}
+	switch plan.ResetPolicy {
+	case "":
+		plan.ResetPolicy = PlanResetNone
+	case PlanResetNone, PlanResetDaily, PlanResetWeekly, PlanResetMonthly:
+	default:
+		return nil, common.NewErrorf("unknown reset policy: %s", plan.ResetPolicy)
+	}
+	var inboundIds []uint
+	if len(plan.Inbounds) > 0 {
+		err = json.Unmarshal(plan.Inbounds, &inboundIds)
+		if err != nil {
+			return nil, common.NewErrorf("invalid inbounds of plan: %v", err)
+		}
+	}
+	inboundIds = uniqueIds(inboundIds)
+	if len(inboundIds) > 0 {
+		var count int64
+		err = tx.Model(model.Inbound{}).Where("id in ?", inboundIds).Count(&count).Error
+		if err != nil {
+			return nil, err
+		}
+		if int(count) != len(inboundIds) {
+			return nil, common.NewError("some inbounds of plan do not exist")
+		}
+	}
+	plan.Inbounds, _ = json.Marshal(inboundIds)
+	return inboundIds, nil
+}
+
+// propagate applies volume, group and inbounds of an edited plan to its clients.
+// Expiry of clients is kept, since it counts from when each client subscribed.
+func (s *PlanService) propagate(tx *gorm.DB, plan *model.Plan, inboundIds []uint, hostname string) ([]uint, error) {
+	var clients []*model.Client
+	err := tx.Model(model.Client{}).Where("plan_id = ?", plan.Id).Find(&clients).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(clients) == 0 {
+		return nil, nil
+	}
+	restartIds := inboundIds
+	for _, client := range clients {
+		var userInbounds []uint
+		if client.Inbounds != nil {
+			err = json.Unmarshal(client.Inbounds, &userInbounds)
+			if err != nil {
+				return nil, common.NewErrorf("failed to unmarshal inbounds of client %s: %v", client.Name, err)
+			}
+		}
+		restartIds = append(restartIds, userInbounds...)
+		client.Volume = plan.Volume
+		client.Group = plan.Group
+		client.Inbounds = plan.Inbounds
+	}
+	err = s.updateLinksWithFixedInbounds(tx, clients, inboundIds, hostname)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Save(clients).Error
+	if err != nil {
+		return nil, err
+	}
+	return uniqueIds(restartIds), nil
+}
+
+// addPlanClients creates clients from a plan, and returns inbounds of the plan
+func (s *ClientService) addPlanClients(tx *gorm.DB, data json.RawMessage, hostname string) ([]uint, error) {
+	var req PlanClients
+	err := json.Unmarshal(data, &req)
+	if err != nil {
+		return nil, common.NewErrorf("failed to unmarshal plan clients: %v", err)
+	}
+	names, err := req.names()
+	if err != nil {
+		return nil, err
+	}
+	var plan model.Plan
+	err = tx.Model(model.Plan{}).Where("id = ?", req.PlanId).First(&plan).Error
+	if err != nil {
+		return nil, common.NewErrorf("plan %d does not exist", req.PlanId)
+	}
+	var existing []string
+	err = tx.Model(model.Client{}).Where("name in ?", names).Pluck("name", &existing).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(existing) > 0 {
+		return nil, common.NewErrorf("clients already exist: %s", strings.Join(existing, ", "))
+	}
+
+	var inboundIds []uint
+	if len(plan.Inbounds) > 0 {
+		err = json.Unmarshal(plan.Inbounds, &inboundIds)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var expiry int64
+	if plan.Duration > 0 {
+		expiry = time.Now().Unix() + plan.Duration*86400
+	}
+	clients := make([]*model.Client, 0, len(names))
+	for _, name := range names {
+		var credentials clientCredentials
+		clients = append(clients, &model.Client{
+			Enable:   true,
+			Name:     name,
+			Config:   credentials.config(name),
+			Inbounds: plan.Inbounds,
+			Links:    json.RawMessage("[]"),
+			Volume:   plan.Volume,
+			Expiry:   expiry,
+			Group:    plan.Group,
+			PlanId:   plan.Id,
+			SubToken: newSubToken(),
+		})
+	}
+	err = s.updateLinksWithFixedInbounds(tx, clients, inboundIds, hostname)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Create(clients).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to save clients of plan: %v", err)
+	}
+	return inboundIds, nil
+}
+
+// ResetPlanTraffic resets traffic of clients whose plan period starts today.
+// Clients which were disabled for their volume and have not expired are enabled again.
+func (s *PlanService) ResetPlanTraffic() error {
+	now := time.Now()
+	policies := []string{PlanResetDaily}
+	if now.Weekday() == time.Monday {
+		policies = append(policies, PlanResetWeekly)
+	}
+	if now.Day() == 1 {
+		policies = append(policies, PlanResetMonthly)
+	}
+
+	var inboundIds []uint
+	reset := false
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var planIds []uint
+		err := tx.Model(model.Plan{}).Where("reset_policy in ?", policies).Pluck("id", &planIds).Error
+		if err != nil || len(planIds) == 0 {
+			return err
+		}
+		reset = true
+		var depleted []model.Client
+		err = tx.Model(model.Client{}).
+			Where("plan_id in ? AND enable = ? AND volume > 0 AND up + down > volume AND (expiry = 0 OR expiry > ?)", planIds, false, now.Unix()).
+			Find(&depleted).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Model(model.Client{}).Where("plan_id in ?", planIds).
+			Updates(map[string]interface{}{"up": 0, "down": 0}).Error
+		if err != nil {
+			return err
+		}
+		changes := []model.Changes{{
+			DateTime: now.Unix(),
+			Actor:    "ResetPlansJob",
+			Key:      "plans",
+			Action:   "resetTraffic",
+			Obj:      json.RawMessage(fmt.Sprintf("%q", strings.Join(policies, ","))),
+		}}
+		for _, client := range depleted {
+			var userInbounds []uint
+			if client.Inbounds != nil {
+				json.Unmarshal(client.Inbounds, &userInbounds)
+			}
+			inboundIds = s.uniqueAppendInboundIds(inboundIds, userInbounds)
+			err = tx.Model(model.Client{}).Where("id = ?", client.Id).Update("enable", true).Error
+			if err != nil {
+				return err
+			}
+			changes = append(changes, model.Changes{
+				DateTime: now.Unix(),
+				Actor:    "ResetPlansJob",
+				Key:      "clients",
+				Action:   "enable",
+				Obj:      json.RawMessage(fmt.Sprintf("%q", client.Name)),
+			})
+		}
+		return tx.Create(&changes).Error
+	})
+	if err != nil || !reset {
+		return err
+	}
+	LastUpdate = now.Unix()
+	if len(inboundIds) > 0 && corePtr.IsRunning() {
+		err = s.InboundService.RestartInbounds(db, inboundIds)
+		if err != nil {
+			logger.Error("unable to restart inbounds: ", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package service
+
+import (
+	"encoding/json"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/util"
+	"s-ui/util/common"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gorm.io/gorm"
+)
+
+// PortalNotice is an announcement of admins in the client portal, shown until Until if it is set
+type PortalNotice struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+	Until   int64  `json:"until,omitempty"`
+}
+
+func parsePortalNotices(value string) ([]PortalNotice, error) {
+	var notices []PortalNotice
+	err := json.Unmarshal([]byte(value), &notices)
+	if err != nil {
+		return nil, common.NewErrorf("invalid portal notices: %v", err)
+	}
+	for _, notice := range notices {
+		if strings.TrimSpace(notice.Title) == "" && strings.TrimSpace(notice.Message) == "" {
+			return nil, common.NewError("portal notice is empty")
+		}
+	}
+	return notices, nil
+}
+
+// GetPortalNotices returns announcements of the portal which have not ended
+func (s *SettingService) GetPortalNotices() ([]PortalNotice, error) {
+	value, err := s.getString(database.GetDB(), "portalNotices")
+	if err != nil {
+		return nil, err
+	}
+	notices, err := parsePortalNotices(value)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	result := []PortalNotice{}
+	for _, notice := range notices {
+		if notice.Until == 0 || notice.Until > now {
+			result = append(result, notice)
+		}
+	}
+	return result, nil
+}
+
+// RotateClient gives an enabled client new secrets in all protocols, new keys of its wireguard peers and a new
+// subscription token, so that its old links stop working. The flow of vless and users of other protocols in its config are kept.
+func (s *ConfigService) RotateClient(name string, hostname string) error {
+	db := database.GetDB()
+	var client model.Client
+	err := db.Model(model.Client{}).Where("enable = ? AND name = ?", true, name).First(&client).Error
+	if err != nil {
+		return err
+	}
+	config := map[string]json.RawMessage{}
+	if len(client.Config) > 0 {
+		err = json.Unmarshal(client.Config, &config)
+		if err != nil {
+			return common.NewErrorf("failed to unmarshal config of client %s: %v", name, err)
+		}
+	}
+	var credentials clientCredentials
+	if vless, ok := config["vless"]; ok {
+		var user struct {
+			Flow string `json:"flow"`
+		}
+		json.Unmarshal(vless, &user)
+		credentials.flow = user.Flow
+	}
+	rotated := map[string]json.RawMessage{}
+	err = json.Unmarshal(credentials.config(name), &rotated)
+	if err != nil {
+		return err
+	}
+	for protocol, user := range rotated {
+		config[protocol] = user
+	}
+	client.Config, err = json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	client.SubToken = newSubToken()
+	data, err := json.Marshal(client)
+	if err != nil {
+		return err
+	}
+	ops := []saveOp{{obj: "clients", act: "edit", data: data}}
+	endpointOps, err := rotateWireguardPeers(db, name)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.saveAll(append(ops, endpointOps...), "portal", hostname, false)
+	return err
+}
+
+// rotateWireguardPeers returns saves of the wireguard endpoints with peers of a client, which give them new keys.
+// Pre-shared keys of the peers are replaced too.
+func rotateWireguardPeers(db *gorm.DB, name string) ([]saveOp, error) {
+	var endpoints []model.Endpoint
+	err := db.Model(model.Endpoint{}).Where("type = ?", "wireguard").Find(&endpoints).Error
+	if err != nil {
+		return nil, err
+	}
+	var ops []saveOp
+	for _, endpoint := range endpoints {
+		var ext map[string]interface{}
+		json.Unmarshal(endpoint.Ext, &ext)
+		extPeersJson, _ := json.Marshal(ext["peers"])
+		var extPeers []util.WireguardPeerExt
+		json.Unmarshal(extPeersJson, &extPeers)
+		var options map[string]interface{}
+		err = json.Unmarshal(endpoint.Options, &options)
+		if err != nil {
+			return nil, common.NewErrorf("invalid options of endpoint %s: %v", endpoint.Tag, err)
+		}
+		peers, _ := options["peers"].([]interface{})
+
+		changed := false
+		for i := range extPeers {
+			if extPeers[i].Client != name {
+				continue
+			}
+			key, err := wgtypes.GeneratePrivateKey()
+			if err != nil {
+				return nil, err
+			}
+			for _, peerRaw := range peers {
+				peer, ok := peerRaw.(map[string]interface{})
+				if !ok || peer["public_key"] != extPeers[i].PublicKey {
+					continue
+				}
+				peer["public_key"] = key.PublicKey().String()
+				if psk, _ := peer["pre_shared_key"].(string); psk != "" {
+					newPsk, err := wgtypes.GenerateKey()
+					if err != nil {
+						return nil, err
+					}
+					peer["pre_shared_key"] = newPsk.String()
+				}
+			}
+			extPeers[i].PrivateKey = key.String()
+			extPeers[i].PublicKey = key.PublicKey().String()
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		ext["peers"] = extPeers
+		endpoint.Ext, err = json.Marshal(ext)
+		if err != nil {
+			return nil, err
+		}
+		endpoint.Options, err = json.Marshal(options)
+		if err != nil {
+			return nil, err
+		}
+		record, err := withId(endpoint, endpoint.Id)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, saveOp{obj: "endpoints", act: "edit", data: data})
+	}
+	return ops, nil
+}
@@ -0,0 +1,137 @@
+package service
+
+import (
+	"encoding/json"
+	"s-ui/database/model"
+	"s-ui/util"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRotateClient(t *testing.T) {
+	db := openTestDb(t)
+	s := &ConfigService{}
+	saveClient(t, s, "new", `{"enable":true,"name":"alice","config":{"vless":{"name":"alice","uuid":"b3a4f6c1-6a1e-4f0e-9c3a-2b1d5e7f8a90","flow":"xtls-rprx-vision"}},"inbounds":[],"links":[]}`)
+	saveClient(t, s, "new", `{"enable":false,"name":"carol","config":{},"inbounds":[],"links":[]}`)
+	// A client from before tokens
+	db.Model(model.Client{}).Where("name = ?", "alice").Update("sub_by_name", true)
+	before := loadClient(t, db, "alice")
+
+	err := s.RotateClient("alice", "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := loadClient(t, db, "alice")
+	if after.SubToken == "" || after.SubToken == before.SubToken {
+		t.Errorf("token %q is not replaced", after.SubToken)
+	}
+	if after.SubByName {
+		t.Error("subscription by name still works after rotating")
+	}
+	var config map[string]struct {
+		Uuid string `json:"uuid"`
+		Flow string `json:"flow"`
+	}
+	json.Unmarshal(after.Config, &config)
+	if config["vless"].Uuid == "" || config["vless"].Uuid == "b3a4f6c1-6a1e-4f0e-9c3a-2b1d5e7f8a90" {
+		t.Errorf("uuid of vless %q is not replaced", config["vless"].Uuid)
+	}
+	if config["vless"].Flow != "xtls-rprx-vision" {
+		t.Errorf("flow of vless = %q, want it kept", config["vless"].Flow)
+	}
+
+	if err = s.RotateClient("carol", "example.com"); err == nil {
+		t.Error("a disabled client rotates")
+	}
+}
+
+func TestRotateWireguardPeers(t *testing.T) {
+	db := openTestDb(t)
+	keys := map[string]wgtypes.Key{}
+	var extPeers []util.WireguardPeerExt
+	var peers []map[string]interface{}
+	psk, _ := wgtypes.GenerateKey()
+	for _, name := range []string{"alice", "bob"} {
+		keys[name], _ = wgtypes.GeneratePrivateKey()
+		extPeers = append(extPeers, util.WireguardPeerExt{
+			Client:     name,
+			PrivateKey: keys[name].String(),
+			PublicKey:  keys[name].PublicKey().String(),
+		})
+		peers = append(peers, map[string]interface{}{
+			"public_key":     keys[name].PublicKey().String(),
+			"pre_shared_key": psk.String(),
+			"allowed_ips":    []string{"10.0.0.2/32"},
+		})
+	}
+	options, _ := json.Marshal(map[string]interface{}{"listen_port": 51820, "peers": peers})
+	ext, _ := json.Marshal(map[string]interface{}{"peers": extPeers})
+	err := db.Create(&model.Endpoint{Type: "wireguard", Tag: "wg", Options: options, Ext: ext}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Create(&model.Endpoint{Type: "wireguard", Tag: "other", Options: json.RawMessage(`{"peers":[]}`), Ext: json.RawMessage(`{}`)}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ops, err := rotateWireguardPeers(db, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].obj != "endpoints" || ops[0].act != "edit" {
+		t.Fatalf("ops = %+v, want an edit of the endpoint with the peer", ops)
+	}
+	var endpoint model.Endpoint
+	err = json.Unmarshal(ops[0].data, &endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint.Id == 0 || endpoint.Tag != "wg" {
+		t.Errorf("edit of endpoint %d %s, want wg", endpoint.Id, endpoint.Tag)
+	}
+	var rotatedExt struct {
+		Peers []util.WireguardPeerExt `json:"peers"`
+	}
+	json.Unmarshal(endpoint.Ext, &rotatedExt)
+	var rotatedOptions struct {
+		Peers []struct {
+			PublicKey    string `json:"public_key"`
+			PreSharedKey string `json:"pre_shared_key"`
+		} `json:"peers"`
+	}
+	json.Unmarshal(endpoint.Options, &rotatedOptions)
+
+	publicKeys := map[string]string{}
+	for _, peer := range rotatedExt.Peers {
+		key, err := wgtypes.ParseKey(peer.PrivateKey)
+		if err != nil || key.PublicKey().String() != peer.PublicKey {
+			t.Errorf("public key of %s does not match its private key", peer.Client)
+		}
+		publicKeys[peer.Client] = peer.PublicKey
+	}
+	if publicKeys["alice"] == keys["alice"].PublicKey().String() {
+		t.Error("key of the peer is not replaced")
+	}
+	if publicKeys["bob"] != keys["bob"].PublicKey().String() {
+		t.Error("key of another client is replaced")
+	}
+	if len(rotatedOptions.Peers) != 2 {
+		t.Fatalf("endpoint has %d peers, want 2", len(rotatedOptions.Peers))
+	}
+	for _, peer := range rotatedOptions.Peers {
+		switch peer.PublicKey {
+		case publicKeys["alice"]:
+			if peer.PreSharedKey == "" || peer.PreSharedKey == psk.String() {
+				t.Errorf("pre-shared key %q is not replaced", peer.PreSharedKey)
+			}
+		case publicKeys["bob"]:
+			if peer.PreSharedKey != psk.String() {
+				t.Error("pre-shared key of another client is replaced")
+			}
+		default:
+			t.Errorf("endpoint accepts the unknown key %s", peer.PublicKey)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Actions on clients whose volume runs out. Throttled and redirected clients stay enabled.
+const (
+	QuotaDisable  = "disable"
+	QuotaThrottle = "throttle"
+	QuotaRedirect = "redirect"
+)
+
+// quotaPolicy is what happens to a client when it expires or runs out of volume
+type quotaPolicy struct {
+	GraceDays    int64
+	Action       string
+	ThrottleKbps int64
+}
+
+func validateQuotaPolicy(graceDays int64, action string, throttleKbps int64) error {
+	if graceDays < 0 || throttleKbps < 0 {
+		return common.NewError("grace days and throttle speed can not be negative")
+	}
+	switch action {
+	case "", QuotaDisable, QuotaRedirect:
+	case QuotaThrottle:
+		if throttleKbps == 0 {
+			return common.NewError("throttle needs a speed in kbps")
+		}
+	default:
+		return common.NewErrorf("unknown quota action: %s", action)
+	}
+	return nil
+}
+
+func parseQuotaRedirect(value string) (string, uint16, error) {
+	if value == "" {
+		return "", 0, nil
+	}
+	host, portStr, err := net.SplitHostPort(value)
+	if err != nil || host == "" {
+		return "", 0, common.NewErrorf("quotaRedirect must be host:port: %s", value)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return "", 0, common.NewErrorf("invalid port of quotaRedirect: %s", portStr)
+	}
+	return host, uint16(port), nil
+}
+
+// quotaPolicies resolves the policy of each client, where fields set on the client override its plan
+func (s *ClientService) quotaPolicies(tx *gorm.DB, clients []model.Client) (map[uint]quotaPolicy, error) {
+	planIds := []uint{}
+	for _, client := range clients {
+		if client.PlanId > 0 {
+			planIds = append(planIds, client.PlanId)
+		}
+	}
+	plans := map[uint]model.Plan{}
+	if len(planIds) > 0 {
+		var planList []model.Plan
+		err := tx.Model(model.Plan{}).Where("id in ?", uniqueIds(planIds)).Find(&planList).Error
+		if err != nil {
+			return nil, err
+		}
+		for _, plan := range planList {
+			plans[plan.Id] = plan
+		}
+	}
+	policies := make(map[uint]quotaPolicy, len(clients))
+	for _, client := range clients {
+		plan := plans[client.PlanId]
+		policy := quotaPolicy{
+			GraceDays:    client.GraceDays,
+			Action:       client.QuotaAction,
+			ThrottleKbps: client.ThrottleKbps,
+		}
+		if policy.GraceDays == 0 {
+			policy.GraceDays = plan.GraceDays
+		}
+		if policy.Action == "" {
+			policy.Action = plan.QuotaAction
+		}
+		if policy.ThrottleKbps == 0 {
+			policy.ThrottleKbps = plan.ThrottleKbps
+		}
+		policies[client.Id] = policy
+	}
+	return policies, nil
+}
+
+// depleteClients disables expired clients after their grace period, and applies the quota action
+// to clients out of volume. Clients which got volume again are no longer limited.
+// It returns whether throttled or redirected clients have changed.
+func (s *ClientService) depleteClients(tx *gorm.DB, now int64) ([]uint, bool, error) {
+	var clients []model.Client
+	err := tx.Model(model.Client{}).
+		Where("enable = ? AND ((volume > 0 AND up + down > volume) OR (expiry > 0 AND expiry < ?) OR limited <> ?)", true, now, "").
+		Find(&clients).Error
+	if err != nil {
+		return nil, false, common.NewErrorf("failed to find clients for depletion: %v", err)
+	}
+	if len(clients) == 0 {
+		return nil, false, nil
+	}
+	policies, err := s.quotaPolicies(tx, clients)
+	if err != nil {
+		return nil, false, err
+	}
+	settingService := SettingService{}
+	redirectTo, err := settingService.getString(tx, "quotaRedirect")
+	if err != nil {
+		return nil, false, err
+	}
+
+	var inboundIds []uint
+	var changes []model.Changes
+	limitsChanged := false
+	for _, client := range clients {
+		policy := policies[client.Id]
+		expired := client.Expiry > 0 && now >= client.Expiry+policy.GraceDays*86400
+		overQuota := client.Volume > 0 && client.Up+client.Down > client.Volume
+
+		action := ""
+		switch {
+		case expired:
+			action = QuotaDisable
+		case overQuota:
+			action = policy.Action
+			if action == QuotaRedirect && redirectTo == "" {
+				logger.Warning("quotaRedirect is not set, client ", client.Name, " is disabled instead")
+				action = QuotaDisable
+			}
+			if action == "" || (action == QuotaThrottle && policy.ThrottleKbps == 0) {
+				action = QuotaDisable
+			}
+		}
+
+		updates := map[string]interface{}{}
+		switch action {
+		case QuotaDisable:
+			updates["enable"] = false
+			updates["limited"] = ""
+		case client.Limited:
+			// The action is already applied
+			continue
+		default:
+			updates["limited"] = action
+		}
+		if client.Limited != "" || action != QuotaDisable {
+			limitsChanged = true
+		}
+		if action == "" {
+			action = "unlimit"
+		}
+
+		logger.Debug("Client ", client.Name, " is going to be ", action)
+		err = tx.Model(model.Client{}).Where("id = ?", client.Id).Updates(updates).Error
+		if err != nil {
+			return nil, false, common.NewErrorf("failed to update client %s during depletion: %v", client.Name, err)
+		}
+		// Users are restarted, so that existing connections follow the new action
+		var userInbounds []uint
+		if client.Inbounds != nil {
+			errInbounds := json.Unmarshal(client.Inbounds, &userInbounds)
+			if errInbounds != nil {
+				logger.Errorf("failed to unmarshal inbounds of client %s during depletion: %v", client.Name, errInbounds)
+			}
+		}
+		inboundIds = s.uniqueAppendInboundIds(inboundIds, userInbounds)
+		changes = append(changes, model.Changes{
+			DateTime: now,
+			Actor:    "DepleteJob",
+			Key:      "clients",
+			Action:   action,
+			Obj:      json.RawMessage(fmt.Sprintf("%q", client.Name)),
+		})
+	}
+	if len(changes) > 0 {
+		err = tx.Model(model.Changes{}).Create(&changes).Error
+		if err != nil {
+			return nil, false, common.NewErrorf("failed to create change log during client depletion: %v", err)
+		}
+	}
+	return inboundIds, limitsChanged, nil
+}
+
+// DepleteClients applies depletion of clients, then limits of throttled and redirected clients to the core
+func (s *ConfigService) DepleteClients() error {
+	var inboundIds []uint
+	limitsChanged := false
+	now := time.Now().Unix()
+	db := database.GetDB()
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		inboundIds, limitsChanged, err = s.ClientService.depleteClients(tx, now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(inboundIds) == 0 && !limitsChanged {
+		return nil
+	}
+	LastUpdate = now
+	if !corePtr.IsRunning() {
+		return nil
+	}
+	if limitsChanged {
+		err = s.applyUserLimits(db)
+		if err != nil {
+			return err
+		}
+		singboxConfig, err := s.getConfig(db, "")
+		if err != nil {
+			return err
+		}
+		err = s.reloadRouter(singboxConfig)
+		if err != nil {
+			return err
+		}
+	}
+	if len(inboundIds) > 0 {
+		err = s.InboundService.RestartInbounds(db, inboundIds)
+		if err != nil {
+			logger.Error("unable to restart inbounds: ", err)
+		}
+	}
+	return nil
+}
+
+// applyUserLimits passes speed limits of plans and speeds of throttled clients to the core
+func (s *ClientService) applyUserLimits(db *gorm.DB) error {
+	var planLimits []struct {
+		Name       string
+		SpeedLimit int64
+	}
+	err := db.Model(model.Client{}).
+		Select("clients.name, plans.speed_limit").
+		Joins("JOIN plans ON plans.id = clients.plan_id").
+		Where("clients.enable = ? AND plans.speed_limit > 0", true).
+		Scan(&planLimits).Error
+	if err != nil {
+		return err
+	}
+	var clients []model.Client
+	err = db.Model(model.Client{}).Where("enable = ? AND limited = ?", true, QuotaThrottle).Find(&clients).Error
+	if err != nil {
+		return err
+	}
+	policies, err := s.quotaPolicies(db, clients)
+	if err != nil {
+		return err
+	}
+	limits := make(map[string]int64, len(planLimits)+len(clients))
+	for _, client := range planLimits {
+		// Mbps to bytes per second
+		limits[client.Name] = client.SpeedLimit * 1000 * 1000 / 8
+	}
+	for _, client := range clients {
+		// kbps to bytes per second, unless the plan is slower
+		throttle := policies[client.Id].ThrottleKbps * 1000 / 8
+		if limit, ok := limits[client.Name]; !ok || (throttle > 0 && throttle < limit) {
+			limits[client.Name] = throttle
+		}
+	}
+	corePtr.SetUserLimits(limits)
+	return nil
+}
+
+// redirectRules sends TCP of redirected clients to the notice page, and rejects their UDP
+func (s *ClientService) redirectRules(db *gorm.DB) ([]json.RawMessage, error) {
+	var names []string
+	err := db.Model(model.Client{}).Where("enable = ? AND limited = ?", true, QuotaRedirect).Order("id").Pluck("name", &names).Error
+	if err != nil || len(names) == 0 {
+		return nil, err
+	}
+	settingService := SettingService{}
+	value, err := settingService.getString(db, "quotaRedirect")
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := parseQuotaRedirect(value)
+	if err != nil || host == "" {
+		return nil, err
+	}
+	redirect, err := json.Marshal(map[string]interface{}{
+		"auth_user":        names,
+		"network":          []string{"tcp"},
+		"action":           "route-options",
+		"override_address": host,
+		"override_port":    port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	reject, err := json.Marshal(map[string]interface{}{
+		"auth_user": names,
+		"network":   []string{"udp"},
+		"action":    "reject",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []json.RawMessage{redirect, reject}, nil
+}
+
+// QuotaStatus is the quota action in effect on a client, as shown in its subscription
+type QuotaStatus struct {
+	Limited      string
+	ThrottleKbps int64
+	// GraceUntil is when an expired client is disabled, or 0 without grace
+	GraceUntil int64
+}
+
+func (s *ClientService) GetQuotaStatus(client *model.Client) (*QuotaStatus, error) {
+	policies, err := s.quotaPolicies(database.GetDB(), []model.Client{*client})
+	if err != nil {
+		return nil, err
+	}
+	policy := policies[client.Id]
+	status := &QuotaStatus{Limited: client.Limited}
+	if client.Limited == QuotaThrottle {
+		status.ThrottleKbps = policy.ThrottleKbps
+	}
+	if client.Expiry > 0 && policy.GraceDays > 0 {
+		status.GraceUntil = client.Expiry + policy.GraceDays*86400
+	}
+	return status, nil
+}
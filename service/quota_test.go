@@ -0,0 +1,200 @@
+package service
+
+import (
+	"encoding/json"
+	"s-ui/database/model"
+	"slices"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+const testNow = int64(1_700_000_000)
+
+func createClients(t *testing.T, db *gorm.DB, clients []model.Client) map[string]model.Client {
+	t.Helper()
+	result := make(map[string]model.Client, len(clients))
+	for _, client := range clients {
+		client.Enable = true
+		client.SubToken = client.Name
+		if client.Inbounds == nil {
+			client.Inbounds = json.RawMessage(`[]`)
+		}
+		err := db.Create(&client).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[client.Name] = client
+	}
+	return result
+}
+
+func loadClient(t *testing.T, db *gorm.DB, name string) model.Client {
+	t.Helper()
+	var client model.Client
+	err := db.Model(model.Client{}).Where("name = ?", name).First(&client).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestQuotaPolicies(t *testing.T) {
+	db := openTestDb(t)
+	plan := model.Plan{Name: "basic", GraceDays: 3, QuotaAction: QuotaThrottle, ThrottleKbps: 256}
+	err := db.Create(&plan).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := createClients(t, db, []model.Client{
+		{Name: "plan", PlanId: plan.Id},
+		{Name: "override", PlanId: plan.Id, GraceDays: 1, QuotaAction: QuotaRedirect},
+		{Name: "speed", PlanId: plan.Id, ThrottleKbps: 64},
+		{Name: "own", GraceDays: 2, QuotaAction: QuotaThrottle, ThrottleKbps: 128},
+		{Name: "none"},
+	})
+
+	var list []model.Client
+	for _, client := range clients {
+		list = append(list, client)
+	}
+	clientService := ClientService{}
+	policies, err := clientService.quotaPolicies(db, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]quotaPolicy{
+		"plan":     {GraceDays: 3, Action: QuotaThrottle, ThrottleKbps: 256},
+		"override": {GraceDays: 1, Action: QuotaRedirect, ThrottleKbps: 256},
+		"speed":    {GraceDays: 3, Action: QuotaThrottle, ThrottleKbps: 64},
+		"own":      {GraceDays: 2, Action: QuotaThrottle, ThrottleKbps: 128},
+		"none":     {},
+	}
+	for name, policy := range want {
+		if got := policies[clients[name].Id]; got != policy {
+			t.Errorf("policy of %s = %+v, want %+v", name, got, policy)
+		}
+	}
+}
+
+func TestDepleteClients(t *testing.T) {
+	db := openTestDb(t)
+	settingService := SettingService{}
+	err := settingService.saveSetting(db, "quotaRedirect", "notice.example:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan := model.Plan{Name: "grace", GraceDays: 3, QuotaAction: QuotaThrottle, ThrottleKbps: 256}
+	err = db.Create(&plan).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	const day = int64(86400)
+	createClients(t, db, []model.Client{
+		{Name: "active", Volume: 1000, Up: 10, Expiry: testNow + day},
+		{Name: "in-grace", PlanId: plan.Id, Expiry: testNow - day},
+		{Name: "after-grace", PlanId: plan.Id, Expiry: testNow - 3*day, Inbounds: json.RawMessage(`[1,2]`)},
+		{Name: "client-grace", PlanId: plan.Id, GraceDays: 5, Expiry: testNow - 4*day},
+		{Name: "no-grace", Expiry: testNow - 1},
+		{Name: "throttle", PlanId: plan.Id, Volume: 100, Up: 60, Down: 60, Inbounds: json.RawMessage(`[2,3]`)},
+		{Name: "redirect", PlanId: plan.Id, QuotaAction: QuotaRedirect, Volume: 100, Down: 200},
+		{Name: "no-action", Volume: 100, Up: 200},
+		{Name: "no-speed", QuotaAction: QuotaThrottle, Volume: 100, Up: 200},
+		{Name: "refilled", PlanId: plan.Id, Limited: QuotaThrottle, Volume: 1000, Up: 200},
+		// Expiry beats the quota action, also in grace of volume
+		{Name: "expired-throttled", PlanId: plan.Id, Limited: QuotaThrottle, Volume: 100, Up: 200, Expiry: testNow - 3*day},
+	})
+
+	clientService := ClientService{}
+	inboundIds, limitsChanged, err := clientService.depleteClients(db, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]struct {
+		enable  bool
+		limited string
+	}{
+		"active":            {true, ""},
+		"in-grace":          {true, ""},
+		"after-grace":       {false, ""},
+		"client-grace":      {true, ""},
+		"no-grace":          {false, ""},
+		"throttle":          {true, QuotaThrottle},
+		"redirect":          {true, QuotaRedirect},
+		"no-action":         {false, ""},
+		"no-speed":          {false, ""},
+		"refilled":          {true, ""},
+		"expired-throttled": {false, ""},
+	}
+	for name, state := range want {
+		client := loadClient(t, db, name)
+		if client.Enable != state.enable || client.Limited != state.limited {
+			t.Errorf("%s: enable = %v, limited = %q, want %v, %q", name, client.Enable, client.Limited, state.enable, state.limited)
+		}
+	}
+	slices.Sort(inboundIds)
+	if !slices.Equal(inboundIds, []uint{1, 2, 3}) {
+		t.Errorf("inbounds to restart = %v, want [1 2 3]", inboundIds)
+	}
+	if !limitsChanged {
+		t.Error("limits of throttled and redirected clients are not reported as changed")
+	}
+
+	var changes []model.Changes
+	err = db.Model(model.Changes{}).Where("actor = ?", "DepleteJob").Find(&changes).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := map[string]string{}
+	for _, change := range changes {
+		var name string
+		json.Unmarshal(change.Obj, &name)
+		actions[name] = change.Action
+	}
+	wantActions := map[string]string{
+		"after-grace":       QuotaDisable,
+		"no-grace":          QuotaDisable,
+		"throttle":          QuotaThrottle,
+		"redirect":          QuotaRedirect,
+		"no-action":         QuotaDisable,
+		"no-speed":          QuotaDisable,
+		"refilled":          "unlimit",
+		"expired-throttled": QuotaDisable,
+	}
+	if len(actions) != len(wantActions) {
+		t.Errorf("changes = %v, want %v", actions, wantActions)
+	}
+	for name, action := range wantActions {
+		if actions[name] != action {
+			t.Errorf("change of %s = %q, want %q", name, actions[name], action)
+		}
+	}
+
+	// Applied actions are not applied again
+	inboundIds, limitsChanged, err = clientService.depleteClients(db, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inboundIds) > 0 || limitsChanged {
+		t.Errorf("second run restarts inbounds %v, limits changed = %v", inboundIds, limitsChanged)
+	}
+}
+
+func TestDepleteRedirectWithoutTarget(t *testing.T) {
+	db := openTestDb(t)
+	createClients(t, db, []model.Client{
+		{Name: "redirect", QuotaAction: QuotaRedirect, Volume: 100, Up: 200},
+	})
+	clientService := ClientService{}
+	_, limitsChanged, err := clientService.depleteClients(db, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := loadClient(t, db, "redirect")
+	if client.Enable || client.Limited != "" {
+		t.Errorf("enable = %v, limited = %q, want a disabled client without quotaRedirect", client.Enable, client.Limited)
+	}
+	if limitsChanged {
+		t.Error("disabling a client is reported as a change of limits")
+	}
+}
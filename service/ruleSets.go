@@ -0,0 +1,329 @@
+package service
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"s-ui/config"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const defaultRuleSetUpdateInterval = 24 * time.Hour
+
+type RuleSetService struct{}
+
+type remoteRuleSet struct {
+	Format         string `json:"format"`
+	URL            string `json:"url"`
+	UpdateInterval string `json:"update_interval"`
+}
+
+func (s *RuleSetService) GetAll() ([]map[string]interface{}, error) {
+	db := database.GetDB()
+	ruleSets := []model.RuleSet{}
+	err := db.Model(model.RuleSet{}).Find(&ruleSets).Error
+	if err != nil {
+		return nil, err
+	}
+	data := make([]map[string]interface{}, 0, len(ruleSets))
+	for _, ruleSet := range ruleSets {
+		ruleSetData, err := withId(ruleSet, ruleSet.Id)
+		if err != nil {
+			return nil, err
+		}
+		if ruleSet.Type == "remote" {
+			if info, err := os.Stat(ruleSetCachePath(ruleSet)); err == nil {
+				ruleSetData["cached"] = info.ModTime().Unix()
+			}
+		}
+		data = append(data, ruleSetData)
+	}
+	return data, nil
+}
+
+// GetAllConfig returns rule-sets for the final config. Remote rule-sets with a local copy are
+// loaded from the cache, so the core does not depend on the source being reachable on start.
+func (s *RuleSetService) GetAllConfig(db *gorm.DB) ([]json.RawMessage, error) {
+	var ruleSets []model.RuleSet
+	err := db.Model(model.RuleSet{}).Find(&ruleSets).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to get rule sets: %v", err)
+	}
+	ruleSetsJson := make([]json.RawMessage, 0, len(ruleSets))
+	for _, ruleSet := range ruleSets {
+		var ruleSetJson json.RawMessage
+		if ruleSet.Type == "remote" {
+			cachePath := ruleSetCachePath(ruleSet)
+			if _, err := os.Stat(cachePath); err == nil && !removedAfterCommit(db, cachePath) {
+				ruleSetJson, err = json.Marshal(map[string]interface{}{
+					"type":   "local",
+					"tag":    ruleSet.Tag,
+					"format": ruleSetFormat(ruleSet),
+					"path":   cachePath,
+				})
+				if err != nil {
+					return nil, err
+				}
+				ruleSetsJson = append(ruleSetsJson, ruleSetJson)
+				continue
+			}
+		}
+		ruleSetJson, err = ruleSet.MarshalJSON()
+		if err != nil {
+			logger.Warning("Failed to marshal rule set ", ruleSet.Tag, ": ", err)
+			continue
+		}
+		ruleSetsJson = append(ruleSetsJson, ruleSetJson)
+	}
+	return ruleSetsJson, nil
+}
+
+func (s *RuleSetService) Save(tx *gorm.DB, act string, data json.RawMessage) error {
+	var err error
+
+	switch act {
+	case "new", "edit":
+		var ruleSet model.RuleSet
+		err = ruleSet.UnmarshalJSON(data)
+		if err != nil {
+			return err
+		}
+		if ruleSet.Tag == "" {
+			return common.NewError("rule set tag cannot be empty")
+		}
+		switch ruleSet.Type {
+		case "inline", "local", "remote":
+		default:
+			return common.NewErrorf("unknown rule set type: %s", ruleSet.Type)
+		}
+		if ruleSet.Type == "remote" {
+			var remote remoteRuleSet
+			json.Unmarshal(ruleSet.Options, &remote)
+			if remote.URL == "" {
+				return common.NewErrorf("url of remote rule set '%s' cannot be empty", ruleSet.Tag)
+			}
+		}
+		var count int64
+		query := tx.Model(model.RuleSet{}).Where("tag = ?", ruleSet.Tag)
+		if act == "edit" {
+			query = query.Where("id != ?", ruleSet.Id)
+		}
+		err = query.Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return common.NewErrorf("rule set tag '%s' already exists", ruleSet.Tag)
+		}
+		if act == "edit" {
+			var oldRuleSet model.RuleSet
+			err = tx.Model(model.RuleSet{}).Where("id = ?", ruleSet.Id).First(&oldRuleSet).Error
+			if err != nil {
+				return err
+			}
+			if oldRuleSet.Tag != ruleSet.Tag {
+				err = s.checkNotInUse(tx, oldRuleSet.Tag)
+				if err != nil {
+					return err
+				}
+			}
+			// The cached copy belongs to the old source
+			removeAfterCommit(tx, ruleSetCachePath(oldRuleSet))
+		}
+		err = tx.Save(&ruleSet).Error
+		if err != nil {
+			return err
+		}
+	case "del":
+		var tag string
+		err = json.Unmarshal(data, &tag)
+		if err != nil {
+			return err
+		}
+		err = s.checkNotInUse(tx, tag)
+		if err != nil {
+			return err
+		}
+		var ruleSet model.RuleSet
+		err = tx.Model(model.RuleSet{}).Where("tag = ?", tag).First(&ruleSet).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Delete(&ruleSet).Error
+		if err != nil {
+			return err
+		}
+		removeAfterCommit(tx, ruleSetCachePath(ruleSet))
+	default:
+		return common.NewErrorf("unknown action: %s", act)
+	}
+	return nil
+}
+
+func (s *RuleSetService) checkNotInUse(tx *gorm.DB, tag string) error {
+	var rules []model.RouteRule
+	err := tx.Model(model.RouteRule{}).Find(&rules).Error
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if ruleUsesTag(rule.Rule, "rule_set", tag) {
+			return common.NewErrorf("rule set '%s' is used by rule %d", tag, rule.Id)
+		}
+	}
+	var dnsRules []model.DnsRule
+	err = tx.Model(model.DnsRule{}).Find(&dnsRules).Error
+	if err != nil {
+		return err
+	}
+	for _, rule := range dnsRules {
+		if ruleUsesTag(rule.Rule, "rule_set", tag) {
+			return common.NewErrorf("rule set '%s' is used by dns rule %d", tag, rule.Id)
+		}
+	}
+	return nil
+}
+
+// UpdateRemote downloads remote rule-sets whose local copy is missing or older than their update interval.
+// With force, all of them are downloaded. A non-empty tag limits the update to that rule-set.
+func (s *RuleSetService) UpdateRemote(tag string, force bool) (bool, error) {
+	db := database.GetDB()
+	var ruleSets []model.RuleSet
+	query := db.Model(model.RuleSet{}).Where("type = ?", "remote")
+	if tag != "" {
+		query = query.Where("tag = ?", tag)
+	}
+	err := query.Find(&ruleSets).Error
+	if err != nil {
+		return false, err
+	}
+	updated := false
+	for _, ruleSet := range ruleSets {
+		var remote remoteRuleSet
+		json.Unmarshal(ruleSet.Options, &remote)
+		interval := defaultRuleSetUpdateInterval
+		if remote.UpdateInterval != "" {
+			if d, err := time.ParseDuration(remote.UpdateInterval); err == nil && d > 0 {
+				interval = d
+			}
+		}
+		cachePath := ruleSetCachePath(ruleSet)
+		if info, err := os.Stat(cachePath); err == nil && !force && time.Since(info.ModTime()) < interval {
+			continue
+		}
+		err = downloadRuleSet(remote.URL, cachePath)
+		if err != nil {
+			if tag != "" {
+				return updated, common.NewErrorf("failed to download rule set '%s': %v", ruleSet.Tag, err)
+			}
+			logger.Warning("failed to download rule set ", ruleSet.Tag, ": ", err)
+			continue
+		}
+		updated = true
+		logger.Debug("rule set ", ruleSet.Tag, " downloaded")
+	}
+	return updated, nil
+}
+
+func downloadRuleSet(url string, path string) error {
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return common.NewErrorf("unexpected status: %s", resp.Status)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a broken download never replaces a working copy
+	tempPath := path + ".tmp"
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, resp.Body)
+	file.Close()
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+func ruleSetFormat(ruleSet model.RuleSet) string {
+	var remote remoteRuleSet
+	json.Unmarshal(ruleSet.Options, &remote)
+	switch {
+	case remote.Format != "":
+		return remote.Format
+	case strings.HasSuffix(remote.URL, ".json"):
+		return "source"
+	}
+	return "binary"
+}
+
+// ruleSetCachePath is named by the id of the rule-set, since tags are free text
+func ruleSetCachePath(ruleSet model.RuleSet) string {
+	ext := ".srs"
+	if ruleSetFormat(ruleSet) == "source" {
+		ext = ".json"
+	}
+	return filepath.Join(config.GetDBFolderPath(), "rulesets", strconv.FormatUint(uint64(ruleSet.Id), 10)+ext)
+}
+
+// allRuleSetTags returns tags of rule-sets in the base config and in the database
+func allRuleSetTags(tx *gorm.DB) ([]string, error) {
+	var tags []string
+	err := tx.Model(model.RuleSet{}).Pluck("tag", &tags).Error
+	if err != nil {
+		return nil, err
+	}
+	var baseConfig struct {
+		Route struct {
+			RuleSet []struct {
+				Tag string `json:"tag"`
+			} `json:"rule_set"`
+		} `json:"route"`
+	}
+	settingService := SettingService{}
+	baseConfigJson, err := settingService.getString(tx, "config")
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(baseConfigJson), &baseConfig)
+	for _, ruleSet := range baseConfig.Route.RuleSet {
+		tags = append(tags, ruleSet.Tag)
+	}
+	return tags, nil
+}
+
+// UpdateRuleSets refreshes local copies of remote rule-sets, and reloads the route of the core if any changed
+func (s *ConfigService) UpdateRuleSets(tag string, force bool) error {
+	updated, err := s.RuleSetService.UpdateRemote(tag, force)
+	if err != nil || !updated || !corePtr.IsRunning() {
+		return err
+	}
+	singboxConfig, err := s.GetConfig("")
+	if err != nil {
+		return err
+	}
+	rawConfig, err := json.Marshal(singboxConfig)
+	if err != nil {
+		return err
+	}
+	return corePtr.ReloadRouter(rawConfig)
+}
@@ -0,0 +1,209 @@
+package service
+
+import (
+	"encoding/json"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/util/common"
+
+	"gorm.io/gorm"
+)
+
+type RouteRuleService struct{}
+
+func (s *RouteRuleService) GetAll() ([]model.RouteRule, error) {
+	db := database.GetDB()
+	rules := []model.RouteRule{}
+	err := db.Model(model.RouteRule{}).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// GetAllConfig returns enabled rules in their order, to be appended to rules of the base config
+func (s *RouteRuleService) GetAllConfig(db *gorm.DB) ([]json.RawMessage, error) {
+	var rules []model.RouteRule
+	err := db.Model(model.RouteRule{}).Where("enable = ?", true).Order("priority, id").Find(&rules).Error
+	if err != nil {
+		return nil, common.NewErrorf("failed to get route rules: %v", err)
+	}
+	rulesJson := make([]json.RawMessage, 0, len(rules))
+	for _, rule := range rules {
+		rulesJson = append(rulesJson, rule.Rule)
+	}
+	return rulesJson, nil
+}
+
+// Save applies a rule change and returns id of the changed rule.
+// "del" data is the rule id, and "order" data is the list of rule ids in their new order.
+func (s *RouteRuleService) Save(tx *gorm.DB, act string, data json.RawMessage) (uint, error) {
+	var err error
+
+	switch act {
+	case "new", "edit":
+		var rule model.RouteRule
+		err = json.Unmarshal(data, &rule)
+		if err != nil {
+			return 0, err
+		}
+		err = s.validate(tx, rule.Rule)
+		if err != nil {
+			return 0, err
+		}
+		if act == "new" {
+			// New rules are added to the end
+			var maxPriority *int
+			err = tx.Model(model.RouteRule{}).Select("MAX(priority)").Scan(&maxPriority).Error
+			if err != nil {
+				return 0, err
+			}
+			if maxPriority != nil {
+				rule.Priority = *maxPriority + 1
+			}
+			err = tx.Create(&rule).Error
+		} else {
+			err = tx.Save(&rule).Error
+		}
+		if err != nil {
+			return 0, err
+		}
+		return rule.Id, nil
+	case "del":
+		var id uint
+		err = json.Unmarshal(data, &id)
+		if err != nil {
+			return 0, err
+		}
+		err = tx.Where("id = ?", id).Delete(model.RouteRule{}).Error
+		if err != nil {
+			return 0, err
+		}
+		return id, nil
+	case "order":
+		var ids []uint
+		err = json.Unmarshal(data, &ids)
+		if err != nil {
+			return 0, err
+		}
+		for priority, id := range ids {
+			err = tx.Model(model.RouteRule{}).Where("id = ?", id).Update("priority", priority).Error
+			if err != nil {
+				return 0, err
+			}
+		}
+		return 0, nil
+	default:
+		return 0, common.NewErrorf("unknown action: %s", act)
+	}
+}
+
+// validate checks that inbounds, outbounds and rule-sets referenced by a rule exist
+func (s *RouteRuleService) validate(tx *gorm.DB, ruleJson json.RawMessage) error {
+	var rule map[string]interface{}
+	err := json.Unmarshal(ruleJson, &rule)
+	if err != nil || rule == nil {
+		return common.NewError("invalid rule")
+	}
+	refs, err := ruleRefs(tx)
+	if err != nil {
+		return err
+	}
+	return validateRuleRefs(rule, refs)
+}
+
+// ruleRefs returns existing tags of objects which rules can reference, by rule key
+func ruleRefs(tx *gorm.DB) (map[string]map[string]bool, error) {
+	var inboundTags, outboundTags, endpointTags []string
+	err := tx.Model(model.Inbound{}).Pluck("tag", &inboundTags).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Model(model.Outbound{}).Pluck("tag", &outboundTags).Error
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Model(model.Endpoint{}).Pluck("tag", &endpointTags).Error
+	if err != nil {
+		return nil, err
+	}
+	ruleSetTags, err := allRuleSetTags(tx)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]map[string]bool{
+		"inbound":  tagSet(inboundTags),
+		"outbound": tagSet(append(outboundTags, endpointTags...)),
+		"rule_set": tagSet(ruleSetTags),
+	}, nil
+}
+
+func validateRuleRefs(rule map[string]interface{}, refs map[string]map[string]bool) error {
+	for key, tags := range refs {
+		for _, tag := range stringList(rule[key]) {
+			if !tags[tag] {
+				return common.NewErrorf("%s '%s' of rule does not exist", key, tag)
+			}
+		}
+	}
+	// Logical rules keep their sub rules in "rules"
+	if subRules, ok := rule["rules"].([]interface{}); ok {
+		for _, subRule := range subRules {
+			if subRuleMap, ok := subRule.(map[string]interface{}); ok {
+				err := validateRuleRefs(subRuleMap, refs)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ruleUsesTag reports whether a rule or one of its sub rules references tag in key
+func ruleUsesTag(ruleJson json.RawMessage, key string, tag string) bool {
+	var rule map[string]interface{}
+	json.Unmarshal(ruleJson, &rule)
+	return ruleMapUsesTag(rule, key, tag)
+}
+
+func ruleMapUsesTag(rule map[string]interface{}, key string, tag string) bool {
+	for _, t := range stringList(rule[key]) {
+		if t == tag {
+			return true
+		}
+	}
+	if subRules, ok := rule["rules"].([]interface{}); ok {
+		for _, subRule := range subRules {
+			if subRuleMap, ok := subRule.(map[string]interface{}); ok && ruleMapUsesTag(subRuleMap, key, tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stringList reads a sing-box listable string, which is either a string or a list of strings
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func tagSet(tags []string) map[string]bool {
+	set := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		set[tag] = true
+	}
+	return set
+}
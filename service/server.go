@@ -62,7 +62,7 @@ func (s *ServerService) GetStatus(request string) *map[string]interface{} {
 func (s *ServerService) GetCpuPercent() (float64, error) {
 	percents, err := cpu.Percent(0, false)
 	if err != nil {
-		return 0, common.NewErrorf("get cpu percent failed: %w", err)
+		return 0, common.NewErrorf("get cpu percent failed: %v", err)
 	}
 	if len(percents) == 0 {
 		return 0, common.NewError("cpu.Percent returned empty slice")
@@ -73,7 +73,7 @@ func (s *ServerService) GetCpuPercent() (float64, error) {
 func (s *ServerService) GetUptime() (uint64, error) {
 	upTime, err := host.Uptime()
 	if err != nil {
-		return 0, common.NewErrorf("get uptime failed: %w", err)
+		return 0, common.NewErrorf("get uptime failed: %v", err)
 	}
 	return upTime, nil
 }
@@ -81,7 +81,7 @@ func (s *ServerService) GetUptime() (uint64, error) {
 func (s *ServerService) GetMemInfo() (map[string]interface{}, error) {
 	memInfoStat, err := mem.VirtualMemory()
 	if err != nil {
-		return nil, common.NewErrorf("get virtual memory failed: %w", err)
+		return nil, common.NewErrorf("get virtual memory failed: %v", err)
 	}
 	info := make(map[string]interface{})
 	info["current"] = memInfoStat.Used
@@ -92,7 +92,7 @@ func (s *ServerService) GetMemInfo() (map[string]interface{}, error) {
 func (s *ServerService) GetNetInfo() (map[string]interface{}, error) {
 	ioStats, err := net.IOCounters(false)
 	if err != nil {
-		return nil, common.NewErrorf("get io counters failed: %w", err)
+		return nil, common.NewErrorf("get io counters failed: %v", err)
 	}
 	if len(ioStats) == 0 {
 		return nil, common.NewError("net.IOCounters returned empty slice")
@@ -121,6 +121,7 @@ func (s *ServerService) GetSingboxInfo() map[string]interface{} {
 			"Alloc":        rtm.Alloc,
 			"Uptime":       uptime,
 		},
+		"supervisor": supervisor.info(),
 	}
 }
 
@@ -197,7 +198,7 @@ func (s *ServerService) GetLogs(countStr string, level string) ([]string, error)
 	c, err := strconv.Atoi(countStr)
 	if err != nil {
 		// Return error instead of defaulting, or make default explicit and clear
-		return nil, common.NewErrorf("invalid count parameter '%s': %w", countStr, err)
+		return nil, common.NewErrorf("invalid count parameter '%s': %v", countStr, err)
 	}
 	if c <= 0 {
 		// Consider if this should be an error or return empty logs
@@ -232,11 +233,11 @@ func (s *ServerService) generateECHKeyPair(options string) ([]string, error) { /
 	}
 	isLite, err := strconv.ParseBool(parts[1])
 	if err != nil {
-		return nil, common.NewErrorf("Failed to generate ECH keypair: invalid boolean for isLite '%s': %w", parts[1], err)
+		return nil, common.NewErrorf("Failed to generate ECH keypair: invalid boolean for isLite '%s': %v", parts[1], err)
 	}
 	configPem, keyPem, err := tls.ECHKeygenDefault(parts[0], isLite)
 	if err != nil {
-		return nil, common.NewErrorf("Failed to generate ECH keypair: %w", err)
+		return nil, common.NewErrorf("Failed to generate ECH keypair: %v", err)
 	}
 	// Return keys as separate elements in the slice, not split by newline, for easier programmatic use.
 	// If newline splitting is truly desired by client, it can do it.
@@ -249,7 +250,7 @@ func (s *ServerService) generateTLSKeyPair(serverName string) ([]string, error)
 	}
 	privateKeyPem, publicKeyPem, err := tls.GenerateCertificate(nil, nil, time.Now, serverName, time.Now().AddDate(1, 0, 0)) // 1 year validity
 	if err != nil {
-		return nil, common.NewErrorf("Failed to generate TLS keypair: %w", err)
+		return nil, common.NewErrorf("Failed to generate TLS keypair: %v", err)
 	}
 	return []string{string(privateKeyPem), string(publicKeyPem)}, nil
 }
@@ -257,7 +258,7 @@ func (s *ServerService) generateTLSKeyPair(serverName string) ([]string, error)
 func (s *ServerService) generateRealityKeyPair() ([]string, error) { // Changed to return error
 	privateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		return nil, common.NewErrorf("Failed to generate Reality private key: %w", err)
+		return nil, common.NewErrorf("Failed to generate Reality private key: %v", err)
 	}
 	publicKey := privateKey.PublicKey()
 	// Return keys in a structured way or clearly labeled if string format is kept
@@ -271,13 +272,13 @@ func (s *ServerService) generateWireGuardKey(pk string) ([]string, error) { // C
 	if len(pk) > 0 {
 		parsedKey, err := wgtypes.ParseKey(pk)
 		if err != nil {
-			return nil, common.NewErrorf("Failed to parse provided WireGuard private key: %w", err)
+			return nil, common.NewErrorf("Failed to parse provided WireGuard private key: %v", err)
 		}
 		return []string{parsedKey.PublicKey().String()}, nil
 	}
 	wgPrivateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
-		return nil, common.NewErrorf("Failed to generate WireGuard keypair: %w", err)
+		return nil, common.NewErrorf("Failed to generate WireGuard keypair: %v", err)
 	}
 	return []string{wgPrivateKey.String(), wgPrivateKey.PublicKey().String()}, nil
 }
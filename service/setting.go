@@ -33,32 +33,52 @@ var defaultConfig = `{
 }`
 
 var defaultValueMap = map[string]string{
-	"webListen":     "",
-	"webDomain":     "",
-	"webPort":       "2095",
-	"secret":        common.Random(32),
-	"webCertFile":   "",
-	"webKeyFile":    "",
-	"webPath":       "/app/",
-	"webURI":        "",
-	"sessionMaxAge": "0",
-	"trafficAge":    "30",
-	"timeLocation":  "Asia/Tehran",
-	"subListen":     "",
-	"subPort":       "2096",
-	"subPath":       "/sub/",
-	"subDomain":     "",
-	"subCertFile":   "",
-	"subKeyFile":    "",
-	"subUpdates":    "12",
-	"subEncode":     "true",
-	"subShowInfo":   "false",
-	"subURI":        "",
-	"subJsonExt":    "",
-	"config":        defaultConfig,
-	"version":       config.GetVersion(),
-	"panelLanguage": "en",    // Added default
-	"panelTheme":    "light", // Added default
+	"webListen":          "",
+	"webDomain":          "",
+	"webPort":            "2095",
+	"secret":             common.Random(32),
+	"webCertFile":        "",
+	"webKeyFile":         "",
+	"webPath":            "/app/",
+	"webURI":             "",
+	"sessionMaxAge":      "0",
+	"trafficAge":         "30",
+	"changesAge":         "90",
+	"timeLocation":       "Asia/Tehran",
+	"subListen":          "",
+	"subPort":            "2096",
+	"subPath":            "/sub/",
+	"subDomain":          "",
+	"subCertFile":        "",
+	"subKeyFile":         "",
+	"subUpdates":         "12",
+	"subEncode":          "true",
+	"subShowInfo":        "false",
+	"subURI":             "",
+	"subJsonExt":         "",
+	"config":             defaultConfig,
+	"version":            config.GetVersion(),
+	"panelLanguage":      "en",    // Added default
+	"panelTheme":         "light", // Added default
+	"backupInterval":     "0",
+	"backupKeep":         "7",
+	"backupDestinations": `[{"type":"local"}]`,
+	"backupPassphrase":   "",
+	"notifyVolume":       "80,95",
+	"notifyExpiry":       "3,1",
+	"notifyChannels":     "[]",
+	"notifyCerts":        "14,3",
+	"quotaRedirect":      "",
+	"subPortal":          "false",
+	"subByName":          "false",
+	"portalNotices":      "[]",
+	"acmeEmail":          "",
+	"acmeCA":             "",
+	"acmeCARoot":         "",
+	"acmeHttpPort":       "80",
+	"acmeTlsPort":        "443",
+	"webAcme":            "",
+	"subAcme":            "",
 }
 
 type SettingService struct {
@@ -103,7 +123,7 @@ func (s *SettingService) ResetSettings() error {
 
 func (s *SettingService) getSetting(db *gorm.DB, key string) (*model.Setting, error) {
 	setting := &model.Setting{}
-	err := db.Model(model.Setting{}).Where("key = ?", key).First(setting).Error
+	err := db.Model(model.Setting{}).Where(&model.Setting{Key: key}).First(setting).Error
 	if err != nil {
 		return nil, err
 	}
@@ -112,7 +132,7 @@ func (s *SettingService) getSetting(db *gorm.DB, key string) (*model.Setting, er
 
 func (s *SettingService) getString(db *gorm.DB, key string) (string, error) {
 	setting := &model.Setting{}
-	err := db.Model(model.Setting{}).Where("key = ?", key).First(setting).Error
+	err := db.Model(model.Setting{}).Where(&model.Setting{Key: key}).First(setting).Error
 	if database.IsNotFound(err) {
 		value, ok := defaultValueMap[key]
 		if !ok {
@@ -133,7 +153,7 @@ func (s *SettingService) getString(db *gorm.DB, key string) (string, error) {
 // saveSetting saves a key-value pair. It uses the provided db instance (which can be a transaction).
 func (s *SettingService) saveSetting(db *gorm.DB, key string, value string) error {
 	setting := &model.Setting{}
-	err := db.Model(model.Setting{}).Where("key = ?", key).First(setting).Error
+	err := db.Model(model.Setting{}).Where(&model.Setting{Key: key}).First(setting).Error
 	if database.IsNotFound(err) {
 		return db.Create(&model.Setting{
 			Key:   key,
@@ -196,6 +216,42 @@ func (s *SettingService) Update(tx *gorm.DB, key string, value string) error {
 			return common.NewErrorf("failed to parse trafficAge to int: %v", errConv)
 		}
 		typedValue = i
+	case "changesAge":
+		i, errConv := strconv.Atoi(value)
+		if errConv != nil {
+			return common.NewErrorf("failed to parse changesAge to int: %v", errConv)
+		}
+		typedValue = i
+	case "backupInterval", "backupKeep":
+		i, errConv := strconv.Atoi(value)
+		if errConv != nil || i < 0 {
+			return common.NewErrorf("%s must be a non-negative number", key)
+		}
+		typedValue = i
+	case "backupDestinations":
+		_, err = parseBackupDestinations(value)
+		if err != nil {
+			return err
+		}
+		typedValue = value
+	case "notifyVolume", "notifyExpiry", "notifyCerts":
+		_, err = parseThresholds(key, value)
+		if err != nil {
+			return err
+		}
+		typedValue = value
+	case "notifyChannels":
+		_, err = parseNotifyChannels(value)
+		if err != nil {
+			return err
+		}
+		typedValue = value
+	case "quotaRedirect":
+		_, _, err = parseQuotaRedirect(value)
+		if err != nil {
+			return err
+		}
+		typedValue = value
 	case "timeLocation":
 		// Validate if it's a valid time location
 		_, errConv := time.LoadLocation(value)
@@ -244,8 +300,50 @@ func (s *SettingService) Update(tx *gorm.DB, key string, value string) error {
 			return common.NewErrorf("failed to parse subShowInfo to bool: %v", errConv)
 		}
 		typedValue = b
+	case "subPortal":
+		b, errConv := strconv.ParseBool(value)
+		if errConv != nil {
+			return common.NewErrorf("failed to parse subPortal to bool: %v", errConv)
+		}
+		typedValue = b
+	case "subByName":
+		b, errConv := strconv.ParseBool(value)
+		if errConv != nil {
+			return common.NewErrorf("failed to parse subByName to bool: %v", errConv)
+		}
+		typedValue = b
+	case "portalNotices":
+		_, err = parsePortalNotices(value)
+		if err != nil {
+			return err
+		}
+		typedValue = value
 	case "subURI":
 		typedValue = value
+	case "acmeEmail", "acmeCA", "acmeCARoot":
+		typedValue = value
+	case "acmeHttpPort", "acmeTlsPort":
+		i, errConv := strconv.Atoi(value)
+		if errConv != nil || i < 1 || i > 65535 {
+			return common.NewErrorf("%s must be a port number", key)
+		}
+		typedValue = i
+	case "webAcme", "subAcme":
+		if value != "" {
+			db := database.GetDB()
+			if tx != nil {
+				db = tx
+			}
+			var count int64
+			err = db.Model(model.AcmeCert{}).Where("domain = ?", value).Count(&count).Error
+			if err != nil {
+				return err
+			}
+			if count == 0 {
+				return common.NewErrorf("certificate of %s is not managed", value)
+			}
+		}
+		typedValue = value
 	case "subJsonExt":
 		typedValue = value
 	// Note: "config" and "version" are typically not updated via this generic method.
@@ -323,6 +421,10 @@ func (s *SettingService) GetKeyFile() (string, error) {
 	return s.getString(database.GetDB(), "webKeyFile")
 }
 
+func (s *SettingService) GetWebAcme() (string, error) {
+	return s.getString(database.GetDB(), "webAcme")
+}
+
 func (s *SettingService) GetWebPath() (string, error) {
 	webPath, err := s.getString(database.GetDB(), "webPath")
 	if err != nil {
@@ -369,6 +471,30 @@ func (s *SettingService) GetTrafficAge() (int, error) {
 	return strconv.Atoi(str)
 }
 
+func (s *SettingService) GetChangesAge() (int, error) {
+	str, err := s.getString(database.GetDB(), "changesAge")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+func (s *SettingService) GetBackupInterval() (int, error) {
+	str, err := s.getString(database.GetDB(), "backupInterval")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
+func (s *SettingService) GetBackupKeep() (int, error) {
+	str, err := s.getString(database.GetDB(), "backupKeep")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(str)
+}
+
 func (s *SettingService) GetTimeLocation() (*time.Location, error) {
 	l, err := s.getString(database.GetDB(), "timeLocation")
 	if err != nil {
@@ -455,6 +581,27 @@ func (s *SettingService) GetSubShowInfo() (bool, error) {
 	return strconv.ParseBool(str)
 }
 
+func (s *SettingService) GetSubPortal() (bool, error) {
+	str, err := s.getString(database.GetDB(), "subPortal")
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(str)
+}
+
+// GetSubByName tells whether subscriptions are also found by the name of clients, as before they had tokens
+func (s *SettingService) GetSubByName() (bool, error) {
+	str, err := s.getString(database.GetDB(), "subByName")
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(str)
+}
+
+func (s *SettingService) GetSubAcme() (string, error) {
+	return s.getString(database.GetDB(), "subAcme")
+}
+
 func (s *SettingService) GetSubURI() (string, error) {
 	return s.getString(database.GetDB(), "subURI")
 }
@@ -551,6 +698,16 @@ func (s *SettingService) GetWebSettings() (map[string]interface{}, error) {
 	}
 	settings["trafficAge"] = intVal
 
+	strVal, err = s.getString(db, "changesAge")
+	if err != nil {
+		return nil, common.NewErrorf("GetWebSettings: failed to get changesAge: %v", err)
+	}
+	intVal, err = strconv.Atoi(strVal)
+	if err != nil {
+		return nil, common.NewErrorf("GetWebSettings: failed to parse changesAge: %v", err)
+	}
+	settings["changesAge"] = intVal
+
 	timeLoc, err := s.GetTimeLocation() // Uses its own DB get
 	if err != nil {
 		return nil, common.NewErrorf("GetWebSettings: failed to get timeLocation: %v", err)
@@ -0,0 +1,238 @@
+package service
+
+import (
+	"encoding/json"
+	"reflect"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const keepSnapshots = 10
+
+// Tables which make up the config of the core. Clients are not listed, because their
+// traffic must survive a restore; only their inbounds and links are restored.
+var snapshotTables = []struct {
+	name  string
+	model interface{}
+}{
+	{"tls", &model.Tls{}},
+	{"inbounds", &model.Inbound{}},
+	{"outbounds", &model.Outbound{}},
+	{"endpoints", &model.Endpoint{}},
+	{"rules", &model.RouteRule{}},
+	{"rulesets", &model.RuleSet{}},
+	{"dnsservers", &model.DnsServer{}},
+	{"dnsrules", &model.DnsRule{}},
+}
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+type snapshotState struct {
+	Config  string                              `json:"config"`
+	Tables  map[string][]map[string]interface{} `json:"tables"`
+	Clients []map[string]interface{}            `json:"clients"`
+}
+
+// GetSnapshots lists snapshots without their content
+func (s *ConfigService) GetSnapshots() ([]model.Snapshot, error) {
+	db := database.GetDB()
+	snapshots := []model.Snapshot{}
+	err := db.Model(model.Snapshot{}).Select("id", "date_time", "config_hash").Order("id desc").Find(&snapshots).Error
+	if err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+func (s *ConfigService) latestSnapshot() (*model.Snapshot, error) {
+	db := database.GetDB()
+	snapshot := &model.Snapshot{}
+	err := db.Model(model.Snapshot{}).Order("id desc").First(snapshot).Error
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// SaveSnapshot stores the rendered config and the database state behind it as last known-good
+func (s *ConfigService) SaveSnapshot() error {
+	db := database.GetDB()
+	singboxConfig, err := s.GetConfig("")
+	if err != nil {
+		return err
+	}
+	rawConfig, err := json.MarshalIndent(singboxConfig, "", "  ")
+	if err != nil {
+		return err
+	}
+	hash := configHash(rawConfig)
+	if latest, err := s.latestSnapshot(); err == nil && latest.ConfigHash == hash {
+		return nil
+	}
+
+	state := snapshotState{Tables: map[string][]map[string]interface{}{}}
+	state.Config, err = s.SettingService.getString(db, "config")
+	if err != nil {
+		return err
+	}
+	for _, table := range snapshotTables {
+		var rows []map[string]interface{}
+		err = db.Model(table.model).Find(&rows).Error
+		if err != nil {
+			return err
+		}
+		state.Tables[table.name] = rows
+	}
+	err = db.Model(model.Client{}).Select("id", "inbounds", "links").Find(&state.Clients).Error
+	if err != nil {
+		return err
+	}
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Create(&model.Snapshot{
+			DateTime:   time.Now().Unix(),
+			ConfigHash: hash,
+			Config:     rawConfig,
+			State:      stateJson,
+		}).Error
+		if err != nil {
+			return err
+		}
+		// mysql does not allow an offset without a limit
+		var ids []uint
+		err = tx.Model(model.Snapshot{}).Order("id desc").Pluck("id", &ids).Error
+		if err != nil || len(ids) <= keepSnapshots {
+			return err
+		}
+		return tx.Where("id IN ?", ids[keepSnapshots:]).Delete(model.Snapshot{}).Error
+	})
+}
+
+// RestoreSnapshot brings the database back to a snapshot. It does not touch the core,
+// callers restart it when it is running.
+func (s *ConfigService) RestoreSnapshot(id uint, loginUser string, reason string) error {
+	db := database.GetDB()
+	snapshot := &model.Snapshot{}
+	err := db.Model(model.Snapshot{}).Where("id = ?", id).First(snapshot).Error
+	if err != nil {
+		return err
+	}
+	var state snapshotState
+	err = json.Unmarshal(snapshot.State, &state)
+	if err != nil {
+		return common.NewErrorf("invalid snapshot %d: %v", id, err)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		err := s.SettingService.Update(tx, "config", state.Config)
+		if err != nil {
+			return err
+		}
+		for _, table := range snapshotTables {
+			err = tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(table.model).Error
+			if err != nil {
+				return err
+			}
+			records, err := snapshotRows(tx, table.model, state.Tables[table.name])
+			if err != nil {
+				return err
+			}
+			for _, record := range records {
+				err = tx.Create(record).Error
+				if err != nil {
+					return err
+				}
+			}
+		}
+		clients, err := snapshotRows(tx, &model.Client{}, state.Clients)
+		if err != nil {
+			return err
+		}
+		for _, record := range clients {
+			client := record.(*model.Client)
+			err = tx.Model(model.Client{}).Where("id = ?", client.Id).
+				Updates(map[string]interface{}{"inbounds": client.Inbounds, "links": client.Links}).Error
+			if err != nil {
+				return err
+			}
+		}
+		obj, _ := json.Marshal(map[string]interface{}{"id": id, "reason": reason})
+		return tx.Create(&model.Changes{
+			DateTime: time.Now().Unix(),
+			Actor:    loginUser,
+			Key:      "snapshots",
+			Action:   "restore",
+			Obj:      obj,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	LastUpdate = time.Now().Unix()
+	logger.Info("restored snapshot ", id, " ", reason)
+	return nil
+}
+
+// snapshotRows converts rows decoded from json back to records of the model
+func snapshotRows(tx *gorm.DB, dbModel interface{}, rows []map[string]interface{}) ([]interface{}, error) {
+	stmt := &gorm.Statement{DB: tx}
+	err := stmt.Parse(dbModel)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]interface{}, 0, len(rows))
+	for _, row := range rows {
+		record := reflect.New(stmt.Schema.ModelType)
+		for column, value := range row {
+			field := stmt.Schema.LookUpField(column)
+			if field == nil || value == nil {
+				continue
+			}
+			raw, err := json.Marshal(value)
+			if err != nil {
+				return nil, err
+			}
+			var fieldValue interface{} = json.RawMessage(raw)
+			if field.FieldType != rawMessageType {
+				typed := reflect.New(field.FieldType)
+				err = json.Unmarshal(raw, typed.Interface())
+				if err != nil {
+					return nil, err
+				}
+				fieldValue = typed.Elem().Interface()
+			}
+			err = field.Set(tx.Statement.Context, record.Elem(), fieldValue)
+			if err != nil {
+				return nil, err
+			}
+		}
+		records = append(records, record.Interface())
+	}
+	return records, nil
+}
+
+// rollbackToSnapshot restores the last known-good snapshot after a change stopped the core from starting
+func (s *ConfigService) rollbackToSnapshot(loginUser string, startErr error) error {
+	snapshot, err := s.latestSnapshot()
+	if err != nil {
+		return common.NewErrorf("core failed to start after the change: %v; no snapshot to roll back to", startErr)
+	}
+	err = s.RestoreSnapshot(snapshot.Id, loginUser, "core failed to start: "+startErr.Error())
+	if err != nil {
+		return common.NewErrorf("core failed to start after the change: %v; rollback failed: %v", startErr, err)
+	}
+	err = s.StartCore("")
+	if err != nil {
+		return common.NewErrorf("core failed to start after the change: %v; rolled back to snapshot %d, but core still fails: %v", startErr, snapshot.Id, err)
+	}
+	return common.NewErrorf("core failed to start after the change: %v; rolled back to snapshot %d", startErr, snapshot.Id)
+}
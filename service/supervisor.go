@@ -0,0 +1,296 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	supervisorMinBackoff   = 5 * time.Second
+	supervisorMaxBackoff   = 5 * time.Minute
+	supervisorGracePeriod  = 30 * time.Second
+	supervisorFallbackAt   = 3
+	supervisorUnhealthyAt  = 3
+	supervisorHistorySize  = 100
+	supervisorProbeTimeout = 2 * time.Second
+	// Known-good configs are checked inside the core at this interval, while new ones are probed at every run
+	supervisorCheckInterval = time.Minute
+)
+
+// Inbound types which only listen on udp, and can not be probed by a tcp dial
+var udpInboundTypes = map[string]bool{
+	"hysteria":  true,
+	"hysteria2": true,
+	"tuic":      true,
+}
+
+type CoreEvent struct {
+	Time       int64  `json:"time"`
+	Event      string `json:"event"`
+	Reason     string `json:"reason,omitempty"`
+	ConfigHash string `json:"configHash,omitempty"`
+}
+
+// coreSupervisor keeps the state of core starts, to back off after failures
+// and to fall back to the last config which ran well
+type coreSupervisor struct {
+	mu             sync.Mutex
+	history        []CoreEvent
+	failures       int
+	unhealthy      int
+	nextStart      time.Time
+	startedAt      time.Time
+	currentConfig  []byte
+	currentHash    string
+	lastGoodConfig []byte
+	lastGoodHash   string
+	fallback       bool
+	lastCheck      time.Time
+}
+
+var supervisor = &coreSupervisor{}
+
+func configHash(rawConfig []byte) string {
+	sum := sha256.Sum256(rawConfig)
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func (c *coreSupervisor) record(event string, reason string, hash string) {
+	c.history = append(c.history, CoreEvent{
+		Time:       time.Now().Unix(),
+		Event:      event,
+		Reason:     reason,
+		ConfigHash: hash,
+	})
+	if len(c.history) > supervisorHistorySize {
+		c.history = c.history[len(c.history)-supervisorHistorySize:]
+	}
+}
+
+func (c *coreSupervisor) started(rawConfig []byte, fallback bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.startedAt = time.Now()
+	c.currentConfig = rawConfig
+	c.currentHash = configHash(rawConfig)
+	c.fallback = fallback
+	c.unhealthy = 0
+	event := "start"
+	if fallback {
+		event = "fallback"
+	}
+	c.record(event, "", c.currentHash)
+}
+
+func (c *coreSupervisor) failed(hash string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures++
+	backoff := supervisorMinBackoff << min(c.failures-1, 10)
+	if backoff > supervisorMaxBackoff {
+		backoff = supervisorMaxBackoff
+	}
+	c.nextStart = time.Now().Add(backoff)
+	c.record("fail", strings.TrimSpace(err.Error()), hash)
+}
+
+func (c *coreSupervisor) stopped(event string, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.record(event, reason, c.currentHash)
+	c.startedAt = time.Time{}
+}
+
+func (c *coreSupervisor) canStart() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().After(c.nextStart)
+}
+
+// fallbackConfig returns the last known-good config after repeated failures of another config
+func (c *coreSupervisor) fallbackConfig() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < supervisorFallbackAt || c.lastGoodConfig == nil {
+		return nil, false
+	}
+	if len(c.history) > 0 && c.history[len(c.history)-1].ConfigHash == c.lastGoodHash {
+		return nil, false
+	}
+	return c.lastGoodConfig, true
+}
+
+// check reports whether a health check is due, and whether it verifies a start by dialing the listeners.
+// A config is verified until it becomes known-good, and later only checked inside the core.
+func (c *coreSupervisor) check() (due bool, verify bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	verify = !c.fallback && c.currentHash != c.lastGoodHash
+	if !verify && time.Since(c.lastCheck) < supervisorCheckInterval {
+		return false, false
+	}
+	c.lastCheck = time.Now()
+	return true, verify
+}
+
+// healthy counts consecutive failed health checks, and reports false when the core should be restarted.
+// good is true when the running config has just become the last known-good one.
+func (c *coreSupervisor) healthy(ok bool) (healthy bool, good bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Inbounds in the database do not describe a fallback config
+	if !ok && !c.fallback {
+		c.unhealthy++
+		return c.unhealthy < supervisorUnhealthyAt, false
+	}
+	c.unhealthy = 0
+	// A config which stays up for the grace period is known to be good
+	if !c.fallback && c.currentHash != c.lastGoodHash && time.Since(c.startedAt) >= supervisorGracePeriod {
+		c.lastGoodConfig = c.currentConfig
+		c.lastGoodHash = c.currentHash
+		c.failures = 0
+		c.nextStart = time.Time{}
+		c.record("good", "", c.currentHash)
+		return true, true
+	}
+	return true, false
+}
+
+// initLastGood sets the last known-good config from a stored snapshot, if none is known in this run
+func (c *coreSupervisor) initLastGood(rawConfig []byte, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lastGoodConfig == nil {
+		c.lastGoodConfig = rawConfig
+		c.lastGoodHash = hash
+	}
+}
+
+func (c *coreSupervisor) info() map[string]interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state := "stopped"
+	switch {
+	case corePtr.IsRunning() && c.fallback:
+		state = "fallback"
+	case corePtr.IsRunning():
+		state = "running"
+	case time.Now().Before(c.nextStart):
+		state = "backoff"
+	}
+	info := map[string]interface{}{
+		"state":        state,
+		"failures":     c.failures,
+		"configHash":   c.currentHash,
+		"lastGoodHash": c.lastGoodHash,
+		"history":      append([]CoreEvent{}, c.history...),
+	}
+	if state == "backoff" {
+		info["nextStart"] = c.nextStart.Unix()
+	}
+	return info
+}
+
+// SuperviseCore starts the core when it is down, respecting the backoff after failures,
+// and restarts it when its listeners do not answer after a start, or are gone later
+func (s *ConfigService) SuperviseCore() {
+	if corePtr.IsRunning() {
+		due, verify := supervisor.check()
+		if !due {
+			return
+		}
+		var ok bool
+		if verify {
+			ok = s.probeInbounds()
+		} else {
+			ok = s.checkInbounds()
+		}
+		healthy, good := supervisor.healthy(ok)
+		if good {
+			err := s.SaveSnapshot()
+			if err != nil {
+				logger.Warning("failed to save snapshot of known-good config: ", err)
+			}
+		}
+		if healthy {
+			return
+		}
+		logger.Warning("sing-box inbounds are not listening, restarting")
+		err := corePtr.Stop()
+		if err != nil {
+			logger.Warning("failed to stop unhealthy sing-box: ", err)
+		}
+		supervisor.stopped("crash", "health check failed")
+	}
+	if !supervisor.canStart() {
+		return
+	}
+	err := s.StartCore("")
+	if err == nil {
+		return
+	}
+	if snapshot, err := s.latestSnapshot(); err == nil {
+		supervisor.initLastGood(snapshot.Config, snapshot.ConfigHash)
+	}
+	if rawConfig, ok := supervisor.fallbackConfig(); ok {
+		logger.Warning("starting sing-box with the last known-good config")
+		s.startCore(rawConfig, true)
+	}
+}
+
+// probeInbounds dials tcp listeners of inbounds, and fails only if none of them answers
+func (s *ConfigService) probeInbounds() bool {
+	inbounds, err := s.InboundService.GetAllConfig(database.GetDB())
+	if err != nil {
+		return true
+	}
+	probed := false
+	for _, inboundJson := range inbounds {
+		var inbound struct {
+			Type       string `json:"type"`
+			Listen     string `json:"listen"`
+			ListenPort int    `json:"listen_port"`
+		}
+		json.Unmarshal(inboundJson, &inbound)
+		if inbound.ListenPort == 0 || udpInboundTypes[inbound.Type] {
+			continue
+		}
+		host := inbound.Listen
+		switch host {
+		case "", "0.0.0.0", "::":
+			host = "127.0.0.1"
+		}
+		probed = true
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(inbound.ListenPort)), supervisorProbeTimeout)
+		if err == nil {
+			conn.Close()
+			return true
+		}
+	}
+	return !probed
+}
+
+// checkInbounds looks up inbounds in the running core, and fails if any of them is missing
+func (s *ConfigService) checkInbounds() bool {
+	var tags []string
+	err := database.GetDB().Model(model.Inbound{}).Pluck("tag", &tags).Error
+	if err != nil {
+		return true
+	}
+	for _, tag := range tags {
+		if !corePtr.HasInbound(tag) {
+			logger.Warning("sing-box has no inbound ", tag)
+			return false
+		}
+	}
+	return true
+}
@@ -24,7 +24,8 @@ func (s *TlsService) GetAll() ([]model.Tls, error) {
 	return tlsConfig, nil
 }
 
-func (s *TlsService) Save(tx *gorm.DB, action string, data json.RawMessage) ([]uint, error) {
+// Save returns inbounds using the tls profile, and warnings of checkTls for new and edited profiles
+func (s *TlsService) Save(tx *gorm.DB, action string, data json.RawMessage) ([]uint, []string, error) {
 	var err error
 	var inboundIds []uint
 
@@ -33,36 +34,54 @@ func (s *TlsService) Save(tx *gorm.DB, action string, data json.RawMessage) ([]u
 		var tls model.Tls
 		err = json.Unmarshal(data, &tls)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if tls.Acme != "" {
+			var count int64
+			err = tx.Model(model.AcmeCert{}).Where("domain = ?", tls.Acme).Count(&count).Error
+			if err != nil {
+				return nil, nil, err
+			}
+			if count == 0 {
+				return nil, nil, common.NewErrorf("certificate of %s is not managed", tls.Acme)
+			}
 		}
 		err = tx.Save(&tls).Error
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		warnings, err := s.checkTls(tx, &tls)
+		if err != nil {
+			return nil, nil, err
 		}
 		err = tx.Model(model.Inbound{}).Select("id").Where("tls_id = ?", tls.Id).Scan(&inboundIds).Error
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		return inboundIds, nil
+		return inboundIds, warnings, nil
 	case "del":
 		var id uint
 		err = json.Unmarshal(data, &id)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		var inboundCount int64
 		err = tx.Model(model.Inbound{}).Where("tls_id = ?", id).Count(&inboundCount).Error
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		if inboundCount > 0 {
-			return nil, common.NewError("tls in use")
+			return nil, nil, common.NewError("tls in use")
 		}
 		err = tx.Where("id = ?", id).Delete(model.Tls{}).Error
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		err = tx.Where("tls_id = ?", id).Delete(model.TlsRotation{}).Error
+		if err != nil {
+			return nil, nil, err
 		}
 	}
 
-	return nil, nil
+	return nil, nil, nil
 }
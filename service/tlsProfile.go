@@ -0,0 +1,268 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/util/common"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// UtlsFingerprints are the uTLS fingerprints which sing-box clients accept
+var UtlsFingerprints = []string{"chrome", "firefox", "edge", "safari", "360", "qq", "ios", "android", "random", "randomized"}
+
+// realityDialTimeout limits the check of the handshake server of reality
+const realityDialTimeout = 3 * time.Second
+
+// tlsList is a list of sing-box options, which may be a single string
+type tlsList []string
+
+func (l *tlsList) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*l = tlsList{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+type TlsUtls struct {
+	Enabled     bool   `json:"enabled,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+type TlsRealityServer struct {
+	Enabled   bool `json:"enabled,omitempty"`
+	Handshake struct {
+		Server     string `json:"server,omitempty"`
+		ServerPort uint16 `json:"server_port,omitempty"`
+	} `json:"handshake,omitempty"`
+}
+
+// TlsServer is the part of sing-box inbound tls options which is checked against clients
+type TlsServer struct {
+	Enabled    bool              `json:"enabled,omitempty"`
+	ServerName string            `json:"server_name,omitempty"`
+	Alpn       tlsList           `json:"alpn,omitempty"`
+	Reality    *TlsRealityServer `json:"reality,omitempty"`
+}
+
+// TlsClient is the client side of a tls profile, and of tls overrides in addresses of inbounds
+type TlsClient struct {
+	ServerName string   `json:"server_name,omitempty"`
+	Insecure   bool     `json:"insecure,omitempty"`
+	Alpn       tlsList  `json:"alpn,omitempty"`
+	Utls       *TlsUtls `json:"utls,omitempty"`
+}
+
+// TlsProfile is the typed form of a tls profile
+type TlsProfile struct {
+	Server TlsServer
+	Client TlsClient
+}
+
+func ParseTlsProfile(tls *model.Tls) (*TlsProfile, error) {
+	profile := &TlsProfile{}
+	if len(tls.Server) > 0 {
+		err := json.Unmarshal(tls.Server, &profile.Server)
+		if err != nil {
+			return nil, common.NewErrorf("invalid server of tls: %v", err)
+		}
+	}
+	if len(tls.Client) > 0 {
+		err := json.Unmarshal(tls.Client, &profile.Client)
+		if err != nil {
+			return nil, common.NewErrorf("invalid client of tls: %v", err)
+		}
+	}
+	return profile, nil
+}
+
+func (p *TlsProfile) isReality() bool {
+	return p.Server.Reality != nil && p.Server.Reality.Enabled
+}
+
+func checkFingerprint(utls *TlsUtls) error {
+	if utls == nil || !utls.Enabled || utls.Fingerprint == "" {
+		return nil
+	}
+	if !slices.Contains(UtlsFingerprints, utls.Fingerprint) {
+		return common.NewErrorf("unknown uTLS fingerprint: %s", utls.Fingerprint)
+	}
+	return nil
+}
+
+// checkTls validates a tls profile, with the inbounds using it and the tls overrides in their addresses.
+// What sing-box refuses is an error, and what only breaks some clients is a warning.
+func (s *TlsService) checkTls(tx *gorm.DB, tls *model.Tls) ([]string, error) {
+	profile, err := ParseTlsProfile(tls)
+	if err != nil {
+		return nil, err
+	}
+	err = checkFingerprint(profile.Client.Utls)
+	if err != nil {
+		return nil, err
+	}
+	warnings := []string{}
+	if !profile.Server.Enabled {
+		return warnings, nil
+	}
+
+	if profile.isReality() {
+		if profile.Client.Utls == nil || !profile.Client.Utls.Enabled {
+			warnings = append(warnings, "reality clients need uTLS")
+		}
+		if profile.Server.ServerName == "" {
+			warnings = append(warnings, "reality needs a server name which its handshake server serves")
+		}
+		if profile.Server.Reality.Handshake.Server == "" {
+			warnings = append(warnings, "reality needs a handshake server")
+		}
+	}
+
+	// Names of clients are checked against the certificate, unless they do not verify it
+	var leafPem []byte
+	if !profile.isReality() {
+		leafPem, err = s.serverCertPem(tx, tls)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("certificate can not be read: %v", err))
+		}
+	}
+	checkName := func(name string, insecure bool, where string) {
+		if len(leafPem) == 0 || name == "" || insecure {
+			return
+		}
+		leaf, err := parseCertPem(string(leafPem))
+		if err != nil {
+			return
+		}
+		if leaf.VerifyHostname(name) != nil {
+			warnings = append(warnings, fmt.Sprintf("server name %s%s is not in the certificate", name, where))
+		}
+	}
+	checkName(profile.Server.ServerName, profile.Client.Insecure, "")
+
+	var inbounds []model.Inbound
+	err = tx.Model(model.Inbound{}).Where("tls_id = ?", tls.Id).Find(&inbounds).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, inbound := range inbounds {
+		var options struct {
+			Transport struct {
+				Type string `json:"type"`
+			} `json:"transport"`
+		}
+		json.Unmarshal(inbound.Options, &options)
+		where := " of " + inbound.Tag
+		if msg := checkAlpn(profile.Server.Alpn, options.Transport.Type); msg != "" {
+			warnings = append(warnings, msg+where)
+		}
+
+		var addrs []struct {
+			Server string     `json:"server"`
+			Tls    *TlsClient `json:"tls"`
+		}
+		json.Unmarshal(inbound.Addrs, &addrs)
+		for _, addr := range addrs {
+			if addr.Tls == nil {
+				continue
+			}
+			where := fmt.Sprintf(" of %s in address %s", inbound.Tag, addr.Server)
+			if err := checkFingerprint(addr.Tls.Utls); err != nil {
+				warnings = append(warnings, strings.TrimSpace(err.Error())+where)
+			}
+			if !profile.isReality() {
+				checkName(addr.Tls.ServerName, profile.Client.Insecure || addr.Tls.Insecure, where)
+			}
+			if msg := checkAlpn(addr.Tls.Alpn, options.Transport.Type); msg != "" {
+				warnings = append(warnings, msg+where)
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// checkAlpn finds ALPN which does not carry the transport: gRPC and HTTP need h2,
+// and WebSocket and HTTPUpgrade need http/1.1. Without ALPN, clients offer both.
+func checkAlpn(alpn []string, transport string) string {
+	if len(alpn) == 0 {
+		return ""
+	}
+	var needed string
+	switch transport {
+	case "grpc", "http":
+		needed = "h2"
+	case "ws", "httpupgrade":
+		needed = "http/1.1"
+	default:
+		return ""
+	}
+	if slices.Contains(alpn, needed) {
+		return ""
+	}
+	return fmt.Sprintf("ALPN needs %s for transport %s", needed, transport)
+}
+
+// realityTargetWarnings dials the handshake server of reality in a saved tls profile, as the inbound does.
+// It runs before the transaction of the save, and only for a new or changed server,
+// so edits which keep it, like rotation of keys, do not wait on the network.
+func (s *TlsService) realityTargetWarnings(data json.RawMessage) []string {
+	var tls model.Tls
+	if json.Unmarshal(data, &tls) != nil {
+		return nil
+	}
+	profile, err := ParseTlsProfile(&tls)
+	if err != nil || !profile.Server.Enabled || !profile.isReality() || profile.Server.Reality.Handshake.Server == "" {
+		return nil
+	}
+	if tls.Id > 0 {
+		var old model.Tls
+		err = database.GetDB().Model(model.Tls{}).Where("id = ?", tls.Id).First(&old).Error
+		if err == nil {
+			oldProfile, err := ParseTlsProfile(&old)
+			if err == nil && oldProfile.isReality() && oldProfile.Server.Reality.Handshake == profile.Server.Reality.Handshake {
+				return nil
+			}
+		}
+	}
+	return checkRealityTarget(profile.Server.Reality)
+}
+
+func checkRealityTarget(reality *TlsRealityServer) []string {
+	server := reality.Handshake.Server
+	port := reality.Handshake.ServerPort
+	if port == 0 {
+		port = 443
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(server, strconv.Itoa(int(port))), realityDialTimeout)
+	if err != nil {
+		return []string{fmt.Sprintf("handshake server %s:%d of reality is not reachable: %v", server, port, err)}
+	}
+	conn.Close()
+	return nil
+}
+
+// serverCertPem reads the certificate of a tls profile, or nothing if it has none yet
+func (s *TlsService) serverCertPem(tx *gorm.DB, tls *model.Tls) ([]byte, error) {
+	if tls.Acme != "" {
+		certPem, err := acmeCertPem(tx, tls.Acme)
+		if err != nil {
+			// Not obtained yet
+			return nil, nil
+		}
+		return certPem, nil
+	}
+	if certFile, _ := tlsServerFiles(tls.Server); certFile != "" {
+		return os.ReadFile(certFile)
+	}
+	return tlsServerPem(tls.Server), nil
+}
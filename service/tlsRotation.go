@@ -0,0 +1,557 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/util/common"
+	"strings"
+	"time"
+
+	"github.com/sagernet/sing-box/common/tls"
+	"gorm.io/gorm"
+)
+
+// Keys of a tls profile which rotate
+const (
+	RotateRealityKey     = "realityKey"
+	RotateRealityShortId = "realityShortId"
+	RotateEch            = "ech"
+)
+
+func (s *ConfigService) GetTlsRotations() ([]model.TlsRotation, error) {
+	rotations := []model.TlsRotation{}
+	err := database.GetDB().Model(model.TlsRotation{}).Order("tls_id").Find(&rotations).Error
+	if err != nil {
+		return nil, err
+	}
+	return rotations, nil
+}
+
+// SaveTlsRotation sets ("set") or removes ("del", data is the id of the tls profile) the rotation policy of a tls profile.
+// "rotate" replaces keys at once, with data like {"tlsId":1,"kinds":["ech"]}.
+func (s *ConfigService) SaveTlsRotation(act string, data json.RawMessage, loginUser string, hostname string) error {
+	db := database.GetDB()
+	switch act {
+	case "set":
+		var rotation model.TlsRotation
+		err := json.Unmarshal(data, &rotation)
+		if err != nil {
+			return err
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			err := s.validateTlsRotation(tx, &rotation)
+			if err != nil {
+				return err
+			}
+			return s.recordTlsRotation(tx, act, data, loginUser)
+		})
+		if err != nil {
+			return err
+		}
+	case "del":
+		var tlsId uint
+		err := json.Unmarshal(data, &tlsId)
+		if err != nil {
+			return err
+		}
+		return db.Transaction(func(tx *gorm.DB) error {
+			err := tx.Where("tls_id = ?", tlsId).Delete(model.TlsRotation{}).Error
+			if err != nil {
+				return err
+			}
+			return s.recordTlsRotation(tx, act, data, loginUser)
+		})
+	case "rotate":
+		var request struct {
+			TlsId uint     `json:"tlsId"`
+			Kinds []string `json:"kinds"`
+		}
+		err := json.Unmarshal(data, &request)
+		if err != nil {
+			return err
+		}
+		if len(request.Kinds) == 0 {
+			return common.NewError("no keys to rotate")
+		}
+		for _, kind := range request.Kinds {
+			switch kind {
+			case RotateRealityKey, RotateRealityShortId, RotateEch:
+			default:
+				return common.NewErrorf("unknown key to rotate: %s", kind)
+			}
+		}
+		var rotation model.TlsRotation
+		err = db.Model(model.TlsRotation{}).Where("tls_id = ?", request.TlsId).Find(&rotation).Error
+		if err != nil {
+			return err
+		}
+		// Without a policy, old keys are replaced at once
+		rotation.TlsId = request.TlsId
+		return s.rotateTls(&rotation, request.Kinds, loginUser, hostname)
+	default:
+		return common.NewErrorf("unknown action: %s", act)
+	}
+	return nil
+}
+
+func (s *ConfigService) recordTlsRotation(tx *gorm.DB, act string, data json.RawMessage, loginUser string) error {
+	return tx.Create(&model.Changes{
+		DateTime: time.Now().Unix(),
+		Actor:    loginUser,
+		Key:      "tlsRotation",
+		Action:   act,
+		Obj:      data,
+	}).Error
+}
+
+// validateTlsRotation checks the keys of a policy exist in its tls profile, and stores it.
+// Intervals start when they are set.
+func (s *ConfigService) validateTlsRotation(tx *gorm.DB, rotation *model.TlsRotation) error {
+	if rotation.RealityKey < 0 || rotation.RealityShortId < 0 || rotation.Ech < 0 || rotation.Overlap < 0 {
+		return common.NewError("days and hours of rotation can not be negative")
+	}
+	if rotation.RealityKey == 0 && rotation.RealityShortId == 0 && rotation.Ech == 0 {
+		return common.NewError("no keys to rotate")
+	}
+	var tlsProfile model.Tls
+	err := tx.Model(model.Tls{}).Where("id = ?", rotation.TlsId).First(&tlsProfile).Error
+	if err != nil {
+		return common.NewErrorf("tls %d not found", rotation.TlsId)
+	}
+	server, client, err := tlsMaps(&tlsProfile)
+	if err != nil {
+		return err
+	}
+	if rotation.RealityKey > 0 || rotation.RealityShortId > 0 {
+		_, _, err = realityMaps(server, client)
+		if err != nil {
+			return err
+		}
+	}
+	if rotation.Ech > 0 {
+		_, _, err = echMaps(server, client)
+		if err != nil {
+			return err
+		}
+	}
+
+	var old model.TlsRotation
+	err = tx.Model(model.TlsRotation{}).Where("tls_id = ?", rotation.TlsId).Find(&old).Error
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	rotation.Id = old.Id
+	rotation.OverlapUntil = old.OverlapUntil
+	rotation.LastRealityKey = lastRotation(rotation.RealityKey, old.LastRealityKey, now)
+	rotation.LastRealityShortId = lastRotation(rotation.RealityShortId, old.LastRealityShortId, now)
+	rotation.LastEch = lastRotation(rotation.Ech, old.LastEch, now)
+	return tx.Save(rotation).Error
+}
+
+func lastRotation(days int, last int64, now int64) int64 {
+	if days == 0 {
+		return 0
+	}
+	if last == 0 {
+		return now
+	}
+	return last
+}
+
+// RotateTlsKeys replaces keys whose days have passed, and removes old ones after their overlap
+func (s *ConfigService) RotateTlsKeys() error {
+	rotations, err := s.GetTlsRotations()
+	if err != nil {
+		return err
+	}
+	hostname := s.jobHostname()
+	now := time.Now().Unix()
+	for i := range rotations {
+		rotation := &rotations[i]
+		var kinds []string
+		for _, due := range []struct {
+			kind string
+			days int
+			last int64
+		}{
+			{RotateRealityKey, rotation.RealityKey, rotation.LastRealityKey},
+			{RotateRealityShortId, rotation.RealityShortId, rotation.LastRealityShortId},
+			{RotateEch, rotation.Ech, rotation.LastEch},
+		} {
+			if due.days > 0 && now >= due.last+int64(due.days)*86400 {
+				kinds = append(kinds, due.kind)
+			}
+		}
+		if len(kinds) == 0 && (rotation.OverlapUntil == 0 || now < rotation.OverlapUntil) {
+			continue
+		}
+		err = s.rotateTls(rotation, kinds, "RotateJob", hostname)
+		if err != nil {
+			logger.Warning("rotate keys of tls ", rotation.TlsId, " failed: ", err)
+		}
+	}
+	return nil
+}
+
+// jobHostname is the host of links which jobs generate, where requests of the panel use their own host
+func (s *ConfigService) jobHostname() string {
+	for _, key := range []string{"subDomain", "webDomain"} {
+		hostname, _ := s.SettingService.getString(database.GetDB(), key)
+		if hostname != "" {
+			return hostname
+		}
+	}
+	return ""
+}
+
+// rotateTls replaces keys of kinds in a tls profile, and drops old keys whose overlap ended.
+// The profile is saved like an edit, which updates links and out_json of its inbounds and records the change.
+func (s *ConfigService) rotateTls(rotation *model.TlsRotation, kinds []string, actor string, hostname string) error {
+	db := database.GetDB()
+	var tlsProfile model.Tls
+	err := db.Model(model.Tls{}).Where("id = ?", rotation.TlsId).First(&tlsProfile).Error
+	if err != nil {
+		return common.NewErrorf("tls %d not found", rotation.TlsId)
+	}
+	server, client, err := tlsMaps(&tlsProfile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	if rotation.OverlapUntil > 0 && now >= rotation.OverlapUntil {
+		err = dropOldKeys(server, client)
+		if err != nil {
+			return err
+		}
+		rotation.OverlapUntil = 0
+	}
+	keepOld := rotation.Overlap > 0
+	for _, kind := range kinds {
+		switch kind {
+		case RotateRealityKey:
+			err = rotateRealityKey(server, client)
+			rotation.LastRealityKey = now
+		case RotateRealityShortId:
+			err = rotateRealityShortId(server, client, keepOld)
+			rotation.LastRealityShortId = now
+		case RotateEch:
+			err = rotateEch(server, client, keepOld)
+			rotation.LastEch = now
+		}
+		if err != nil {
+			return err
+		}
+		if keepOld && kind != RotateRealityKey {
+			rotation.OverlapUntil = now + int64(rotation.Overlap)*3600
+		}
+	}
+
+	tlsProfile.Server, err = json.MarshalIndent(server, "", "  ")
+	if err != nil {
+		return err
+	}
+	tlsProfile.Client, err = json.MarshalIndent(client, "", "  ")
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(tlsProfile)
+	if err != nil {
+		return err
+	}
+	_, check, err := s.Save("tls", "edit", data, "", actor, hostname, false)
+	if err != nil {
+		return err
+	}
+	if check != nil {
+		for _, warning := range check.Warnings {
+			logger.Warning("tls ", tlsProfile.Name, ": ", warning)
+		}
+	}
+	if len(kinds) > 0 {
+		logger.Info("rotated ", strings.Join(kinds, ", "), " of tls ", tlsProfile.Name)
+	}
+	if rotation.Id == 0 {
+		// Rotated at once without a policy
+		return nil
+	}
+	return db.Save(rotation).Error
+}
+
+func tlsMaps(tlsProfile *model.Tls) (map[string]interface{}, map[string]interface{}, error) {
+	server := map[string]interface{}{}
+	client := map[string]interface{}{}
+	if len(tlsProfile.Server) > 0 {
+		err := json.Unmarshal(tlsProfile.Server, &server)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(tlsProfile.Client) > 0 && string(tlsProfile.Client) != "null" {
+		err := json.Unmarshal(tlsProfile.Client, &client)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return server, client, nil
+}
+
+func realityMaps(server map[string]interface{}, client map[string]interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	serverReality, _ := server["reality"].(map[string]interface{})
+	if enabled, _ := serverReality["enabled"].(bool); !enabled {
+		return nil, nil, common.NewError("reality is not enabled in tls")
+	}
+	clientReality, _ := client["reality"].(map[string]interface{})
+	if clientReality == nil {
+		clientReality = map[string]interface{}{}
+		client["reality"] = clientReality
+	}
+	return serverReality, clientReality, nil
+}
+
+func echMaps(server map[string]interface{}, client map[string]interface{}) (map[string]interface{}, map[string]interface{}, error) {
+	serverEch, _ := server["ech"].(map[string]interface{})
+	if enabled, _ := serverEch["enabled"].(bool); !enabled {
+		return nil, nil, common.NewError("ech is not enabled in tls")
+	}
+	if keyPath, _ := serverEch["key_path"].(string); keyPath != "" {
+		return nil, nil, common.NewError("ech key in a file can not rotate")
+	}
+	if serverName, _ := server["server_name"].(string); serverName == "" {
+		return nil, nil, common.NewError("ech needs the server name of tls")
+	}
+	clientEch, _ := client["ech"].(map[string]interface{})
+	if clientEch == nil {
+		clientEch = map[string]interface{}{}
+		client["ech"] = clientEch
+	}
+	return serverEch, clientEch, nil
+}
+
+func rotateRealityKey(server map[string]interface{}, client map[string]interface{}) error {
+	serverReality, clientReality, err := realityMaps(server, client)
+	if err != nil {
+		return err
+	}
+	serverService := ServerService{}
+	keys, err := serverService.generateRealityKeyPair()
+	if err != nil {
+		return err
+	}
+	serverReality["private_key"] = keys[0]
+	clientReality["public_key"] = keys[1]
+	return nil
+}
+
+// rotateRealityShortId gives clients a new short id, which the server accepts before the old ones if they are kept
+func rotateRealityShortId(server map[string]interface{}, client map[string]interface{}, keepOld bool) error {
+	serverReality, clientReality, err := realityMaps(server, client)
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 8)
+	_, err = rand.Read(random)
+	if err != nil {
+		return err
+	}
+	shortId := hex.EncodeToString(random)
+	shortIds := []interface{}{shortId}
+	if keepOld {
+		old, _ := serverReality["short_id"].([]interface{})
+		shortIds = append(shortIds, old...)
+	}
+	serverReality["short_id"] = shortIds
+	clientReality["short_id"] = shortId
+	return nil
+}
+
+// rotateEch gives clients a new ECH config. Its keys get config ids which old keys do not use,
+// so the server tells them apart while it accepts both.
+func rotateEch(server map[string]interface{}, client map[string]interface{}, keepOld bool) error {
+	serverEch, clientEch, err := echMaps(server, client)
+	if err != nil {
+		return err
+	}
+	oldKeys, err := echKeys(serverEch["key"])
+	if err != nil {
+		return err
+	}
+	usedIds := map[byte]bool{}
+	for _, key := range oldKeys {
+		usedIds[key.config[4]] = true
+	}
+	serverName, _ := server["server_name"].(string)
+	pqEnabled, _ := serverEch["pq_signature_schemes_enabled"].(bool)
+	_, keyPem, err := tls.ECHKeygenDefault(serverName, pqEnabled)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode([]byte(keyPem))
+	if block == nil {
+		return common.NewError("failed to generate ech keys")
+	}
+	newKeys, err := parseEchKeys(block.Bytes)
+	if err != nil {
+		return err
+	}
+	var id byte
+	for _, key := range newKeys {
+		for usedIds[id] {
+			id++
+		}
+		usedIds[id] = true
+		key.config[4] = id
+	}
+
+	var configs []byte
+	for _, key := range newKeys {
+		configs = append(configs, key.config...)
+	}
+	keys := newKeys
+	if keepOld {
+		keys = append(keys, oldKeys...)
+	}
+	serverEch["key"] = echPemLines("ECH KEYS", marshalEchKeys(keys))
+	clientEch["config"] = echPemLines("ECH CONFIGS", binary.BigEndian.AppendUint16(nil, uint16(len(configs))), configs)
+	delete(clientEch, "config_path")
+	return nil
+}
+
+// dropOldKeys keeps only the reality short id and ECH configs which clients have
+func dropOldKeys(server map[string]interface{}, client map[string]interface{}) error {
+	if serverReality, clientReality, err := realityMaps(server, client); err == nil {
+		if shortId, _ := clientReality["short_id"].(string); shortId != "" {
+			serverReality["short_id"] = []interface{}{shortId}
+		}
+	}
+	serverEch, clientEch, err := echMaps(server, client)
+	if err != nil {
+		return nil
+	}
+	keys, err := echKeys(serverEch["key"])
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	clientIds, err := echConfigIds(clientEch["config"])
+	if err != nil || len(clientIds) == 0 {
+		return err
+	}
+	var current []*echKey
+	for _, key := range keys {
+		if clientIds[key.config[4]] {
+			current = append(current, key)
+		}
+	}
+	if len(current) > 0 {
+		serverEch["key"] = echPemLines("ECH KEYS", marshalEchKeys(current))
+	}
+	return nil
+}
+
+// echKey is a private key with its config, where the config id is the byte at index 4
+type echKey struct {
+	private []byte
+	config  []byte
+}
+
+func pemBlock(lines interface{}, blockType string) ([]byte, error) {
+	var text string
+	switch value := lines.(type) {
+	case string:
+		text = value
+	case []interface{}:
+		parts := make([]string, len(value))
+		for i, line := range value {
+			parts[i], _ = line.(string)
+		}
+		text = strings.Join(parts, "\n")
+	}
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(text))
+	if block == nil || block.Type != blockType {
+		return nil, common.NewErrorf("invalid %s", strings.ToLower(blockType))
+	}
+	return block.Bytes, nil
+}
+
+func echKeys(lines interface{}) ([]*echKey, error) {
+	data, err := pemBlock(lines, "ECH KEYS")
+	if err != nil {
+		return nil, err
+	}
+	return parseEchKeys(data)
+}
+
+// parseEchKeys reads keys, each of them a private key and a config with 16 bit lengths
+func parseEchKeys(data []byte) ([]*echKey, error) {
+	var keys []*echKey
+	for len(data) > 0 {
+		var parts [2][]byte
+		for i := range parts {
+			if len(data) < 2 || len(data) < 2+int(binary.BigEndian.Uint16(data)) {
+				return nil, common.NewError("invalid ech keys")
+			}
+			length := int(binary.BigEndian.Uint16(data))
+			parts[i] = data[2 : 2+length]
+			data = data[2+length:]
+		}
+		if len(parts[1]) < 5 {
+			return nil, common.NewError("invalid ech config")
+		}
+		keys = append(keys, &echKey{private: parts[0], config: parts[1]})
+	}
+	return keys, nil
+}
+
+func marshalEchKeys(keys []*echKey) []byte {
+	var data []byte
+	for _, key := range keys {
+		data = binary.BigEndian.AppendUint16(data, uint16(len(key.private)))
+		data = append(data, key.private...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(key.config)))
+		data = append(data, key.config...)
+	}
+	return data
+}
+
+// echConfigIds reads ids of an ECH config list, which has a 16 bit length, then configs of version, length and contents
+func echConfigIds(lines interface{}) (map[byte]bool, error) {
+	data, err := pemBlock(lines, "ECH CONFIGS")
+	if err != nil || len(data) < 2 {
+		return nil, err
+	}
+	data = data[2:]
+	ids := map[byte]bool{}
+	for len(data) >= 5 {
+		length := int(binary.BigEndian.Uint16(data[2:]))
+		if len(data) < 4+length {
+			return nil, common.NewError("invalid ech configs")
+		}
+		ids[data[4]] = true
+		data = data[4+length:]
+	}
+	return ids, nil
+}
+
+// echPemLines is a pem block in lines, like sing-box options take it
+func echPemLines(blockType string, parts ...[]byte) []interface{} {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+	text := strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data})))
+	lines := []interface{}{}
+	for _, line := range strings.Split(text, "\n") {
+		lines = append(lines, line)
+	}
+	return lines
+}
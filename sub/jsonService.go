@@ -44,6 +44,7 @@ const defaultJson = `
 type JsonService struct {
 	service.SettingService
 	LinkService
+	service.CaService
 }
 
 func (j *JsonService) GetJson(subId string, format string) (*string, error) {
@@ -61,10 +62,11 @@ func (j *JsonService) GetJson(subId string, format string) (*string, error) {
 
 	links := j.LinkService.GetLinks(&client.Links, "external", "")
 	for index, link := range links {
-		json, tag, err := util.GetOutbound(link, index)
-		if err == nil && len(tag) > 0 {
-			*outbounds = append(*outbounds, *json)
-			*outTags = append(*outTags, tag)
+		jsons, tags, err := util.GetOutbounds(link, index)
+		if err == nil && len(tags[0]) > 0 {
+			// Only the main outbound is selectable, the rest are its detours
+			*outbounds = append(*outbounds, jsons...)
+			*outTags = append(*outTags, tags[0])
 		}
 	}
 
@@ -87,8 +89,7 @@ func (j *JsonService) GetJson(subId string, format string) (*string, error) {
 
 func (j *JsonService) getData(subId string) (*model.Client, []*model.Inbound, error) {
 	db := database.GetDB()
-	client := &model.Client{}
-	err := db.Model(model.Client{}).Where("enable = true and name = ?", subId).First(client).Error
+	client, err := findClient(subId, true)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -131,6 +132,13 @@ func (j *JsonService) getOutbounds(clientConfig json.RawMessage, inbounds []*mod
 			}
 			outbound[key] = value
 		}
+		// Trust the internal CA instead of skipping verification
+		if outTls, ok := outbound["tls"].(map[string]interface{}); ok {
+			if root := j.CaService.TrustedRoot(inData.Tls); root != nil {
+				outTls["certificate"] = root
+				delete(outTls, "insecure")
+			}
+		}
 
 		var addrs []map[string]interface{}
 		err = json.Unmarshal(inData.Addrs, &addrs)
@@ -0,0 +1,293 @@
+package sub
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"s-ui/database"
+	"s-ui/database/model"
+	"s-ui/logger"
+	"s-ui/service"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+//go:embed html/*
+var portalContent embed.FS
+
+var portalTemplate = template.Must(template.ParseFS(portalContent, "html/portal.html"))
+
+// maxPortalHours limits the traffic history of the portal to the default age of stats,
+// which is drawn in about portalPoints points
+const (
+	maxPortalHours = 30 * 24
+	portalPoints   = 120
+)
+
+type PortalLink struct {
+	Remark   string `json:"remark"`
+	Protocol string `json:"protocol"`
+	Uri      string `json:"uri"`
+}
+
+type PortalInfo struct {
+	Name         string                 `json:"name"`
+	Enable       bool                   `json:"enable"`
+	Up           int64                  `json:"up"`
+	Down         int64                  `json:"down"`
+	Volume       int64                  `json:"volume"`
+	Expiry       int64                  `json:"expiry"`
+	Limited      string                 `json:"limited,omitempty"`
+	ThrottleKbps int64                  `json:"throttleKbps,omitempty"`
+	GraceUntil   int64                  `json:"graceUntil,omitempty"`
+	SubUrl       string                 `json:"subUrl"`
+	PortalUrl    string                 `json:"portalUrl"`
+	Links        []PortalLink           `json:"links"`
+	Notices      []service.PortalNotice `json:"notices"`
+}
+
+type PortalTraffic struct {
+	DateTime int64 `json:"dateTime"`
+	Up       int64 `json:"up"`
+	Down     int64 `json:"down"`
+}
+
+// PortalHandler serves the self-service page of clients, who are known by their subscription id
+type PortalHandler struct {
+	service.SettingService
+	service.StatsService
+	SubService
+	configService service.ConfigService
+	clientService service.ClientService
+}
+
+func NewPortalHandler(g *gin.RouterGroup) {
+	a := &PortalHandler{}
+	a.initRouter(g)
+}
+
+func (s *PortalHandler) initRouter(g *gin.RouterGroup) {
+	g = g.Group("/:subid/portal")
+	g.Use(s.checkEnabled)
+	g.GET("", s.page)
+	g.GET("/info", s.info)
+	g.GET("/stats", s.stats)
+	g.GET("/qr", s.qr)
+	g.POST("/rotate", s.rotate)
+}
+
+func (s *PortalHandler) checkEnabled(c *gin.Context) {
+	enabled, err := s.SettingService.GetSubPortal()
+	if err != nil || !enabled {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	c.Next()
+}
+
+// getClient finds the client of the subscription token, disabled ones too so they can see why.
+// Unlike subscriptions, the portal is never found by the name of the client.
+func (s *PortalHandler) getClient(c *gin.Context) *model.Client {
+	client := &model.Client{}
+	err := database.GetDB().Model(model.Client{}).Where("sub_token = ?", c.Param("subid")).First(client).Error
+	if err != nil {
+		c.AbortWithStatus(http.StatusNotFound)
+		return nil
+	}
+	return client
+}
+
+func (s *PortalHandler) page(c *gin.Context) {
+	client := s.getClient(c)
+	if client == nil {
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	err := portalTemplate.Execute(c.Writer, map[string]string{"Name": client.Name})
+	if err != nil {
+		logger.Warning("portal: ", err)
+	}
+}
+
+func (s *PortalHandler) info(c *gin.Context) {
+	client := s.getClient(c)
+	if client == nil {
+		return
+	}
+	info, err := s.getInfo(c, client)
+	if err != nil {
+		logger.Warning("portal: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
+
+func (s *PortalHandler) getInfo(c *gin.Context, client *model.Client) (*PortalInfo, error) {
+	status, err := s.clientService.GetQuotaStatus(client)
+	if err != nil {
+		return nil, err
+	}
+	notices, err := s.SettingService.GetPortalNotices()
+	if err != nil {
+		return nil, err
+	}
+	info := &PortalInfo{
+		Name:         client.Name,
+		Enable:       client.Enable,
+		Up:           client.Up,
+		Down:         client.Down,
+		Volume:       client.Volume,
+		Expiry:       client.Expiry,
+		Limited:      status.Limited,
+		ThrottleKbps: status.ThrottleKbps,
+		GraceUntil:   status.GraceUntil,
+		SubUrl:       s.subUrl(c, client.SubToken),
+		PortalUrl:    s.subUrl(c, client.SubToken) + "/portal",
+		Links:        []PortalLink{},
+		Notices:      notices,
+	}
+	if !client.Enable {
+		return info, nil
+	}
+	uris := s.LinkService.GetLinks(&client.Links, "all", "")
+	wgLinks, _, err := s.getWireguardLinks(client, getHostname(c))
+	if err != nil {
+		return nil, err
+	}
+	for _, uri := range append(uris, wgLinks...) {
+		link := PortalLink{Uri: uri}
+		if scheme, rest, ok := strings.Cut(uri, "://"); ok {
+			link.Protocol = scheme
+			if _, remark, ok := strings.Cut(rest, "#"); ok {
+				link.Remark, _ = url.PathUnescape(remark)
+			}
+		}
+		info.Links = append(info.Links, link)
+	}
+	return info, nil
+}
+
+// subUrl is the subscription link of a client token, on subURI if it is set
+func (s *PortalHandler) subUrl(c *gin.Context, token string) string {
+	subURI, _ := s.SettingService.GetSubURI()
+	if subURI == "" {
+		subPath, _ := s.SettingService.GetSubPath()
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		subURI = scheme + "://" + c.Request.Host + subPath
+	}
+	return subURI + url.PathEscape(token)
+}
+
+// stats sums traffic of the client in the last hours, over periods of equal length
+func (s *PortalHandler) stats(c *gin.Context) {
+	client := s.getClient(c)
+	if client == nil {
+		return
+	}
+	hours, _ := strconv.Atoi(c.DefaultQuery("hours", "24"))
+	if hours < 1 || hours > maxPortalHours {
+		hours = 24
+	}
+	stats, err := s.StatsService.GetStats("user", client.Name, hours)
+	if err != nil {
+		logger.Warning("portal: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	step := int64(hours) * 3600 / portalPoints
+	points := map[int64]*PortalTraffic{}
+	for _, stat := range stats {
+		dateTime := stat.DateTime - stat.DateTime%step
+		point, ok := points[dateTime]
+		if !ok {
+			point = &PortalTraffic{DateTime: dateTime}
+			points[dateTime] = point
+		}
+		if stat.Direction {
+			point.Up += stat.Traffic
+		} else {
+			point.Down += stat.Traffic
+		}
+	}
+	result := make([]PortalTraffic, 0, len(points))
+	for _, point := range points {
+		result = append(result, *point)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].DateTime < result[j].DateTime })
+	c.JSON(http.StatusOK, result)
+}
+
+// qr draws the subscription link, or the link at index "link" of the info
+func (s *PortalHandler) qr(c *gin.Context) {
+	client := s.getClient(c)
+	if client == nil {
+		return
+	}
+	content := s.subUrl(c, client.SubToken)
+	if index, ok := c.GetQuery("link"); ok {
+		info, err := s.getInfo(c, client)
+		if err != nil {
+			logger.Warning("portal: ", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		i, err := strconv.Atoi(index)
+		if err != nil || i < 0 || i >= len(info.Links) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		content = info.Links[i].Uri
+	}
+	png, err := qrcode.Encode(content, qrcode.Medium, 320)
+	if err != nil {
+		logger.Warning("portal: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// rotate gives the client new secrets and a new token, and returns its info with the new portal link.
+// The custom header keeps other sites from posting it.
+func (s *PortalHandler) rotate(c *gin.Context) {
+	if c.GetHeader("X-Requested-With") != "XMLHttpRequest" {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	client := s.getClient(c)
+	if client == nil {
+		return
+	}
+	if !client.Enable {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	err := s.configService.RotateClient(client.Name, getHostname(c))
+	if err != nil {
+		logger.Warning("portal: failed to rotate client ", client.Name, ": ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	err = database.GetDB().Model(model.Client{}).Where("id = ?", client.Id).First(client).Error
+	if err != nil {
+		logger.Warning("portal: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	info, err := s.getInfo(c, client)
+	if err != nil {
+		logger.Warning("portal: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, info)
+}
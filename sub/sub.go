@@ -60,6 +60,7 @@ func (s *Server) initRouter() (*gin.Engine, error) {
 
 	g := engine.Group(subPath)
 	NewSubHandler(g)
+	NewPortalHandler(g)
 
 	return engine, nil
 }
@@ -85,6 +86,10 @@ func (s *Server) Start() (err error) {
 	if err != nil {
 		return err
 	}
+	acmeDomain, err := s.SettingService.GetSubAcme()
+	if err != nil {
+		return err
+	}
 	listen, err := s.SettingService.GetSubListen()
 	if err != nil {
 		return err
@@ -100,20 +105,25 @@ func (s *Server) Start() (err error) {
 		return err
 	}
 
-	if certFile != "" || keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	isHttps := acmeDomain != "" || certFile != "" || keyFile != ""
+	if isHttps {
+		var c *tls.Config
+		if acmeDomain != "" {
+			acmeService := service.AcmeService{}
+			c, err = acmeService.AcmeTlsConfig(acmeDomain)
+		} else {
+			certService := service.CertService{}
+			c, err = certService.KeyPairTlsConfig("sub", certFile, keyFile)
+		}
 		if err != nil {
 			listener.Close()
 			return err
 		}
-		c := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
 		listener = network.NewAutoHttpsListener(listener)
 		listener = tls.NewListener(listener, c)
 	}
 
-	if certFile != "" || keyFile != "" {
+	if isHttps {
 		logger.Info("Sub server run https on", listener.Addr())
 	} else {
 		logger.Info("Sub server run http on", listener.Addr())
@@ -133,6 +143,8 @@ func (s *Server) Start() (err error) {
 
 func (s *Server) Stop() error {
 	s.cancel()
+	certService := service.CertService{}
+	certService.ReleaseKeyPair("sub")
 	var err error
 	if s.httpServer != nil {
 		err = s.httpServer.Shutdown(s.ctx)
@@ -1,8 +1,10 @@
 package sub
 
 import (
+	"net"
 	"s-ui/logger"
 	"s-ui/service"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -11,6 +13,7 @@ type SubHandler struct {
 	service.SettingService
 	SubService
 	JsonService
+	service.CaService
 }
 
 func NewSubHandler(g *gin.RouterGroup) {
@@ -19,13 +22,40 @@ func NewSubHandler(g *gin.RouterGroup) {
 }
 
 func (s *SubHandler) initRouter(g *gin.RouterGroup) {
+	g.GET("/ca.crt", s.caRoot)
 	g.GET("/:subid", s.subs)
 }
 
+// caRoot publishes the root of the internal CA, for clients to trust
+func (s *SubHandler) caRoot(c *gin.Context) {
+	rootPem, err := s.CaService.GetRootPem()
+	if err != nil {
+		logger.Error(err)
+		c.String(400, "Error!")
+		return
+	}
+	if rootPem == "" {
+		c.String(404, "Not found")
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=ca.crt")
+	c.Data(200, "application/x-x509-ca-cert", []byte(rootPem))
+}
+
 func (s *SubHandler) subs(c *gin.Context) {
 	subId := c.Param("subid")
+	hostname := getHostname(c)
 	format, isFormat := c.GetQuery("format")
-	if isFormat {
+	if format == "wireguard" {
+		result, err := s.SubService.GetWireguardConfs(subId, hostname)
+		if err != nil || result == nil {
+			logger.Error(err)
+			c.String(400, "Error!")
+		} else {
+			c.Header("Content-Disposition", "attachment; filename="+subId+".conf")
+			c.String(200, *result)
+		}
+	} else if isFormat {
 		result, err := s.JsonService.GetJson(subId, format)
 		if err != nil || result == nil {
 			logger.Error(err)
@@ -34,7 +64,7 @@ func (s *SubHandler) subs(c *gin.Context) {
 			c.String(200, *result)
 		}
 	} else {
-		result, headers, err := s.SubService.GetSubs(subId)
+		result, headers, err := s.SubService.GetSubs(subId, hostname)
 		if err != nil || result == nil {
 			logger.Error(err)
 			c.String(400, "Error!")
@@ -49,3 +79,11 @@ func (s *SubHandler) subs(c *gin.Context) {
 		}
 	}
 }
+
+func getHostname(c *gin.Context) string {
+	host := c.Request.Host
+	if colonIndex := strings.LastIndex(host, ":"); colonIndex != -1 {
+		host, _, _ = net.SplitHostPort(c.Request.Host)
+	}
+	return host
+}
@@ -6,8 +6,12 @@ import (
 	"s-ui/database"
 	"s-ui/database/model"
 	"s-ui/service"
+	"s-ui/util"
+	"s-ui/util/common"
 	"strings"
 	"time"
+
+	"gorm.io/gorm"
 )
 
 type SubService struct {
@@ -15,12 +19,29 @@ type SubService struct {
 	LinkService
 }
 
-func (s *SubService) GetSubs(subId string) (*string, []string, error) {
-	var err error
-
+// findClient finds the client of a subscription id, which is its token, or its name while subByName is on
+// and the client has not rotated since it got its token. With enabled, disabled clients are not found.
+func findClient(subId string, enabled bool) (*model.Client, error) {
 	db := database.GetDB()
 	client := &model.Client{}
-	err = db.Model(model.Client{}).Where("enable = true and name = ?", subId).First(client).Error
+	err := db.Model(model.Client{}).Where("sub_token = ?", subId).First(client).Error
+	if database.IsNotFound(err) {
+		settingService := service.SettingService{}
+		if byName, _ := settingService.GetSubByName(); byName {
+			err = db.Model(model.Client{}).Where("name = ? AND sub_by_name = ?", subId, true).First(client).Error
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabled && !client.Enable {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return client, nil
+}
+
+func (s *SubService) GetSubs(subId string, hostname string) (*string, []string, error) {
+	client, err := findClient(subId, true)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -32,13 +53,20 @@ func (s *SubService) GetSubs(subId string) (*string, []string, error) {
 	}
 
 	linksArray := s.LinkService.GetLinks(&client.Links, "all", clientInfo)
+	wgLinks, _, err := s.getWireguardLinks(client, hostname)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, wgLink := range wgLinks {
+		linksArray = append(linksArray, s.LinkService.addClientInfo(wgLink, clientInfo))
+	}
 	result := strings.Join(linksArray, "\n")
 
 	var headers []string
 	updateInterval, _ := s.SettingService.GetSubUpdates()
 	headers = append(headers, fmt.Sprintf("upload=%d; download=%d; total=%d; expire=%d", client.Up, client.Down, client.Volume, client.Expiry))
 	headers = append(headers, fmt.Sprintf("%d", updateInterval))
-	headers = append(headers, subId)
+	headers = append(headers, client.Name)
 
 	subEncode, _ := s.SettingService.GetSubEncode()
 	if subEncode {
@@ -48,15 +76,62 @@ func (s *SubService) GetSubs(subId string) (*string, []string, error) {
 	return &result, headers, nil
 }
 
+func (s *SubService) GetWireguardConfs(subId string, hostname string) (*string, error) {
+	client, err := findClient(subId, true)
+	if err != nil {
+		return nil, err
+	}
+	_, confs, err := s.getWireguardLinks(client, hostname)
+	if err != nil {
+		return nil, err
+	}
+	if len(confs) == 0 {
+		return nil, common.NewError("no wireguard peer for client ", client.Name)
+	}
+	result := strings.Join(confs, "\n")
+	return &result, nil
+}
+
+func (s *SubService) getWireguardLinks(c *model.Client, hostname string) ([]string, []string, error) {
+	var endpoints []model.Endpoint
+	err := database.GetDB().Model(model.Endpoint{}).Where("type = ?", "wireguard").Find(&endpoints).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	var links, confs []string
+	for _, endpoint := range endpoints {
+		epLinks, epConfs := util.WireguardLinks(&endpoint, c.Name, hostname)
+		links = append(links, epLinks...)
+		confs = append(confs, epConfs...)
+	}
+	return links, confs, nil
+}
+
 func (s *SubService) getClientInfo(c *model.Client) string {
 	now := time.Now().Unix()
 
+	clientService := service.ClientService{}
+	status, err := clientService.GetQuotaStatus(c)
+	if err != nil {
+		status = &service.QuotaStatus{Limited: c.Limited}
+	}
+
 	var result []string
 	if vol := c.Volume - (c.Up + c.Down); vol > 0 {
 		result = append(result, fmt.Sprintf("%s%s", s.formatTraffic(vol), "📊"))
 	}
+	switch status.Limited {
+	case service.QuotaThrottle:
+		result = append(result, fmt.Sprintf("%dkbps🐢", status.ThrottleKbps))
+	case service.QuotaRedirect:
+		result = append(result, "🚫")
+	}
 	if c.Expiry > 0 {
-		result = append(result, fmt.Sprintf("%d%s⏳", (c.Expiry-now)/86400, "Days"))
+		if c.Expiry < now && status.GraceUntil > now {
+			result = append(result, fmt.Sprintf("%d%s⌛", (status.GraceUntil-now)/86400, "Days"))
+		} else {
+			result = append(result, fmt.Sprintf("%d%s⏳", (c.Expiry-now)/86400, "Days"))
+		}
 	}
 	if len(result) > 0 {
 		return " " + strings.Join(result, " ")
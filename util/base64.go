@@ -2,9 +2,17 @@ package util
 
 import "encoding/base64"
 
+// Links are encoded with any of padded, unpadded, standard or url-safe alphabets
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.RawStdEncoding,
+	base64.URLEncoding,
+	base64.RawURLEncoding,
+}
+
 // Function to return decoded bytes if a string is Base64 encoded
 func StrOrBase64Encoded(str string) string {
-	decoded, err := base64.StdEncoding.DecodeString(str)
+	decoded, err := B64StrToByte(str)
 	if err == nil {
 		return string(decoded)
 	}
@@ -12,7 +20,15 @@ func StrOrBase64Encoded(str string) string {
 }
 
 func B64StrToByte(str string) ([]byte, error) {
-	return base64.StdEncoding.DecodeString(str)
+	var err error
+	for _, encoding := range base64Encodings {
+		var decoded []byte
+		decoded, err = encoding.DecodeString(str)
+		if err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, err
 }
 
 func ByteToB64Str(b []byte) string {
@@ -4,13 +4,17 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net"
 	"net/url"
 	"s-ui/database/model"
 	"s-ui/util/common"
 	"strings"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-var InboundTypeWithLink = []string{"shadowsocks", "naive", "hysteria", "hysteria2", "tuic", "vless", "trojan", "vmess"}
+var InboundTypeWithLink = []string{"socks", "http", "mixed", "shadowsocks", "shadowtls", "naive", "hysteria", "hysteria2", "tuic", "vless", "trojan", "vmess"}
 
 func LinkGenerator(clientConfig json.RawMessage, i *model.Inbound, hostname string) []string {
 	inbound, err := i.MarshalFull()
@@ -18,9 +22,55 @@ func LinkGenerator(clientConfig json.RawMessage, i *model.Inbound, hostname stri
 		return []string{}
 	}
 
-	var tls map[string]interface{}
-	if i.TlsId > 0 {
-		tls = prepareTls(i.Tls)
+	var userConfig map[string]map[string]interface{}
+	if err := json.Unmarshal(clientConfig, &userConfig); err != nil {
+		return []string{}
+	}
+
+	Addrs := prepareAddrs(i, *inbound, hostname)
+
+	switch i.Type {
+	case "socks":
+		return socksLink(userConfig["socks"], Addrs)
+	case "http":
+		return httpLink(userConfig["http"], Addrs)
+	case "mixed":
+		return append(socksLink(userConfig["mixed"], Addrs), httpLink(userConfig["mixed"], Addrs)...)
+	case "shadowsocks":
+		return shadowsocksLink(userConfig, *inbound, Addrs)
+	case "naive":
+		return naiveLink(userConfig["naive"], *inbound, Addrs)
+	case "hysteria":
+		return hysteriaLink(userConfig["hysteria"], *inbound, Addrs)
+	case "hysteria2":
+		return hysteria2Link(userConfig["hysteria2"], *inbound, Addrs)
+	case "tuic":
+		return tuicLink(userConfig["tuic"], *inbound, Addrs)
+	case "vless":
+		return vlessLink(userConfig["vless"], *inbound, Addrs)
+	case "trojan":
+		return trojanLink(userConfig["trojan"], *inbound, Addrs)
+	case "vmess":
+		return vmessLink(userConfig["vmess"], *inbound, Addrs)
+	}
+
+	return []string{}
+}
+
+// ShadowTlsLinkGenerator generates shadowsocks links wrapped by a shadowtls inbound.
+// detour is the shadowsocks inbound which the shadowtls inbound forwards to, and
+// detourMultiUser reports whether it has clients or runs with its own password only.
+func ShadowTlsLinkGenerator(clientConfig json.RawMessage, i *model.Inbound, detour *model.Inbound, detourMultiUser bool, hostname string) []string {
+	if i.Type != "shadowtls" || detour == nil || detour.Type != "shadowsocks" {
+		return []string{}
+	}
+	inbound, err := i.MarshalFull()
+	if err != nil {
+		return []string{}
+	}
+	detourInbound, err := detour.MarshalFull()
+	if err != nil {
+		return []string{}
 	}
 
 	var userConfig map[string]map[string]interface{}
@@ -28,12 +78,22 @@ func LinkGenerator(clientConfig json.RawMessage, i *model.Inbound, hostname stri
 		return []string{}
 	}
 
+	Addrs := prepareAddrs(i, *inbound, hostname)
+	return shadowTlsLink(userConfig, *inbound, *detourInbound, detourMultiUser, Addrs)
+}
+
+func prepareAddrs(i *model.Inbound, inbound map[string]interface{}, hostname string) []map[string]interface{} {
+	var tls map[string]interface{}
+	if i.TlsId > 0 {
+		tls = prepareTls(i.Tls)
+	}
+
 	var Addrs []map[string]interface{}
 	json.Unmarshal(i.Addrs, &Addrs)
 	if len(Addrs) == 0 {
 		Addrs = append(Addrs, map[string]interface{}{
 			"server":      hostname,
-			"server_port": (*inbound)["listen_port"],
+			"server_port": inbound["listen_port"],
 			"remark":      i.Tag,
 		})
 		if i.TlsId > 0 {
@@ -59,27 +119,7 @@ func LinkGenerator(clientConfig json.RawMessage, i *model.Inbound, hostname stri
 			}
 		}
 	}
-
-	switch i.Type {
-	case "shadowsocks":
-		return shadowsocksLink(userConfig, *inbound, Addrs)
-	case "naive":
-		return naiveLink(userConfig["naive"], *inbound, Addrs)
-	case "hysteria":
-		return hysteriaLink(userConfig["hysteria"], *inbound, Addrs)
-	case "hysteria2":
-		return hysteria2Link(userConfig["hysteria2"], *inbound, Addrs)
-	case "tuic":
-		return tuicLink(userConfig["tuic"], *inbound, Addrs)
-	case "vless":
-		return vlessLink(userConfig["vless"], *inbound, Addrs)
-	case "trojan":
-		return trojanLink(userConfig["trojan"], *inbound, Addrs)
-	case "vmess":
-		return vmessLink(userConfig["vmess"], *inbound, Addrs)
-	}
-
-	return []string{}
+	return Addrs
 }
 
 func prepareTls(t *model.Tls) map[string]interface{} {
@@ -104,31 +144,139 @@ func prepareTls(t *model.Tls) map[string]interface{} {
 	return oTls
 }
 
+func socksLink(
+	userConfig map[string]interface{},
+	addrs []map[string]interface{}) []string {
+
+	username, _ := userConfig["username"].(string)
+	password, _ := userConfig["password"].(string)
+
+	var links []string
+	for _, addr := range addrs {
+		port, _ := addr["server_port"].(float64)
+		URL := &url.URL{
+			Scheme: "socks5",
+			Host:   net.JoinHostPort(addr["server"].(string), fmt.Sprint(uint(port))),
+		}
+		if len(username) > 0 {
+			URL.User = url.UserPassword(username, password)
+		}
+		links = append(links, addParams(URL.String(), map[string]string{}, addr["remark"].(string)))
+	}
+	return links
+}
+
+func httpLink(
+	userConfig map[string]interface{},
+	addrs []map[string]interface{}) []string {
+
+	username, _ := userConfig["username"].(string)
+	password, _ := userConfig["password"].(string)
+
+	var links []string
+	for _, addr := range addrs {
+		params := map[string]string{}
+		scheme := "http"
+		if tls, ok := addr["tls"].(map[string]interface{}); ok {
+			if enabled, _ := tls["enabled"].(bool); enabled {
+				scheme = "https"
+				params = getTlsParams(tls)
+			}
+		}
+		port, _ := addr["server_port"].(float64)
+		URL := &url.URL{
+			Scheme: scheme,
+			Host:   net.JoinHostPort(addr["server"].(string), fmt.Sprint(uint(port))),
+		}
+		if len(username) > 0 {
+			URL.User = url.UserPassword(username, password)
+		}
+		links = append(links, addParams(URL.String(), params, addr["remark"].(string)))
+	}
+	return links
+}
+
 func shadowsocksLink(
 	userConfig map[string]map[string]interface{},
 	inbound map[string]interface{},
 	addrs []map[string]interface{}) []string {
 
+	uriBase := shadowsocksUriBase(userConfig, inbound, true)
+
+	var links []string
+	for _, addr := range addrs {
+		port, _ := addr["server_port"].(float64)
+		uri := fmt.Sprintf("%s@%s:%d", uriBase, addr["server"].(string), uint(port))
+		if remark, ok := addr["remark"].(string); ok && len(remark) > 0 {
+			uri += "#" + url.PathEscape(remark)
+		}
+		links = append(links, uri)
+	}
+	return links
+}
+
+func shadowsocksUriBase(userConfig map[string]map[string]interface{}, inbound map[string]interface{}, multiUser bool) string {
 	var userPass []string
 	method, _ := inbound["method"].(string)
-	if strings.HasPrefix(method, "2022") {
-		inbPass, _ := inbound["password"].(string)
+	inbPass, _ := inbound["password"].(string)
+	if !multiUser {
+		// Single user inbound accepts only its own password
 		userPass = append(userPass, inbPass)
-	}
-	var pass string
-	if method == "2022-blake3-aes-128-gcm" {
-		pass, _ = userConfig["shadowsocks16"]["password"].(string)
 	} else {
-		pass, _ = userConfig["shadowsocks"]["password"].(string)
+		if strings.HasPrefix(method, "2022") {
+			userPass = append(userPass, inbPass)
+		}
+		var pass string
+		if method == "2022-blake3-aes-128-gcm" {
+			pass, _ = userConfig["shadowsocks16"]["password"].(string)
+		} else {
+			pass, _ = userConfig["shadowsocks"]["password"].(string)
+		}
+		userPass = append(userPass, pass)
+	}
+
+	return fmt.Sprintf("ss://%s", toBase64([]byte(fmt.Sprintf("%s:%s", method, strings.Join(userPass, ":")))))
+}
+
+func shadowTlsLink(
+	userConfig map[string]map[string]interface{},
+	inbound map[string]interface{},
+	detour map[string]interface{},
+	detourMultiUser bool,
+	addrs []map[string]interface{}) []string {
+
+	version, _ := inbound["version"].(float64)
+	if version == 0 {
+		version = 1
+	}
+	pluginOpts := []string{"shadow-tls", fmt.Sprintf("version=%d", uint(version))}
+	switch uint(version) {
+	case 2:
+		if password, ok := inbound["password"].(string); ok {
+			pluginOpts = append(pluginOpts, "password="+password)
+		}
+	case 3:
+		if password, ok := userConfig["shadowtls"]["password"].(string); ok {
+			pluginOpts = append(pluginOpts, "password="+password)
+		}
 	}
-	userPass = append(userPass, pass)
+	if handshake, ok := inbound["handshake"].(map[string]interface{}); ok {
+		if server, ok := handshake["server"].(string); ok {
+			pluginOpts = append(pluginOpts, "host="+server)
+		}
+	}
+
+	uriBase := shadowsocksUriBase(userConfig, detour, detourMultiUser)
 
-	uriBase := fmt.Sprintf("ss://%s", toBase64([]byte(fmt.Sprintf("%s:%s", method, strings.Join(userPass, ":")))))
+	params := url.Values{}
+	params.Set("plugin", strings.Join(pluginOpts, ";"))
 
 	var links []string
 	for _, addr := range addrs {
 		port, _ := addr["server_port"].(float64)
-		links = append(links, fmt.Sprintf("%s@%s:%d", uriBase, addr["server"].(string), uint(port)))
+		remark := &url.URL{Fragment: addr["remark"].(string)}
+		// Base64 user info is not always a valid URL, so the query is added manually
+		links = append(links, fmt.Sprintf("%s@%s:%d?%s#%s", uriBase, addr["server"].(string), uint(port), params.Encode(), remark.EscapedFragment()))
 	}
 	return links
 }
@@ -187,11 +335,12 @@ func hysteriaLink(
 
 	for _, addr := range addrs {
 		params := map[string]string{}
-		if upmbps, ok := inbound["up_mbps"].(string); ok {
-			params["up_mbps"] = upmbps
+		// Client's upload is server's download
+		if downmbps, ok := inbound["down_mbps"].(float64); ok && downmbps > 0 {
+			params["upmbps"] = fmt.Sprintf("%d", uint(downmbps))
 		}
-		if downmbps, ok := inbound["down_mbps"].(string); ok {
-			params["down_mbps"] = downmbps
+		if upmbps, ok := inbound["up_mbps"].(float64); ok && upmbps > 0 {
+			params["downmbps"] = fmt.Sprintf("%d", uint(upmbps))
 		}
 		if auth, ok := userConfig["auth_str"].(string); ok {
 			params["auth"] = auth
@@ -213,8 +362,9 @@ func hysteriaLink(
 				params["insecure"] = "1"
 			}
 		}
-		if obfs, ok := inbound["obfs"].(string); ok {
-			params["obfs"] = obfs
+		if obfs, ok := inbound["obfs"].(string); ok && len(obfs) > 0 {
+			params["obfs"] = "xplus"
+			params["obfsParam"] = obfs
 		}
 		if tfo, ok := inbound["tcp_fast_open"].(bool); ok && tfo {
 			params["fastopen"] = "1"
@@ -241,11 +391,12 @@ func hysteria2Link(
 
 	for _, addr := range addrs {
 		params := map[string]string{}
-		if upmbps, ok := inbound["up_mbps"].(string); ok {
-			params["up_mbps"] = upmbps
+		// Client's upload is server's download
+		if downmbps, ok := inbound["down_mbps"].(float64); ok && downmbps > 0 {
+			params["upmbps"] = fmt.Sprintf("%d", uint(downmbps))
 		}
-		if downmbps, ok := inbound["down_mbps"].(string); ok {
-			params["down_mbps"] = downmbps
+		if upmbps, ok := inbound["up_mbps"].(float64); ok && upmbps > 0 {
+			params["downmbps"] = fmt.Sprintf("%d", uint(upmbps))
 		}
 		if tls, ok := addr["tls"].(map[string]interface{}); ok {
 			if sni, ok := tls["server_name"].(string); ok {
@@ -340,7 +491,7 @@ func vlessLink(
 	var links []string
 
 	for _, addr := range addrs {
-		params := baseParams
+		params := maps.Clone(baseParams)
 		if tls, ok := addr["tls"].(map[string]interface{}); ok && tls["enabled"].(bool) {
 			if reality, ok := tls["reality"].(map[string]interface{}); ok && reality["enabled"].(bool) {
 				params["security"] = "reality"
@@ -393,7 +544,7 @@ func trojanLink(
 	var links []string
 
 	for _, addr := range addrs {
-		params := baseParams
+		params := maps.Clone(baseParams)
 		if tls, ok := addr["tls"].(map[string]interface{}); ok && tls["enabled"].(bool) {
 			if reality, ok := tls["reality"].(map[string]interface{}); ok && reality["enabled"].(bool) {
 				params["security"] = "reality"
@@ -458,7 +609,7 @@ func vmessLink(
 	}
 
 	for _, addr := range addrs {
-		obj := baseParams
+		obj := maps.Clone(baseParams)
 		obj["add"], _ = addr["server"].(string)
 		port, _ := addr["server_port"].(float64)
 		obj["port"] = uint(port)
@@ -469,6 +620,10 @@ func vmessLink(
 		if trasportParams["path"] != "" {
 			obj["path"] = trasportParams["path"]
 		}
+		// vmess links carry the service name of grpc in path
+		if trasportParams["serviceName"] != "" {
+			obj["path"] = trasportParams["serviceName"]
+		}
 		if tls, ok := addr["tls"].(map[string]interface{}); ok && tls["enabled"].(bool) {
 			obj["tls"] = "tls"
 			if insecure, ok := tls["insecure"].(bool); ok && insecure {
@@ -477,6 +632,9 @@ func vmessLink(
 			if sni, ok := tls["server_name"].(string); ok {
 				obj["sni"] = sni
 			}
+			if alpn := getTlsParams(tls)["alpn"]; alpn != "" {
+				obj["alpn"] = alpn
+			}
 			if utls, ok := tls["utls"].(map[string]interface{}); ok {
 				obj["fp"], _ = utls["fingerprint"].(string)
 			}
@@ -492,6 +650,116 @@ func vmessLink(
 	return links
 }
 
+// WireguardPeerExt keeps client side data of a wireguard endpoint peer in endpoint's ext.
+// AllowedIPs is only given to create a peer, and is then kept in the peer of options.
+type WireguardPeerExt struct {
+	PublicKey  string   `json:"public_key"`
+	PrivateKey string   `json:"private_key"`
+	Client     string   `json:"client"`
+	AllowedIPs []string `json:"allowed_ips,omitempty"`
+}
+
+type wireguardPeer struct {
+	PublicKey                   string   `json:"public_key"`
+	PreSharedKey                string   `json:"pre_shared_key"`
+	AllowedIPs                  []string `json:"allowed_ips"`
+	PersistentKeepaliveInterval uint16   `json:"persistent_keepalive_interval"`
+	Reserved                    []uint8  `json:"reserved"`
+}
+
+type wireguardEndpoint struct {
+	MTU        uint32          `json:"mtu"`
+	PrivateKey string          `json:"private_key"`
+	ListenPort uint16          `json:"listen_port"`
+	Peers      []wireguardPeer `json:"peers"`
+}
+
+// WireguardLinks generates wireguard:// links and wg-quick configs for peers of
+// a listening wireguard endpoint that belong to the given client.
+func WireguardLinks(e *model.Endpoint, clientName string, hostname string) ([]string, []string) {
+	links := []string{}
+	confs := []string{}
+	if e.Type != "wireguard" {
+		return links, confs
+	}
+
+	var options wireguardEndpoint
+	if err := json.Unmarshal(e.Options, &options); err != nil || options.ListenPort == 0 {
+		return links, confs
+	}
+	serverKey, err := wgtypes.ParseKey(options.PrivateKey)
+	if err != nil {
+		return links, confs
+	}
+	var ext struct {
+		Peers []WireguardPeerExt `json:"peers"`
+	}
+	json.Unmarshal(e.Ext, &ext)
+
+	server := net.JoinHostPort(hostname, fmt.Sprint(options.ListenPort))
+	for _, peer := range options.Peers {
+		var peerExt *WireguardPeerExt
+		for index := range ext.Peers {
+			if ext.Peers[index].PublicKey == peer.PublicKey {
+				peerExt = &ext.Peers[index]
+				break
+			}
+		}
+		if peerExt == nil || peerExt.Client != clientName || len(peerExt.PrivateKey) == 0 {
+			continue
+		}
+
+		params := map[string]string{
+			"publickey": serverKey.PublicKey().String(),
+			"address":   strings.Join(peer.AllowedIPs, ","),
+		}
+		if len(peer.PreSharedKey) > 0 {
+			params["presharedkey"] = peer.PreSharedKey
+		}
+		if options.MTU > 0 {
+			params["mtu"] = fmt.Sprint(options.MTU)
+		}
+		if len(peer.Reserved) > 0 {
+			reserved := make([]string, len(peer.Reserved))
+			for i, v := range peer.Reserved {
+				reserved[i] = fmt.Sprint(v)
+			}
+			params["reserved"] = strings.Join(reserved, ",")
+		}
+		if peer.PersistentKeepaliveInterval > 0 {
+			params["keepalive"] = fmt.Sprint(peer.PersistentKeepaliveInterval)
+		}
+		uri := fmt.Sprintf("wireguard://%s@%s", url.PathEscape(peerExt.PrivateKey), server)
+		links = append(links, addParams(uri, params, e.Tag))
+
+		conf := []string{
+			"[Interface]",
+			"PrivateKey = " + peerExt.PrivateKey,
+			"Address = " + strings.Join(peer.AllowedIPs, ", "),
+		}
+		if options.MTU > 0 {
+			conf = append(conf, fmt.Sprintf("MTU = %d", options.MTU))
+		}
+		conf = append(conf,
+			"",
+			"[Peer]",
+			"PublicKey = "+serverKey.PublicKey().String(),
+		)
+		if len(peer.PreSharedKey) > 0 {
+			conf = append(conf, "PresharedKey = "+peer.PreSharedKey)
+		}
+		conf = append(conf,
+			"AllowedIPs = 0.0.0.0/0, ::/0",
+			"Endpoint = "+server,
+		)
+		if peer.PersistentKeepaliveInterval > 0 {
+			conf = append(conf, fmt.Sprintf("PersistentKeepalive = %d", peer.PersistentKeepaliveInterval))
+		}
+		confs = append(confs, "# "+e.Tag+"\n"+strings.Join(conf, "\n")+"\n")
+	}
+	return links, confs
+}
+
 func toBase64(d []byte) string {
 	return base64.StdEncoding.EncodeToString([]byte(d))
 }
@@ -0,0 +1,436 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"s-ui/database/model"
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var linkTransports = map[string]map[string]interface{}{
+	"ws":          {"type": "ws", "path": "/ws", "headers": map[string]interface{}{"Host": "cdn.example.com"}},
+	"grpc":        {"type": "grpc", "service_name": "grpc-svc"},
+	"httpupgrade": {"type": "httpupgrade", "path": "/up", "host": "cdn.example.com"},
+	"http":        {"type": "http", "path": "/h2", "host": []interface{}{"a.example.com", "b.example.com"}},
+}
+
+var linkTls = map[string]*model.Tls{
+	"tls": {
+		Id:     1,
+		Server: json.RawMessage(`{"enabled":true,"server_name":"example.com","alpn":["h2","http/1.1"]}`),
+		Client: json.RawMessage(`{"utls":{"enabled":true,"fingerprint":"firefox"}}`),
+	},
+	"reality": {
+		Id:     2,
+		Server: json.RawMessage(`{"enabled":true,"server_name":"www.example.org","reality":{"enabled":true,"handshake":{"server":"www.example.org","server_port":443},"private_key":"private","short_id":["0123abcd"]}}`),
+		Client: json.RawMessage(`{"utls":{"enabled":true,"fingerprint":"chrome"},"reality":{"public_key":"public-key","short_id":"0123abcd"}}`),
+	},
+}
+
+var linkClient = json.RawMessage(`{
+	"vless":{"name":"alice","uuid":"11111111-2222-3333-4444-555555555555"},
+	"trojan":{"name":"alice","password":"secret"},
+	"vmess":{"name":"alice","uuid":"11111111-2222-3333-4444-555555555555","alterId":0}
+}`)
+
+// TestLinkRoundTrip generates links of inbounds and parses them back to outbounds,
+// which must keep the user, transport and tls of the inbound
+func TestLinkRoundTrip(t *testing.T) {
+	type linkCase struct {
+		protocol  string
+		transport string
+		security  string
+	}
+	var cases []linkCase
+	for _, protocol := range []string{"vless", "trojan", "vmess"} {
+		for _, transport := range []string{"ws", "grpc", "httpupgrade", "http"} {
+			for _, security := range []string{"tls", "reality"} {
+				// vmess links have no reality
+				if protocol == "vmess" && security == "reality" {
+					continue
+				}
+				cases = append(cases, linkCase{protocol, transport, security})
+			}
+		}
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s-%s-%s", c.protocol, c.transport, c.security), func(t *testing.T) {
+			tls := linkTls[c.security]
+			inboundJson, _ := json.Marshal(map[string]interface{}{
+				"type":        c.protocol,
+				"tag":         "in-" + c.transport,
+				"listen":      "::",
+				"listen_port": 8443,
+				"tls_id":      tls.Id,
+				"transport":   linkTransports[c.transport],
+				"addrs":       []interface{}{},
+			})
+			var inbound model.Inbound
+			if err := json.Unmarshal(inboundJson, &inbound); err != nil {
+				t.Fatal(err)
+			}
+			inbound.Tls = tls
+
+			links := LinkGenerator(linkClient, &inbound, "proxy.example.com")
+			if len(links) != 1 {
+				t.Fatalf("expected 1 link, got %v", links)
+			}
+			outbound, tag, err := GetOutbound(links[0], 0)
+			if err != nil {
+				t.Fatalf("parse %s: %v", links[0], err)
+			}
+			out := *outbound
+
+			if out["type"] != c.protocol {
+				t.Errorf("type = %v", out["type"])
+			}
+			if tag != inbound.Tag {
+				t.Errorf("tag = %q, want %q", tag, inbound.Tag)
+			}
+			if out["server"] != "proxy.example.com" || fmt.Sprint(out["server_port"]) != "8443" {
+				t.Errorf("server = %v:%v", out["server"], out["server_port"])
+			}
+			switch c.protocol {
+			case "vless", "vmess":
+				if out["uuid"] != "11111111-2222-3333-4444-555555555555" {
+					t.Errorf("uuid = %v", out["uuid"])
+				}
+			case "trojan":
+				if out["password"] != "secret" {
+					t.Errorf("password = %v", out["password"])
+				}
+			}
+
+			transport := *asMap(t, out["transport"])
+			want := linkTransports[c.transport]
+			if transport["type"] != want["type"] {
+				t.Errorf("transport type = %v, want %v", transport["type"], want["type"])
+			}
+			for _, key := range []string{"path", "service_name", "host", "headers"} {
+				if value, ok := want[key]; ok && !reflect.DeepEqual(normalize(transport[key]), normalize(value)) {
+					t.Errorf("transport %s = %v, want %v", key, transport[key], value)
+				}
+			}
+
+			outTls := *asMap(t, out["tls"])
+			if outTls["enabled"] != true {
+				t.Errorf("tls is not enabled: %v", outTls)
+			}
+			var server map[string]interface{}
+			json.Unmarshal(tls.Server, &server)
+			if outTls["server_name"] != server["server_name"] {
+				t.Errorf("server_name = %v, want %v", outTls["server_name"], server["server_name"])
+			}
+			if alpn, ok := server["alpn"]; ok && !reflect.DeepEqual(normalize(outTls["alpn"]), normalize(alpn)) {
+				t.Errorf("alpn = %v, want %v", outTls["alpn"], alpn)
+			}
+			var client map[string]interface{}
+			json.Unmarshal(tls.Client, &client)
+			wantUtls := client["utls"].(map[string]interface{})
+			if utls := asMap(t, outTls["utls"]); (*utls)["fingerprint"] != wantUtls["fingerprint"] {
+				t.Errorf("utls = %v, want %v", *utls, wantUtls)
+			}
+			if c.security == "reality" {
+				reality := *asMap(t, outTls["reality"])
+				if reality["enabled"] != true || reality["public_key"] != "public-key" || reality["short_id"] != "0123abcd" {
+					t.Errorf("reality = %v", reality)
+				}
+			} else if _, ok := outTls["reality"]; ok {
+				t.Errorf("unexpected reality: %v", outTls["reality"])
+			}
+		})
+	}
+}
+
+func asMap(t *testing.T, v interface{}) *map[string]interface{} {
+	t.Helper()
+	switch m := v.(type) {
+	case map[string]interface{}:
+		return &m
+	case *map[string]interface{}:
+		return m
+	}
+	t.Fatalf("not an object: %#v", v)
+	return nil
+}
+
+// normalize compares lists and objects after a json round trip
+func normalize(v interface{}) interface{} {
+	data, _ := json.Marshal(v)
+	var out interface{}
+	json.Unmarshal(data, &out)
+	return out
+}
+
+var proxyClient = json.RawMessage(`{
+	"socks":{"username":"alice","password":"p@ss:word"},
+	"http":{"username":"alice","password":"p@ss:word"},
+	"mixed":{"username":"alice","password":"p@ss:word"},
+	"naive":{"username":"alice","password":"p@ss:word"},
+	"hysteria":{"name":"alice","auth_str":"hy-auth"},
+	"shadowsocks":{"name":"alice","password":"c3MtdXNlci1wYXNzd29yZA=="},
+	"shadowsocks16":{"name":"alice","password":"AAECAwQFBgcICQoLDA0ODw=="},
+	"shadowtls":{"name":"alice","password":"stls-pass"}
+}`)
+
+func testInbound(t *testing.T, fields map[string]interface{}, tls *model.Tls) *model.Inbound {
+	t.Helper()
+	fields["listen"] = "::"
+	fields["addrs"] = []interface{}{}
+	if tls != nil {
+		fields["tls_id"] = tls.Id
+	}
+	inboundJson, _ := json.Marshal(fields)
+	var inbound model.Inbound
+	if err := json.Unmarshal(inboundJson, &inbound); err != nil {
+		t.Fatal(err)
+	}
+	inbound.Tls = tls
+	return &inbound
+}
+
+func parseLink(t *testing.T, link string) map[string]interface{} {
+	t.Helper()
+	outbound, _, err := GetOutbound(link, 0)
+	if err != nil {
+		t.Fatalf("parse %s: %v", link, err)
+	}
+	return *outbound
+}
+
+// TestProxyLinkRoundTrip covers links of socks, http and mixed inbounds, with credentials which need escaping
+func TestProxyLinkRoundTrip(t *testing.T) {
+	cases := []struct {
+		inbound string
+		tls     *model.Tls
+		types   []string
+	}{
+		{"socks", nil, []string{"socks"}},
+		{"http", nil, []string{"http"}},
+		{"http", linkTls["tls"], []string{"http"}},
+		{"mixed", nil, []string{"socks", "http"}},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("%s-tls-%v", c.inbound, c.tls != nil), func(t *testing.T) {
+			inbound := testInbound(t, map[string]interface{}{"type": c.inbound, "tag": "in", "listen_port": 1080}, c.tls)
+			links := LinkGenerator(proxyClient, inbound, "proxy.example.com")
+			if len(links) != len(c.types) {
+				t.Fatalf("links = %v, want %d", links, len(c.types))
+			}
+			for i, link := range links {
+				out := parseLink(t, link)
+				if out["type"] != c.types[i] || out["tag"] != "in" {
+					t.Errorf("%s: type = %v, tag = %v", link, out["type"], out["tag"])
+				}
+				if out["server"] != "proxy.example.com" || fmt.Sprint(out["server_port"]) != "1080" {
+					t.Errorf("%s: server = %v:%v", link, out["server"], out["server_port"])
+				}
+				if out["username"] != "alice" || out["password"] != "p@ss:word" {
+					t.Errorf("%s: user = %v:%v", link, out["username"], out["password"])
+				}
+				if c.types[i] == "socks" && out["version"] != "5" {
+					t.Errorf("%s: version = %v", link, out["version"])
+				}
+				_, hasTls := out["tls"]
+				if hasTls != (c.tls != nil) {
+					t.Errorf("%s: tls = %v", link, out["tls"])
+				}
+				if c.tls != nil {
+					outTls := *asMap(t, out["tls"])
+					if outTls["enabled"] != true || outTls["server_name"] != "example.com" {
+						t.Errorf("%s: tls = %v", link, outTls)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestNaiveLinkRoundTrip parses naive links into http outbounds over tls, which is how sing-box dials naive
+func TestNaiveLinkRoundTrip(t *testing.T) {
+	inbound := testInbound(t, map[string]interface{}{"type": "naive", "tag": "naive-in", "listen_port": 443}, linkTls["tls"])
+	links := LinkGenerator(proxyClient, inbound, "proxy.example.com")
+	if len(links) != 1 {
+		t.Fatalf("links = %v", links)
+	}
+	out := parseLink(t, links[0])
+	if out["type"] != "http" || out["tag"] != "naive-in" {
+		t.Errorf("type = %v, tag = %v", out["type"], out["tag"])
+	}
+	if out["server"] != "proxy.example.com" || fmt.Sprint(out["server_port"]) != "443" {
+		t.Errorf("server = %v:%v", out["server"], out["server_port"])
+	}
+	if out["username"] != "alice" || out["password"] != "p@ss:word" {
+		t.Errorf("user = %v:%v", out["username"], out["password"])
+	}
+	outTls := *asMap(t, out["tls"])
+	if outTls["enabled"] != true || outTls["server_name"] != "example.com" {
+		t.Errorf("tls = %v", outTls)
+	}
+}
+
+// TestHysteriaLinkRoundTrip checks that speeds are swapped to the side of the client, and obfs is kept
+func TestHysteriaLinkRoundTrip(t *testing.T) {
+	inbound := testInbound(t, map[string]interface{}{
+		"type":        "hysteria",
+		"tag":         "hy-in",
+		"listen_port": 8443,
+		"up_mbps":     100,
+		"down_mbps":   50,
+		"obfs":        "obfs-secret",
+	}, linkTls["tls"])
+	links := LinkGenerator(proxyClient, inbound, "proxy.example.com")
+	if len(links) != 1 {
+		t.Fatalf("links = %v", links)
+	}
+	out := parseLink(t, links[0])
+	if out["type"] != "hysteria" || out["auth_str"] != "hy-auth" || out["obfs"] != "obfs-secret" {
+		t.Errorf("hysteria = %v", out)
+	}
+	// The upload of the client is the download of the server
+	if fmt.Sprint(out["up_mbps"]) != "50" || fmt.Sprint(out["down_mbps"]) != "100" {
+		t.Errorf("up_mbps = %v, down_mbps = %v", out["up_mbps"], out["down_mbps"])
+	}
+	outTls := *asMap(t, out["tls"])
+	if outTls["server_name"] != "example.com" || !reflect.DeepEqual(normalize(outTls["alpn"]), normalize([]string{"h2", "http/1.1"})) {
+		t.Errorf("tls = %v", outTls)
+	}
+}
+
+// TestShadowTlsLinkRoundTrip generates SIP002 links with the shadow-tls plugin, which are parsed into
+// a shadowsocks outbound with a shadowtls outbound as its detour
+func TestShadowTlsLinkRoundTrip(t *testing.T) {
+	for _, multiUser := range []bool{true, false} {
+		t.Run(fmt.Sprintf("multiUser-%v", multiUser), func(t *testing.T) {
+			inbound := testInbound(t, map[string]interface{}{
+				"type":        "shadowtls",
+				"tag":         "stls-in",
+				"listen_port": 443,
+				"version":     3,
+				"handshake":   map[string]interface{}{"server": "www.example.org", "server_port": 443},
+				"detour":      "ss-in",
+			}, nil)
+			detour := testInbound(t, map[string]interface{}{
+				"type":        "shadowsocks",
+				"tag":         "ss-in",
+				"listen":      "127.0.0.1",
+				"listen_port": 8388,
+				"method":      "2022-blake3-aes-128-gcm",
+				"password":    "c2VydmVyLWtleS0xNmJ5dA==",
+			}, nil)
+			links := ShadowTlsLinkGenerator(proxyClient, inbound, detour, multiUser, "proxy.example.com")
+			if len(links) != 1 {
+				t.Fatalf("links = %v", links)
+			}
+			outbounds, tags, err := GetOutbounds(links[0], 0)
+			if err != nil {
+				t.Fatalf("parse %s: %v", links[0], err)
+			}
+			if len(outbounds) != 2 || !reflect.DeepEqual(tags, []string{"stls-in", "stls-in-shadowtls"}) {
+				t.Fatalf("outbounds = %v, tags = %v", outbounds, tags)
+			}
+			ss, stls := outbounds[0], outbounds[1]
+			wantPassword := "c2VydmVyLWtleS0xNmJ5dA=="
+			if multiUser {
+				wantPassword += ":AAECAwQFBgcICQoLDA0ODw=="
+			}
+			if ss["type"] != "shadowsocks" || ss["method"] != "2022-blake3-aes-128-gcm" || ss["password"] != wantPassword {
+				t.Errorf("shadowsocks = %v", ss)
+			}
+			if ss["detour"] != "stls-in-shadowtls" || ss["server"] != nil {
+				t.Errorf("shadowsocks is not dialed through its detour: %v", ss)
+			}
+			if stls["type"] != "shadowtls" || stls["server"] != "proxy.example.com" || fmt.Sprint(stls["server_port"]) != "443" {
+				t.Errorf("shadowtls = %v", stls)
+			}
+			if fmt.Sprint(stls["version"]) != "3" || stls["password"] != "stls-pass" {
+				t.Errorf("version = %v, password = %v", stls["version"], stls["password"])
+			}
+			stlsTls := *asMap(t, stls["tls"])
+			if stlsTls["enabled"] != true || stlsTls["server_name"] != "www.example.org" {
+				t.Errorf("tls = %v", stlsTls)
+			}
+		})
+	}
+}
+
+// TestWireguardLinks generates the link and wg-quick config of a peer of a client, and parses the link back
+func TestWireguardLinks(t *testing.T) {
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	clientKey, _ := wgtypes.GeneratePrivateKey()
+	otherKey, _ := wgtypes.GeneratePrivateKey()
+	psk, _ := wgtypes.GenerateKey()
+	options, _ := json.Marshal(map[string]interface{}{
+		"private_key": serverKey.String(),
+		"listen_port": 51820,
+		"mtu":         1408,
+		"peers": []interface{}{
+			map[string]interface{}{
+				"public_key":                    clientKey.PublicKey().String(),
+				"pre_shared_key":                psk.String(),
+				"allowed_ips":                   []string{"10.0.0.2/32", "fd00::2/128"},
+				"persistent_keepalive_interval": 25,
+				"reserved":                      []int{1, 2, 3},
+			},
+			map[string]interface{}{
+				"public_key":  otherKey.PublicKey().String(),
+				"allowed_ips": []string{"10.0.0.3/32"},
+			},
+		},
+	})
+	ext, _ := json.Marshal(map[string]interface{}{
+		"peers": []WireguardPeerExt{
+			{PublicKey: clientKey.PublicKey().String(), PrivateKey: clientKey.String(), Client: "alice"},
+			{PublicKey: otherKey.PublicKey().String(), PrivateKey: otherKey.String(), Client: "bob"},
+		},
+	})
+	endpoint := &model.Endpoint{Type: "wireguard", Tag: "wg-in", Options: options, Ext: ext}
+
+	links, confs := WireguardLinks(endpoint, "alice", "vpn.example.com")
+	if len(links) != 1 || len(confs) != 1 {
+		t.Fatalf("links = %v, confs = %v", links, confs)
+	}
+	out := parseLink(t, links[0])
+	if out["type"] != "wireguard" || out["tag"] != "wg-in" {
+		t.Errorf("type = %v, tag = %v", out["type"], out["tag"])
+	}
+	if out["server"] != "vpn.example.com" || fmt.Sprint(out["server_port"]) != "51820" {
+		t.Errorf("server = %v:%v", out["server"], out["server_port"])
+	}
+	if out["private_key"] != clientKey.String() || out["peer_public_key"] != serverKey.PublicKey().String() {
+		t.Errorf("keys = %v, %v", out["private_key"], out["peer_public_key"])
+	}
+	if out["pre_shared_key"] != psk.String() || fmt.Sprint(out["mtu"]) != "1408" {
+		t.Errorf("pre_shared_key = %v, mtu = %v", out["pre_shared_key"], out["mtu"])
+	}
+	if !reflect.DeepEqual(out["local_address"], []string{"10.0.0.2/32", "fd00::2/128"}) || !reflect.DeepEqual(out["reserved"], []int{1, 2, 3}) {
+		t.Errorf("local_address = %v, reserved = %v", out["local_address"], out["reserved"])
+	}
+
+	for _, line := range []string{
+		"# wg-in",
+		"PrivateKey = " + clientKey.String(),
+		"Address = 10.0.0.2/32, fd00::2/128",
+		"MTU = 1408",
+		"PublicKey = " + serverKey.PublicKey().String(),
+		"PresharedKey = " + psk.String(),
+		"AllowedIPs = 0.0.0.0/0, ::/0",
+		"Endpoint = vpn.example.com:51820",
+		"PersistentKeepalive = 25",
+	} {
+		if !slices.Contains(strings.Split(confs[0], "\n"), line) {
+			t.Errorf("config has no line %q:\n%s", line, confs[0])
+		}
+	}
+
+	// Peers of other clients and endpoints which do not listen have no links
+	if links, confs := WireguardLinks(endpoint, "carol", "vpn.example.com"); len(links) != 0 || len(confs) != 0 {
+		t.Errorf("links of another client = %v", links)
+	}
+}
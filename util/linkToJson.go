@@ -15,7 +15,7 @@ func GetOutbound(uri string, i int) (*map[string]interface{}, string, error) {
 	if err == nil {
 		switch u.Scheme {
 		case "vmess":
-			return vmess(u.Host, i)
+			return vmess(strings.TrimPrefix(uri, u.Scheme+"://"), i)
 		case "vless":
 			return vless(u, i)
 		case "trojan":
@@ -26,13 +26,47 @@ func GetOutbound(uri string, i int) (*map[string]interface{}, string, error) {
 			return hy2(u, i)
 		case "tuic":
 			return tuic(u, i)
-		case "ss", "shadowsocks":
-			return ss(u, i)
+		case "socks", "socks4", "socks4a", "socks5", "socks5h":
+			return socks(u, i)
+		case "http", "https":
+			return httpOutbound(u, i)
+		case "http2", "naive+https", "naive+http":
+			return naive(uri, i)
+		case "wg", "wireguard":
+			return wireguard(u, i)
+		case "ssh":
+			return ssh(u, i)
+		case "shadowtls":
+			return shadowtls(u, i)
 		}
 	}
+	// Shadowsocks user info could be an invalid url part
+	scheme, _, _ := strings.Cut(uri, "://")
+	switch scheme {
+	case "ss", "shadowsocks":
+		return ss(uri, i)
+	}
 	return nil, "", common.NewError("Unsupported link format")
 }
 
+// GetOutbounds converts a link to its outbound and the outbounds it depends on,
+// like a shadowtls outbound used as detour of shadowsocks
+func GetOutbounds(uri string, i int) ([]map[string]interface{}, []string, error) {
+	outbound, tag, err := GetOutbound(uri, i)
+	if err != nil {
+		return nil, nil, err
+	}
+	outbounds := []map[string]interface{}{*outbound}
+	tags := []string{tag}
+	if detour, ok := (*outbound)["detour"].(map[string]interface{}); ok {
+		detourTag, _ := detour["tag"].(string)
+		(*outbound)["detour"] = detourTag
+		outbounds = append(outbounds, detour)
+		tags = append(tags, detourTag)
+	}
+	return outbounds, tags, nil
+}
+
 func vmess(data string, i int) (*map[string]interface{}, string, error) {
 	dataByte, err := B64StrToByte(data)
 	if err != nil {
@@ -44,10 +78,10 @@ func vmess(data string, i int) (*map[string]interface{}, string, error) {
 		return nil, "", err
 	}
 	transport := map[string]interface{}{}
-	tp_net, _ := dataJson["net"].(string)
-	tp_type, _ := dataJson["type"].(string)
-	tp_host, _ := dataJson["host"].(string)
-	tp_path, _ := dataJson["path"].(string)
+	tp_net := jsonString(dataJson["net"])
+	tp_type := jsonString(dataJson["type"])
+	tp_host := jsonString(dataJson["host"])
+	tp_path := jsonString(dataJson["path"])
 	switch strings.ToLower(tp_net) {
 	case "tcp", "":
 		if tp_type == "http" {
@@ -85,13 +119,13 @@ func vmess(data string, i int) (*map[string]interface{}, string, error) {
 		return nil, "", common.NewError("Invalid vmess")
 	}
 	tls := map[string]interface{}{}
-	vmess_tls, _ := dataJson["tls"].(string)
+	vmess_tls := jsonString(dataJson["tls"])
 	if vmess_tls == "tls" {
 		tls["enabled"] = true
-		tls_sni, _ := dataJson["sni"].(string)
-		tls_alpn, _ := dataJson["alpn"].(string)
-		_, tls_insecure := dataJson["allowInsecure"]
-		tls_fp, _ := dataJson["fp"].(string)
+		tls_sni := jsonString(dataJson["sni"])
+		tls_alpn := jsonString(dataJson["alpn"])
+		tls_insecure := jsonBool(dataJson["allowInsecure"]) || jsonBool(dataJson["insecure"])
+		tls_fp := jsonString(dataJson["fp"])
 		if len(tls_sni) > 0 {
 			tls["server_name"] = tls_sni
 		}
@@ -108,21 +142,24 @@ func vmess(data string, i int) (*map[string]interface{}, string, error) {
 			}
 		}
 	}
-	tag, _ := dataJson["ps"].(string)
+	tag := jsonString(dataJson["ps"])
 	if i > 0 {
 		tag = fmt.Sprintf("%d.%s", i, tag)
 	}
-	alter_id, ok := dataJson["aid"].(int)
-	if !ok {
-		alter_id = 0
+	// v2rayN clients write numbers both as json numbers and strings
+	port, _ := strconv.Atoi(jsonString(dataJson["port"]))
+	alter_id, _ := strconv.Atoi(jsonString(dataJson["aid"]))
+	security := jsonString(dataJson["scy"])
+	if len(security) == 0 {
+		security = "auto"
 	}
 	vmess := map[string]interface{}{
 		"type":        "vmess",
 		"tag":         tag,
-		"server":      dataJson["add"],
-		"server_port": dataJson["port"],
-		"uuid":        dataJson["id"],
-		"security":    "auto",
+		"server":      jsonString(dataJson["add"]),
+		"server_port": port,
+		"uuid":        jsonString(dataJson["id"]),
+		"security":    security,
 		"alter_id":    alter_id,
 		"tls":         tls,
 		"transport":   transport,
@@ -307,6 +344,9 @@ func tuic(u *url.URL, i int) (*map[string]interface{}, string, error) {
 	}
 	alpn := query.Get("alpn")
 	insecure := query.Get("allow_insecure")
+	if len(insecure) == 0 {
+		insecure = query.Get("insecure")
+	}
 	disable_sni := query.Get("disable_sni")
 	if len(alpn) > 0 {
 		tls["alpn"] = strings.Split(alpn, ",")
@@ -337,29 +377,52 @@ func tuic(u *url.URL, i int) (*map[string]interface{}, string, error) {
 	return &tuic, tag, nil
 }
 
-func ss(u *url.URL, i int) (*map[string]interface{}, string, error) {
-	query, _ := url.ParseQuery(u.RawQuery)
-	host, portStr, _ := net.SplitHostPort(u.Host)
+func ss(uri string, i int) (*map[string]interface{}, string, error) {
+	_, rest, _ := strings.Cut(uri, "://")
+	rest, fragment, _ := strings.Cut(rest, "#")
+	if unescaped, err := url.PathUnescape(fragment); err == nil {
+		fragment = unescaped
+	}
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	rest = strings.TrimSuffix(rest, "/")
+	query, _ := url.ParseQuery(rawQuery)
+
+	// Legacy links encode the whole method:password@host:port part
+	if !strings.Contains(rest, "@") {
+		decoded, err := B64StrToByte(rest)
+		if err != nil {
+			return nil, "", common.NewError("Unsupported shadowsocks")
+		}
+		rest = string(decoded)
+	}
+	at := strings.LastIndex(rest, "@")
+	if at < 0 {
+		return nil, "", common.NewError("Unsupported shadowsocks")
+	}
+	userInfo, hostPort := rest[:at], rest[at+1:]
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = strings.Trim(hostPort, "[]")
+	}
 	port := 443
 	if len(portStr) > 0 {
 		port, _ = strconv.Atoi(portStr)
 	}
-	method := u.User.Username()
-	password, ok := u.User.Password()
+
+	if unescaped, err := url.PathUnescape(userInfo); err == nil {
+		userInfo = unescaped
+	}
+	if !strings.Contains(userInfo, ":") {
+		userInfo = StrOrBase64Encoded(userInfo)
+	}
+	method, password, ok := strings.Cut(userInfo, ":")
 	if !ok {
-		decrypted := StrOrBase64Encoded(method)
-		decrypted_arr := strings.Split(decrypted, ":")
-		if len(decrypted_arr) > 1 {
-			method = decrypted_arr[0]
-			password = strings.Join(decrypted_arr[1:], ":")
-		} else {
-			return nil, "", common.NewError("Unsupported shadowsocks")
-		}
+		return nil, "", common.NewError("Unsupported shadowsocks")
 	}
 
-	tag := u.Fragment
+	tag := fragment
 	if i > 0 {
-		tag = fmt.Sprintf("%d.%s", i, u.Fragment)
+		tag = fmt.Sprintf("%d.%s", i, fragment)
 	}
 	ss := map[string]interface{}{
 		"type":        "shadowsocks",
@@ -389,7 +452,40 @@ func ss(u *url.URL, i int) (*map[string]interface{}, string, error) {
 	plugin := query.Get("plugin")
 	if len(plugin) > 0 {
 		pl_arr := strings.Split(plugin, ";")
-		if len(pl_arr) > 0 {
+		switch pl_arr[0] {
+		case "shadow-tls":
+			// sing-box has no shadow-tls plugin, it needs a shadowtls outbound as detour
+			stls := map[string]interface{}{
+				"type":        "shadowtls",
+				"tag":         tag + "-shadowtls",
+				"server":      host,
+				"server_port": port,
+				"version":     3,
+			}
+			tls := map[string]interface{}{
+				"enabled": true,
+			}
+			for _, opt := range pl_arr[1:] {
+				key, value, _ := strings.Cut(opt, "=")
+				switch key {
+				case "version":
+					if version, err := strconv.Atoi(value); err == nil {
+						stls["version"] = version
+					}
+				case "password", "passwd":
+					stls["password"] = value
+				case "host":
+					tls["server_name"] = value
+				}
+			}
+			stls["tls"] = tls
+			delete(ss, "server")
+			delete(ss, "server_port")
+			ss["detour"] = stls
+		case "simple-obfs", "obfs-local":
+			ss["plugin"] = "obfs-local"
+			ss["plugin_opts"] = strings.Join(pl_arr[1:], ";")
+		default:
 			ss["plugin"] = pl_arr[0]
 			ss["plugin_opts"] = strings.Join(pl_arr[1:], ";")
 		}
@@ -397,6 +493,280 @@ func ss(u *url.URL, i int) (*map[string]interface{}, string, error) {
 	return &ss, tag, nil
 }
 
+func socks(u *url.URL, i int) (*map[string]interface{}, string, error) {
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port := 1080
+	if len(portStr) > 0 {
+		port, _ = strconv.Atoi(portStr)
+	} else {
+		host = u.Hostname()
+	}
+	version := "5"
+	switch u.Scheme {
+	case "socks4":
+		version = "4"
+	case "socks4a":
+		version = "4a"
+	}
+
+	tag := u.Fragment
+	if i > 0 {
+		tag = fmt.Sprintf("%d.%s", i, u.Fragment)
+	}
+	socks := map[string]interface{}{
+		"type":        "socks",
+		"tag":         tag,
+		"server":      host,
+		"server_port": port,
+		"version":     version,
+	}
+	if u.User != nil {
+		username := u.User.Username()
+		password, ok := u.User.Password()
+		// v2rayN encodes username:password as base64
+		if !ok {
+			decoded := StrOrBase64Encoded(username)
+			if user, pass, found := strings.Cut(decoded, ":"); found {
+				username, password = user, pass
+			}
+		}
+		if len(username) > 0 {
+			socks["username"] = username
+			socks["password"] = password
+		}
+	}
+	return &socks, tag, nil
+}
+
+func httpOutbound(u *url.URL, i int) (*map[string]interface{}, string, error) {
+	query, _ := url.ParseQuery(u.RawQuery)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if len(portStr) > 0 {
+		port, _ = strconv.Atoi(portStr)
+	} else if len(host) == 0 {
+		host = u.Host
+	}
+
+	tag := u.Fragment
+	if i > 0 {
+		tag = fmt.Sprintf("%d.%s", i, u.Fragment)
+	}
+	http := map[string]interface{}{
+		"type":        "http",
+		"tag":         tag,
+		"server":      host,
+		"server_port": port,
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		http["username"] = u.User.Username()
+		http["password"] = password
+	}
+	if u.Scheme == "https" {
+		http["tls"] = getTls("tls", &query)
+	}
+	return &http, tag, nil
+}
+
+func naive(uri string, i int) (*map[string]interface{}, string, error) {
+	scheme, rest, _ := strings.Cut(uri, "://")
+	rest, fragment, _ := strings.Cut(rest, "#")
+	if unescaped, err := url.PathUnescape(fragment); err == nil {
+		fragment = unescaped
+	}
+	rest, rawQuery, _ := strings.Cut(rest, "?")
+	query, _ := url.ParseQuery(rawQuery)
+	// http2 links of shadowrocket encode user:pass@host:port as base64
+	if scheme == "http2" && !strings.Contains(rest, "@") {
+		decoded, err := B64StrToByte(strings.TrimSuffix(rest, "/"))
+		if err != nil {
+			return nil, "", common.NewError("Invalid naive link")
+		}
+		rest = string(decoded)
+	}
+	u, err := url.Parse("https://" + rest)
+	if err != nil {
+		return nil, "", err
+	}
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port := 443
+	if len(portStr) > 0 {
+		port, _ = strconv.Atoi(portStr)
+	} else {
+		host = u.Host
+	}
+
+	tag := fragment
+	if i > 0 {
+		tag = fmt.Sprintf("%d.%s", i, fragment)
+	}
+	tls := map[string]interface{}{
+		"enabled": scheme != "naive+http",
+	}
+	sni := query.Get("peer")
+	if len(sni) == 0 {
+		sni = query.Get("sni")
+	}
+	if len(sni) > 0 {
+		tls["server_name"] = sni
+	}
+	insecure := query.Get("insecure")
+	if insecure == "1" || insecure == "true" {
+		tls["insecure"] = true
+	}
+	naive := map[string]interface{}{
+		"type":        "http",
+		"tag":         tag,
+		"server":      host,
+		"server_port": port,
+		"tls":         tls,
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		naive["username"] = u.User.Username()
+		naive["password"] = password
+	}
+	return &naive, tag, nil
+}
+
+func wireguard(u *url.URL, i int) (*map[string]interface{}, string, error) {
+	query, _ := url.ParseQuery(u.RawQuery)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port := 51820
+	if len(portStr) > 0 {
+		port, _ = strconv.Atoi(portStr)
+	} else {
+		host = u.Hostname()
+	}
+	privateKey := u.User.Username()
+	if len(privateKey) == 0 {
+		privateKey = query.Get("privatekey")
+	}
+	publicKey := query.Get("publickey")
+	if len(publicKey) == 0 {
+		publicKey = query.Get("peer_public_key")
+	}
+
+	tag := u.Fragment
+	if i > 0 {
+		tag = fmt.Sprintf("%d.%s", i, u.Fragment)
+	}
+	wg := map[string]interface{}{
+		"type":            "wireguard",
+		"tag":             tag,
+		"server":          host,
+		"server_port":     port,
+		"private_key":     privateKey,
+		"peer_public_key": publicKey,
+	}
+	address := query.Get("address")
+	if len(address) == 0 {
+		address = query.Get("ip")
+	}
+	if len(address) > 0 {
+		wg["local_address"] = strings.Split(address, ",")
+	}
+	psk := query.Get("presharedkey")
+	if len(psk) == 0 {
+		psk = query.Get("psk")
+	}
+	if len(psk) > 0 {
+		wg["pre_shared_key"] = psk
+	}
+	if reserved := query.Get("reserved"); len(reserved) > 0 {
+		reservedArr := []int{}
+		for _, r := range strings.Split(reserved, ",") {
+			value, err := strconv.Atoi(strings.TrimSpace(r))
+			if err != nil {
+				return nil, "", common.NewError("Invalid wireguard reserved")
+			}
+			reservedArr = append(reservedArr, value)
+		}
+		wg["reserved"] = reservedArr
+	}
+	if mtu, _ := strconv.Atoi(query.Get("mtu")); mtu > 0 {
+		wg["mtu"] = mtu
+	}
+	return &wg, tag, nil
+}
+
+func ssh(u *url.URL, i int) (*map[string]interface{}, string, error) {
+	query, _ := url.ParseQuery(u.RawQuery)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port := 22
+	if len(portStr) > 0 {
+		port, _ = strconv.Atoi(portStr)
+	} else {
+		host = u.Hostname()
+	}
+
+	tag := u.Fragment
+	if i > 0 {
+		tag = fmt.Sprintf("%d.%s", i, u.Fragment)
+	}
+	ssh := map[string]interface{}{
+		"type":        "ssh",
+		"tag":         tag,
+		"server":      host,
+		"server_port": port,
+	}
+	if u.User != nil {
+		ssh["user"] = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			ssh["password"] = password
+		}
+	}
+	if privateKey := query.Get("private_key"); len(privateKey) > 0 {
+		ssh["private_key"] = privateKey
+	}
+	if hostKey := query.Get("host_key"); len(hostKey) > 0 {
+		ssh["host_key"] = strings.Split(hostKey, ",")
+	}
+	if clientVersion := query.Get("client_version"); len(clientVersion) > 0 {
+		ssh["client_version"] = clientVersion
+	}
+	return &ssh, tag, nil
+}
+
+func shadowtls(u *url.URL, i int) (*map[string]interface{}, string, error) {
+	query, _ := url.ParseQuery(u.RawQuery)
+	host, portStr, _ := net.SplitHostPort(u.Host)
+	port := 443
+	if len(portStr) > 0 {
+		port, _ = strconv.Atoi(portStr)
+	} else {
+		host = u.Hostname()
+	}
+	version, _ := strconv.Atoi(query.Get("version"))
+	if version == 0 {
+		version = 3
+	}
+	password := u.User.Username()
+	if pass, ok := u.User.Password(); ok {
+		password = pass
+	}
+
+	tag := u.Fragment
+	if i > 0 {
+		tag = fmt.Sprintf("%d.%s", i, u.Fragment)
+	}
+	tls := getTls("tls", &query)
+	shadowtls := map[string]interface{}{
+		"type":        "shadowtls",
+		"tag":         tag,
+		"server":      host,
+		"server_port": port,
+		"version":     version,
+		"password":    password,
+		"tls":         tls,
+	}
+	return &shadowtls, tag, nil
+}
+
 func getTransport(tp_type string, q *url.Values) *map[string]interface{} {
 	transport := map[string]interface{}{}
 	tp_host := q.Get("host")
@@ -442,6 +812,9 @@ func getTls(security string, q *url.Values) *map[string]interface{} {
 	tls_fp := q.Get("fp")
 	tls_sni := q.Get("sni")
 	tls_insecure := q.Get("allowInsecure")
+	if len(tls_insecure) == 0 {
+		tls_insecure = q.Get("insecure")
+	}
 	tls_alpn := q.Get("alpn")
 	switch security {
 	case "tls":
@@ -471,3 +844,29 @@ func getTls(security string, q *url.Values) *map[string]interface{} {
 	}
 	return &tls
 }
+
+// jsonString reads a json value which may be written as a string or a number
+func jsonString(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	return ""
+}
+
+// jsonBool reads a json value which may be written as a bool, a string or a number
+func jsonBool(v interface{}) bool {
+	switch value := v.(type) {
+	case bool:
+		return value
+	case string:
+		return value == "1" || value == "true"
+	case float64:
+		return value != 0
+	}
+	return false
+}
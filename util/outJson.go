@@ -104,7 +104,9 @@ func addTls(out *map[string]interface{}, tls *model.Tls) {
 	if reality, ok := tlsServer["reality"].(map[string]interface{}); ok && reality["enabled"].(bool) {
 		realityConfig := tlsConfig["reality"].(map[string]interface{})
 		realityConfig["enabled"] = true
-		if shortIDs, ok := reality["short_id"].([]interface{}); ok && len(shortIDs) > 0 {
+		// A short id of the client, like a rotated one, is kept
+		shortID, _ := realityConfig["short_id"].(string)
+		if shortIDs, ok := reality["short_id"].([]interface{}); ok && len(shortIDs) > 0 && shortID == "" {
 			realityConfig["short_id"] = shortIDs[rand.Intn(len(shortIDs))]
 		}
 		tlsConfig["reality"] = realityConfig
@@ -154,6 +154,10 @@ func (s *Server) Start() (err error) {
 	if err != nil {
 		return err
 	}
+	acmeDomain, err := s.settingService.GetWebAcme()
+	if err != nil {
+		return err
+	}
 	listen, err := s.settingService.GetListen()
 	if err != nil {
 		return err
@@ -167,20 +171,25 @@ func (s *Server) Start() (err error) {
 	if err != nil {
 		return err
 	}
-	if certFile != "" || keyFile != "" {
-		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	isHttps := acmeDomain != "" || certFile != "" || keyFile != ""
+	if isHttps {
+		var c *tls.Config
+		if acmeDomain != "" {
+			acmeService := service.AcmeService{}
+			c, err = acmeService.AcmeTlsConfig(acmeDomain)
+		} else {
+			certService := service.CertService{}
+			c, err = certService.KeyPairTlsConfig("web", certFile, keyFile)
+		}
 		if err != nil {
 			listener.Close()
 			return err
 		}
-		c := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-		}
 		listener = network.NewAutoHttpsListener(listener)
 		listener = tls.NewListener(listener, c)
 	}
 
-	if certFile != "" || keyFile != "" {
+	if isHttps {
 		logger.Info("web server run https on", listener.Addr())
 	} else {
 		logger.Info("web server run http on", listener.Addr())
@@ -200,6 +209,8 @@ func (s *Server) Start() (err error) {
 
 func (s *Server) Stop() error {
 	s.cancel()
+	certService := service.CertService{}
+	certService.ReleaseKeyPair("web")
 	var err error
 	if s.httpServer != nil {
 		err = s.httpServer.Shutdown(s.ctx)